@@ -1,37 +1,192 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/bxrne/beacon/aggregator/internal/admin"
 	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/internal/health"
+	"github.com/bxrne/beacon/aggregator/internal/lease"
 	"github.com/bxrne/beacon/aggregator/internal/logger"
 	"github.com/bxrne/beacon/aggregator/internal/poller"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/bxrne/beacon/aggregator/internal/sink"
+	"github.com/bxrne/beacon/aggregator/internal/spool"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	"github.com/bxrne/beacon/aggregator/pkg/mdns"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "probe":
+			os.Exit(probe(os.Args[2:]))
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		}
+	}
+
 	cfg, err := config.Load("config.toml")
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 	log := logger.NewLogger(cfg)
 	log.Infof("Starting service %s in %s environment", cfg.Labels.Service, cfg.Labels.Environment)
+	for _, warning := range cfg.Warnings {
+		log.Warn(warning)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var sp *spool.Spool
+	if cfg.Spool.Dir != "" {
+		sp, err = spool.Open(cfg.Spool)
+		if err != nil {
+			log.Fatalf("Failed to open spool: %v", err)
+		}
+		defer sp.Close()
+	}
+
+	up := uploader.New(cfg, log, sp)
+	up.Start()
+
+	// Every sample goes to the API and to each sink, queued separately
+	out := sink.Fanout{up}
+	var sinks []*sink.Sink
+	for _, sc := range cfg.Sinks {
+		s, err := sink.New(sc, cfg.Telemetry, log)
+		if err != nil {
+			log.Fatalf("Failed to create sink: %v", err)
+		}
+		s.Start()
+		sinks = append(sinks, s)
+		out = append(out, s)
+		log.Infof("Writing metrics to %s sink %s", sc.Type, sc.Name)
+	}
+
+	tracker := health.NewTracker(cfg, log)
+	tracker.Start(ctx)
+
+	var sources []discovery.Source
+	if cfg.Discovery.File != "" {
+		sources = append(sources, discovery.NewFileSource(cfg.Discovery, log))
+	}
+	if cfg.Discovery.MDNS {
+		sources = append(sources, discovery.NewMDNSSource(cfg.Discovery, mdns.GroupAddr, log))
+	}
+
+	pollers := discovery.NewManager(cfg.Targets, sources, func(target config.Target) (discovery.Runner, error) {
+		return poller.NewPoller(target, cfg, out, tracker), nil
+	}, log)
+
+	var leases *lease.Client
+	if cfg.HA.Enabled {
+		leases = lease.New(cfg, log)
+		pollers.SetOwner(leases)
+		log.Infof("Sharing targets with other aggregators as %s", leases.ID())
+	}
+	pollers.Start(ctx)
 
-	pollers := make([]*poller.Poller, 0)
-	for i := 0; i < len(cfg.Targets.Hosts); i++ {
-		p := poller.NewPoller(cfg.Targets.Hosts[i], cfg.Targets.Ports[i], cfg.Targets.Frequencies[i], cfg)
-		pollers = append(pollers, p)
-		log.Infof("Created poller for host %s with frequency %d", p.Host, p.Frequency)
+	// Devices publishing to MQTT take commands alongside the polled targets,
+	// and are leased like them
+	targets, wanted := pollers.Targets, pollers.Wanted
+	var subscriber *poller.Subscriber
+	if cfg.MQTT.Broker != "" {
+		subscriber = poller.NewSubscriber(cfg, out, log)
+		if leases != nil {
+			subscriber.SetOwner(leases)
+		}
+		subscriber.Start(ctx)
+		targets = func() []config.Target { return slices.Concat(pollers.Targets(), subscriber.Targets()) }
+		wanted = func() []string { return slices.Concat(pollers.Wanted(), subscriber.Wanted()) }
 	}
+	if leases != nil {
+		leases.Start(ctx, wanted, pollers.Refresh)
+	}
+
+	commandPoller := poller.NewCommandPoller(cfg, targets, log)
+	if subscriber != nil && cfg.MQTT.CommandTopic != "" {
+		commandPoller.SetSender(config.ProtocolMQTT, subscriber)
+	}
+	commandPoller.Start(ctx)
+
+	var adminServer *admin.Server
+	if cfg.Admin.Listen != "" {
+		adminServer = admin.New(cfg, pollers, tracker, log)
+		if err := adminServer.Start(); err != nil {
+			log.Fatalf("Failed to start admin server: %v", err)
+		}
+	}
+
+	go reportSelf(ctx, cfg, out)
+
+	<-ctx.Done()
+	log.Info("Shutting down, draining uploads")
+
+	// Stop producers before draining so nothing is queued behind the drain
+	if adminServer != nil {
+		adminServer.Stop()
+	}
+	pollers.Stop()
+	if leases != nil {
+		leases.Stop() // After the pollers, so no target is polled twice while handed over
+	}
+	commandPoller.Stop()
+	if subscriber != nil {
+		subscriber.Stop() // After the command poller, which publishes through it
+	}
+	tracker.Stop()
 
-	for _, p := range pollers {
-		log.Infof("Starting poller for host %s", p.Host)
-		go p.Start()
-		defer p.Stop()
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Telemetry.Timeout)*time.Second)
+	defer cancel()
+	// The sinks drain alongside the API, within the same timeout
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Drain(drainCtx); err != nil {
+				log.Errorf("Failed to drain sink: %v", err)
+			}
+		}()
+	}
+	err = up.Drain(drainCtx)
+	wg.Wait()
+	if err != nil {
+		log.Errorf("Failed to drain uploads: %v", err)
+		return
 	}
+	log.Info("Shutdown complete")
+}
 
-	commandPoller := poller.NewCommandPoller(cfg, log)
-	commandPoller.Start()
-	defer commandPoller.Stop()
+// selfReportInterval is how often the aggregator uploads its own counters
+const selfReportInterval = 30 * time.Second
 
-	select {} // Block forever
+// reportSelf uploads the aggregator's counters as a device named after the service
+func reportSelf(ctx context.Context, cfg *config.Config, up uploader.Submitter) {
+	hostname, _ := os.Hostname()
+	ticker := time.NewTicker(selfReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			up.Submit(uploader.Sample{
+				DeviceID: cfg.Labels.Service,
+				Metrics:  &metrics.DeviceMetrics{Hostname: hostname, Metrics: selfmetrics.Snapshot(now)},
+			})
+		}
+	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/poller"
+)
+
+// maxProbeDump caps the raw reply printed by probe
+const maxProbeDump = 4096
+
+// probe polls one device and sends it a command, printing every step
+func probe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	protocol := fs.String("protocol", config.ProtocolDaemon, "daemon, diorama, http-json or prometheus")
+	timeout := fs.Int("timeout", 5, "seconds for connecting and each read")
+	path := fs.String("path", "", "HTTP path of http-json and prometheus targets")
+	var mappings []config.Mapping
+	fs.Func("map", "http-json mapping as type=jsonpath or type:unit=jsonpath, repeatable", func(s string) error {
+		spec, jsonPath, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected type=jsonpath")
+		}
+		metricType, unit, _ := strings.Cut(spec, ":")
+		mappings = append(mappings, config.Mapping{Type: metricType, Path: jsonPath, Unit: unit})
+		return nil
+	})
+	command := fs.String("command", "notify", "command sent after the poll to daemons and dioramas, empty to skip")
+	cmdArgs := fs.String("args", "", "JSON arguments of the command")
+	replyTimeout := fs.Int("reply-timeout", 360, "seconds the device may take to run the command and answer")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: aggregator probe host:port [flags]")
+		fs.PrintDefaults()
+	}
+
+	// Flags may come before or after the address
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	addr := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return 2
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid address %q: %v\n", addr, err)
+		return 2
+	}
+	target := config.NewTarget()
+	target.Address, target.Port, target.Interval, target.Timeout, target.Protocol = host, port, 1, *timeout, *protocol
+	target.Path, target.Mappings = *path, mappings
+	if err := config.ValidateTargets([]config.Target{target}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(4**timeout)*time.Second)
+	defer cancel()
+
+	fmt.Printf("Polling %s over %s\n", target.Addr(), target.Protocol)
+	result, pollErr := poller.ProbeTarget(ctx, target)
+	printRaw(result.Raw)
+	if f := result.Frame; f != nil {
+		fmt.Printf("\n--- frame\nversion %d, type %d, %d byte payload\n", f.Version, f.Type, len(f.Payload))
+		fmt.Println("\n--- payload")
+		if utf8.Valid(f.Payload) {
+			fmt.Println(string(f.Payload))
+		} else {
+			fmt.Print(hex.Dump(f.Payload))
+		}
+	}
+	if result.Metrics != nil {
+		out, _ := json.MarshalIndent(result.Metrics, "", "  ")
+		fmt.Printf("\n--- metrics\n%s\n", out)
+	}
+	if pollErr != nil {
+		fmt.Fprintf(os.Stderr, "\nPoll failed: %v\n", pollErr)
+	}
+
+	if *command == "" || !poller.TakesCommands(target.Protocol) {
+		return exitCode(pollErr)
+	}
+	cmd := poller.Command{Device: target.DeviceID(), Command: *command}
+	if *cmdArgs != "" {
+		cmd.Args = json.RawMessage(*cmdArgs)
+	}
+	fmt.Printf("\n--- command %s\n", cmd.Command)
+	reply, err := poller.SendCommand(context.Background(), target, cmd, time.Duration(*replyTimeout)*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Command failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("success=%v status=%s message=%q", reply.Success, reply.Status, reply.Message)
+	if len(reply.Output) > 0 {
+		fmt.Printf(" output=%d bytes", len(reply.Output))
+	}
+	fmt.Println()
+	return exitCode(pollErr)
+}
+
+func printRaw(raw []byte) {
+	fmt.Printf("\n--- raw reply, %d bytes\n", len(raw))
+	if len(raw) > maxProbeDump {
+		fmt.Print(hex.Dump(raw[:maxProbeDump]))
+		fmt.Printf("... %d more bytes\n", len(raw)-maxProbeDump)
+		return
+	}
+	fmt.Print(hex.Dump(raw))
+}
+
+func exitCode(err error) int {
+	if err != nil {
+		return 1
+	}
+	return 0
+}
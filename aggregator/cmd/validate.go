@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+)
+
+// validate checks a config file, and the targets file it points to, without
+// starting anything
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	path := fs.String("config", "config.toml", "config file to check")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *path, err)
+		return 1
+	}
+	for _, warning := range cfg.Warnings {
+		fmt.Printf("%s: warning: %s\n", *path, warning)
+	}
+
+	if cfg.Discovery.File != "" {
+		targets, err := discovery.LoadTargets(cfg.Discovery.File)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cfg.Discovery.File, err)
+			return 1
+		}
+		fmt.Printf("%s: %d targets\n", cfg.Discovery.File, len(targets))
+	}
+
+	fmt.Printf("%s: ok, %d targets and %d processors\n", *path, len(cfg.Targets), len(cfg.Processors))
+	return 0
+}
@@ -0,0 +1,214 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/internal/health"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	maxBodyBytes    = 1 << 20
+	shutdownTimeout = 5 * time.Second
+)
+
+// Server serves the aggregator's metrics for Prometheus and lets operators
+// list, poll, pause, add and remove targets while it runs
+type Server struct {
+	cfg     *config.Config
+	logger  *log.Logger
+	targets *discovery.Manager
+	health  *health.Tracker
+	server  *http.Server
+	done    chan struct{}
+}
+
+// Target is a target with how it is being polled and its health
+type Target struct {
+	config.Target
+	Origin      string     `json:"origin"`
+	Polling     bool       `json:"polling"`
+	Paused      bool       `json:"paused"`
+	Skipped     string     `json:"skipped,omitempty"`
+	State       string     `json:"state"`
+	StateSince  *time.Time `json:"state_since,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+func New(cfg *config.Config, targets *discovery.Manager, tracker *health.Tracker, logger *log.Logger) *Server {
+	s := &Server{cfg: cfg, logger: logger, targets: targets, health: tracker}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	mux.HandleFunc("GET /api/targets", s.handleListTargets)
+	mux.HandleFunc("POST /api/targets", s.handleAddTarget)
+	mux.HandleFunc("DELETE /api/targets/{name}", s.handleRemoveTarget)
+	mux.HandleFunc("POST /api/targets/{name}/poll", s.handlePollTarget)
+	mux.HandleFunc("POST /api/targets/{name}/pause", s.handlePauseTarget)
+	mux.HandleFunc("POST /api/targets/{name}/resume", s.handleResumeTarget)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// Handler serves the admin API without listening, for tests
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Start listens on the configured address and serves until Stop is called
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.cfg.Admin.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Admin.Listen, err)
+	}
+	s.logger.Infof("Admin server listening on %s", ln.Addr())
+
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("Admin server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits briefly for requests in flight and closes the server
+func (s *Server) Stop() {
+	if s.done == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.logger.Errorf("Failed to shut down admin server: %v", err)
+	}
+	<-s.done
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", selfmetrics.ContentType)
+	if err := selfmetrics.WritePrometheus(w); err != nil {
+		s.logger.Debugf("Failed to write metrics: %v", err)
+	}
+}
+
+func (s *Server) handleListTargets(w http.ResponseWriter, r *http.Request) {
+	statuses := make(map[string]health.Status)
+	for _, status := range s.health.Statuses() {
+		statuses[status.DeviceID] = status
+	}
+
+	entries := s.targets.Entries()
+	out := make([]Target, 0, len(entries))
+	for _, e := range entries {
+		t := Target{
+			Target:  e.Target,
+			Origin:  e.Origin,
+			Polling: e.Polling,
+			Paused:  e.Paused,
+			Skipped: e.Skipped,
+			State:   string(health.Unknown),
+		}
+		if status, ok := statuses[e.Target.DeviceID()]; ok {
+			t.State = string(status.State)
+			t.StateSince = &status.Since
+			t.LastError = status.LastError
+			if !status.LastSuccess.IsZero() {
+				t.LastSuccess = &status.LastSuccess
+			}
+		}
+		out = append(out, t)
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleAddTarget(w http.ResponseWriter, r *http.Request) {
+	target := config.NewTarget()
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&target); err != nil {
+		http.Error(w, "Invalid target format", http.StatusBadRequest)
+		return
+	}
+	targets := []config.Target{target}
+	if err := config.ValidateTargets(targets); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.targets.Add(targets[0]); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Infof("Added target %s (%s) from the admin API", targets[0].Name, targets[0].Addr())
+	s.writeJSON(w, http.StatusCreated, targets[0])
+}
+
+func (s *Server) handleRemoveTarget(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.targets.Remove(name); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Infof("Removed target %s from the admin API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePollTarget(w http.ResponseWriter, r *http.Request) {
+	if err := s.targets.PollNow(r.PathValue("name")); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handlePauseTarget(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.targets.Pause(name); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Infof("Paused target %s from the admin API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleResumeTarget(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.targets.Resume(name); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Infof("Resumed target %s from the admin API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError maps manager errors to status codes
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, discovery.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, discovery.ErrExists), errors.Is(err, discovery.ErrNotPolling):
+		status = http.StatusConflict
+	case errors.Is(err, discovery.ErrStopped):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Debugf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/internal/admin"
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/internal/health"
+	"github.com/charmbracelet/log"
+)
+
+// TEST: GIVEN an admin server over a manager with one configured target
+// WHEN targets are listed, added, polled, paused and removed over HTTP
+// THEN the manager should follow and errors should map to status codes
+func TestServer_Targets(t *testing.T) {
+	logger := log.NewWithOptions(os.Stderr, log.Options{Level: log.ErrorLevel})
+	cfg := &config.Config{Telemetry: config.Telemetry{Server: "http://127.0.0.1:0", RetryInterval: 1, Timeout: 1}}
+
+	static := config.NewTarget()
+	static.Name, static.Address, static.Port, static.Interval = "edge", "10.0.0.1", "80", 5
+
+	runners := &fakeRunners{polls: make(map[string]int)}
+	manager := discovery.NewManager([]config.Target{static}, nil, runners.create, logger)
+	manager.Start(context.Background())
+	defer manager.Stop()
+
+	tracker := health.NewTracker(cfg, logger)
+	tracker.Observe(static.DeviceID(), nil)
+
+	srv := httptest.NewServer(admin.New(cfg, manager, tracker, logger).Handler())
+	defer srv.Close()
+
+	var listed []admin.Target
+	do(t, srv, "GET", "/api/targets", "", http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0].Name != "edge" || listed[0].Origin != discovery.OriginConfigured || listed[0].State != "up" || listed[0].LastSuccess == nil {
+		t.Fatalf("Unexpected targets %+v", listed)
+	}
+
+	do(t, srv, "POST", "/api/targets", `{"address": "10.0.0.2", "port": "81", "interval": 2}`, http.StatusCreated, nil)
+	do(t, srv, "POST", "/api/targets", `{"address": "10.0.0.2", "port": "81", "interval": 2}`, http.StatusConflict, nil)
+	do(t, srv, "POST", "/api/targets", `{"address": "10.0.0.3", "port": "81"}`, http.StatusBadRequest, nil)
+
+	do(t, srv, "POST", "/api/targets/10.0.0.2:81/poll", "", http.StatusAccepted, nil)
+	if runners.get("10.0.0.2:81") != 1 {
+		t.Errorf("Expected one immediate poll")
+	}
+
+	do(t, srv, "POST", "/api/targets/edge/pause", "", http.StatusNoContent, nil)
+	do(t, srv, "POST", "/api/targets/edge/poll", "", http.StatusConflict, nil)
+	do(t, srv, "GET", "/api/targets", "", http.StatusOK, &listed)
+	if len(listed) != 2 || !listed[1].Paused || listed[1].Polling {
+		t.Errorf("Expected edge to be paused, got %+v", listed)
+	}
+	do(t, srv, "POST", "/api/targets/edge/resume", "", http.StatusNoContent, nil)
+
+	do(t, srv, "DELETE", "/api/targets/10.0.0.2:81", "", http.StatusNoContent, nil)
+	do(t, srv, "DELETE", "/api/targets/10.0.0.2:81", "", http.StatusNotFound, nil)
+	if names := manager.Targets(); len(names) != 1 || names[0].Name != "edge" {
+		t.Errorf("Expected only edge to be polled, got %+v", names)
+	}
+}
+
+// TEST: GIVEN an admin server
+// WHEN /metrics is scraped
+// THEN it should answer in the Prometheus text format
+func TestServer_Metrics(t *testing.T) {
+	logger := log.NewWithOptions(os.Stderr, log.Options{Level: log.ErrorLevel})
+	cfg := &config.Config{}
+	manager := discovery.NewManager(nil, nil, nil, logger)
+	srv := httptest.NewServer(admin.New(cfg, manager, health.NewTracker(cfg, logger), logger).Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string, status int, out any) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected %d, got %d: %s", method, path, status, resp.StatusCode, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("Failed to decode %s: %v", data, err)
+		}
+	}
+}
+
+type fakeRunners struct {
+	mu    sync.Mutex
+	polls map[string]int
+}
+
+func (f *fakeRunners) create(t config.Target) (discovery.Runner, error) {
+	return &fakeRunner{name: t.Name, runners: f}, nil
+}
+
+func (f *fakeRunners) get(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.polls[name]
+}
+
+type fakeRunner struct {
+	name    string
+	runners *fakeRunners
+}
+
+func (r *fakeRunner) Start(ctx context.Context) {}
+func (r *fakeRunner) Stop()                     {}
+func (r *fakeRunner) PollNow() {
+	r.runners.mu.Lock()
+	defer r.runners.mu.Unlock()
+	r.runners.polls[r.name]++
+}
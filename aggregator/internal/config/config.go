@@ -2,14 +2,24 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bxrne/beacon/aggregator/pkg/jsonpath"
 )
 
 type Telemetry struct {
-	Server        string `toml:"server"`
-	RetryInterval int    `toml:"retry_interval"`
-	Timeout       int    `toml:"timeout"`
+	Server           string `toml:"server"`
+	RetryInterval    int    `toml:"retry_interval"`
+	MaxRetryInterval int    `toml:"max_retry_interval"` // Optional, defaults to 60 seconds
+	MaxRetries       int    `toml:"max_retries"`        // Optional, defaults to 5
+	Timeout          int    `toml:"timeout"`
+	BatchSize        int    `toml:"batch_size"`     // Optional, samples per upload, defaults to 100
+	BatchInterval    int    `toml:"batch_interval"` // Optional, milliseconds before a partial batch is sent, defaults to 1000
 }
 
 type Labels struct {
@@ -21,29 +31,272 @@ type Logging struct {
 	Level string `toml:"level"`
 }
 
-type Targets struct {
+// Protocols a target can be polled with
+const (
+	ProtocolDaemon     = "daemon"
+	ProtocolDiorama    = "diorama"
+	ProtocolHTTPJSON   = "http-json"
+	ProtocolPrometheus = "prometheus"
+	// ProtocolMQTT marks devices that publish to the [mqtt] broker, they are
+	// not configured as targets
+	ProtocolMQTT = "mqtt"
+)
+
+const (
+	defaultTargetTimeout = 5
+	maxPort              = 65535
+)
+
+// Target is one device to poll, configured as a [[targets]] table or found by discovery
+type Target struct {
+	Name     string            `toml:"name" json:"name" yaml:"name"`             // Optional, defaults to address:port
+	Address  string            `toml:"address" json:"address" yaml:"address"`    // Host name or IP
+	Port     string            `toml:"port" json:"port" yaml:"port"`             // Quoted, e.g. "80"
+	Interval int               `toml:"interval" json:"interval" yaml:"interval"` // Seconds between polls
+	Timeout  int               `toml:"timeout" json:"timeout" yaml:"timeout"`    // Optional, seconds, defaults to 5
+	Protocol string            `toml:"protocol" json:"protocol" yaml:"protocol"` // Optional, defaults to daemon
+	Labels   map[string]string `toml:"labels" json:"labels" yaml:"labels"`       // Optional, added to every metric from the target
+	Group    string            `toml:"group" json:"group" yaml:"group"`          // Optional, for applying processors to several targets
+	Window   int               `toml:"window" json:"window" yaml:"window"`       // Optional, seconds of polls rolled up into one upload, 0 uploads every poll
+	Path     string            `toml:"path" json:"path" yaml:"path"`             // Optional, HTTP path for prometheus and http-json, defaults to /metrics and /
+	Mappings []Mapping         `toml:"mappings" json:"mappings" yaml:"mappings"` // http-json: the values to read from the reply
+	Enabled  bool              `toml:"enabled" json:"enabled" yaml:"enabled"`    // Optional, defaults to true
+}
+
+// Mapping reads metrics of one type from an http-json target's reply
+type Mapping struct {
+	Type string `toml:"type" json:"type" yaml:"type"`
+	Path string `toml:"path" json:"path" yaml:"path"` // JSONPath, e.g. "$.sensors[0].temp", a wildcard reads several
+	Unit string `toml:"unit" json:"unit" yaml:"unit"` // Optional, defaults to unknown
+}
+
+// NewTarget returns a target with the optional fields at their defaults, to decode into
+func NewTarget() Target {
+	return Target{Timeout: defaultTargetTimeout, Protocol: ProtocolDaemon, Enabled: true}
+}
+
+// DeviceID identifies the target's metrics and commands to the API. Devices
+// without a port, like those publishing to MQTT, go by their address alone.
+func (t Target) DeviceID() string {
+	if t.Port == "" {
+		return t.Address
+	}
+	return fmt.Sprintf("%v:%v", t.Address, t.Port)
+}
+
+// Addr is the target's address for dialing
+func (t Target) Addr() string {
+	return net.JoinHostPort(t.Address, t.Port)
+}
+
+// legacyTargets is the deprecated [targets] table of parallel arrays
+type legacyTargets struct {
 	Hosts       []string `toml:"hosts"`
 	Frequencies []int    `toml:"frequencies"`
 	Ports       []string `toml:"ports"`
 }
 
+// Spool keeps uploads that failed on disk until the API is back
+type Spool struct {
+	Dir          string `toml:"dir"`           // Optional, spooling is disabled without it
+	MaxBytes     int64  `toml:"max_bytes"`     // Optional, defaults to 64 MiB
+	MaxAge       int    `toml:"max_age"`       // Optional, seconds, defaults to 24 hours
+	SegmentBytes int64  `toml:"segment_bytes"` // Optional, defaults to 4 MiB
+}
+
+// Discovery finds targets beyond the [[targets]] tables while the aggregator runs
+type Discovery struct {
+	File         string `toml:"file"`          // Optional, JSON, TOML or YAML file of targets, watched for changes
+	FileInterval int    `toml:"file_interval"` // Optional, seconds between checks of the file, defaults to 5
+	MDNS         bool   `toml:"mdns"`          // Optional, browse DNS-SD for daemons advertising _beacon._tcp
+	MDNSInterval int    `toml:"mdns_interval"` // Optional, seconds between browses, defaults to 30
+	Interval     int    `toml:"interval"`      // Optional, seconds between polls of daemons found by DNS-SD, defaults to 5
+}
+
+// Health decides when a target counts as down or flapping
+type Health struct {
+	DownAfter     int `toml:"down_after"`     // Optional, failed polls in a row before a target is down, defaults to 3
+	UpAfter       int `toml:"up_after"`       // Optional, good polls in a row before it is up again, defaults to 2
+	FlapWindow    int `toml:"flap_window"`    // Optional, seconds over which up/down changes are counted, defaults to 600
+	FlapThreshold int `toml:"flap_threshold"` // Optional, changes within the window that count as flapping, defaults to 4
+}
+
+// Commands controls how commands queued in the API reach the targets
+type Commands struct {
+	PollOnly bool `toml:"poll_only"` // Optional, poll every interval instead of holding a stream open
+	Interval int  `toml:"interval"`  // Optional, seconds between polls when not streaming, defaults to 5
+	Timeout  int  `toml:"timeout"`   // Optional, seconds for each request to the API, defaults to 5
+	// ReplyTimeout is how long a device may take to answer a command, which
+	// covers running it. Optional, seconds, defaults to 360 to outlast the
+	// daemon's five minute update download.
+	ReplyTimeout int `toml:"reply_timeout"`
+}
+
+// Admin serves Prometheus metrics and target controls over HTTP
+type Admin struct {
+	Listen string `toml:"listen"` // Optional, e.g. "127.0.0.1:9100", the admin server is disabled without it
+}
+
+// Processor kinds, applied in the order they are configured
+const (
+	ProcessorDrop    = "drop"    // Drops the metric types matching metrics
+	ProcessorRename  = "rename"  // Renames metric types by rename
+	ProcessorLabel   = "label"   // Adds labels, the device's own labels win
+	ProcessorConvert = "convert" // Scales and offsets the value of metrics and sets their unit
+	ProcessorRate    = "rate"    // Derives a per second rate from counters in metrics
+	ProcessorReboot  = "reboot"  // Emits an event when the metric in metrics, uptime by default, goes down
+)
+
+// Processor changes a target's metrics before they are forwarded, configured
+// as a [[processors]] table. It applies to the targets named in targets and
+// the targets in groups, or to every target when both are empty.
+type Processor struct {
+	Type    string            `toml:"type"`
+	Targets []string          `toml:"targets"`
+	Groups  []string          `toml:"groups"`
+	Metrics []string          `toml:"metrics"` // Metric types or glob patterns, e.g. "battery_*"
+	Rename  map[string]string `toml:"rename"`  // rename: old type to new type
+	Labels  map[string]string `toml:"labels"`  // label
+	From    string            `toml:"from"`    // convert: Optional, only metrics in this unit
+	Unit    string            `toml:"unit"`    // convert: the new unit, rate: the rate's unit, defaults to per_second
+	Scale   float64           `toml:"scale"`   // convert: Optional, defaults to 1
+	Offset  float64           `toml:"offset"`  // convert: Optional, added after scaling
+	Suffix  string            `toml:"suffix"`  // rate: Optional, appended to the type, defaults to _rate
+	Name    string            `toml:"name"`    // reboot: Optional, the event's type, defaults to reboot
+}
+
+// HA shares the targets among several aggregators, each polling only those it
+// holds a lease on from the API
+type HA struct {
+	Enabled  bool   `toml:"enabled"`
+	Instance string `toml:"instance"`  // Optional, unique per aggregator, defaults to hostname-pid
+	Interval int    `toml:"interval"`  // Optional, seconds between heartbeats, defaults to 5
+	LeaseTTL int    `toml:"lease_ttl"` // Optional, seconds a lease outlives its last heartbeat, defaults to 3 intervals
+}
+
+// Sink kinds, destinations the metric stream is written to besides the API
+const (
+	SinkJSONL  = "jsonl"  // A local file of one JSON sample per line, rotated by size
+	SinkInflux = "influx" // InfluxDB line protocol posted over HTTP
+	SinkMQTT   = "mqtt"   // One JSON sample per message to an MQTT topic
+)
+
+// Sink writes the same samples as are uploaded to another destination,
+// configured as a [[sinks]] table. Each sink has its own queue and retries,
+// so a slow one does not hold up the API or the others.
+type Sink struct {
+	Type          string `toml:"type"`
+	Name          string `toml:"name"`           // Optional, for logs and metrics, defaults to the type
+	QueueSize     int    `toml:"queue_size"`     // Optional, samples waiting before new ones are dropped, defaults to 4096
+	BatchSize     int    `toml:"batch_size"`     // Optional, samples per write, defaults to 100
+	BatchInterval int    `toml:"batch_interval"` // Optional, milliseconds before a partial batch is written, defaults to 1000
+	MaxRetries    int    `toml:"max_retries"`    // Optional, defaults to the telemetry's max_retries
+
+	Path     string `toml:"path"`      // jsonl: the file written, rotated files get .1, .2, ...
+	MaxBytes int64  `toml:"max_bytes"` // jsonl: Optional, size the file is rotated at, defaults to 64 MiB
+	MaxFiles int    `toml:"max_files"` // jsonl: Optional, rotated files kept, defaults to 3
+
+	URL   string `toml:"url"`   // influx: the write endpoint with its query, e.g. http://localhost:8086/api/v2/write?org=o&bucket=b
+	Token string `toml:"token"` // influx: Optional, sent as Authorization: Token
+
+	Broker   string `toml:"broker"`    // mqtt: host:port, with ssl:// for TLS
+	Topic    string `toml:"topic"`     // mqtt: {device} is replaced by the device ID, e.g. beacon/{device}/metrics
+	QoS      int    `toml:"qos"`       // mqtt: Optional, 0 or 1, defaults to 0
+	ClientID string `toml:"client_id"` // mqtt: Optional, defaults to a random ID
+	Username string `toml:"username"`  // mqtt: Optional
+	Password string `toml:"password"`  // mqtt: Optional
+}
+
+// Payload decoders for MQTT subscriptions
+const (
+	DecoderJSON   = "json"   // The daemon's JSON metrics, or values read by JSONPath mappings
+	DecoderBproto = "bproto" // The bproto text payload, "key: value, ...", or a whole frame
+)
+
+// DeviceLevel in a subscription's topic matches one level and names the device
+const DeviceLevel = "{device}"
+
+// MQTT ingests readings from devices that publish to a broker instead of
+// serving them, and publishes their commands back
+type MQTT struct {
+	Broker        string         `toml:"broker"`        // host:port, with ssl:// for TLS, ingestion is disabled without it
+	ClientID      string         `toml:"client_id"`     // Optional, defaults to a random ID
+	Username      string         `toml:"username"`      // Optional
+	Password      string         `toml:"password"`      // Optional
+	QoS           int            `toml:"qos"`           // Optional, 0 or 1 for subscriptions and commands, defaults to 0
+	CommandTopic  string         `toml:"command_topic"` // Optional, with {device} for the device ID, commands are not delivered without it
+	MaxDevices    int            `toml:"max_devices"`   // Optional, devices tracked at once, messages from more are dropped, defaults to 1000
+	DeviceTTL     int            `toml:"device_ttl"`    // Optional, seconds without a message before a device is forgotten, defaults to 3600
+	Subscriptions []Subscription `toml:"subscriptions"`
+}
+
+// Subscription maps the messages on a topic pattern to a device's metrics,
+// configured as an [[mqtt.subscriptions]] table
+type Subscription struct {
+	Topic    string            `toml:"topic"`    // + and # as in MQTT, and {device} for the level naming the device, e.g. sensors/{device}/state
+	Device   string            `toml:"device"`   // Optional, the device ID for a topic without {device}
+	Decoder  string            `toml:"decoder"`  // json or bproto
+	Mappings []Mapping         `toml:"mappings"` // json: Optional, values read by JSONPath instead of the daemon's JSON
+	Labels   map[string]string `toml:"labels"`   // Optional, added to every metric from the devices
+	Group    string            `toml:"group"`    // Optional, for applying processors to the devices
+}
+
 type Config struct {
-	Labels    Labels    `toml:"labels"`
-	Logging   Logging   `toml:"logging"`
-	Telemetry Telemetry `toml:"telemetry"`
-	Targets   Targets   `toml:"targets"`
+	Labels     Labels      `toml:"labels"`
+	Logging    Logging     `toml:"logging"`
+	Telemetry  Telemetry   `toml:"telemetry"`
+	Targets    []Target    `toml:"-"`
+	Spool      Spool       `toml:"spool"`
+	Discovery  Discovery   `toml:"discovery"`
+	Health     Health      `toml:"health"`
+	Admin      Admin       `toml:"admin"`
+	Commands   Commands    `toml:"commands"`
+	HA         HA          `toml:"ha"`
+	Processors []Processor `toml:"processors"`
+	Sinks      []Sink      `toml:"sinks"`
+	MQTT       MQTT        `toml:"mqtt"`
+
+	// Warnings are problems that did not stop the config loading, like deprecated settings
+	Warnings []string `toml:"-"`
+}
+
+// file is the config as decoded, targets are decoded once their layout is known
+type file struct {
+	Labels     Labels         `toml:"labels"`
+	Logging    Logging        `toml:"logging"`
+	Telemetry  Telemetry      `toml:"telemetry"`
+	Targets    toml.Primitive `toml:"targets"`
+	Spool      Spool          `toml:"spool"`
+	Discovery  Discovery      `toml:"discovery"`
+	Health     Health         `toml:"health"`
+	Admin      Admin          `toml:"admin"`
+	Commands   Commands       `toml:"commands"`
+	HA         HA             `toml:"ha"`
+	Processors []Processor    `toml:"processors"`
+	Sinks      []Sink         `toml:"sinks"`
+	MQTT       MQTT           `toml:"mqtt"`
 }
 
 func Load(path string) (*Config, error) {
-	config := &Config{
-		Labels:    Labels{},
-		Logging:   Logging{},
-		Telemetry: Telemetry{},
-		Targets:   Targets{},
+	var raw file
+	md, err := toml.DecodeFile(path, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
-	if _, err := toml.DecodeFile(path, config); err != nil {
-		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	config := &Config{
+		Labels:     raw.Labels,
+		Logging:    raw.Logging,
+		Telemetry:  raw.Telemetry,
+		Spool:      raw.Spool,
+		Discovery:  raw.Discovery,
+		Health:     raw.Health,
+		Admin:      raw.Admin,
+		Commands:   raw.Commands,
+		HA:         raw.HA,
+		Processors: raw.Processors,
+		Sinks:      raw.Sinks,
+		MQTT:       raw.MQTT,
 	}
 
 	// if missing fields, return an error
@@ -59,24 +312,301 @@ func Load(path string) (*Config, error) {
 	if config.Telemetry.Server == "" {
 		return nil, fmt.Errorf("missing server field in config")
 	}
-	if config.Targets.Hosts == nil {
-		return nil, fmt.Errorf("missing hosts field in config")
-	}
 	if config.Telemetry.RetryInterval == 0 {
 		return nil, fmt.Errorf("missing retry_interval field in config")
 	}
-	if config.Targets.Frequencies == nil {
+
+	switch md.Type("targets") {
+	case "ArrayHash":
+		config.Targets, err = decodeTargets(md, raw.Targets)
+	case "Hash":
+		config.Targets, err = decodeLegacyTargets(md, raw.Targets)
+		config.Warnings = append(config.Warnings,
+			"[targets] with hosts, ports and frequencies arrays is deprecated, use a [[targets]] table per target")
+	case "":
+		// Every target may come from discovery or MQTT
+		if config.Discovery.File == "" && !config.Discovery.MDNS && config.MQTT.Broker == "" {
+			err = fmt.Errorf("missing targets in config")
+		}
+	default:
+		err = fmt.Errorf("targets must be [[targets]] tables")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateTargets(config.Targets); err != nil {
+		return nil, err
+	}
+	if err := ValidateProcessors(config.Processors); err != nil {
+		return nil, err
+	}
+	if err := ValidateSinks(config.Sinks); err != nil {
+		return nil, err
+	}
+	if err := ValidateMQTT(config.MQTT); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func decodeTargets(md toml.MetaData, prim toml.Primitive) ([]Target, error) {
+	var tables []toml.Primitive
+	if err := md.PrimitiveDecode(prim, &tables); err != nil {
+		return nil, fmt.Errorf("failed to decode targets: %w", err)
+	}
+
+	targets := make([]Target, 0, len(tables))
+	for i, table := range tables {
+		target := NewTarget()
+		if err := md.PrimitiveDecode(table, &target); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// decodeLegacyTargets converts the deprecated parallel arrays to targets
+func decodeLegacyTargets(md toml.MetaData, prim toml.Primitive) ([]Target, error) {
+	var legacy legacyTargets
+	if err := md.PrimitiveDecode(prim, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to decode targets: %w", err)
+	}
+
+	if legacy.Hosts == nil {
+		return nil, fmt.Errorf("missing hosts field in config")
+	}
+	if legacy.Frequencies == nil {
 		return nil, fmt.Errorf("missing frequencies field in config")
 	}
-	if config.Targets.Ports == nil {
+	if legacy.Ports == nil {
 		return nil, fmt.Errorf("missing ports field in config")
 	}
-	if len(config.Targets.Hosts) != len(config.Targets.Frequencies) {
+	if len(legacy.Hosts) != len(legacy.Frequencies) {
 		return nil, fmt.Errorf("hosts and frequencies fields must be equal in length")
 	}
-	if len(config.Targets.Hosts) != len(config.Targets.Ports) {
+	if len(legacy.Hosts) != len(legacy.Ports) {
 		return nil, fmt.Errorf("hosts and ports fields must be equal in length")
 	}
 
-	return config, nil
+	targets := make([]Target, len(legacy.Hosts))
+	for i := range legacy.Hosts {
+		targets[i] = NewTarget()
+		targets[i].Address = legacy.Hosts[i]
+		targets[i].Port = legacy.Ports[i]
+		targets[i].Interval = legacy.Frequencies[i]
+	}
+	return targets, nil
+}
+
+// ValidateTargets fills in names and reports the first invalid target by name
+func ValidateTargets(targets []Target) error {
+	names := make(map[string]bool, len(targets))
+	for i := range targets {
+		t := &targets[i]
+		if t.Address == "" {
+			return fmt.Errorf("target %d: missing address", i+1)
+		}
+		if t.Name == "" {
+			t.Name = t.DeviceID()
+		}
+		if names[t.Name] {
+			return fmt.Errorf("target %q: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		if port, err := strconv.Atoi(t.Port); err != nil || port < 1 || port > maxPort {
+			return fmt.Errorf("target %q: invalid port %q", t.Name, t.Port)
+		}
+		if t.Interval <= 0 {
+			return fmt.Errorf("target %q: interval must be positive", t.Name)
+		}
+		if t.Timeout <= 0 {
+			return fmt.Errorf("target %q: timeout must be positive", t.Name)
+		}
+		if t.Window < 0 {
+			return fmt.Errorf("target %q: window must not be negative", t.Name)
+		}
+		switch t.Protocol {
+		case ProtocolDaemon, ProtocolDiorama, ProtocolPrometheus:
+		case ProtocolHTTPJSON:
+			if len(t.Mappings) == 0 {
+				return fmt.Errorf("target %q: http-json needs mappings", t.Name)
+			}
+			for _, m := range t.Mappings {
+				if m.Type == "" {
+					return fmt.Errorf("target %q: mapping %q has no type", t.Name, m.Path)
+				}
+				if _, err := jsonpath.Compile(m.Path); err != nil {
+					return fmt.Errorf("target %q: %w", t.Name, err)
+				}
+			}
+		default:
+			return fmt.Errorf("target %q: unknown protocol %q", t.Name, t.Protocol)
+		}
+		if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+			return fmt.Errorf("target %q: path must start with /", t.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateProcessors reports the first processor missing what its type needs
+func ValidateProcessors(processors []Processor) error {
+	for i, p := range processors {
+		var err error
+		switch p.Type {
+		case ProcessorDrop, ProcessorConvert, ProcessorRate:
+			if len(p.Metrics) == 0 {
+				err = fmt.Errorf("missing metrics")
+			}
+			if p.Type == ProcessorConvert && p.Unit == "" && p.Scale == 0 && p.Offset == 0 {
+				err = fmt.Errorf("missing unit, scale or offset")
+			}
+		case ProcessorRename:
+			if len(p.Rename) == 0 {
+				err = fmt.Errorf("missing rename")
+			}
+		case ProcessorLabel:
+			if len(p.Labels) == 0 {
+				err = fmt.Errorf("missing labels")
+			}
+		case ProcessorReboot:
+			if len(p.Metrics) > 1 {
+				err = fmt.Errorf("watches one metric, got %d", len(p.Metrics))
+			}
+		default:
+			err = fmt.Errorf("unknown type %q", p.Type)
+		}
+		if err == nil {
+			for _, pattern := range p.Metrics {
+				if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+					err = fmt.Errorf("invalid metric pattern %q", pattern)
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("processor %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// ValidateSinks fills in names and reports the first sink missing what its
+// type needs
+func ValidateSinks(sinks []Sink) error {
+	names := make(map[string]bool, len(sinks))
+	for i := range sinks {
+		s := &sinks[i]
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		if names[s.Name] {
+			return fmt.Errorf("sink %q: duplicate name, name each sink of the same type", s.Name)
+		}
+		names[s.Name] = true
+
+		var err error
+		switch s.Type {
+		case SinkJSONL:
+			if s.Path == "" {
+				err = fmt.Errorf("missing path")
+			}
+		case SinkInflux:
+			if u, parseErr := url.Parse(s.URL); parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				err = fmt.Errorf("url must be http or https")
+			}
+		case SinkMQTT:
+			switch {
+			case s.Broker == "":
+				err = fmt.Errorf("missing broker")
+			case s.Topic == "" || strings.ContainsAny(s.Topic, "+#"):
+				err = fmt.Errorf("topic must be set and without wildcards")
+			case s.QoS < 0 || s.QoS > 1:
+				err = fmt.Errorf("qos must be 0 or 1")
+			}
+		default:
+			err = fmt.Errorf("unknown type %q", s.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("sink %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// ValidateMQTT reports the first problem with the broker settings or a
+// subscription
+func ValidateMQTT(m MQTT) error {
+	if m.Broker == "" {
+		if len(m.Subscriptions) > 0 {
+			return fmt.Errorf("mqtt: subscriptions need a broker")
+		}
+		return nil
+	}
+	if m.QoS < 0 || m.QoS > 1 {
+		return fmt.Errorf("mqtt: qos must be 0 or 1")
+	}
+	if m.CommandTopic != "" && (!strings.Contains(m.CommandTopic, DeviceLevel) || strings.ContainsAny(m.CommandTopic, "+#")) {
+		return fmt.Errorf("mqtt: command_topic must contain {device} and no wildcards")
+	}
+	if m.MaxDevices < 0 || m.DeviceTTL < 0 {
+		return fmt.Errorf("mqtt: max_devices and device_ttl must not be negative")
+	}
+	if len(m.Subscriptions) == 0 {
+		return fmt.Errorf("mqtt: missing subscriptions")
+	}
+
+	for i, s := range m.Subscriptions {
+		var err error
+		levels := strings.Split(s.Topic, "/")
+		devices := 0
+		for j, level := range levels {
+			switch {
+			case level == DeviceLevel:
+				devices++
+			case level == "#" && j != len(levels)-1, level != "#" && level != "+" && strings.ContainsAny(level, "+#{}"):
+				err = fmt.Errorf("invalid topic %q", s.Topic)
+			}
+		}
+		switch {
+		case err != nil:
+		case s.Topic == "":
+			err = fmt.Errorf("missing topic")
+		case devices > 1:
+			err = fmt.Errorf("topic %q names the device more than once", s.Topic)
+		case devices == 0 && s.Device == "":
+			err = fmt.Errorf("topic %q needs {device} or a device", s.Topic)
+		case devices == 1 && s.Device != "":
+			err = fmt.Errorf("topic %q names the device, device must be empty", s.Topic)
+		}
+		if err == nil {
+			switch s.Decoder {
+			case DecoderJSON:
+				for _, mapping := range s.Mappings {
+					if mapping.Type == "" {
+						err = fmt.Errorf("mapping %q has no type", mapping.Path)
+						break
+					}
+					if _, compileErr := jsonpath.Compile(mapping.Path); compileErr != nil {
+						err = compileErr
+						break
+					}
+				}
+			case DecoderBproto:
+				if len(s.Mappings) > 0 {
+					err = fmt.Errorf("mappings are only for the json decoder")
+				}
+			default:
+				err = fmt.Errorf("unknown decoder %q", s.Decoder)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("mqtt subscription %d: %w", i+1, err)
+		}
+	}
+	return nil
 }
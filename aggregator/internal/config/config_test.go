@@ -9,9 +9,9 @@ import (
 	"github.com/bxrne/beacon/aggregator/internal/config"
 )
 
-// TEST: GIVEN a valid TOML configuration file
+// TEST: GIVEN a valid TOML configuration file with the deprecated parallel target arrays
 // WHEN the Load function is called
-// THEN it should correctly parse all fields and return a matching Config struct
+// THEN it should convert them to targets and warn about the deprecation
 func TestLoad_ValidConfig(t *testing.T) {
 	content := `
 [telemetry]
@@ -45,10 +45,9 @@ level = "info"
 			RetryInterval: 10,
 			Timeout:       30,
 		},
-		Targets: config.Targets{
-			Hosts:       []string{"host1", "host2"},
-			Frequencies: []int{5, 10},
-			Ports:       []string{"8080", "9090"},
+		Targets: []config.Target{
+			{Name: "host1:8080", Address: "host1", Port: "8080", Interval: 5, Timeout: 5, Protocol: "daemon", Enabled: true},
+			{Name: "host2:9090", Address: "host2", Port: "9090", Interval: 10, Timeout: 5, Protocol: "daemon", Enabled: true},
 		},
 		Labels: config.Labels{
 			Environment: "production",
@@ -57,6 +56,7 @@ level = "info"
 		Logging: config.Logging{
 			Level: "info",
 		},
+		Warnings: []string{"[targets] with hosts, ports and frequencies arrays is deprecated, use a [[targets]] table per target"},
 	}
 
 	if !reflect.DeepEqual(cfg, expected) {
@@ -64,6 +64,326 @@ level = "info"
 	}
 }
 
+// TEST: GIVEN a configuration with [[targets]] tables, some fields left to defaults
+// WHEN the Load function is called
+// THEN it should parse every target with defaults filled in and no warnings
+func TestLoad_TargetTables(t *testing.T) {
+	content := validHeader + `
+[[targets]]
+name = "crossing"
+address = "192.168.1.20"
+port = "80"
+interval = 2
+timeout = 3
+protocol = "diorama"
+labels = { site = "lab" }
+
+[[targets]]
+address = "edge-1"
+port = "8080"
+interval = 10
+enabled = false
+`
+	tmpFile := createTempFile(t, content)
+
+	cfg, err := config.Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	want := []config.Target{
+		{Name: "crossing", Address: "192.168.1.20", Port: "80", Interval: 2, Timeout: 3, Protocol: "diorama", Labels: map[string]string{"site": "lab"}, Enabled: true},
+		{Name: "edge-1:8080", Address: "edge-1", Port: "8080", Interval: 10, Timeout: 5, Protocol: "daemon", Enabled: false},
+	}
+	if !reflect.DeepEqual(cfg.Targets, want) {
+		t.Errorf("Targets mismatch\nGot: %+v\nWant: %+v", cfg.Targets, want)
+	}
+	if len(cfg.Warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", cfg.Warnings)
+	}
+}
+
+// TEST: GIVEN [[targets]] tables with one invalid target
+// WHEN the Load function is called
+// THEN the error should name the offending target
+func TestLoad_InvalidTargetNamed(t *testing.T) {
+	cases := map[string]string{
+		`name = "north"
+address = "a"
+port = "80"
+interval = 0`: `target "north": interval must be positive`,
+		`name = "south"
+address = "b"
+port = "http"
+interval = 1`: `target "south": invalid port "http"`,
+		`address = "c"
+port = "80"
+interval = 1
+protocol = "snmp"`: `target "c:80": unknown protocol "snmp"`,
+		`name = "west"
+port = "80"
+interval = 1`: `target 2: missing address`,
+		`name = "pump"
+address = "d"
+port = "80"
+interval = 1
+protocol = "http-json"`: `target "pump": http-json needs mappings`,
+		`name = "tank"
+address = "e"
+port = "80"
+interval = 1
+protocol = "http-json"
+mappings = [{ type = "level", path = "level" }]`: `target "tank": jsonpath "level": must start with $`,
+		`name = "node"
+address = "f"
+port = "9100"
+interval = 1
+protocol = "prometheus"
+path = "metrics"`: `target "node": path must start with /`,
+	}
+
+	for target, want := range cases {
+		content := validHeader + `
+[[targets]]
+address = "ok"
+port = "80"
+interval = 1
+
+[[targets]]
+` + target + "\n"
+		_, err := config.Load(createTempFile(t, content))
+		if err == nil || err.Error() != want {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+// TEST: GIVEN [[processors]] tables, valid and not
+// WHEN the Load function is called
+// THEN valid ones should load in order and the error should name an invalid one
+func TestLoad_Processors(t *testing.T) {
+	content := validHeader + `
+[[targets]]
+address = "ok"
+port = "80"
+interval = 1
+group = "lab"
+
+[[processors]]
+type = "drop"
+metrics = ["battery_*"]
+
+[[processors]]
+type = "rate"
+groups = ["lab"]
+metrics = ["bytes_sent"]
+`
+	cfg, err := config.Load(createTempFile(t, content))
+	if err != nil {
+		t.Fatalf("Failed to load processors: %v", err)
+	}
+	want := []config.Processor{
+		{Type: "drop", Metrics: []string{"battery_*"}},
+		{Type: "rate", Groups: []string{"lab"}, Metrics: []string{"bytes_sent"}},
+	}
+	if !reflect.DeepEqual(cfg.Processors, want) || cfg.Targets[0].Group != "lab" {
+		t.Errorf("Expected processors %+v and group lab, got %+v and %q", want, cfg.Processors, cfg.Targets[0].Group)
+	}
+
+	cases := map[string]string{
+		`type = "sample"`: `processor 2: unknown type "sample"`,
+		`type = "drop"`:   `processor 2: missing metrics`,
+		`type = "convert"` + "\nmetrics = [\"a\"]": `processor 2: missing unit, scale or offset`,
+		`type = "rename"`:                          `processor 2: missing rename`,
+		`type = "drop"` + "\nmetrics = [\"[\"]":    `processor 2: invalid metric pattern "["`,
+	}
+	for processor, want := range cases {
+		content := validHeader + `
+[[targets]]
+address = "ok"
+port = "80"
+interval = 1
+
+[[processors]]
+type = "reboot"
+
+[[processors]]
+` + processor + "\n"
+		_, err := config.Load(createTempFile(t, content))
+		if err == nil || err.Error() != want {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+// TEST: GIVEN [[sinks]] tables, valid and not
+// WHEN the Load function is called
+// THEN valid ones should load named after their type and the error should name an invalid one
+func TestLoad_Sinks(t *testing.T) {
+	targets := `
+[[targets]]
+address = "ok"
+port = "80"
+interval = 1
+`
+	content := validHeader + targets + `
+[[sinks]]
+type = "jsonl"
+path = "metrics.jsonl"
+
+[[sinks]]
+type = "mqtt"
+name = "site"
+broker = "localhost:1883"
+topic = "beacon/{device}"
+qos = 1
+`
+	cfg, err := config.Load(createTempFile(t, content))
+	if err != nil {
+		t.Fatalf("Failed to load sinks: %v", err)
+	}
+	want := []config.Sink{
+		{Type: "jsonl", Name: "jsonl", Path: "metrics.jsonl"},
+		{Type: "mqtt", Name: "site", Broker: "localhost:1883", Topic: "beacon/{device}", QoS: 1},
+	}
+	if !reflect.DeepEqual(cfg.Sinks, want) {
+		t.Errorf("Expected sinks %+v, got %+v", want, cfg.Sinks)
+	}
+
+	cases := map[string]string{
+		`type = "kafka"`: `sink "kafka": unknown type "kafka"`,
+		`type = "jsonl"`: `sink "jsonl": duplicate name, name each sink of the same type`,
+		`type = "influx"` + "\nurl = \"localhost:8086\"":             `sink "influx": url must be http or https`,
+		`type = "mqtt"` + "\nbroker = \"b\"\ntopic = \"a/#\"":        `sink "mqtt": topic must be set and without wildcards`,
+		`type = "mqtt"` + "\nbroker = \"b\"\ntopic = \"a\"\nqos = 2": `sink "mqtt": qos must be 0 or 1`,
+	}
+	for sink, want := range cases {
+		content := validHeader + targets + `
+[[sinks]]
+type = "jsonl"
+path = "metrics.jsonl"
+
+[[sinks]]
+` + sink + "\n"
+		_, err := config.Load(createTempFile(t, content))
+		if err == nil || err.Error() != want {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+}
+
+// TEST: GIVEN an [mqtt] section with subscriptions and no [[targets]], valid and not
+// WHEN the Load function is called
+// THEN a valid one should load and the error should name what is wrong with an invalid one
+func TestLoad_MQTT(t *testing.T) {
+	content := validHeader + `
+[mqtt]
+broker = "localhost:1883"
+command_topic = "sensors/{device}/cmd"
+
+[[mqtt.subscriptions]]
+topic = "sensors/{device}/state"
+decoder = "json"
+mappings = [{ type = "temperature", path = "$.temp" }]
+
+[[mqtt.subscriptions]]
+topic = "greenhouse/#"
+device = "greenhouse"
+decoder = "bproto"
+`
+	cfg, err := config.Load(createTempFile(t, content))
+	if err != nil {
+		t.Fatalf("Failed to load mqtt: %v", err)
+	}
+	if len(cfg.Targets) != 0 || len(cfg.MQTT.Subscriptions) != 2 || cfg.MQTT.Subscriptions[1].Device != "greenhouse" {
+		t.Errorf("Unexpected config %+v", cfg.MQTT)
+	}
+
+	cases := map[string]string{
+		`topic = "a/{device}/{device}"` + "\ndecoder = \"json\"":                                         `mqtt subscription 2: topic "a/{device}/{device}" names the device more than once`,
+		`topic = "a/b"` + "\ndecoder = \"json\"":                                                         `mqtt subscription 2: topic "a/b" needs {device} or a device`,
+		`topic = "a/#/b"` + "\ndevice = \"d\"\ndecoder = \"json\"":                                       `mqtt subscription 2: invalid topic "a/#/b"`,
+		`topic = "a/x{device}"` + "\ndevice = \"d\"\ndecoder = \"json\"":                                 `mqtt subscription 2: invalid topic "a/x{device}"`,
+		`topic = "a/{device}"` + "\ndecoder = \"xml\"":                                                   `mqtt subscription 2: unknown decoder "xml"`,
+		`topic = "a/{device}"` + "\ndecoder = \"bproto\"\nmappings = [{ type = \"t\", path = \"$.t\" }]": `mqtt subscription 2: mappings are only for the json decoder`,
+	}
+	for subscription, want := range cases {
+		content := validHeader + `
+[mqtt]
+broker = "localhost:1883"
+
+[[mqtt.subscriptions]]
+topic = "ok/{device}"
+decoder = "json"
+
+[[mqtt.subscriptions]]
+` + subscription + "\n"
+		_, err := config.Load(createTempFile(t, content))
+		if err == nil || err.Error() != want {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+
+	content = validHeader + `
+[mqtt]
+broker = "localhost:1883"
+command_topic = "sensors/cmd"
+
+[[mqtt.subscriptions]]
+topic = "ok/{device}"
+decoder = "json"
+`
+	want := "mqtt: command_topic must contain {device} and no wildcards"
+	if _, err := config.Load(createTempFile(t, content)); err == nil || err.Error() != want {
+		t.Errorf("Expected error %q, got %v", want, err)
+	}
+}
+
+const validHeader = `
+[telemetry]
+server = "http://localhost:8080"
+retry_interval = 10
+timeout = 30
+
+[labels]
+environment = "production"
+service = "myapp"
+
+[logging]
+level = "info"
+`
+
+// TEST: GIVEN a config without [[targets]] but with discovery enabled
+// WHEN the Load function is called
+// THEN it should load with no configured targets and the discovery settings
+func TestLoad_DiscoveryOnly(t *testing.T) {
+	content := `
+[telemetry]
+server = "http://localhost:8080"
+retry_interval = 5
+
+[labels]
+environment = "test"
+service = "aggregator"
+
+[logging]
+level = "info"
+
+[discovery]
+file = "targets.yaml"
+mdns = true
+`
+	tmpFile := createTempFile(t, content)
+
+	cfg, err := config.Load(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Targets) != 0 || cfg.Discovery.File != "targets.yaml" || !cfg.Discovery.MDNS {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
 // TEST: GIVEN a non-existent file path
 // WHEN the Load function is called
 // THEN it should return an error
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+)
+
+// Origins of a target besides the names of the sources
+const (
+	OriginConfigured = "configured"
+	OriginAdmin      = "admin"
+)
+
+var (
+	ErrNotFound   = errors.New("target not found")
+	ErrExists     = errors.New("target already exists")
+	ErrNotPolling = errors.New("target is not being polled")
+	ErrStopped    = errors.New("manager is not running")
+)
+
+// Entry is a target as the manager sees it
+type Entry struct {
+	Target  config.Target
+	Origin  string // configured, admin or the source that found it
+	Polling bool
+	Paused  bool
+	Skipped string // Why it is not polled, empty when it is
+}
+
+// Entries returns every target, polled or not, sorted by name
+func (m *Manager) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]Entry, 0, len(m.active))
+	for _, r := range m.active {
+		entries = append(entries, Entry{
+			Target:  r.target,
+			Origin:  r.origin,
+			Polling: r.runner != nil,
+			Paused:  r.paused,
+			Skipped: r.skipped,
+		})
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Target.Name, b.Target.Name) })
+	return entries
+}
+
+// Add polls a target until it is removed or the aggregator restarts. Its name
+// and address must not be in use by another target.
+func (m *Manager) Add(target config.Target) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.running(); err != nil {
+		return err
+	}
+	for name, r := range m.active {
+		if name == target.Name {
+			return fmt.Errorf("%w: %s", ErrExists, name)
+		}
+		if r.target.DeviceID() == target.DeviceID() {
+			return fmt.Errorf("%w: %s already polls %s", ErrExists, name, target.DeviceID())
+		}
+	}
+	m.added[target.Name] = target
+	m.reconcile()
+	return nil
+}
+
+// Remove stops polling a target. A configured or discovered target stays
+// removed until the aggregator restarts, even if its source reports it again.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.running(); err != nil {
+		return err
+	}
+	r, ok := m.active[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if r.origin == OriginAdmin {
+		delete(m.added, name)
+	} else {
+		m.removed[name] = true
+	}
+	delete(m.paused, name)
+	m.reconcile()
+	return nil
+}
+
+// Pause stops polling a target but keeps it, until Resume
+func (m *Manager) Pause(name string) error {
+	return m.setPaused(name, true)
+}
+
+func (m *Manager) Resume(name string) error {
+	return m.setPaused(name, false)
+}
+
+func (m *Manager) setPaused(name string, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.running(); err != nil {
+		return err
+	}
+	if _, ok := m.active[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if paused {
+		m.paused[name] = true
+	} else {
+		delete(m.paused, name)
+	}
+	m.reconcile()
+	return nil
+}
+
+// PollNow polls a target straight away rather than at its next interval
+func (m *Manager) PollNow(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.active[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if r.runner == nil {
+		return fmt.Errorf("%w: %s", ErrNotPolling, name)
+	}
+	r.runner.PollNow()
+	return nil
+}
+
+// running reports whether targets can be changed. Callers hold mu.
+func (m *Manager) running() error {
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return ErrStopped
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/charmbracelet/log"
+)
+
+// Runner is a poller for one target
+type Runner interface {
+	Start(ctx context.Context)
+	Stop()
+	PollNow()
+}
+
+// Factory creates the runner for a target, or says why the target can't be polled
+type Factory func(target config.Target) (Runner, error)
+
+// Owner decides which targets this aggregator may poll when several share
+// them, e.g. by holding a lease on each
+type Owner interface {
+	Owns(deviceID string) bool
+}
+
+// Source reports the complete set of targets it knows about each time it changes
+type Source interface {
+	Name() string
+	Run(ctx context.Context, update func(targets []config.Target))
+}
+
+// Manager keeps one runner per target across the configured targets and all
+// sources, starting and stopping runners as the sources change. Configured
+// targets win over targets added at runtime, and those over sources, with
+// earlier sources winning over later ones, when two share a name or address.
+type Manager struct {
+	logger  *log.Logger
+	static  []config.Target
+	sources []Source
+	factory Factory
+	owner   Owner // Optional, every target is ours without it
+
+	mu      sync.Mutex
+	ctx     context.Context
+	found   map[string][]config.Target // Latest targets of each source
+	added   map[string]config.Target   // Added at runtime, by name
+	removed map[string]bool            // Removed at runtime, whatever their origin
+	paused  map[string]bool
+	active  map[string]running // By target name
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// running is an active target, runner is nil for targets that are skipped
+type running struct {
+	target  config.Target
+	origin  string
+	runner  Runner
+	paused  bool
+	owned   bool
+	skipped string // Why there is no runner
+}
+
+// candidate is a wanted target with where it came from
+type candidate struct {
+	target config.Target
+	origin string
+}
+
+func NewManager(static []config.Target, sources []Source, factory Factory, logger *log.Logger) *Manager {
+	return &Manager{
+		logger:  logger,
+		static:  static,
+		sources: sources,
+		factory: factory,
+		found:   make(map[string][]config.Target),
+		added:   make(map[string]config.Target),
+		removed: make(map[string]bool),
+		paused:  make(map[string]bool),
+		active:  make(map[string]running),
+	}
+}
+
+// Start runs the configured targets and watches the sources until ctx is done or Stop is called
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.reconcile()
+	m.mu.Unlock()
+
+	for _, source := range m.sources {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			source.Run(m.ctx, func(targets []config.Target) { m.update(source.Name(), targets) })
+		}()
+	}
+}
+
+// Stop stops watching the sources and waits for every runner to stop
+func (m *Manager) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, r := range m.active {
+		if r.runner != nil {
+			r.runner.Stop()
+		}
+		delete(m.active, name)
+	}
+}
+
+// Targets returns the targets being polled, sorted by name
+func (m *Manager) Targets() []config.Target {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	targets := make([]config.Target, 0, len(m.active))
+	for _, r := range m.active {
+		if r.runner != nil {
+			targets = append(targets, r.target)
+		}
+	}
+	slices.SortFunc(targets, func(a, b config.Target) int { return strings.Compare(a.Name, b.Name) })
+	return targets
+}
+
+func (m *Manager) update(source string, targets []config.Target) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx.Err() != nil {
+		return // Stopping, Stop owns the runners now
+	}
+	m.found[source] = targets
+	m.reconcile()
+}
+
+// desired merges the configured, added and discovered targets in priority order
+func (m *Manager) desired() map[string]candidate {
+	want := make(map[string]candidate)
+	devices := make(map[string]string)
+	add := func(origin string, targets []config.Target) {
+		for _, t := range targets {
+			if m.removed[t.Name] && origin != OriginAdmin {
+				continue
+			}
+			if _, taken := want[t.Name]; taken {
+				m.logger.Debugf("Ignoring %s target %s, the name is already in use", origin, t.Name)
+				continue
+			}
+			if other, taken := devices[t.DeviceID()]; taken {
+				m.logger.Debugf("Ignoring %s target %s, %s already polls %s", origin, t.Name, other, t.DeviceID())
+				continue
+			}
+			want[t.Name] = candidate{target: t, origin: origin}
+			devices[t.DeviceID()] = t.Name
+		}
+	}
+
+	add(OriginConfigured, m.static)
+	added := make([]config.Target, 0, len(m.added))
+	for _, t := range m.added {
+		added = append(added, t)
+	}
+	slices.SortFunc(added, func(a, b config.Target) int { return strings.Compare(a.Name, b.Name) })
+	add(OriginAdmin, added)
+	for _, source := range m.sources {
+		add(source.Name(), m.found[source.Name()])
+	}
+	return want
+}
+
+// reconcile stops runners for targets that went away or changed and starts
+// runners for new ones. Callers hold mu.
+func (m *Manager) reconcile() {
+	want := m.desired()
+
+	for name, r := range m.active {
+		if c, ok := want[name]; ok && reflect.DeepEqual(c.target, r.target) && m.paused[name] == r.paused && m.owns(c.target) == r.owned {
+			r.origin = c.origin
+			m.active[name] = r
+			continue
+		}
+		if r.runner != nil {
+			m.logger.Infof("Stopping poller for %s", name)
+			r.runner.Stop()
+		}
+		delete(m.active, name)
+	}
+
+	for name, c := range want {
+		if _, ok := m.active[name]; ok {
+			continue
+		}
+		t := c.target
+		r := running{target: t, origin: c.origin, paused: m.paused[name], owned: m.owns(t)}
+		switch {
+		case !t.Enabled:
+			m.logger.Infof("Skipping disabled target %s", name)
+			r.skipped = "disabled"
+		case r.paused:
+			m.logger.Infof("Not polling paused target %s", name)
+			r.skipped = "paused"
+		case !r.owned:
+			m.logger.Debugf("Not polling %s, another aggregator holds it", name)
+			r.skipped = "held by another aggregator"
+		default:
+			runner, err := m.factory(t)
+			if err != nil {
+				m.logger.Warnf("Skipping target %s: %v", name, err)
+				r.skipped = err.Error()
+				break
+			}
+			m.logger.Infof("Starting poller for %s (%s) with interval %d", name, t.Addr(), t.Interval)
+			runner.Start(m.ctx)
+			r.runner = runner
+		}
+		m.active[name] = r
+	}
+}
+
+func (m *Manager) owns(t config.Target) bool {
+	return m.owner == nil || m.owner.Owns(t.DeviceID())
+}
+
+// SetOwner shares targets with other aggregators, polling only those owner
+// grants. Call it before Start, and Refresh whenever the grants change.
+func (m *Manager) SetOwner(owner Owner) {
+	m.owner = owner
+}
+
+// Refresh starts and stops runners after the owner's grants changed
+func (m *Manager) Refresh() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running() == nil {
+		m.reconcile()
+	}
+}
+
+// Wanted returns the device IDs of the enabled targets, polled or not, for
+// asking the owner for them
+func (m *Manager) Wanted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.active))
+	for _, r := range m.active {
+		if r.target.Enabled {
+			ids = append(ids, r.target.DeviceID())
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,362 @@
+package discovery_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/pkg/mdns"
+	"github.com/charmbracelet/log"
+)
+
+// TEST: GIVEN the same two targets written as JSON, TOML and YAML
+// WHEN each file is parsed
+// THEN they should decode alike with names and defaults filled in
+func TestParseTargets_Formats(t *testing.T) {
+	files := map[string]string{
+		"targets.json": `{"targets": [
+			{"name": "edge", "address": "10.0.0.2", "port": "80", "interval": 5, "labels": {"site": "lab"}},
+			{"address": "10.0.0.3", "port": "81", "interval": 2, "protocol": "diorama", "enabled": false}
+		]}`,
+		"targets.toml": `
+[[targets]]
+name = "edge"
+address = "10.0.0.2"
+port = "80"
+interval = 5
+labels = { site = "lab" }
+
+[[targets]]
+address = "10.0.0.3"
+port = "81"
+interval = 2
+protocol = "diorama"
+enabled = false
+`,
+		"targets.yaml": `
+targets:
+  - name: edge
+    address: 10.0.0.2
+    port: "80"
+    interval: 5
+    labels: {site: lab}
+  - address: 10.0.0.3
+    port: "81"
+    interval: 2
+    protocol: diorama
+    enabled: false
+`,
+	}
+
+	for name, content := range files {
+		targets, err := discovery.ParseTargets(name, []byte(content))
+		if err != nil {
+			t.Errorf("%s: ParseTargets failed: %v", name, err)
+			continue
+		}
+		if len(targets) != 2 {
+			t.Errorf("%s: expected 2 targets, got %+v", name, targets)
+			continue
+		}
+		edge, diorama := targets[0], targets[1]
+		if edge.Name != "edge" || edge.Timeout != 5 || edge.Protocol != config.ProtocolDaemon || !edge.Enabled || edge.Labels["site"] != "lab" {
+			t.Errorf("%s: unexpected first target %+v", name, edge)
+		}
+		if diorama.Name != "10.0.0.3:81" || diorama.Protocol != config.ProtocolDiorama || diorama.Enabled {
+			t.Errorf("%s: unexpected second target %+v", name, diorama)
+		}
+	}
+}
+
+// TEST: GIVEN a targets file with an unknown extension or an invalid target
+// WHEN it is parsed
+// THEN it should fail naming the file and the target
+func TestParseTargets_Invalid(t *testing.T) {
+	if _, err := discovery.ParseTargets("targets.ini", nil); err == nil {
+		t.Error("Expected an error for an unknown format, got nil")
+	}
+
+	_, err := discovery.ParseTargets("targets.yaml", []byte("targets:\n  - name: bad\n    address: x\n    port: \"0\"\n    interval: 1\n"))
+	if err == nil || !strings.Contains(err.Error(), "targets.yaml") || !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("Expected an error naming the file and target, got %v", err)
+	}
+}
+
+// TEST: GIVEN a manager with a configured target and a source that changes its targets
+// WHEN the source adds, changes and removes targets
+// THEN runners should be started and stopped to match, with the configured target kept
+func TestManager_Reconciles(t *testing.T) {
+	source := &fakeSource{name: "fake", updates: make(chan []config.Target)}
+	factory := newFakeFactory()
+	static := []config.Target{target("static", "10.0.0.1", 1)}
+
+	m := discovery.NewManager(static, []discovery.Source{source}, factory.create, quietLogger())
+	m.Start(context.Background())
+	defer m.Stop()
+
+	source.updates <- []config.Target{
+		target("a", "10.0.0.2", 1),
+		target("dup", "10.0.0.1", 1), // Same device as the configured target
+	}
+	waitFor(t, func() bool { return names(m) == "a,static" })
+
+	source.updates <- []config.Target{target("a", "10.0.0.2", 9)}
+	waitFor(t, func() bool { return factory.started("a") == 2 && factory.stopped("a") == 1 })
+
+	source.updates <- nil
+	waitFor(t, func() bool { return names(m) == "static" && factory.stopped("a") == 2 })
+
+	if factory.started("dup") != 0 {
+		t.Errorf("Expected the duplicate device to be ignored")
+	}
+}
+
+// TEST: GIVEN a factory that refuses a protocol and a disabled target
+// WHEN the manager starts
+// THEN neither should be polled and the refused one should not be retried on every update
+func TestManager_SkipsRefusedAndDisabled(t *testing.T) {
+	factory := newFakeFactory()
+	factory.refuse = config.ProtocolPrometheus
+
+	refused := target("prom", "10.0.0.5", 1)
+	refused.Protocol = config.ProtocolPrometheus
+	disabled := target("off", "10.0.0.6", 1)
+	disabled.Enabled = false
+	source := &fakeSource{name: "fake", updates: make(chan []config.Target)}
+
+	m := discovery.NewManager([]config.Target{refused, disabled}, []discovery.Source{source}, factory.create, quietLogger())
+	m.Start(context.Background())
+	defer m.Stop()
+
+	source.updates <- []config.Target{target("a", "10.0.0.2", 1)}
+	waitFor(t, func() bool { return names(m) == "a" })
+
+	if calls := factory.calls("prom"); calls != 1 {
+		t.Errorf("Expected the refused target to be tried once, got %d", calls)
+	}
+	if calls := factory.calls("off"); calls != 0 {
+		t.Errorf("Expected the disabled target not to be created, got %d", calls)
+	}
+}
+
+// TEST: GIVEN a manager with a configured target and a source
+// WHEN targets are added, paused, resumed and removed at runtime
+// THEN runners should follow and a removed discovered target should stay removed
+func TestManager_RuntimeControl(t *testing.T) {
+	source := &fakeSource{name: "fake", updates: make(chan []config.Target)}
+	factory := newFakeFactory()
+	m := discovery.NewManager([]config.Target{target("static", "10.0.0.1", 1)}, []discovery.Source{source}, factory.create, quietLogger())
+	m.Start(context.Background())
+	defer m.Stop()
+
+	if err := m.Add(target("extra", "10.0.0.1", 1)); !errors.Is(err, discovery.ErrExists) {
+		t.Errorf("Expected a duplicate device to be refused, got %v", err)
+	}
+	if err := m.Add(target("extra", "10.0.0.3", 1)); err != nil {
+		t.Fatalf("Failed to add target: %v", err)
+	}
+	if names(m) != "extra,static" {
+		t.Fatalf("Expected extra and static, got %s", names(m))
+	}
+
+	if err := m.Pause("static"); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	if names(m) != "extra" || factory.stopped("static") != 1 {
+		t.Errorf("Expected static to be stopped, polling %s", names(m))
+	}
+	if err := m.PollNow("static"); !errors.Is(err, discovery.ErrNotPolling) {
+		t.Errorf("Expected a paused target not to poll, got %v", err)
+	}
+	if err := m.Resume("static"); err != nil || factory.started("static") != 2 {
+		t.Errorf("Expected static to start again, got %v", err)
+	}
+	if err := m.PollNow("static"); err != nil || factory.get("poll:static") != 1 {
+		t.Errorf("Expected an immediate poll, got %v", err)
+	}
+
+	source.updates <- []config.Target{target("found", "10.0.0.4", 1)}
+	waitFor(t, func() bool { return names(m) == "extra,found,static" })
+	if err := m.Remove("found"); err != nil {
+		t.Fatalf("Failed to remove: %v", err)
+	}
+	if err := m.Remove("extra"); err != nil {
+		t.Fatalf("Failed to remove: %v", err)
+	}
+	source.updates <- []config.Target{target("found", "10.0.0.4", 2)}
+	source.updates <- []config.Target{target("found", "10.0.0.4", 2)} // Returns once the first is applied
+	if names(m) != "static" {
+		t.Errorf("Expected only static after removals, got %s", names(m))
+	}
+	if err := m.Remove("found"); !errors.Is(err, discovery.ErrNotFound) {
+		t.Errorf("Expected a removed target to be gone, got %v", err)
+	}
+}
+
+// TEST: GIVEN a file source watching a targets file
+// WHEN the file is rewritten, broken and then removed
+// THEN pollers should follow the good versions and stop once it is gone
+func TestFileSource_FollowsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	writeFile(t, path, "targets:\n  - name: a\n    address: 10.0.0.2\n    port: \"80\"\n    interval: 1\n")
+
+	factory := newFakeFactory()
+	source := discovery.NewFileSource(config.Discovery{File: path, FileInterval: 1}, quietLogger())
+	m := discovery.NewManager(nil, []discovery.Source{source}, factory.create, quietLogger())
+	m.Start(context.Background())
+	defer m.Stop()
+	waitFor(t, func() bool { return names(m) == "a" })
+
+	writeFile(t, path, "targets:\n  - name: b\n    address: 10.0.0.3\n    port: \"80\"\n    interval: 1\n")
+	waitFor(t, func() bool { return names(m) == "b" })
+
+	writeFile(t, path, "targets: [")
+	time.Sleep(1500 * time.Millisecond)
+	if got := names(m); got != "b" {
+		t.Errorf("Expected a broken file to keep the last targets, got %q", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Failed to remove targets file: %v", err)
+	}
+	waitFor(t, func() bool { return names(m) == "" })
+}
+
+// TEST: GIVEN an in-process DNS-SD responder for a daemon with an interval TXT pair
+// WHEN the DNS-SD source browses it
+// THEN a poller should be started for the daemon's address, port and interval
+func TestMDNSSource_FindsDaemon(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mdns.NewResponder(conn, mdns.Instance{
+		Name: "edge-1",
+		Host: "edge-1",
+		Port: 8080,
+		IPs:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		Text: map[string]string{"interval": "7"},
+	}).Serve(ctx)
+
+	factory := newFakeFactory()
+	source := discovery.NewMDNSSource(config.Discovery{MDNSInterval: 1}, conn.LocalAddr(), quietLogger())
+	m := discovery.NewManager(nil, []discovery.Source{source}, factory.create, quietLogger())
+	m.Start(ctx)
+	defer m.Stop()
+
+	waitFor(t, func() bool { return names(m) == "edge-1" })
+	got := m.Targets()[0]
+	if got.Addr() != "127.0.0.1:8080" || got.Interval != 7 || got.Protocol != config.ProtocolDaemon {
+		t.Errorf("Unexpected target %+v", got)
+	}
+}
+
+type fakeSource struct {
+	name    string
+	updates chan []config.Target
+}
+
+func (s *fakeSource) Name() string { return s.name }
+
+func (s *fakeSource) Run(ctx context.Context, update func([]config.Target)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-s.updates:
+			update(targets)
+		}
+	}
+}
+
+type fakeFactory struct {
+	refuse string
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newFakeFactory() *fakeFactory {
+	return &fakeFactory{counts: make(map[string]int)}
+}
+
+func (f *fakeFactory) create(t config.Target) (discovery.Runner, error) {
+	f.inc("create:" + t.Name)
+	if t.Protocol == f.refuse {
+		return nil, errors.New("not supported")
+	}
+	return &fakeRunner{name: t.Name, factory: f}, nil
+}
+
+func (f *fakeFactory) inc(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[key]++
+}
+
+func (f *fakeFactory) get(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[key]
+}
+
+func (f *fakeFactory) calls(name string) int   { return f.get("create:" + name) }
+func (f *fakeFactory) started(name string) int { return f.get("start:" + name) }
+func (f *fakeFactory) stopped(name string) int { return f.get("stop:" + name) }
+
+type fakeRunner struct {
+	name    string
+	factory *fakeFactory
+}
+
+func (r *fakeRunner) Start(ctx context.Context) { r.factory.inc("start:" + r.name) }
+func (r *fakeRunner) Stop()                     { r.factory.inc("stop:" + r.name) }
+func (r *fakeRunner) PollNow()                  { r.factory.inc("poll:" + r.name) }
+
+func target(name, address string, interval int) config.Target {
+	t := config.NewTarget()
+	t.Name = name
+	t.Address = address
+	t.Port = "80"
+	t.Interval = interval
+	return t
+}
+
+func names(m *discovery.Manager) string {
+	var out []string
+	for _, t := range m.Targets() {
+		out = append(out, t.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func quietLogger() *log.Logger {
+	return log.NewWithOptions(os.Stderr, log.Options{Level: log.ErrorLevel})
+}
@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultFileInterval = 5 * time.Second
+
+// FileSource watches a file of targets. The file holds a targets list in the
+// same shape as the [[targets]] tables, as JSON, TOML or YAML by extension.
+type FileSource struct {
+	path     string
+	interval time.Duration
+	logger   *log.Logger
+}
+
+func NewFileSource(cfg config.Discovery, logger *log.Logger) *FileSource {
+	interval := time.Duration(cfg.FileInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultFileInterval
+	}
+	return &FileSource{path: cfg.File, interval: interval, logger: logger}
+}
+
+func (s *FileSource) Name() string {
+	return "file"
+}
+
+// Run checks the file every interval and reports its targets when the
+// contents change. A file that fails to load keeps the last good targets, a
+// missing file has none.
+func (s *FileSource) Run(ctx context.Context, update func([]config.Target)) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var last []byte
+	loaded := false
+	for {
+		data, err := os.ReadFile(s.path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if !loaded || last != nil {
+				s.logger.Warnf("Targets file %s does not exist", s.path)
+				last, loaded = nil, true
+				update(nil)
+			}
+		case err != nil:
+			s.logger.Errorf("Failed to read targets file: %v", err)
+		case loaded && last != nil && bytes.Equal(data, last):
+		default:
+			targets, err := ParseTargets(s.path, data)
+			if err != nil {
+				s.logger.Errorf("Ignoring targets file change: %v", err)
+				break
+			}
+			last, loaded = data, true
+			s.logger.Infof("Loaded %d targets from %s", len(targets), s.path)
+			update(targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// LoadTargets reads and validates a targets file
+func LoadTargets(path string) ([]config.Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTargets(path, data)
+}
+
+// ParseTargets decodes a targets file in the format given by the path's
+// extension, applies the target defaults and validates the result
+func ParseTargets(path string, data []byte) ([]config.Target, error) {
+	var targets []config.Target
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		targets, err = parseJSON(data)
+	case ".toml":
+		targets, err = parseTOML(data)
+	case ".yaml", ".yml":
+		targets, err = parseYAML(data)
+	default:
+		return nil, fmt.Errorf("%s: unknown targets file format %q", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := config.ValidateTargets(targets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return targets, nil
+}
+
+func parseJSON(data []byte) ([]config.Target, error) {
+	var doc struct {
+		Targets []json.RawMessage `json:"targets"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	targets := make([]config.Target, 0, len(doc.Targets))
+	for i, raw := range doc.Targets {
+		target := config.NewTarget()
+		if err := json.Unmarshal(raw, &target); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func parseTOML(data []byte) ([]config.Target, error) {
+	var doc struct {
+		Targets []toml.Primitive `toml:"targets"`
+	}
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]config.Target, 0, len(doc.Targets))
+	for i, prim := range doc.Targets {
+		target := config.NewTarget()
+		if err := md.PrimitiveDecode(prim, &target); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func parseYAML(data []byte) ([]config.Target, error) {
+	var doc struct {
+		Targets []yaml.Node `yaml:"targets"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	targets := make([]config.Target, 0, len(doc.Targets))
+	for i, node := range doc.Targets {
+		target := config.NewTarget()
+		if err := node.Decode(&target); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/pkg/mdns"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	defaultMDNSInterval     = 30 * time.Second
+	defaultDiscoverInterval = 5
+	maxBrowseWait           = 2 * time.Second
+	// missedBrowses is how many browses in a row an instance can miss before it is dropped
+	missedBrowses = 3
+)
+
+// MDNSSource browses DNS-SD for daemons advertising _beacon._tcp. Daemons can
+// set interval and protocol TXT pairs, otherwise the discovery interval and
+// the daemon protocol are used.
+type MDNSSource struct {
+	dest     net.Addr
+	interval time.Duration
+	poll     int
+	logger   *log.Logger
+}
+
+// NewMDNSSource browses dest, which is mdns.GroupAddr outside of tests
+func NewMDNSSource(cfg config.Discovery, dest net.Addr, logger *log.Logger) *MDNSSource {
+	interval := time.Duration(cfg.MDNSInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultMDNSInterval
+	}
+	poll := cfg.Interval
+	if poll <= 0 {
+		poll = defaultDiscoverInterval
+	}
+	return &MDNSSource{dest: dest, interval: interval, poll: poll, logger: logger}
+}
+
+func (s *MDNSSource) Name() string {
+	return "mdns"
+}
+
+// Run browses every interval and reports the instances seen recently
+func (s *MDNSSource) Run(ctx context.Context, update func([]config.Target)) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		s.logger.Errorf("Failed to open DNS-SD socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	browser := mdns.NewBrowser(conn, s.dest)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	wait := min(s.interval/2, maxBrowseWait)
+	seen := make(map[string]time.Time)
+	found := make(map[string]config.Target)
+	var reported []config.Target
+	for {
+		instances, err := browser.Browse(ctx, wait)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Errorf("DNS-SD browse failed: %v", err)
+		}
+
+		now := time.Now()
+		for _, inst := range instances {
+			target, ok := s.target(inst)
+			if !ok {
+				continue
+			}
+			seen[target.Name] = now
+			found[target.Name] = target
+		}
+		for name, at := range seen {
+			if now.Sub(at) >= missedBrowses*s.interval {
+				s.logger.Infof("DNS-SD instance %s is gone", name)
+				delete(seen, name)
+				delete(found, name)
+			}
+		}
+
+		targets := make([]config.Target, 0, len(found))
+		for _, target := range found {
+			targets = append(targets, target)
+		}
+		if !sameTargets(targets, reported) {
+			reported = targets
+			update(targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// target turns an instance into a target, preferring its IPv4 address over
+// its .local host name
+func (s *MDNSSource) target(inst mdns.Instance) (config.Target, bool) {
+	target := config.NewTarget()
+	target.Name = inst.Name
+	target.Address = inst.Host + ".local"
+	if len(inst.IPs) > 0 {
+		target.Address = inst.IPs[0].String()
+	}
+	target.Port = strconv.Itoa(inst.Port)
+	target.Interval = s.poll
+	if interval, err := strconv.Atoi(inst.Text["interval"]); err == nil && interval > 0 {
+		target.Interval = interval
+	}
+	if protocol := inst.Text["protocol"]; protocol != "" {
+		target.Protocol = protocol
+	}
+
+	targets := []config.Target{target}
+	if err := config.ValidateTargets(targets); err != nil {
+		s.logger.Debugf("Ignoring DNS-SD instance %s: %v", inst.Name, err)
+		return config.Target{}, false
+	}
+	return targets[0], true
+}
+
+// sameTargets compares two target sets ignoring order
+func sameTargets(a, b []config.Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	byName := make(map[string]config.Target, len(b))
+	for _, t := range b {
+		byName[t.Name] = t
+	}
+	for _, t := range a {
+		if other, ok := byName[t.Name]; !ok || !reflect.DeepEqual(t, other) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package fakedevice
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/pkg/mqtt"
+)
+
+// maxBrokerPacket bounds the packets the broker reads
+const maxBrokerPacket = 1 << 20
+
+// Broker is an MQTT broker that accepts any client, keeps what clients
+// publish and forwards it to the clients subscribed, at QoS 0
+type Broker struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	conns     map[*brokerConn]struct{}
+	published []mqtt.Message
+	clients   []mqtt.Connect
+}
+
+// brokerConn is one client, writes come from its own reader and from others
+// publishing to its subscriptions
+type brokerConn struct {
+	net.Conn
+	writeMu sync.Mutex
+	filters []string // Guarded by the broker's mu
+}
+
+func (c *brokerConn) send(p mqtt.Packet) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Write(p.Encode())
+}
+
+func NewBroker() (*Broker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{ln: ln, conns: make(map[*brokerConn]struct{})}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &brokerConn{Conn: conn}
+			b.mu.Lock()
+			b.conns[c] = struct{}{}
+			b.mu.Unlock()
+
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.serve(c)
+			}()
+		}
+	}()
+	return b, nil
+}
+
+// Addr is the host:port the broker listens on
+func (b *Broker) Addr() string {
+	return b.ln.Addr().String()
+}
+
+// Published returns the messages clients published so far, in order
+func (b *Broker) Published() []mqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqtt.Message(nil), b.published...)
+}
+
+// Clients returns the CONNECT of every client so far, in order
+func (b *Broker) Clients() []mqtt.Connect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqtt.Connect(nil), b.clients...)
+}
+
+// Subscribed reports whether any client is subscribed with filter
+func (b *Broker) Subscribed(filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		for _, f := range c.filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Publish sends a message to the subscribed clients, like a device would
+func (b *Broker) Publish(topic string, payload []byte) {
+	b.route(mqtt.Message{Topic: topic, Payload: payload})
+}
+
+// Disconnect drops every client connection, the broker keeps listening
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+func (b *Broker) Close() error {
+	err := b.ln.Close()
+	b.Disconnect()
+	b.wg.Wait()
+	return err
+}
+
+func (b *Broker) route(m mqtt.Message) {
+	b.mu.Lock()
+	var to []*brokerConn
+	for c := range b.conns {
+		for _, f := range c.filters {
+			if mqtt.Match(f, m.Topic) {
+				to = append(to, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	packet := mqtt.EncodePublish(mqtt.Message{Topic: m.Topic, Payload: m.Payload}, 0)
+	for _, c := range to {
+		c.send(packet)
+	}
+}
+
+func (b *Broker) serve(c *brokerConn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+		c.Close()
+	}()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := mqtt.ReadPacket(c, maxBrokerPacket)
+	if err != nil || p.Type != mqtt.TypeConnect {
+		return
+	}
+	connect, err := mqtt.DecodeConnect(p)
+	if err != nil {
+		c.send(mqtt.Connack(1))
+		return
+	}
+	b.mu.Lock()
+	b.clients = append(b.clients, connect)
+	b.mu.Unlock()
+	c.send(mqtt.Connack(0))
+
+	for {
+		c.SetReadDeadline(time.Time{})
+		p, err := mqtt.ReadPacket(c, maxBrokerPacket)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqtt.TypePublish:
+			m, id, err := mqtt.DecodePublish(p)
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.published = append(b.published, m)
+			b.mu.Unlock()
+			if m.QoS > 0 {
+				c.send(mqtt.Ack(mqtt.TypePuback, id))
+			}
+			b.route(m)
+		case mqtt.TypeSubscribe:
+			id, subs, err := mqtt.DecodeSubscribe(p)
+			if err != nil {
+				return
+			}
+			granted := make([]byte, len(subs))
+			b.mu.Lock()
+			for _, s := range subs {
+				c.filters = append(c.filters, s.Filter)
+			}
+			b.mu.Unlock()
+			c.send(mqtt.Suback(id, granted...))
+		case mqtt.TypePingreq:
+			c.send(mqtt.Packet{Type: mqtt.TypePingresp})
+		case mqtt.TypeDisconnect:
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package fakedevice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+)
+
+// Daemon answers like the beacon daemon: metrics as bproto frames and
+// commands as JSON, in a bproto result frame when the caller accepts one.
+// It knows the notify and reboot commands.
+type Daemon struct {
+	*device
+	srv *http.Server
+	// CommandDelay is how long each command takes to run, set before any is sent
+	CommandDelay time.Duration
+}
+
+func NewDaemon() (*Daemon, error) {
+	dev, err := listen(config.ProtocolDaemon)
+	if err != nil {
+		return nil, err
+	}
+	d := &Daemon{device: dev}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metric", d.handleMetric)
+	mux.HandleFunc("POST /cmd", d.handleCommand)
+	d.srv = &http.Server{Handler: mux}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.srv.Serve(d.ln) // Returns once closed
+	}()
+	return d, nil
+}
+
+func (d *Daemon) Close() error {
+	err := d.srv.Close()
+	d.wg.Wait()
+	return err
+}
+
+func (d *Daemon) handleMetric(w http.ResponseWriter, r *http.Request) {
+	frame, err := bproto.EncodeMetrics(bproto.Negotiate(r.Header.Get(bproto.VersionHeader)), sampleMetrics("uptime", "memory_used"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", bproto.ContentType)
+	w.Write(frame)
+}
+
+func (d *Daemon) handleCommand(w http.ResponseWriter, r *http.Request) {
+	var cmd struct {
+		ID      uint            `json:"id,omitempty"`
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "Invalid command format", http.StatusBadRequest)
+		return
+	}
+	d.record(Received{ID: cmd.ID, Command: cmd.Command, Args: cmd.Args})
+	time.Sleep(d.CommandDelay)
+
+	var message string
+	switch cmd.Command {
+	case "notify":
+		message = "Command executed successfully"
+	case "reboot":
+		message = "Rebooting device"
+	default:
+		http.Error(w, "Unknown command", http.StatusBadRequest)
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		ID      uint   `json:"id,omitempty"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{cmd.ID, "success", message})
+	if strings.Contains(r.Header.Get("Accept"), bproto.ContentType) {
+		frame, err := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeCommandResult, Payload: body})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", bproto.ContentType)
+		w.Write(frame)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,102 @@
+package fakedevice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+)
+
+// maxDioramaRequest is the diorama's receive buffer
+const maxDioramaRequest = 1024
+
+// Diorama answers like the ESP32 firmware in diorama/src/tcp_server.c: a bare
+// v1 frame of light states for GET /metric, and for POST /cmd a raw text body
+// that must be exactly "reboot". The replies are byte for byte the
+// firmware's, including its Content-Length that is one short for errors.
+type Diorama struct {
+	*device
+}
+
+func NewDiorama() (*Diorama, error) {
+	dev, err := listen(config.ProtocolDiorama)
+	if err != nil {
+		return nil, err
+	}
+	d := &Diorama{device: dev}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := d.ln.Accept()
+			if err != nil {
+				return
+			}
+			d.serve(conn) // One connection at a time, like the firmware
+		}
+	}()
+	return d, nil
+}
+
+func (d *Diorama) Close() error {
+	err := d.ln.Close()
+	d.wg.Wait()
+	return err
+}
+
+func (d *Diorama) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	raw, err := readDioramaRequest(bufio.NewReader(io.LimitReader(conn, maxDioramaRequest-1)))
+	if err != nil {
+		return
+	}
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+
+	switch {
+	case strings.Contains(head, "POST /cmd"):
+		d.record(Received{Command: body})
+		if body == "reboot" {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 20\r\n\r\nRebooting device...\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain\r\nContent-Length: 15\r\n\r\nUnknown command\n")
+	case strings.Contains(head, "GET /metric"):
+		payload := fmt.Sprintf("car_light: green, ped_light: red, recorded_at: %s", time.Now().UTC().Format(time.RFC3339))
+		frame, _ := bproto.Encode(bproto.Frame{Version: bproto.Version1, Payload: []byte(payload)})
+		conn.Write(frame)
+	default:
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 10\r\n\r\nNot Found\n")
+	}
+}
+
+// readDioramaRequest reads headers and as much body as Content-Length says,
+// the way the firmware does
+func readDioramaRequest(br *bufio.Reader) (string, error) {
+	var head strings.Builder
+	contentLength := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		head.WriteString(line)
+		if value, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			fmt.Sscanf(strings.TrimSpace(value), "%d", &contentLength)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	body := make([]byte, contentLength)
+	n, _ := io.ReadFull(br, body)
+	return head.String() + string(body[:n]), nil
+}
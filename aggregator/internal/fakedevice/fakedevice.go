@@ -0,0 +1,79 @@
+// Package fakedevice runs in-process stand-ins for the devices and brokers the
+// aggregator talks to, speaking their wire protocols, so tests can exercise
+// the real encoding without hardware
+package fakedevice
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// Received is a command as a fake device saw it
+type Received struct {
+	ID      uint            // Zero for devices that don't know command IDs
+	Command string          // The command name, or the whole body for the diorama
+	Args    json.RawMessage // Daemon only
+}
+
+// device is what the fakes share: a listener and the commands they got
+type device struct {
+	ln       net.Listener
+	protocol string
+
+	mu       sync.Mutex
+	received []Received
+	wg       sync.WaitGroup
+}
+
+func listen(protocol string) (*device, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &device{ln: ln, protocol: protocol}, nil
+}
+
+// Addr is the host:port the device listens on
+func (d *device) Addr() string {
+	return d.ln.Addr().String()
+}
+
+// Target returns a target for polling the device, with a 1 second interval
+func (d *device) Target(name string) config.Target {
+	host, port, _ := net.SplitHostPort(d.Addr())
+	t := config.NewTarget()
+	t.Name = name
+	t.Address = host
+	t.Port = port
+	t.Interval = 1
+	t.Protocol = d.protocol
+	return t
+}
+
+// Commands returns the commands received so far, in order
+func (d *device) Commands() []Received {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Received(nil), d.received...)
+}
+
+func (d *device) record(r Received) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.received = append(d.received, r)
+}
+
+// sampleMetrics is what the fakes report when polled
+func sampleMetrics(types ...string) *metrics.DeviceMetrics {
+	now := time.Now().UTC().Format(time.RFC3339)
+	dm := &metrics.DeviceMetrics{Hostname: "fake"}
+	for _, t := range types {
+		dm.Metrics = append(dm.Metrics, metrics.Metric{Type: t, Value: "1", Unit: "count", RecordedAt: now})
+	}
+	return dm
+}
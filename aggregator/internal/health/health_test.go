@@ -0,0 +1,136 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/health"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+var errPoll = errors.New("connection refused")
+
+// TEST: GIVEN a machine needing 3 failures for down and 2 good polls for up
+// WHEN polls fail and recover around those thresholds
+// THEN it should pass through degraded and only change state at the thresholds
+func TestMachine_Hysteresis(t *testing.T) {
+	m := health.NewMachine(health.Thresholds{DownAfter: 3, UpAfter: 2, FlapWindow: time.Hour, FlapThreshold: 10})
+	now := time.Unix(0, 0)
+
+	steps := []struct {
+		err  error
+		want health.State
+	}{
+		{nil, health.Up},
+		{errPoll, health.Degraded},
+		{nil, health.Degraded}, // One good poll is not enough to be up again
+		{nil, health.Up},
+		{errPoll, health.Degraded},
+		{errPoll, health.Degraded},
+		{errPoll, health.Down},
+		{errPoll, health.Down},
+		{nil, health.Down},
+		{nil, health.Up},
+	}
+	for i, step := range steps {
+		now = now.Add(time.Second)
+		m.Observe(step.err, now)
+		if got := m.State(); got != step.want {
+			t.Fatalf("Step %d: expected %s, got %s", i+1, step.want, got)
+		}
+	}
+}
+
+// TEST: GIVEN a machine that goes down and up again repeatedly
+// WHEN the changes reach the flap threshold and then stop for a window
+// THEN it should report flapping and then settle back to up
+func TestMachine_Flapping(t *testing.T) {
+	m := health.NewMachine(health.Thresholds{DownAfter: 1, UpAfter: 1, FlapWindow: time.Minute, FlapThreshold: 4})
+	now := time.Unix(0, 0)
+	observe := func(err error) (health.Transition, bool) {
+		now = now.Add(time.Second)
+		return m.Observe(err, now)
+	}
+
+	observe(nil)
+	for i := 0; i < 2; i++ {
+		observe(errPoll)
+		observe(nil)
+	}
+	if m.State() != health.Flapping {
+		t.Fatalf("Expected flapping after 4 changes, got %s", m.State())
+	}
+
+	// A quiet window lets it settle
+	now = now.Add(time.Minute)
+	tr, changed := observe(nil)
+	if !changed || tr.From != health.Flapping || tr.To != health.Up {
+		t.Errorf("Expected flapping to settle to up, got %+v (changed=%v)", tr, changed)
+	}
+}
+
+// TEST: GIVEN a tracker pointed at a fake API
+// WHEN a device goes up and then down
+// THEN the API should receive both events in order with the last error
+func TestTracker_SendsEvents(t *testing.T) {
+	var mu sync.Mutex
+	var got []metrics.DeviceEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/device/event" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var event metrics.DeviceEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		mu.Lock()
+		got = append(got, event)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{
+		Telemetry: config.Telemetry{Server: srv.URL, RetryInterval: 1, Timeout: 5},
+		Health:    config.Health{DownAfter: 2},
+	}
+	tracker := health.NewTracker(cfg, log.NewWithOptions(os.Stderr, log.Options{Level: log.ErrorLevel}))
+	tracker.Start(context.Background())
+	defer tracker.Stop()
+
+	tracker.Observe("edge:80", nil)
+	tracker.Observe("edge:80", errPoll)
+	tracker.Observe("edge:80", errPoll)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 events, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	states := []string{got[0].State, got[1].State, got[2].State}
+	if states[0] != "up" || states[1] != "degraded" || states[2] != "down" {
+		t.Errorf("Expected up, degraded, down, got %v", states)
+	}
+	if got[2].Previous != "degraded" || got[2].Error != errPoll.Error() || got[2].DeviceID != "edge:80" {
+		t.Errorf("Unexpected down event %+v", got[2])
+	}
+}
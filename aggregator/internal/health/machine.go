@@ -0,0 +1,161 @@
+package health
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+)
+
+type State string
+
+const (
+	Unknown  State = "unknown"
+	Up       State = "up"
+	Degraded State = "degraded"
+	Down     State = "down"
+	Flapping State = "flapping"
+)
+
+const (
+	defaultDownAfter     = 3
+	defaultUpAfter       = 2
+	defaultFlapWindow    = 10 * time.Minute
+	defaultFlapThreshold = 4
+)
+
+// Thresholds are the hysteresis settings shared by every machine
+type Thresholds struct {
+	DownAfter     int
+	UpAfter       int
+	FlapWindow    time.Duration
+	FlapThreshold int
+}
+
+// NewThresholds reads the health config, filling in defaults
+func NewThresholds(cfg config.Health) Thresholds {
+	t := Thresholds{
+		DownAfter:     cfg.DownAfter,
+		UpAfter:       cfg.UpAfter,
+		FlapWindow:    time.Duration(cfg.FlapWindow) * time.Second,
+		FlapThreshold: cfg.FlapThreshold,
+	}
+	if t.DownAfter <= 0 {
+		t.DownAfter = defaultDownAfter
+	}
+	if t.UpAfter <= 0 {
+		t.UpAfter = defaultUpAfter
+	}
+	if t.FlapWindow <= 0 {
+		t.FlapWindow = defaultFlapWindow
+	}
+	if t.FlapThreshold <= 0 {
+		t.FlapThreshold = defaultFlapThreshold
+	}
+	return t
+}
+
+// Transition is a change of the reported state
+type Transition struct {
+	From      State
+	To        State
+	Reason    string
+	LastError string
+	At        time.Time
+}
+
+// Machine tracks one target from its poll results. A target starts unknown,
+// is up after its first good poll and degraded after a failure. It is only
+// down after DownAfter failures in a row, and only up again after UpAfter
+// good polls in a row, so a single lost poll never reads as an outage.
+// FlapThreshold changes between up and down within FlapWindow report it as
+// flapping instead, until the changes in the window fall below half of that.
+type Machine struct {
+	thresholds Thresholds
+
+	state     State // Reported
+	actual    State // Followed underneath flapping
+	successes int
+	failures  int
+	lastError string
+	changes   []time.Time // Up/down changes within the flap window
+}
+
+func NewMachine(thresholds Thresholds) *Machine {
+	return &Machine{thresholds: thresholds, state: Unknown, actual: Unknown}
+}
+
+func (m *Machine) State() State {
+	return m.state
+}
+
+func (m *Machine) LastError() string {
+	return m.lastError
+}
+
+// Observe feeds one poll result, err is nil for a good poll. It returns the
+// transition when the reported state changed.
+func (m *Machine) Observe(err error, now time.Time) (Transition, bool) {
+	next, reason := m.step(err)
+	if next != m.actual {
+		if (m.actual == Up || m.actual == Degraded) && next == Down || m.actual == Down && next == Up {
+			m.changes = append(m.changes, now)
+		}
+		m.actual = next
+	}
+
+	// Forget changes that have left the window
+	cutoff := now.Add(-m.thresholds.FlapWindow)
+	i := 0
+	for i < len(m.changes) && !m.changes[i].After(cutoff) {
+		i++
+	}
+	m.changes = m.changes[i:]
+
+	reported := m.actual
+	switch {
+	case len(m.changes) >= m.thresholds.FlapThreshold:
+		reported = Flapping
+		reason = fmt.Sprintf("%d up/down changes in %s", len(m.changes), m.thresholds.FlapWindow)
+	case m.state == Flapping && len(m.changes) >= (m.thresholds.FlapThreshold+1)/2:
+		reported = Flapping // Still settling
+	case m.state == Flapping:
+		reason = fmt.Sprintf("settled, %d up/down changes in %s", len(m.changes), m.thresholds.FlapWindow)
+	}
+
+	if reported == m.state {
+		return Transition{}, false
+	}
+	t := Transition{From: m.state, To: reported, Reason: reason, LastError: m.lastError, At: now}
+	m.state = reported
+	return t, true
+}
+
+// step applies a poll result to the counters and returns the underlying
+// state it leads to, with why
+func (m *Machine) step(err error) (State, string) {
+	if err != nil {
+		m.failures++
+		m.successes = 0
+		m.lastError = err.Error()
+
+		switch {
+		case m.failures >= m.thresholds.DownAfter && m.actual != Down:
+			return Down, fmt.Sprintf("%d failed polls in a row", m.failures)
+		case m.actual == Up:
+			return Degraded, "poll failed"
+		}
+		return m.actual, "poll failed"
+	}
+
+	m.successes++
+	m.failures = 0
+	switch {
+	case m.actual == Unknown:
+		return Up, "first good poll"
+	case (m.actual == Degraded || m.actual == Down) && m.successes >= m.thresholds.UpAfter:
+		m.lastError = ""
+		return Up, fmt.Sprintf("%d good polls in a row", m.successes)
+	}
+	return m.actual, "poll succeeded"
+}
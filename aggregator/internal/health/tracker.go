@@ -0,0 +1,185 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+const eventQueueSize = 256
+
+var (
+	eventsSent    = selfmetrics.NewCounter("aggregator_health_events", "count")
+	eventsDropped = selfmetrics.NewCounter("aggregator_health_event_drops", "count")
+)
+
+// Status is the reported state of one device
+type Status struct {
+	DeviceID    string
+	State       State
+	Since       time.Time
+	LastError   string
+	LastSuccess time.Time // Zero until the first good poll
+}
+
+// Tracker keeps a state machine per device and sends every transition to the
+// API as a device event, in order, from a background queue
+type Tracker struct {
+	cfg        *config.Config
+	logger     *log.Logger
+	client     *http.Client
+	policy     retry.Policy
+	thresholds Thresholds
+
+	mu       sync.Mutex
+	machines map[string]*tracked
+
+	events chan metrics.DeviceEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type tracked struct {
+	machine     *Machine
+	since       time.Time
+	lastSuccess time.Time
+}
+
+func NewTracker(cfg *config.Config, logger *log.Logger) *Tracker {
+	t := &Tracker{
+		cfg:        cfg,
+		logger:     logger,
+		client:     &http.Client{Timeout: time.Duration(cfg.Telemetry.Timeout) * time.Second},
+		policy:     retry.NewPolicy(cfg.Telemetry),
+		thresholds: NewThresholds(cfg.Health),
+		machines:   make(map[string]*tracked),
+		events:     make(chan metrics.DeviceEvent, eventQueueSize),
+	}
+	t.policy.OnRetry = func(err error, delay time.Duration) {
+		logger.Warn("device event failed, retrying", "delay", delay, "error", err)
+	}
+	return t
+}
+
+// Observe feeds a poll result for a device, err is nil for a good poll
+func (t *Tracker) Observe(deviceID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	d, ok := t.machines[deviceID]
+	if !ok {
+		d = &tracked{machine: NewMachine(t.thresholds), since: now}
+		t.machines[deviceID] = d
+	}
+	if err == nil {
+		d.lastSuccess = now
+	}
+	tr, changed := d.machine.Observe(err, now)
+	if !changed {
+		return
+	}
+	d.since = now
+
+	t.logger.Info("device state changed", "device", deviceID, "from", tr.From, "to", tr.To, "reason", tr.Reason)
+	event := metrics.DeviceEvent{
+		DeviceID: deviceID,
+		State:    string(tr.To),
+		Previous: string(tr.From),
+		Reason:   tr.Reason,
+		Error:    tr.LastError,
+		At:       tr.At.UTC().Format(time.RFC3339),
+	}
+	select {
+	case t.events <- event:
+	default:
+		eventsDropped.Inc()
+		t.logger.Warn("device event queue full, dropping event", "device", deviceID, "state", tr.To)
+	}
+}
+
+// Statuses returns the reported state of every device seen so far
+func (t *Tracker) Statuses() []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Status, 0, len(t.machines))
+	for id, d := range t.machines {
+		out = append(out, Status{
+			DeviceID:    id,
+			State:       d.machine.State(),
+			Since:       d.since,
+			LastError:   d.machine.LastError(),
+			LastSuccess: d.lastSuccess,
+		})
+	}
+	return out
+}
+
+// Start sends queued events until ctx is done or Stop is called
+func (t *Tracker) Start(ctx context.Context) {
+	ctx, t.cancel = context.WithCancel(ctx)
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-t.events:
+				if err := t.send(ctx, event); err != nil {
+					eventsDropped.Inc()
+					t.logger.Error("failed to send device event", "device", event.DeviceID, "error", err)
+					continue
+				}
+				eventsSent.Inc()
+			}
+		}
+	}()
+}
+
+// Stop stops sending and waits for an event in flight, queued events are dropped
+func (t *Tracker) Stop() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+}
+
+func (t *Tracker) send(ctx context.Context, event metrics.DeviceEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device event: %w", err)
+	}
+
+	return retry.Do(ctx, t.policy, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", t.cfg.Telemetry.Server+"/api/device/event", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := t.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return retry.Retryable(fmt.Errorf("failed to send device event: %w", err))
+		}
+		defer resp.Body.Close()
+
+		return retry.CheckResponse(resp)
+	})
+}
@@ -0,0 +1,208 @@
+// Package lease lets several aggregators share targets. Each one heartbeats to
+// the API with the targets it can poll and gets back leases on its share,
+// renewed on every heartbeat. When an aggregator stops heartbeating its leases
+// lapse and the API hands its targets to the others.
+package lease
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+const defaultInterval = 5 * time.Second
+
+var heartbeatFailures = selfmetrics.NewCounter("aggregator_lease_heartbeat_failures", "count")
+
+// Client holds this aggregator's leases
+type Client struct {
+	cfg      *config.Config
+	logger   *log.Logger
+	client   *http.Client
+	id       string
+	interval time.Duration
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	owned   map[string]bool // Device IDs
+	expires time.Time       // When the owned leases lapse without a renewal
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func New(cfg *config.Config, logger *log.Logger) *Client {
+	id := cfg.HA.Instance
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	interval := time.Duration(cfg.HA.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ttl := time.Duration(cfg.HA.LeaseTTL) * time.Second
+	if ttl <= interval {
+		ttl = 3 * interval
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		logger:   logger,
+		client:   &http.Client{Timeout: interval},
+		id:       id,
+		interval: interval,
+		ttl:      ttl,
+		owned:    make(map[string]bool),
+	}
+	selfmetrics.NewGaugeFunc("aggregator_leased_targets", "count", func() int64 {
+		return int64(len(c.Owned()))
+	})
+	return c
+}
+
+// ID identifies this aggregator to the API
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Owns reports whether this aggregator holds a live lease on a device
+func (c *Client) Owns(deviceID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owned[deviceID] && time.Now().Before(c.expires)
+}
+
+// Owned returns the device IDs with a live lease, sorted
+func (c *Client) Owned() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !time.Now().Before(c.expires) {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(c.owned))
+}
+
+// Start heartbeats until ctx is done or Stop is called, asking for the device
+// IDs wanted returns. changed is called whenever the leases held change,
+// including when they lapse because the API could not be reached.
+func (c *Client) Start(ctx context.Context, wanted func() []string, changed func()) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		lapse := time.NewTimer(c.ttl)
+		lapse.Stop()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			sent := time.Now()
+			leases, err := c.heartbeat(ctx, metrics.Heartbeat{
+				ID:      c.id,
+				Name:    c.cfg.Labels.Service,
+				Targets: wanted(),
+				TTL:     int(c.ttl / time.Second),
+			})
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				heartbeatFailures.Inc()
+				c.logger.Warn("lease heartbeat failed", "error", err)
+			default:
+				// Measured from sending, the API's lease runs at least this long
+				expires := sent.Add(time.Duration(leases.TTL) * time.Second)
+				lapse.Reset(time.Until(expires))
+				if c.set(leases.Targets, expires) {
+					changed()
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-lapse.C:
+				c.logger.Warn("leases lapsed without a renewal, stopping their polls", "targets", len(c.Owned()))
+				if c.set(nil, time.Time{}) {
+					changed()
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops heartbeating and gives the leases up so other aggregators take
+// the targets over at once
+func (c *Client) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+
+	c.set(nil, time.Time{})
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	if _, err := c.heartbeat(ctx, metrics.Heartbeat{ID: c.id, Leaving: true, TTL: int(c.ttl / time.Second)}); err != nil {
+		c.logger.Warn("failed to give up leases, they lapse on their own", "error", err)
+	}
+}
+
+// set records the leases held, reporting whether the set changed
+func (c *Client) set(targets []string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owned := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		owned[target] = true
+	}
+	changed := !maps.Equal(owned, c.owned)
+	if changed {
+		c.logger.Info("leases changed", "targets", len(owned))
+	}
+	c.owned, c.expires = owned, expires
+	return changed
+}
+
+func (c *Client) heartbeat(ctx context.Context, hb metrics.Heartbeat) (*metrics.Leases, error) {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.Telemetry.Server+"/api/aggregator/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	var leases metrics.Leases
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		return nil, fmt.Errorf("failed to decode leases: %w", err)
+	}
+	return &leases, nil
+}
@@ -0,0 +1,269 @@
+package lease_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/internal/lease"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+// TEST: GIVEN three aggregators configured with the same targets
+// WHEN they heartbeat against one API
+// THEN each target should be polled by exactly one of them and each should poll a share
+func TestClient_SharesTargets(t *testing.T) {
+	api := newFakeAPI()
+	defer api.Close()
+	targets := makeTargets(9)
+
+	var instances []*instance
+	for _, id := range []string{"a", "b", "c"} {
+		inst := startInstance(t, api, id, targets)
+		defer inst.stop()
+		instances = append(instances, inst)
+	}
+
+	waitFor(t, func() bool { return shared(instances, targets) })
+}
+
+// TEST: GIVEN two aggregators sharing targets
+// WHEN one dies without giving its leases up
+// THEN the other should take its targets over once the leases lapse
+func TestClient_FailsOver(t *testing.T) {
+	api := newFakeAPI()
+	defer api.Close()
+	targets := makeTargets(6)
+
+	a := startInstance(t, api, "a", targets)
+	defer a.stop()
+	b := startInstance(t, api, "b", targets)
+	waitFor(t, func() bool { return shared([]*instance{a, b}, targets) })
+
+	// Dying skips the leaving heartbeat
+	b.cancel()
+	b.manager.Stop()
+
+	waitFor(t, func() bool { return len(a.manager.Targets()) == len(targets) })
+}
+
+// TEST: GIVEN two aggregators sharing targets
+// WHEN one stops cleanly
+// THEN the other should take its targets over without waiting for the leases to lapse
+func TestClient_HandsOverOnStop(t *testing.T) {
+	api := newFakeAPI()
+	defer api.Close()
+	targets := makeTargets(6)
+
+	a := startInstance(t, api, "a", targets)
+	defer a.stop()
+	b := startInstance(t, api, "b", targets)
+	waitFor(t, func() bool { return shared([]*instance{a, b}, targets) })
+
+	b.stop()
+	if leased := api.owned("b"); leased != 0 {
+		t.Errorf("Expected b to give up its leases, it still holds %d", leased)
+	}
+	waitFor(t, func() bool { return len(a.manager.Targets()) == len(targets) })
+}
+
+// TEST: GIVEN an aggregator holding leases
+// WHEN the API stops answering
+// THEN it should stop polling once its leases lapse
+func TestClient_StopsWhenLeasesLapse(t *testing.T) {
+	api := newFakeAPI()
+	targets := makeTargets(2)
+
+	a := startInstance(t, api, "a", targets)
+	defer a.stop()
+	waitFor(t, func() bool { return len(a.manager.Targets()) == len(targets) })
+
+	api.Close()
+	waitFor(t, func() bool { return len(a.manager.Targets()) == 0 })
+}
+
+type instance struct {
+	client  *lease.Client
+	manager *discovery.Manager
+	cancel  context.CancelFunc
+}
+
+func startInstance(t *testing.T, api *fakeAPI, id string, targets []config.Target) *instance {
+	t.Helper()
+	cfg := &config.Config{
+		Labels:    config.Labels{Service: "aggregator"},
+		Telemetry: config.Telemetry{Server: api.URL, RetryInterval: 1, Timeout: 1},
+		HA:        config.HA{Enabled: true, Instance: id, Interval: 1, LeaseTTL: 2},
+	}
+	logger := log.NewWithOptions(os.Stderr, log.Options{Level: log.FatalLevel})
+
+	client := lease.New(cfg, logger)
+	manager := discovery.NewManager(targets, nil, func(config.Target) (discovery.Runner, error) {
+		return idleRunner{}, nil
+	}, logger)
+	manager.SetOwner(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.Start(ctx)
+	client.Start(ctx, manager.Wanted, manager.Refresh)
+	return &instance{client: client, manager: manager, cancel: cancel}
+}
+
+func (i *instance) stop() {
+	i.manager.Stop()
+	i.client.Stop()
+	i.cancel()
+}
+
+// shared reports whether every target is polled by exactly one instance and
+// every instance polls some
+func shared(instances []*instance, targets []config.Target) bool {
+	seen := make(map[string]int)
+	for _, inst := range instances {
+		polled := inst.manager.Targets()
+		if len(polled) == 0 {
+			return false
+		}
+		for _, t := range polled {
+			seen[t.Name]++
+		}
+	}
+	for _, t := range targets {
+		if seen[t.Name] != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+type idleRunner struct{}
+
+func (idleRunner) Start(context.Context) {}
+func (idleRunner) Stop()                 {}
+func (idleRunner) PollNow()              {}
+
+func makeTargets(n int) []config.Target {
+	targets := make([]config.Target, n)
+	for i := range targets {
+		t := config.NewTarget()
+		t.Name = fmt.Sprintf("target-%d", i)
+		t.Address = fmt.Sprintf("10.0.0.%d", i)
+		t.Port = "80"
+		t.Interval = 1
+		targets[i] = t
+	}
+	return targets
+}
+
+// fakeAPI leases targets like the web API, spreading them over the live
+// aggregators by their sorted order instead of by hash
+type fakeAPI struct {
+	*httptest.Server
+	mu      sync.Mutex
+	members map[string]time.Time // Expiry by aggregator ID
+	wanted  map[string][]string
+	leases  map[string]fakeLease // By device ID
+}
+
+type fakeLease struct {
+	owner   string
+	expires time.Time
+}
+
+func newFakeAPI() *fakeAPI {
+	api := &fakeAPI{
+		members: make(map[string]time.Time),
+		wanted:  make(map[string][]string),
+		leases:  make(map[string]fakeLease),
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hb metrics.Heartbeat
+		if r.URL.Path != "/api/aggregator/heartbeat" || json.NewDecoder(r.Body).Decode(&hb) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(metrics.Leases{Targets: api.heartbeat(hb), TTL: hb.TTL})
+	}))
+	return api
+}
+
+func (a *fakeAPI) heartbeat(hb metrics.Heartbeat) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for target, l := range a.leases {
+		if l.owner == hb.ID && (hb.Leaving || !slices.Contains(hb.Targets, target)) {
+			delete(a.leases, target)
+		}
+	}
+	if hb.Leaving {
+		delete(a.members, hb.ID)
+		return []string{}
+	}
+	expires := now.Add(time.Duration(hb.TTL) * time.Second)
+	a.members[hb.ID], a.wanted[hb.ID] = expires, hb.Targets
+
+	held := []string{}
+	for _, target := range hb.Targets {
+		l, leased := a.leases[target]
+		preferred := a.preferred(target, now) == hb.ID
+		switch {
+		case leased && l.owner == hb.ID && !preferred:
+			delete(a.leases, target)
+		case preferred && (!leased || l.owner == hb.ID || !now.Before(l.expires)):
+			a.leases[target] = fakeLease{owner: hb.ID, expires: expires}
+			held = append(held, target)
+		}
+	}
+	return held
+}
+
+// preferred picks among the live members wanting target by the target's position
+func (a *fakeAPI) preferred(target string, now time.Time) string {
+	var live []string
+	for id, expires := range a.members {
+		if now.Before(expires) && slices.Contains(a.wanted[id], target) {
+			live = append(live, id)
+		}
+	}
+	if len(live) == 0 {
+		return ""
+	}
+	slices.Sort(live)
+	i := slices.Index(a.wanted[live[0]], target)
+	return live[i%len(live)]
+}
+
+func (a *fakeAPI) owned(id string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	for _, l := range a.leases {
+		if l.owner == id {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
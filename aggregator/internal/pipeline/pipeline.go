@@ -0,0 +1,284 @@
+// Package pipeline applies the configured processors to a target's metrics
+// before they are forwarded: dropping, renaming, labelling and converting
+// metrics, and deriving new series like rates and reboot events. A Window
+// then optionally rolls the results up before upload.
+package pipeline
+
+import (
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+const (
+	defaultRateSuffix   = "_rate"
+	defaultRateUnit     = "per_second"
+	defaultRebootMetric = "uptime"
+	defaultRebootName   = "reboot"
+)
+
+// step is one processor, changing the metrics in place
+type step interface {
+	apply(dm *metrics.DeviceMetrics)
+}
+
+// Chain is the processors of one target, in configured order. Derived series
+// remember earlier polls, so each target needs a chain of its own.
+type Chain struct {
+	steps  []step
+	events []string // Types of the event series derived
+}
+
+// New builds the chain of the processors that apply to target. The
+// processors must have passed config.ValidateProcessors.
+func New(processors []config.Processor, target config.Target) *Chain {
+	c := &Chain{}
+	for _, p := range processors {
+		if !appliesTo(p, target) {
+			continue
+		}
+		switch p.Type {
+		case config.ProcessorDrop:
+			c.steps = append(c.steps, drop{patterns: p.Metrics})
+		case config.ProcessorRename:
+			c.steps = append(c.steps, rename(p.Rename))
+		case config.ProcessorLabel:
+			c.steps = append(c.steps, label(p.Labels))
+		case config.ProcessorConvert:
+			c.steps = append(c.steps, newConvert(p))
+		case config.ProcessorRate:
+			c.steps = append(c.steps, newRate(p))
+		case config.ProcessorReboot:
+			r := newReboot(p)
+			c.steps = append(c.steps, r)
+			c.events = append(c.events, r.name)
+		}
+	}
+	return c
+}
+
+// Process runs every processor over dm in turn
+func (c *Chain) Process(dm *metrics.DeviceMetrics) {
+	for _, s := range c.steps {
+		s.apply(dm)
+	}
+}
+
+// Events returns the types of the event series the chain derives, like
+// reboots, which a Window passes through rather than rolling up
+func (c *Chain) Events() []string {
+	return c.events
+}
+
+func appliesTo(p config.Processor, target config.Target) bool {
+	if len(p.Targets) == 0 && len(p.Groups) == 0 {
+		return true
+	}
+	return slices.Contains(p.Targets, target.Name) || (target.Group != "" && slices.Contains(p.Groups, target.Group))
+}
+
+// matches reports whether a metric type matches any of the glob patterns
+func matches(patterns []string, metricType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, metricType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesKey tells apart the series of one metric type by their labels
+func seriesKey(m metrics.Metric) string {
+	var b strings.Builder
+	b.WriteString(m.Type)
+	for _, k := range slices.Sorted(maps.Keys(m.Labels)) {
+		b.WriteString("\x00" + k + "=" + m.Labels[k])
+	}
+	return b.String()
+}
+
+// derive returns a new metric in the same series as m
+func derive(m metrics.Metric, metricType, value, unit string) metrics.Metric {
+	return metrics.Metric{
+		Type:       metricType,
+		Value:      value,
+		Unit:       unit,
+		Labels:     maps.Clone(m.Labels),
+		RecordedAt: m.RecordedAt,
+	}
+}
+
+type drop struct {
+	patterns []string
+}
+
+func (d drop) apply(dm *metrics.DeviceMetrics) {
+	dm.Metrics = slices.DeleteFunc(dm.Metrics, func(m metrics.Metric) bool { return matches(d.patterns, m.Type) })
+}
+
+// rename maps old metric types to new ones
+type rename map[string]string
+
+func (r rename) apply(dm *metrics.DeviceMetrics) {
+	for i := range dm.Metrics {
+		if to, ok := r[dm.Metrics[i].Type]; ok {
+			dm.Metrics[i].Type = to
+		}
+	}
+}
+
+// label adds static labels without overriding the device's
+type label map[string]string
+
+func (l label) apply(dm *metrics.DeviceMetrics) {
+	for i := range dm.Metrics {
+		m := &dm.Metrics[i]
+		if m.Labels == nil {
+			m.Labels = make(map[string]string, len(l))
+		}
+		for k, v := range l {
+			if _, ok := m.Labels[k]; !ok {
+				m.Labels[k] = v
+			}
+		}
+	}
+}
+
+// convert rewrites numeric values as value*scale+offset in a new unit
+type convert struct {
+	patterns      []string
+	from, unit    string
+	scale, offset float64
+}
+
+func newConvert(p config.Processor) convert {
+	c := convert{patterns: p.Metrics, from: p.From, unit: p.Unit, scale: p.Scale, offset: p.Offset}
+	if c.scale == 0 {
+		c.scale = 1
+	}
+	return c
+}
+
+func (c convert) apply(dm *metrics.DeviceMetrics) {
+	for i := range dm.Metrics {
+		m := &dm.Metrics[i]
+		if !matches(c.patterns, m.Type) || (c.from != "" && m.Unit != c.from) {
+			continue
+		}
+		if c.scale != 1 || c.offset != 0 {
+			v, err := strconv.ParseFloat(m.Value, 64)
+			if err != nil {
+				continue // Not a number, left as it is
+			}
+			m.Value = strconv.FormatFloat(v*c.scale+c.offset, 'f', -1, 64)
+		}
+		if c.unit != "" {
+			m.Unit = c.unit
+		}
+	}
+}
+
+// sample is a series' value at the last poll
+type sample struct {
+	value float64
+	at    time.Time
+}
+
+// numeric returns a metric's value and time, ok is false if either doesn't parse
+func numeric(m metrics.Metric) (sample, bool) {
+	v, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		return sample{}, false
+	}
+	at, err := time.Parse(time.RFC3339, m.RecordedAt)
+	if err != nil {
+		return sample{}, false
+	}
+	return sample{value: v, at: at}, true
+}
+
+// rate derives the per second increase of counters. A counter that went down
+// was reset, so no rate is derived across the reset.
+type rate struct {
+	patterns     []string
+	suffix, unit string
+	last         map[string]sample
+}
+
+func newRate(p config.Processor) *rate {
+	r := &rate{patterns: p.Metrics, suffix: p.Suffix, unit: p.Unit, last: make(map[string]sample)}
+	if r.suffix == "" {
+		r.suffix = defaultRateSuffix
+	}
+	if r.unit == "" {
+		r.unit = defaultRateUnit
+	}
+	return r
+}
+
+func (r *rate) apply(dm *metrics.DeviceMetrics) {
+	var derived []metrics.Metric
+	for _, m := range dm.Metrics {
+		if !matches(r.patterns, m.Type) {
+			continue
+		}
+		cur, ok := numeric(m)
+		if !ok {
+			continue
+		}
+		key := seriesKey(m)
+		prev, seen := r.last[key]
+		r.last[key] = cur
+
+		elapsed := cur.at.Sub(prev.at).Seconds()
+		if !seen || elapsed <= 0 || cur.value < prev.value {
+			continue
+		}
+		value := strconv.FormatFloat((cur.value-prev.value)/elapsed, 'f', -1, 64)
+		derived = append(derived, derive(m, m.Type+r.suffix, value, r.unit))
+	}
+	dm.Metrics = append(dm.Metrics, derived...)
+}
+
+// reboot emits an event when a device's uptime goes down
+type reboot struct {
+	metric, name string
+	last         map[string]float64
+}
+
+func newReboot(p config.Processor) *reboot {
+	r := &reboot{metric: defaultRebootMetric, name: p.Name, last: make(map[string]float64)}
+	if len(p.Metrics) == 1 {
+		r.metric = p.Metrics[0]
+	}
+	if r.name == "" {
+		r.name = defaultRebootName
+	}
+	return r
+}
+
+func (r *reboot) apply(dm *metrics.DeviceMetrics) {
+	var derived []metrics.Metric
+	for _, m := range dm.Metrics {
+		if !matches([]string{r.metric}, m.Type) {
+			continue
+		}
+		cur, ok := numeric(m)
+		if !ok {
+			continue
+		}
+		key := seriesKey(m)
+		prev, seen := r.last[key]
+		r.last[key] = cur.value
+		if seen && cur.value < prev {
+			derived = append(derived, derive(m, r.name, "1", "count"))
+		}
+	}
+	dm.Metrics = append(dm.Metrics, derived...)
+}
@@ -0,0 +1,144 @@
+package pipeline_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/pipeline"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func metric(metricType, value, unit string, at time.Time) metrics.Metric {
+	return metrics.Metric{Type: metricType, Value: value, Unit: unit, RecordedAt: at.Format(time.RFC3339)}
+}
+
+func target(name, group string) config.Target {
+	t := config.NewTarget()
+	t.Name = name
+	t.Group = group
+	return t
+}
+
+// TEST: GIVEN drop, rename, label and convert processors
+// WHEN a poll's metrics go through the chain
+// THEN they should be dropped, renamed, labelled and converted in configured order
+func TestChain_FilterRelabel(t *testing.T) {
+	chain := pipeline.New([]config.Processor{
+		{Type: config.ProcessorDrop, Metrics: []string{"battery_*"}},
+		{Type: config.ProcessorRename, Rename: map[string]string{"memory_used": "mem_used"}},
+		{Type: config.ProcessorLabel, Labels: map[string]string{"site": "lab", "rack": "3"}},
+		{Type: config.ProcessorConvert, Metrics: []string{"uptime"}, From: "seconds", Unit: "hours", Scale: 1.0 / 3600},
+		{Type: config.ProcessorConvert, Metrics: []string{"car_light"}, Unit: "state"},
+	}, target("daemon", ""))
+
+	dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{
+		metric("battery_percent", "80", "percent", start),
+		metric("battery_state", "charging", "state", start),
+		metric("memory_used", "42", "percent", start),
+		metric("uptime", "7200", "seconds", start),
+		metric("car_light", "red", "unknown", start),
+	}}
+	dm.Metrics[2].Labels = map[string]string{"site": "device"}
+	chain.Process(dm)
+
+	want := []metrics.Metric{
+		metric("mem_used", "42", "percent", start),
+		metric("uptime", "2", "hours", start),
+		metric("car_light", "red", "state", start),
+	}
+	want[0].Labels = map[string]string{"site": "device", "rack": "3"}
+	want[1].Labels = map[string]string{"site": "lab", "rack": "3"}
+	want[2].Labels = map[string]string{"site": "lab", "rack": "3"}
+	if !reflect.DeepEqual(dm.Metrics, want) {
+		t.Errorf("Expected %+v, got %+v", want, dm.Metrics)
+	}
+}
+
+// TEST: GIVEN a rate processor on a counter
+// WHEN the counter increases over polls and then resets
+// THEN a per second rate should follow each increase and none the reset
+func TestChain_Rate(t *testing.T) {
+	chain := pipeline.New([]config.Processor{{Type: config.ProcessorRate, Metrics: []string{"bytes_sent"}}}, target("daemon", ""))
+
+	steps := []struct {
+		value string
+		want  string // Empty when no rate is derived
+	}{
+		{"100", ""},
+		{"300", "20"},
+		{"400", "10"},
+		{"5", ""}, // Reset
+		{"55", "5"},
+	}
+	for i, step := range steps {
+		dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("bytes_sent", step.value, "count", start.Add(time.Duration(i)*10*time.Second))}}
+		chain.Process(dm)
+
+		var got string
+		if len(dm.Metrics) == 2 {
+			rate := dm.Metrics[1]
+			if rate.Type != "bytes_sent_rate" || rate.Unit != "per_second" {
+				t.Errorf("Step %d: unexpected rate metric %+v", i+1, rate)
+			}
+			got = rate.Value
+		}
+		if got != step.want {
+			t.Errorf("Step %d: expected rate %q, got %q", i+1, step.want, got)
+		}
+	}
+}
+
+// TEST: GIVEN a reboot processor
+// WHEN uptime grows and then goes down
+// THEN a reboot event should be emitted only when it goes down
+func TestChain_Reboot(t *testing.T) {
+	chain := pipeline.New([]config.Processor{{Type: config.ProcessorReboot}}, target("daemon", ""))
+
+	reboots := 0
+	for i, uptime := range []string{"100", "160", "5", "65"} {
+		dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("uptime", uptime, "seconds", start.Add(time.Duration(i)*time.Minute))}}
+		chain.Process(dm)
+		for _, m := range dm.Metrics[1:] {
+			if m.Type != "reboot" || m.Value != "1" {
+				t.Errorf("Unexpected derived metric %+v", m)
+			}
+			if i != 2 {
+				t.Errorf("Unexpected reboot at uptime %s", uptime)
+			}
+			reboots++
+		}
+	}
+	if reboots != 1 {
+		t.Errorf("Expected 1 reboot, got %d", reboots)
+	}
+}
+
+// TEST: GIVEN processors scoped to a target name and to a group
+// WHEN chains are built for targets inside and outside the scopes
+// THEN each chain should only apply the processors that match
+func TestNew_Scope(t *testing.T) {
+	processors := []config.Processor{
+		{Type: config.ProcessorLabel, Targets: []string{"diorama"}, Labels: map[string]string{"by": "name"}},
+		{Type: config.ProcessorLabel, Groups: []string{"lab"}, Labels: map[string]string{"group": "lab"}},
+	}
+	tests := []struct {
+		target config.Target
+		want   map[string]string
+	}{
+		{target("diorama", ""), map[string]string{"by": "name"}},
+		{target("daemon", "lab"), map[string]string{"group": "lab"}},
+		{target("diorama", "lab"), map[string]string{"by": "name", "group": "lab"}},
+		{target("daemon", ""), nil},
+	}
+	for _, tt := range tests {
+		dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("uptime", "1", "seconds", start)}}
+		pipeline.New(processors, tt.target).Process(dm)
+		if got := dm.Metrics[0].Labels; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s in %q: expected labels %v, got %v", tt.target.Name, tt.target.Group, tt.want, got)
+		}
+	}
+}
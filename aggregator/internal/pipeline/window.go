@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// StatLabel tells the rollups of one series apart
+const StatLabel = "stat"
+
+// Window rolls a target's numeric series up over fixed windows aligned to
+// the clock, so a target polled every second uploads one set of min, max,
+// avg, last and count per window. Series that aren't numbers, like a light's
+// colour, are passed through as soon as their value changes instead. Event
+// series, like reboots, are passed through on every sample.
+type Window struct {
+	size     time.Duration
+	start    time.Time // Of the open window, zero when nothing is open
+	hostname string
+	series   map[string]*rollup // Numeric series of the open window
+	order    []string           // Series keys in the order they were first seen
+	states   map[string]string  // Last value passed through per state series
+	events   []string           // Types passed through as they come
+}
+
+// rollup is one numeric series within a window
+type rollup struct {
+	metric              metrics.Metric // Type, unit and labels of the series
+	min, max, sum, last float64
+	count               int
+}
+
+// NewWindow rolls up over windows of size, passing the event series of the
+// given types through untouched
+func NewWindow(size time.Duration, events ...string) *Window {
+	return &Window{size: size, series: make(map[string]*rollup), states: make(map[string]string), events: events}
+}
+
+// Add folds a poll into the window. It returns what to upload now: the state
+// changes and the rollups of a window the poll closed, or nil.
+func (w *Window) Add(dm *metrics.DeviceMetrics) *metrics.DeviceMetrics {
+	out := &metrics.DeviceMetrics{Hostname: dm.Hostname}
+	w.hostname = dm.Hostname
+
+	for _, m := range dm.Metrics {
+		if slices.Contains(w.events, m.Type) {
+			out.Metrics = append(out.Metrics, m)
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, m.RecordedAt)
+		if err != nil {
+			at = time.Now()
+		}
+		value, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			key := seriesKey(m)
+			if last, seen := w.states[key]; !seen || last != m.Value {
+				w.states[key] = m.Value
+				out.Metrics = append(out.Metrics, m)
+			}
+			continue
+		}
+
+		// A sample from a later window closes the open one, a late sample
+		// joins the open one rather than reopening its own
+		if start := at.Truncate(w.size); start.After(w.start) {
+			out.Metrics = append(out.Metrics, w.close()...)
+			w.start = start
+		}
+		w.observe(m, value)
+	}
+
+	if len(out.Metrics) == 0 {
+		return nil
+	}
+	return out
+}
+
+// Tick closes the open window once now is past its end, for targets that
+// stopped answering. It returns the rollups or nil.
+func (w *Window) Tick(now time.Time) *metrics.DeviceMetrics {
+	if w.start.IsZero() || now.Before(w.start.Add(w.size)) {
+		return nil
+	}
+	return w.Flush()
+}
+
+// Flush closes the open window early, e.g. when polling stops, and returns
+// its rollups or nil
+func (w *Window) Flush() *metrics.DeviceMetrics {
+	rollups := w.close()
+	if len(rollups) == 0 {
+		return nil
+	}
+	return &metrics.DeviceMetrics{Hostname: w.hostname, Metrics: rollups}
+}
+
+func (w *Window) observe(m metrics.Metric, value float64) {
+	key := seriesKey(m)
+	r, ok := w.series[key]
+	if !ok {
+		r = &rollup{metric: m, min: value, max: value}
+		w.series[key] = r
+		w.order = append(w.order, key)
+	}
+	r.min = min(r.min, value)
+	r.max = max(r.max, value)
+	r.sum += value
+	r.last = value
+	r.count++
+}
+
+// close returns the rollups of the open window and starts afresh
+func (w *Window) close() []metrics.Metric {
+	var out []metrics.Metric
+	at := w.start.UTC().Format(time.RFC3339)
+	for _, key := range w.order {
+		r := w.series[key]
+		stat := func(name string, value float64, unit string) {
+			labels := maps.Clone(r.metric.Labels)
+			if labels == nil {
+				labels = make(map[string]string, 1)
+			}
+			labels[StatLabel] = name
+			out = append(out, metrics.Metric{
+				Type:       r.metric.Type,
+				Value:      strconv.FormatFloat(value, 'f', -1, 64),
+				Unit:       unit,
+				Labels:     labels,
+				RecordedAt: at,
+			})
+		}
+		unit := r.metric.Unit
+		stat("min", r.min, unit)
+		stat("max", r.max, unit)
+		stat("avg", r.sum/float64(r.count), unit)
+		stat("last", r.last, unit)
+		stat("count", float64(r.count), "count")
+	}
+	w.series = make(map[string]*rollup)
+	w.order = nil
+	w.start = time.Time{}
+	return out
+}
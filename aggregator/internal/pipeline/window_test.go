@@ -0,0 +1,117 @@
+package pipeline_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/pipeline"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// stats indexes rollups by type and stat
+func stats(dm *metrics.DeviceMetrics) map[string]string {
+	out := make(map[string]string)
+	if dm == nil {
+		return out
+	}
+	for _, m := range dm.Metrics {
+		out[m.Type+"/"+m.Labels[pipeline.StatLabel]] = m.Value
+	}
+	return out
+}
+
+// TEST: GIVEN a one minute window
+// WHEN a numeric series is polled every second past the end of the window
+// THEN nothing should be uploaded until the next window starts, and then its min, max, avg, last and count
+func TestWindow_RollsUp(t *testing.T) {
+	w := pipeline.NewWindow(time.Minute)
+
+	for i, value := range []string{"4", "2", "9", "5"} {
+		dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("memory_used", value, "percent", start.Add(time.Duration(i)*time.Second))}}
+		if out := w.Add(dm); out != nil {
+			t.Fatalf("Expected nothing within the window, got %+v", out.Metrics)
+		}
+	}
+
+	out := w.Add(&metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("memory_used", "7", "percent", start.Add(time.Minute))}})
+	want := map[string]string{
+		"memory_used/min":   "2",
+		"memory_used/max":   "9",
+		"memory_used/avg":   "5",
+		"memory_used/last":  "5",
+		"memory_used/count": "4",
+	}
+	got := stats(out)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected %s = %s, got %q", k, v, got[k])
+		}
+	}
+	if out != nil && out.Metrics[0].RecordedAt != start.Format(time.RFC3339) {
+		t.Errorf("Expected rollups at the window start, got %s", out.Metrics[0].RecordedAt)
+	}
+
+	// The second window closes on its own once it is over
+	if out := w.Tick(start.Add(90 * time.Second)); out != nil {
+		t.Errorf("Expected the window to stay open, got %+v", out.Metrics)
+	}
+	if got := stats(w.Tick(start.Add(2 * time.Minute))); got["memory_used/last"] != "7" || got["memory_used/count"] != "1" {
+		t.Errorf("Expected the second window's rollups, got %v", got)
+	}
+}
+
+// TEST: GIVEN a one minute window
+// WHEN a state series is polled with repeated values
+// THEN only the changes should be passed through, straight away
+func TestWindow_PassesStateChanges(t *testing.T) {
+	w := pipeline.NewWindow(time.Minute)
+
+	var changes []string
+	for i, value := range []string{"red", "red", "green", "green", "red"} {
+		out := w.Add(&metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("car_light", value, "color", start.Add(time.Duration(i)*time.Second))}})
+		if out == nil {
+			continue
+		}
+		for _, m := range out.Metrics {
+			changes = append(changes, m.Value)
+		}
+	}
+	if len(changes) != 3 || changes[0] != "red" || changes[1] != "green" || changes[2] != "red" {
+		t.Errorf("Expected red, green, red, got %v", changes)
+	}
+	if out := w.Flush(); out != nil {
+		t.Errorf("Expected no rollups for a state series, got %+v", out.Metrics)
+	}
+}
+
+// TEST: GIVEN a one minute window over a chain with a reboot processor
+// WHEN the device's uptime goes down within the window
+// THEN the reboot event should be passed through straight away and left out of the rollups
+func TestWindow_PassesEvents(t *testing.T) {
+	chain := pipeline.New([]config.Processor{{Type: config.ProcessorReboot}}, target("daemon", ""))
+	w := pipeline.NewWindow(time.Minute, chain.Events()...)
+
+	var events []metrics.Metric
+	for i, uptime := range []string{"100", "101", "5"} {
+		dm := &metrics.DeviceMetrics{Metrics: []metrics.Metric{metric("uptime", uptime, "seconds", start.Add(time.Duration(i)*time.Second))}}
+		chain.Process(dm)
+		if out := w.Add(dm); out != nil {
+			events = append(events, out.Metrics...)
+		}
+	}
+	if len(events) != 1 || events[0].Type != "reboot" || events[0].Value != "1" || events[0].Labels[pipeline.StatLabel] != "" {
+		t.Fatalf("Expected one reboot passed through, got %+v", events)
+	}
+
+	got := stats(w.Flush())
+	if got["uptime/count"] != "3" {
+		t.Errorf("Expected uptime rolled up, got %v", got)
+	}
+	for k := range got {
+		if strings.HasPrefix(k, "reboot/") {
+			t.Errorf("Expected no reboot rollups, got %s", k)
+		}
+	}
+}
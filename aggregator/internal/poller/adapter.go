@@ -0,0 +1,153 @@
+package poller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+)
+
+// maxDioramaCommand is what fits the firmware's command buffer with its terminator
+const maxDioramaCommand = 127
+
+// commandAdapter speaks the command dialect of one target protocol
+type commandAdapter interface {
+	// request encodes cmd as the bytes written to the device
+	request(cmd Command) ([]byte, error)
+	// result reads the device's reply. A command the device refused is a
+	// result without Success, an error means the reply could not be read.
+	result(cmd Command, reply *reply) (*CommandResult, error)
+}
+
+// commandAdapters by target protocol, targets of other protocols take no commands
+var commandAdapters = map[string]commandAdapter{
+	config.ProtocolDaemon:  daemonCommands{},
+	config.ProtocolDiorama: dioramaCommands{},
+}
+
+// TakesCommands reports whether targets of a protocol can be sent commands
+func TakesCommands(protocol string) bool {
+	_, ok := commandAdapters[protocol]
+	return ok
+}
+
+// reply is a device's answer to a command
+type reply struct {
+	resp    *http.Response // Nil when the device answered without an HTTP status line
+	body    io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// postCommand builds the POST /cmd request every device takes commands on
+func postCommand(contentType, accept string, body []byte) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "POST /cmd HTTP/1.0\r\nContent-Type: %s\r\n", contentType)
+	if accept != "" {
+		fmt.Fprintf(&b, "Accept: %s\r\n", accept)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+	b.Write(body)
+	return []byte(b.String())
+}
+
+// daemonCommands sends JSON and takes a bproto result frame or JSON back
+type daemonCommands struct{}
+
+func (daemonCommands) request(cmd Command) ([]byte, error) {
+	payload := struct {
+		ID      uint            `json:"id,omitempty"`
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args,omitempty"`
+	}{
+		ID:      cmd.ID,
+		Command: cmd.Command,
+		Args:    cmd.Args,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %w", err)
+	}
+	return postCommand("application/json", bproto.ContentType, body), nil
+}
+
+func (daemonCommands) result(cmd Command, reply *reply) (*CommandResult, error) {
+	if reply.resp == nil {
+		return nil, fmt.Errorf("unexpected response without HTTP status")
+	}
+
+	// Daemons that speak bproto answer with a command result frame
+	if reply.resp.StatusCode == http.StatusOK && reply.resp.Header.Get("Content-Type") == bproto.ContentType {
+		frames := bproto.NewReader(reply.body, bproto.WithMaxPayload(maxCommandResponseBytes), bproto.WithReadTimeout(reply.conn, reply.timeout))
+		frame, err := frames.ReadFrame()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read command result: %w", err)
+		}
+		if frame.Type != bproto.TypeCommandResult {
+			return nil, fmt.Errorf("unexpected frame type %d", frame.Type)
+		}
+		result := &CommandResult{}
+		if err := json.Unmarshal(frame.Payload, result); err != nil {
+			return nil, fmt.Errorf("failed to decode command result: %w", err)
+		}
+		result.Success = result.Status == "success"
+		return result, nil
+	}
+
+	text, err := io.ReadAll(io.LimitReader(reply.body, maxCommandResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	message := strings.TrimSpace(string(text))
+
+	// Errors are plain text
+	if reply.resp.StatusCode != http.StatusOK {
+		return &CommandResult{Status: "error", Message: fmt.Sprintf("%s: %s", reply.resp.Status, message)}, nil
+	}
+
+	result := &CommandResult{Status: "success", Message: message}
+	if strings.HasPrefix(reply.resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(text, result); err != nil {
+			return nil, fmt.Errorf("failed to decode command result: %w", err)
+		}
+	}
+	result.Success = result.Status == "success"
+	return result, nil
+}
+
+// dioramaCommands sends the bare command name as the body, which the
+// firmware compares as a string, and takes a plain text reply
+type dioramaCommands struct{}
+
+func (dioramaCommands) request(cmd Command) ([]byte, error) {
+	if len(cmd.Args) > 0 && string(cmd.Args) != "null" {
+		return nil, fmt.Errorf("the diorama takes no command arguments")
+	}
+	if len(cmd.Command) > maxDioramaCommand {
+		return nil, fmt.Errorf("command is longer than the diorama's %d bytes", maxDioramaCommand)
+	}
+	return postCommand("text/plain", "", []byte(cmd.Command)), nil
+}
+
+func (dioramaCommands) result(cmd Command, reply *reply) (*CommandResult, error) {
+	if reply.resp == nil {
+		return nil, fmt.Errorf("unexpected response without HTTP status")
+	}
+	text, err := io.ReadAll(io.LimitReader(reply.body, maxCommandResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	result := &CommandResult{Status: "success", Message: strings.TrimSpace(string(text)), Success: true}
+	if reply.resp.StatusCode != http.StatusOK {
+		result.Status, result.Success = "error", false
+		result.Message = fmt.Sprintf("%s: %s", reply.resp.Status, result.Message)
+	}
+	return result, nil
+}
@@ -1,23 +1,64 @@
 package poller
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
 	"github.com/charmbracelet/log"
 )
 
+const (
+	// maxCommandResponseBytes bounds a device reply, fetched files are capped well below it
+	maxCommandResponseBytes = 4 << 20
+	defaultCommandInterval  = 5 * time.Second
+	defaultCommandTimeout   = 5 * time.Second
+	// defaultReplyTimeout outlasts the daemon's update download and script sandbox
+	defaultReplyTimeout = 6 * time.Minute
+	// settleTimeout bounds reporting a command's result, which goes ahead
+	// after Stop so no command is left sent
+	settleTimeout = 10 * time.Second
+)
+
+// errCommandSettled is the API refusing a status change, the command was
+// claimed elsewhere, already finished or deleted
+var errCommandSettled = errors.New("command already settled")
+
+var (
+	commandStatusRetries = selfmetrics.NewCounter("aggregator_command_status_retries", "count")
+	commandStatusDrops   = selfmetrics.NewCounter("aggregator_command_status_drops", "count")
+	commandResults       = selfmetrics.NewCounterVec("aggregator_commands", "count", "result")
+)
+
+// CommandPoller delivers commands queued in the API to the daemon targets.
+// It holds one stream of commands for every target open and dispatches each
+// as it arrives, polling per target instead while the stream is unavailable.
 type CommandPoller struct {
-	logger     *log.Logger
-	client     *http.Client
-	cfg        *config.Config
-	pollTicker *time.Ticker
-	stopChan   chan struct{}
+	logger   *log.Logger
+	client   *http.Client
+	stream   *http.Client // Without an overall timeout, the stream stays open
+	cfg      *config.Config
+	targets  func() []config.Target
+	senders  map[string]CommandSender // By protocol, for devices not reached over their own connection
+	policy   retry.Policy
+	interval time.Duration
+	reply    time.Duration // For a device to run a command and answer
+
+	mu       sync.Mutex
+	inflight map[string]bool // Device and command being dispatched
+	wg       sync.WaitGroup  // Commands being dispatched
+
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 type Device struct {
@@ -25,162 +66,322 @@ type Device struct {
 }
 
 type Command struct {
-	Device  string `json:"device"`
-	Command string `json:"command"`
+	ID      uint            `json:"id"`
+	Device  string          `json:"device"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
 }
 
-func NewCommandPoller(cfg *config.Config, logger *log.Logger) *CommandPoller {
-	return &CommandPoller{
-		logger:     logger,
-		client:     &http.Client{Timeout: 5 * time.Second},
-		pollTicker: time.NewTicker(5 * time.Second),
-		cfg:        cfg,
-		stopChan:   make(chan struct{}),
+// CommandResult is what a device answers to a command, Output is base64 in JSON
+type CommandResult struct {
+	ID      uint   `json:"id,omitempty"` // Echoed by daemons that know command IDs
+	Success bool   `json:"-"`            // Set by the protocol's adapter
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Output  []byte `json:"output,omitempty"`
+}
+
+// CommandSender delivers commands to the devices of a protocol some other
+// way than a request to the device, like the Subscriber over MQTT
+type CommandSender interface {
+	SendCommand(ctx context.Context, target config.Target, cmd Command) (*CommandResult, error)
+}
+
+// NewCommandPoller fetches commands for the targets returned by targets, which
+// changes as targets are discovered
+func NewCommandPoller(cfg *config.Config, targets func() []config.Target, logger *log.Logger) *CommandPoller {
+	interval := time.Duration(cfg.Commands.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultCommandInterval
+	}
+	timeout := time.Duration(cfg.Commands.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	reply := time.Duration(cfg.Commands.ReplyTimeout) * time.Second
+	if reply <= 0 {
+		reply = defaultReplyTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	p := &CommandPoller{
+		logger:   logger,
+		client:   &http.Client{Timeout: timeout},
+		stream:   &http.Client{Transport: transport},
+		cfg:      cfg,
+		targets:  targets,
+		policy:   retry.NewPolicy(cfg.Telemetry),
+		interval: interval,
+		reply:    reply,
+		inflight: make(map[string]bool),
+		senders:  make(map[string]CommandSender),
 	}
+	p.policy.OnRetry = func(err error, delay time.Duration) {
+		commandStatusRetries.Inc()
+		logger.Warn("command status update failed, retrying", "delay", delay, "error", err)
+	}
+	return p
 }
 
-func (p *CommandPoller) Start() {
+// SetSender delivers the commands for targets of protocol through sender,
+// it must be set before Start
+func (p *CommandPoller) SetSender(protocol string, sender CommandSender) {
+	p.senders[protocol] = sender
+}
+
+// Start delivers commands in the background until ctx is done or Stop is called
+func (p *CommandPoller) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+
 	go func() {
-		for {
-			select {
-			case <-p.pollTicker.C:
-				p.pollCommands()
-			case <-p.stopChan:
-				p.pollTicker.Stop()
-				return
-			}
+		defer close(p.done)
+		if p.cfg.Commands.PollOnly {
+			p.pollEvery(ctx, 0)
+			return
 		}
+		p.run(ctx)
 	}()
 }
 
+// Stop cancels delivery and waits for in-flight commands to finish
 func (p *CommandPoller) Stop() {
-	close(p.stopChan)
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.wg.Wait()
 }
 
-func (p *CommandPoller) pollCommands() {
-	// Iterate over all configured hosts
-	// hosts is each the target and ports matched
-	var hosts []string
-	hosts_num := len(p.cfg.Targets.Hosts)
-	for i := 0; i < hosts_num; i++ {
-		hosts = append(hosts, fmt.Sprintf("%s:%s", p.cfg.Targets.Hosts[i], p.cfg.Targets.Ports[i]))
+// pollEvery polls every interval, for d or until ctx is done when d is 0
+func (p *CommandPoller) pollEvery(ctx context.Context, d time.Duration) {
+	var deadline <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
 	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
 
-	for _, host := range hosts {
-		// Create a new request with the X-DeviceID header
-		req, err := http.NewRequest("GET", p.cfg.Telemetry.Server+"/api/command", nil)
-		if err != nil {
-			p.logger.Error("failed to create request", "error", err)
-			continue
+	for {
+		select {
+		case <-ticker.C:
+			p.pollCommands(ctx)
+		case <-deadline:
+			return
+		case <-ctx.Done():
+			return
 		}
-		req.Header.Set("X-DeviceID", host)
-
-		resp, err := p.client.Do(req)
-		if err != nil {
-			p.logger.Error("failed to get commands", "host", host, "error", err)
-			continue
-		}
-		defer resp.Body.Close()
+	}
+}
 
-		if resp.StatusCode != http.StatusOK {
-			p.logger.Error("failed to get commands", "status", resp.StatusCode, "host", host)
-			continue
+// commandTargets returns the targets that take commands, by device ID
+func (p *CommandPoller) commandTargets() map[string]config.Target {
+	targets := make(map[string]config.Target)
+	for _, target := range p.targets() {
+		// Only protocols with a command adapter or sender take commands
+		_, adapted := commandAdapters[target.Protocol]
+		_, sent := p.senders[target.Protocol]
+		if (adapted || sent) && target.Enabled {
+			targets[target.DeviceID()] = target
 		}
+	}
+	return targets
+}
 
-		var commands []Command
-		if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
-			p.logger.Error("failed to decode commands", "error", err, "host", host)
+// pollCommands fetches each target's commands and dispatches them in the
+// background, so a slow device does not hold up commands for the others
+func (p *CommandPoller) pollCommands(ctx context.Context) {
+	for host, target := range p.commandTargets() {
+		commands, err := p.fetchCommands(ctx, host)
+		if err != nil {
+			p.logger.Error("failed to get commands", "host", host, "error", err)
 			continue
 		}
 
-		// Process each command
 		for _, cmd := range commands {
-			// Skip empty commands
-			if cmd.Command == "" {
-				p.logger.Warn("skipping empty command", "device", cmd.Device)
-				continue
-			}
-
 			// Only process commands for the current host
-			targetHost := cmd.Device
-			if targetHost == host {
-				p.logger.Info("processing command", "command", cmd.Command, "host", host)
-				if err := p.sendCommand(host, cmd.Command); err != nil {
-					p.logger.Error("failed to send command", "error", err, "host", host)
-					// Update command status to "failed"
-					if err := p.updateCommandStatus(host, cmd.Command, "failed"); err != nil {
-						p.logger.Error("failed to update command status", "error", err, "host", host)
-					}
-				} else {
-					p.logger.Info("successfully sent command", "command", cmd.Command, "host", host)
-					// Update command status to "completed"
-					if err := p.updateCommandStatus(host, cmd.Command, "completed"); err != nil {
-						p.logger.Error("failed to update command status", "error", err, "host", host)
-					}
-				}
+			if cmd.Device != host {
+				continue
 			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.dispatch(ctx, target, cmd)
+			}()
 		}
 	}
 }
 
-func (p *CommandPoller) sendCommand(host, command string) error {
-	// Connect to device
-	// remove :port from host
-	hostname := strings.Split(host, ":")[0]
-	port := strings.Split(host, ":")[1]
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", hostname, port))
+func (p *CommandPoller) fetchCommands(ctx context.Context, host string) ([]Command, error) {
+	// Create a new request with the X-DeviceID header
+	req, err := http.NewRequestWithContext(ctx, "GET", p.cfg.Telemetry.Server+"/api/command", nil)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-	defer conn.Close()
+	req.Header.Set("X-DeviceID", host)
 
-	// Create JSON payload
-	payload := struct {
-		Command string `json:"command"`
-	}{
-		Command: command,
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	jsonData, err := json.Marshal(payload)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var commands []Command
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, fmt.Errorf("failed to decode commands: %w", err)
+	}
+	return commands, nil
+}
+
+// dispatch claims a command as sent, sends it to its target and reports the
+// result. A command already being dispatched, seen again by a poll while the
+// stream reconnects, is skipped, as is one the API won't let us claim.
+func (p *CommandPoller) dispatch(ctx context.Context, target config.Target, cmd Command) {
+	host := target.DeviceID()
+	// Skip empty commands
+	if cmd.Command == "" {
+		p.logger.Warn("skipping empty command", "device", cmd.Device)
+		return
+	}
+
+	key := fmt.Sprint(cmd.ID)
+	if cmd.ID == 0 {
+		key = host + "\x00" + cmd.Command // From an API without command IDs
+	}
+	p.mu.Lock()
+	if p.inflight[key] {
+		p.mu.Unlock()
+		p.logger.Debug("command already in flight", "command", cmd.Command, "host", host)
+		return
+	}
+	p.inflight[key] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, key)
+		p.mu.Unlock()
+	}()
+
+	sentAt := time.Now()
+	if err := p.updateCommandStatus(ctx, host, cmd, "sent", &CommandResult{}, sentAt); err != nil {
+		p.logger.Warn("not sending command that could not be claimed", "command", cmd.Command, "id", cmd.ID, "host", host, "error", err)
+		return
+	}
+
+	p.logger.Info("processing command", "command", cmd.Command, "id", cmd.ID, "host", host)
+	var result *CommandResult
+	var err error
+	if sender, ok := p.senders[target.Protocol]; ok {
+		result, err = sender.SendCommand(ctx, target, cmd)
+	} else {
+		result, err = SendCommand(ctx, target, cmd, p.reply)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
+		result = &CommandResult{Message: err.Error()}
+	}
+	status := "completed"
+	if result.Success {
+		p.logger.Info("successfully sent command", "command", cmd.Command, "id", cmd.ID, "host", host)
+	} else {
+		status = "failed"
+		p.logger.Error("command failed", "command", cmd.Command, "id", cmd.ID, "host", host, "error", result.Message)
 	}
+	commandResults.With(status).Inc()
 
-	// Construct HTTP POST request with JSON command
-	request := fmt.Sprintf("POST /cmd HTTP/1.0\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
-		len(jsonData), jsonData)
+	// A command cut short by Stop is still reported, on a context of its own
+	settleCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer cancel()
+	if err := p.updateCommandStatus(settleCtx, host, cmd, status, result, sentAt); err != nil {
+		p.logger.Error("failed to update command status", "error", err, "host", host)
+	}
+}
+
+// SendCommand sends cmd in the dialect of the target's protocol and reads the
+// result. The target's timeout covers connecting and sending, the device then
+// has replyTimeout to run the command and answer.
+func SendCommand(ctx context.Context, target config.Target, cmd Command, replyTimeout time.Duration) (*CommandResult, error) {
+	adapter, ok := commandAdapters[target.Protocol]
+	if !ok {
+		return nil, fmt.Errorf("protocol %s takes no commands", target.Protocol)
+	}
+	request, err := adapter.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect to device
+	timeout := time.Duration(target.Timeout) * time.Second
+	conn, err := dialDevice(ctx, target.Addr(), timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
 
 	// Send request
-	if _, err = conn.Write([]byte(request)); err != nil {
-		return fmt.Errorf("failed to send command: %w", err)
+	if _, err = conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(replyTimeout)); err != nil {
+		return nil, err
 	}
 
-	// Read response
-	response := make([]byte, 1024)
-	n, err := conn.Read(response)
+	// Read the whole response, fetched file content can span many segments
+	body, resp, err := readResponse(bufio.NewReader(conn))
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp != nil {
+		defer resp.Body.Close()
 	}
 
-	// Check response status
-	resp := string(response[:n])
-	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK") && !strings.HasPrefix(resp, "HTTP/1.0 200 OK") {
-		return fmt.Errorf("unexpected response: %s", resp)
+	result, err := adapter.result(cmd, &reply{resp: resp, body: body, conn: conn, timeout: replyTimeout})
+	if err != nil {
+		return nil, err
 	}
+	return checkResultID(cmd, result)
+}
 
-	return nil
+// checkResultID rejects a result for another command, daemons that predate
+// command IDs don't echo one
+func checkResultID(cmd Command, result *CommandResult) (*CommandResult, error) {
+	if result.ID != 0 && result.ID != cmd.ID {
+		return nil, fmt.Errorf("device answered command %d instead of %d", result.ID, cmd.ID)
+	}
+	return result, nil
 }
 
-func (p *CommandPoller) updateCommandStatus(device, command, status string) error {
+// updateCommandStatus reports a command as sent or its result to the API,
+// retrying transient failures
+func (p *CommandPoller) updateCommandStatus(ctx context.Context, device string, cmd Command, status string, result *CommandResult, sentAt time.Time) error {
 	// Create JSON payload
 	payload := struct {
-		Device  string `json:"device"`
-		Command string `json:"command"`
-		Status  string `json:"status"`
+		ID          uint   `json:"id,omitempty"`
+		Device      string `json:"device"`
+		Command     string `json:"command"`
+		Status      string `json:"status"`
+		Message     string `json:"message,omitempty"`
+		Output      []byte `json:"output,omitempty"`
+		SentAt      string `json:"sent_at"`
+		CompletedAt string `json:"completed_at,omitempty"`
 	}{
+		ID:      cmd.ID,
 		Device:  device,
-		Command: command,
+		Command: cmd.Command,
 		Status:  status,
+		Message: result.Message,
+		Output:  result.Output,
+		SentAt:  sentAt.UTC().Format(time.RFC3339),
+	}
+	if status != "sent" {
+		payload.CompletedAt = time.Now().UTC().Format(time.RFC3339)
 	}
 
 	jsonData, err := json.Marshal(payload)
@@ -188,22 +389,35 @@ func (p *CommandPoller) updateCommandStatus(device, command, status string) erro
 		return fmt.Errorf("failed to marshal command status: %w", err)
 	}
 
-	// Send request to update command status
-	req, err := http.NewRequest("POST", p.cfg.Telemetry.Server+"/api/command/status", strings.NewReader(string(jsonData)))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
+	err = retry.Do(ctx, p.policy, func(ctx context.Context) error {
+		// Send request to update command status
+		req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.Telemetry.Server+"/api/command/status", bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	resp, err := p.client.Do(req)
+		resp, err := p.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			return retry.Retryable(fmt.Errorf("failed to update command status: %w", err))
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound {
+			return errCommandSettled
+		}
+		return retry.CheckResponse(resp)
+	})
+	if errors.Is(err, errCommandSettled) {
+		return err
+	}
 	if err != nil {
+		commandStatusDrops.Inc()
 		return fmt.Errorf("failed to update command status: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to update command status, status code: %d", resp.StatusCode)
-	}
 
 	return nil
 }
@@ -0,0 +1,171 @@
+package poller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+)
+
+const (
+	// streamRetryInterval is how long to poll before trying a stream that failed to open again
+	streamRetryInterval = 30 * time.Second
+	// streamIdleTimeout drops a stream that went quiet, the API pings every 15 seconds
+	streamIdleTimeout   = 45 * time.Second
+	maxStreamEventBytes = 8 << 20
+)
+
+var (
+	errTargetsChanged = errors.New("targets changed")
+	errStreamIdle     = errors.New("no data or ping within the idle timeout")
+)
+
+// run streams commands, polling in between while the stream is down
+func (p *CommandPoller) run(ctx context.Context) {
+	for {
+		targets := p.commandTargets()
+		if len(targets) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.interval):
+				continue
+			}
+		}
+
+		connected, err := p.streamCommands(ctx, targets)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A poll covers commands queued while reconnecting
+		wait := p.interval
+		switch {
+		case !connected:
+			p.logger.Warn("command stream unavailable, polling instead", "error", err, "retry", streamRetryInterval)
+			wait = streamRetryInterval
+		case errors.Is(err, errTargetsChanged):
+			p.logger.Debug("targets changed, reopening command stream")
+		default:
+			p.logger.Warn("command stream closed, reconnecting", "error", err)
+		}
+		p.pollCommands(ctx)
+		p.pollEvery(ctx, wait)
+	}
+}
+
+// streamCommands holds a stream of commands for targets open and dispatches
+// each command as it arrives. It returns when the stream ends, reporting
+// whether it was open at all.
+func (p *CommandPoller) streamCommands(ctx context.Context, targets map[string]config.Target) (bool, error) {
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(streamCtx, "GET", p.cfg.Telemetry.Server+"/api/command/stream", nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	hosts := slices.Sorted(maps.Keys(targets))
+	for _, host := range hosts {
+		req.Header.Add("X-DeviceID", host)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := p.stream.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return false, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	p.logger.Info("command stream open", "targets", len(hosts))
+
+	// Reopen with the new set when the targets change
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-streamCtx.Done():
+				return
+			case <-ticker.C:
+				if !slices.Equal(hosts, slices.Sorted(maps.Keys(p.commandTargets()))) {
+					cancel(errTargetsChanged)
+					return
+				}
+			}
+		}
+	}()
+
+	idle := time.AfterFunc(streamIdleTimeout, func() { cancel(errStreamIdle) })
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxStreamEventBytes)
+	var event, data string
+	for scanner.Scan() {
+		idle.Reset(streamIdleTimeout)
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if event == "command" {
+				p.handleStreamedCommand(ctx, targets, data)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// Comment, the API's keepalive ping
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if data != "" {
+					data += "\n"
+				}
+				data += value
+			}
+		}
+	}
+
+	if cause := context.Cause(streamCtx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return true, cause
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("stream ended")
+}
+
+// handleStreamedCommand dispatches a command in the background, so a slow
+// device does not hold up commands for the others. It outlives the stream.
+func (p *CommandPoller) handleStreamedCommand(ctx context.Context, targets map[string]config.Target, data string) {
+	var cmd Command
+	if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+		p.logger.Error("failed to decode streamed command", "error", err)
+		return
+	}
+	target, ok := targets[cmd.Device]
+	if !ok {
+		p.logger.Warn("streamed command for unknown target", "device", cmd.Device)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.dispatch(ctx, target, cmd)
+	}()
+}
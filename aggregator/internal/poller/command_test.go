@@ -0,0 +1,359 @@
+package poller_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/fakedevice"
+	"github.com/bxrne/beacon/aggregator/internal/poller"
+	"github.com/charmbracelet/log"
+)
+
+// TEST: GIVEN an API that streams a command for a daemon target
+// WHEN the command poller runs
+// THEN the command should reach the daemon and its status should be reported
+func TestCommandPoller_Streams(t *testing.T) {
+	daemon, target := fakeDaemon(t)
+	defer daemon.Close()
+
+	api := newFakeAPI(t, true)
+	defer api.Close()
+
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{target} }, quietLogger())
+	p.Start(context.Background())
+	defer p.Stop()
+
+	api.queue(target.DeviceID(), "reboot")
+	if status := api.waitStatus(t); status.ID != 1 || status.Status != "sent" {
+		t.Errorf("Expected the command to be claimed first, got %+v", status)
+	}
+	status := api.waitStatus(t)
+	if status.ID != 1 || status.Device != target.DeviceID() || status.Command != "reboot" || status.Status != "completed" || status.CompletedAt == "" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if api.polls() != 0 {
+		t.Errorf("Expected no polling while the stream is open, got %d polls", api.polls())
+	}
+}
+
+// TEST: GIVEN an API without the command stream
+// WHEN the command poller runs
+// THEN it should fall back to polling and still deliver the command
+func TestCommandPoller_FallsBackToPolling(t *testing.T) {
+	daemon, target := fakeDaemon(t)
+	defer daemon.Close()
+
+	api := newFakeAPI(t, false)
+	defer api.Close()
+	api.queue(target.DeviceID(), "notify")
+
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{target} }, quietLogger())
+	p.Start(context.Background())
+	defer p.Stop()
+
+	api.waitStatus(t) // Sent
+	if status := api.waitStatus(t); status.Command != "notify" || status.Status != "completed" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+// TEST: GIVEN an API that refuses to let a command be claimed
+// WHEN the command is delivered
+// THEN it should not reach the daemon
+func TestCommandPoller_SkipsUnclaimed(t *testing.T) {
+	daemon, target := fakeDaemon(t)
+	defer daemon.Close()
+
+	api := newFakeAPI(t, true)
+	api.refuse = true
+	defer api.Close()
+
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{target} }, quietLogger())
+	p.Start(context.Background())
+
+	api.queue(target.DeviceID(), "reboot")
+	api.waitStatus(t)
+	p.Stop()
+
+	select {
+	case status := <-api.statuses:
+		t.Errorf("Expected no result for an unclaimed command, got %+v", status)
+	default:
+	}
+}
+
+// TEST: GIVEN a fake daemon and a fake diorama
+// WHEN known and unknown commands are streamed to each
+// THEN each should get the command in its own encoding and the results should be reported
+func TestCommandPoller_Adapters(t *testing.T) {
+	daemon, daemonTarget := fakeDaemon(t)
+	defer daemon.Close()
+	diorama, err := fakedevice.NewDiorama()
+	if err != nil {
+		t.Fatalf("Failed to start fake diorama: %v", err)
+	}
+	defer diorama.Close()
+	dioramaTarget := diorama.Target("diorama")
+
+	api := newFakeAPI(t, true)
+	defer api.Close()
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{daemonTarget, dioramaTarget} }, quietLogger())
+	p.Start(context.Background())
+	defer p.Stop()
+
+	tests := []struct {
+		target  config.Target
+		command string
+		status  string
+		message string
+	}{
+		{daemonTarget, "reboot", "completed", "Rebooting device"},
+		{daemonTarget, "dance", "failed", "400 Bad Request: Unknown command"},
+		{dioramaTarget, "reboot", "completed", "Rebooting device..."},
+		{dioramaTarget, "dance", "failed", "400 Bad Request: Unknown command"},
+	}
+	for _, tt := range tests {
+		api.queue(tt.target.DeviceID(), tt.command)
+		api.waitStatus(t) // Sent
+		status := api.waitStatus(t)
+		if status.Status != tt.status || status.Message != tt.message {
+			t.Errorf("%s %s: expected %s %q, got %s %q", tt.target.Name, tt.command, tt.status, tt.message, status.Status, status.Message)
+		}
+	}
+
+	got := daemon.Commands()
+	if len(got) != 2 || got[0].Command != "reboot" || got[0].ID == 0 {
+		t.Errorf("Expected the daemon to get JSON commands with IDs, got %+v", got)
+	}
+	got = diorama.Commands()
+	if len(got) != 2 || got[0].Command != "reboot" || got[1].Command != "dance" {
+		t.Errorf("Expected the diorama to get bare command bodies, got %+v", got)
+	}
+}
+
+// TEST: GIVEN a daemon target with a one second timeout and a command that takes longer to run
+// WHEN the command is delivered
+// THEN the poller should wait for the reply and report the command completed
+func TestCommandPoller_WaitsForSlowCommands(t *testing.T) {
+	daemon, target := fakeDaemon(t)
+	defer daemon.Close()
+	daemon.CommandDelay = 1500 * time.Millisecond
+	target.Timeout = 1
+
+	api := newFakeAPI(t, true)
+	defer api.Close()
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{target} }, quietLogger())
+	p.Start(context.Background())
+	defer p.Stop()
+
+	api.queue(target.DeviceID(), "notify")
+	api.waitStatus(t) // Sent
+	if status := api.waitStatus(t); status.Status != "completed" {
+		t.Errorf("Expected the slow command to complete, got %+v", status)
+	}
+}
+
+// TEST: GIVEN an API without the command stream and commands for a slow and a fast daemon
+// WHEN the command poller falls back to polling
+// THEN the fast daemon's command should complete without waiting for the slow one
+func TestCommandPoller_PollingDoesNotWaitForSlowDevices(t *testing.T) {
+	slow, slowTarget := fakeDaemon(t)
+	defer slow.Close()
+	slow.CommandDelay = 3 * time.Second
+	fast, fastTarget := fakeDaemon(t)
+	defer fast.Close()
+
+	api := newFakeAPI(t, false)
+	defer api.Close()
+	api.queue(slowTarget.DeviceID(), "notify")
+	api.queue(fastTarget.DeviceID(), "notify")
+
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{slowTarget, fastTarget} }, quietLogger())
+	start := time.Now()
+	p.Start(context.Background())
+	defer p.Stop()
+
+	for {
+		status := api.waitStatus(t)
+		if status.Status != "completed" {
+			continue
+		}
+		if status.Device != fastTarget.DeviceID() {
+			t.Fatalf("Expected the fast daemon to complete first, got %+v", status)
+		}
+		break
+	}
+	if elapsed := time.Since(start); elapsed >= slow.CommandDelay {
+		t.Errorf("Expected the fast command to complete before the slow one could, took %s", elapsed)
+	}
+}
+
+// TEST: GIVEN a command a slow daemon is still running
+// WHEN the command poller is stopped
+// THEN the command should still be reported failed rather than left sent
+func TestCommandPoller_SettlesOnStop(t *testing.T) {
+	daemon, target := fakeDaemon(t)
+	defer daemon.Close()
+	daemon.CommandDelay = 3 * time.Second
+
+	api := newFakeAPI(t, true)
+	defer api.Close()
+	p := poller.NewCommandPoller(api.config(), func() []config.Target { return []config.Target{target} }, quietLogger())
+	p.Start(context.Background())
+
+	api.queue(target.DeviceID(), "notify")
+	if status := api.waitStatus(t); status.Status != "sent" {
+		t.Fatalf("Expected the command sent, got %+v", status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(daemon.Commands()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the daemon to get the command")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Stop()
+	if status := api.waitStatus(t); status.ID != 1 || status.Status != "failed" || status.Message == "" {
+		t.Errorf("Expected the command reported failed, got %+v", status)
+	}
+}
+
+type commandStatus struct {
+	ID          uint   `json:"id"`
+	Message     string `json:"message"`
+	CompletedAt string `json:"completed_at"`
+	Device      string `json:"device"`
+	Command     string `json:"command"`
+	Status      string `json:"status"`
+}
+
+type fakeAPI struct {
+	*httptest.Server
+	mu       sync.Mutex
+	pending  []poller.Command
+	wake     chan struct{}
+	statuses chan commandStatus
+	polled   int
+	nextID   uint
+	refuse   bool // Answer every status update with a conflict
+}
+
+func newFakeAPI(t *testing.T, stream bool) *fakeAPI {
+	api := &fakeAPI{wake: make(chan struct{}, 1), statuses: make(chan commandStatus, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/command", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.polled++
+		json.NewEncoder(w).Encode(api.take(r.Header.Get("X-DeviceID")))
+	})
+	if stream {
+		mux.HandleFunc("GET /api/command/stream", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-api.wake:
+				}
+				api.mu.Lock()
+				for _, device := range r.Header.Values("X-DeviceID") {
+					for _, cmd := range api.take(device) {
+						data, _ := json.Marshal(cmd)
+						fmt.Fprintf(w, "event: command\ndata: %s\n\n", data)
+					}
+				}
+				api.mu.Unlock()
+				w.(http.Flusher).Flush()
+			}
+		})
+	}
+	mux.HandleFunc("POST /api/command/status", func(w http.ResponseWriter, r *http.Request) {
+		var status commandStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			t.Errorf("Failed to decode status: %v", err)
+		}
+		api.statuses <- status
+		if api.refuse {
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+	api.Server = httptest.NewServer(mux)
+	return api
+}
+
+func (a *fakeAPI) config() *config.Config {
+	return &config.Config{
+		Telemetry: config.Telemetry{Server: a.URL, RetryInterval: 1, Timeout: 5},
+		Commands:  config.Commands{Interval: 1},
+	}
+}
+
+func (a *fakeAPI) queue(device, command string) {
+	a.mu.Lock()
+	a.nextID++
+	a.pending = append(a.pending, poller.Command{ID: a.nextID, Device: device, Command: command})
+	a.mu.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and forgets the pending commands of a device, callers hold mu
+func (a *fakeAPI) take(device string) []poller.Command {
+	var out, keep []poller.Command
+	for _, cmd := range a.pending {
+		if cmd.Device == device {
+			out = append(out, cmd)
+		} else {
+			keep = append(keep, cmd)
+		}
+	}
+	a.pending = keep
+	if out == nil {
+		out = []poller.Command{}
+	}
+	return out
+}
+
+func (a *fakeAPI) polls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.polled
+}
+
+func (a *fakeAPI) waitStatus(t *testing.T) commandStatus {
+	t.Helper()
+	select {
+	case status := <-a.statuses:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a command status")
+		return commandStatus{}
+	}
+}
+
+// fakeDaemon runs a fake daemon and returns its target
+func fakeDaemon(t *testing.T) (*fakedevice.Daemon, config.Target) {
+	t.Helper()
+	d, err := fakedevice.NewDaemon()
+	if err != nil {
+		t.Fatalf("Failed to start fake daemon: %v", err)
+	}
+	return d, d.Target("daemon")
+}
+
+func quietLogger() *log.Logger {
+	return log.NewWithOptions(os.Stderr, log.Options{Level: log.FatalLevel})
+}
@@ -0,0 +1,396 @@
+package poller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/discovery"
+	"github.com/bxrne/beacon/aggregator/internal/pipeline"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+	"github.com/bxrne/beacon/aggregator/pkg/mqtt"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+var mqttMessages = selfmetrics.NewCounterVec("aggregator_mqtt_messages", "count", "result")
+
+const (
+	// defaultMaxDevices bounds the devices tracked, any topic level can name one
+	defaultMaxDevices = 1000
+	// defaultDeviceTTL is how long a silent device is kept for commands
+	defaultDeviceTTL = time.Hour
+)
+
+var errNotConnected = errors.New("not connected to the MQTT broker")
+
+// Subscriber takes readings from devices that publish to an MQTT broker and
+// forwards them like polled metrics, through the labels and processors of
+// their subscription. Commands for the devices it has heard from are
+// published to their command topic.
+type Subscriber struct {
+	cfg        *config.Config
+	logger     *log.Logger
+	uploader   uploader.Submitter
+	subs       []subscription
+	policy     retry.Policy
+	owner      discovery.Owner // Optional, every device is ours without it
+	maxDevices int
+	deviceTTL  time.Duration
+
+	mu      sync.Mutex
+	client  *mqtt.Client // Nil while disconnected
+	devices map[string]*mqttDevice
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// subscription is a configured topic pattern ready for matching
+type subscription struct {
+	config.Subscription
+	filter string // The pattern with {device} as +
+	level  int    // Index of the {device} level, -1 for a fixed device
+}
+
+// mqttDevice is a device heard from, as a target for processors and commands
+type mqttDevice struct {
+	target config.Target
+	chain  *pipeline.Chain
+	seen   time.Time // Last message
+}
+
+func NewSubscriber(cfg *config.Config, uploader uploader.Submitter, logger *log.Logger) *Subscriber {
+	s := &Subscriber{
+		cfg:        cfg,
+		logger:     logger,
+		uploader:   uploader,
+		policy:     retry.NewPolicy(cfg.Telemetry),
+		maxDevices: cfg.MQTT.MaxDevices,
+		deviceTTL:  time.Duration(cfg.MQTT.DeviceTTL) * time.Second,
+		devices:    make(map[string]*mqttDevice),
+	}
+	if s.maxDevices <= 0 {
+		s.maxDevices = defaultMaxDevices
+	}
+	if s.deviceTTL <= 0 {
+		s.deviceTTL = defaultDeviceTTL
+	}
+	for _, sc := range cfg.MQTT.Subscriptions {
+		sub := subscription{Subscription: sc, level: -1}
+		levels := strings.Split(sc.Topic, "/")
+		for i, level := range levels {
+			if level == config.DeviceLevel {
+				sub.level, levels[i] = i, "+"
+			}
+		}
+		sub.filter = strings.Join(levels, "/")
+		s.subs = append(s.subs, sub)
+	}
+	return s
+}
+
+// SetOwner shares the devices with other aggregators, forwarding readings
+// and taking commands only for those owner grants. Call it before Start, and
+// ask the owner for the devices Wanted returns.
+func (s *Subscriber) SetOwner(owner discovery.Owner) {
+	s.owner = owner
+}
+
+// Start keeps a connection to the broker until ctx is done or Stop is
+// called, reconnecting with backoff when it drops
+func (s *Subscriber) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go s.run(ctx)
+}
+
+// Stop disconnects and waits for the connection to close
+func (s *Subscriber) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+func (s *Subscriber) run(ctx context.Context) {
+	defer close(s.done)
+	failures := 0
+	for {
+		connected, err := s.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			failures = 0
+		}
+		delay := s.policy.Delay(failures)
+		failures++
+		s.logger.Warnf("MQTT connection to %s lost, reconnecting in %s: %v", s.cfg.MQTT.Broker, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// session connects and subscribes, then holds the connection until it drops
+// or ctx is done, reporting whether it got as far as subscribing
+func (s *Subscriber) session(ctx context.Context) (bool, error) {
+	client, err := mqtt.Dial(ctx, s.cfg.MQTT.Broker, mqtt.Options{
+		ClientID:  s.cfg.MQTT.ClientID,
+		Username:  s.cfg.MQTT.Username,
+		Password:  s.cfg.MQTT.Password,
+		Timeout:   time.Duration(s.cfg.Telemetry.Timeout) * time.Second,
+		OnMessage: s.handle,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer client.Close()
+
+	filters := make([]mqtt.Subscription, len(s.subs))
+	for i, sub := range s.subs {
+		filters[i] = mqtt.Subscription{Filter: sub.filter, QoS: byte(s.cfg.MQTT.QoS)}
+	}
+	if err := client.Subscribe(ctx, filters...); err != nil {
+		return false, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	s.logger.Infof("Subscribed to %d topics on %s", len(filters), s.cfg.MQTT.Broker)
+
+	s.mu.Lock()
+	s.client = client
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.client = nil
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return true, nil
+	case <-client.Done():
+		return true, client.Err()
+	}
+}
+
+// handle forwards one message, called in order from the connection's reader
+func (s *Subscriber) handle(m mqtt.Message) {
+	sub, deviceID, ok := s.match(m.Topic)
+	if !ok {
+		mqttMessages.With("unmatched").Inc()
+		s.logger.Debugf("Ignoring MQTT message on %s", m.Topic)
+		return
+	}
+
+	dm, err := decodePayload(sub.Subscription, m.Payload, time.Now())
+	if err != nil {
+		mqttMessages.With("invalid").Inc()
+		s.logger.Errorf("Failed to decode MQTT message on %s: %v", m.Topic, err)
+		return
+	}
+	device, ok := s.device(deviceID, sub, time.Now())
+	if !ok {
+		mqttMessages.With("dropped").Inc()
+		s.logger.Debugf("Dropping MQTT message on %s, already tracking %d devices", m.Topic, s.maxDevices)
+		return
+	}
+	// Another aggregator forwards it, this one only asks for its lease
+	if !s.owns(deviceID) {
+		mqttMessages.With("unowned").Inc()
+		return
+	}
+	mqttMessages.With("ok").Inc()
+	if dm.Hostname == "" {
+		dm.Hostname = deviceID
+	}
+
+	addLabels(dm, device.target.Labels)
+	device.chain.Process(dm)
+	if len(dm.Metrics) > 0 {
+		s.uploader.Submit(uploader.Sample{DeviceID: deviceID, Metrics: dm})
+	}
+}
+
+// match finds the first subscription the topic matches and the device it names
+func (s *Subscriber) match(topic string) (subscription, string, bool) {
+	for _, sub := range s.subs {
+		if !mqtt.Match(sub.filter, topic) {
+			continue
+		}
+		if sub.level < 0 {
+			return sub, sub.Device, true
+		}
+		return sub, strings.Split(topic, "/")[sub.level], true
+	}
+	return subscription{}, "", false
+}
+
+func (s *Subscriber) owns(deviceID string) bool {
+	return s.owner == nil || s.owner.Owns(deviceID)
+}
+
+// device returns the state of a device, creating it on its first message
+// unless as many devices are already tracked
+func (s *Subscriber) device(id string, sub subscription, now time.Time) (*mqttDevice, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.devices[id]; ok {
+		d.seen = now
+		return d, true
+	}
+	s.expire(now)
+	if len(s.devices) >= s.maxDevices {
+		return nil, false
+	}
+	target := config.Target{
+		Name:     id,
+		Address:  id,
+		Protocol: config.ProtocolMQTT,
+		Labels:   sub.Labels,
+		Group:    sub.Group,
+		Enabled:  true,
+	}
+	d := &mqttDevice{target: target, chain: pipeline.New(s.cfg.Processors, target), seen: now}
+	s.devices[id] = d
+	s.logger.Infof("Receiving metrics from %s over MQTT", id)
+	return d, true
+}
+
+// expire forgets the devices silent for longer than the TTL, called with mu held
+func (s *Subscriber) expire(now time.Time) {
+	for id, d := range s.devices {
+		if now.Sub(d.seen) > s.deviceTTL {
+			delete(s.devices, id)
+			s.logger.Infof("Forgetting %s, no MQTT message for %s", id, s.deviceTTL)
+		}
+	}
+}
+
+// Wanted returns the IDs of the devices heard from, owned or not, sorted for
+// asking the owner for them
+func (s *Subscriber) Wanted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	return slices.Sorted(maps.Keys(s.devices))
+}
+
+// Targets returns the owned devices heard from, sorted by ID
+func (s *Subscriber) Targets() []config.Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	targets := make([]config.Target, 0, len(s.devices))
+	for _, id := range slices.Sorted(maps.Keys(s.devices)) {
+		if s.owns(id) {
+			targets = append(targets, s.devices[id].target)
+		}
+	}
+	return targets
+}
+
+// SendCommand publishes cmd as the daemon's JSON to the device's command
+// topic. It succeeds once the broker has taken the command, which says
+// nothing of whether the device has run it.
+func (s *Subscriber) SendCommand(ctx context.Context, target config.Target, cmd Command) (*CommandResult, error) {
+	if s.cfg.MQTT.CommandTopic == "" {
+		return nil, fmt.Errorf("no command_topic for MQTT devices")
+	}
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+	if client == nil {
+		return nil, errNotConnected
+	}
+
+	payload, err := json.Marshal(struct {
+		ID      uint            `json:"id,omitempty"`
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args,omitempty"`
+	}{cmd.ID, cmd.Command, cmd.Args})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %w", err)
+	}
+	topic := strings.ReplaceAll(s.cfg.MQTT.CommandTopic, config.DeviceLevel, target.DeviceID())
+	if err := client.Publish(ctx, mqtt.Message{Topic: topic, Payload: payload, QoS: byte(s.cfg.MQTT.QoS)}); err != nil {
+		return nil, fmt.Errorf("failed to publish command: %w", err)
+	}
+	return &CommandResult{Status: "success", Message: "Published to " + topic, Success: true}, nil
+}
+
+// decodePayload turns a message into metrics with the subscription's decoder
+func decodePayload(sub config.Subscription, payload []byte, now time.Time) (*metrics.DeviceMetrics, error) {
+	if sub.Decoder == config.DecoderBproto {
+		return decodeBproto(payload)
+	}
+	if len(sub.Mappings) > 0 {
+		return parseJSON(payload, sub.Mappings, now)
+	}
+
+	var dm metrics.DeviceMetrics
+	if err := json.Unmarshal(payload, &dm); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	recordedAt := now.UTC().Format(time.RFC3339)
+	for i := range dm.Metrics {
+		m := &dm.Metrics[i]
+		if m.Type == "" {
+			return nil, fmt.Errorf("metric %d has no type", i)
+		}
+		if m.RecordedAt == "" {
+			m.RecordedAt = recordedAt
+		}
+		if m.Unit == "" {
+			m.Unit = determineUnit(m.Type)
+		}
+	}
+	if len(dm.Metrics) == 0 {
+		return nil, fmt.Errorf("no metrics in payload")
+	}
+	return &dm, nil
+}
+
+// decodeBproto reads the text payload, or a whole frame for devices that
+// publish what they would serve
+func decodeBproto(payload []byte) (*metrics.DeviceMetrics, error) {
+	var dm *metrics.DeviceMetrics
+	var err error
+	if len(payload) > 0 && (payload[0] == bproto.StartByte || payload[0] == bproto.HeadingByte) {
+		frame, _, decodeErr := bproto.Decode(payload)
+		switch {
+		case decodeErr != nil:
+			return nil, fmt.Errorf("failed to decode frame: %w", decodeErr)
+		case frame.Type != bproto.TypeMetrics:
+			return nil, fmt.Errorf("unexpected frame type %d", frame.Type)
+		case frame.Version >= bproto.Version3:
+			dm, err = bproto.DecodeMetrics(frame)
+		default:
+			dm, err = parseMetrics(string(frame.Payload))
+		}
+	} else {
+		dm, err = parseMetrics(string(bytes.TrimSpace(payload)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(dm.Metrics) == 0 {
+		return nil, fmt.Errorf("no metrics in payload")
+	}
+	return dm, nil
+}
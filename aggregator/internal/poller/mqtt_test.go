@@ -0,0 +1,210 @@
+package poller_test
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/fakedevice"
+	"github.com/bxrne/beacon/aggregator/internal/poller"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+)
+
+// TEST: GIVEN subscriptions decoding JSON by mapping, the daemon's JSON and bproto text
+// WHEN devices publish readings to the broker
+// THEN each should be forwarded under its device ID with the subscription's labels and processors
+func TestSubscriber_Forwards(t *testing.T) {
+	broker := fakeBroker(t)
+	defer broker.Close()
+
+	cfg := mqttConfig(broker, []config.Subscription{
+		{Topic: "sensors/{device}/state", Decoder: config.DecoderJSON, Group: "field", Labels: map[string]string{"site": "north"},
+			Mappings: []config.Mapping{{Type: "temperature", Path: "$.temp", Unit: "celsius"}}},
+		{Topic: "daemons/{device}", Decoder: config.DecoderJSON},
+		{Topic: "legacy/+/text", Device: "greenhouse", Decoder: config.DecoderBproto},
+	})
+	cfg.Processors = []config.Processor{{Type: config.ProcessorLabel, Groups: []string{"field"}, Labels: map[string]string{"power": "battery"}}}
+
+	out := newSampleRecorder()
+	s := poller.NewSubscriber(cfg, out, quietLogger())
+	s.Start(context.Background())
+	defer s.Stop()
+	waitSubscribed(t, broker, "legacy/+/text")
+
+	broker.Publish("sensors/s1/state", []byte(`{"temp": 21.5, "rssi": -70}`))
+	broker.Publish("daemons/pi", []byte(`{"hostname": "pi.local", "metrics": [{"type": "uptime", "value": "10"}]}`))
+	broker.Publish("legacy/gh/text", []byte("car_light: green, recorded_at: 2026-01-02T03:04:05Z"))
+	broker.Publish("sensors/s1/state", []byte(`not json`))
+
+	got := map[string]uploader.Sample{}
+	for range 3 {
+		sample := out.wait(t)
+		got[sample.DeviceID] = sample
+	}
+
+	m := got["s1"].Metrics
+	if m == nil || m.Hostname != "s1" || len(m.Metrics) != 1 || m.Metrics[0].Value != "21.5" || m.Metrics[0].Unit != "celsius" ||
+		m.Metrics[0].Labels["site"] != "north" || m.Metrics[0].Labels["power"] != "battery" {
+		t.Errorf("Unexpected metrics from s1: %+v", m)
+	}
+	m = got["pi"].Metrics
+	if m == nil || m.Hostname != "pi.local" || m.Metrics[0].Unit != "seconds" || m.Metrics[0].RecordedAt == "" || m.Metrics[0].Labels != nil {
+		t.Errorf("Unexpected metrics from pi: %+v", m)
+	}
+	m = got["greenhouse"].Metrics
+	if m == nil || m.Metrics[0].Type != "car_light" || m.Metrics[0].Value != "green" || m.Metrics[0].RecordedAt != "2026-01-02T03:04:05Z" {
+		t.Errorf("Unexpected metrics from greenhouse: %+v", m)
+	}
+
+	targets := s.Targets()
+	if len(targets) != 3 || targets[2].DeviceID() != "s1" || targets[2].Protocol != config.ProtocolMQTT {
+		t.Errorf("Expected the three devices heard from as targets, got %+v", targets)
+	}
+}
+
+// TEST: GIVEN a device heard from over MQTT and a command queued for it in the API
+// WHEN the command poller delivers through the subscriber
+// THEN the command should be published to the device's command topic and reported completed
+func TestSubscriber_PublishesCommands(t *testing.T) {
+	broker := fakeBroker(t)
+	defer broker.Close()
+
+	cfg := mqttConfig(broker, []config.Subscription{{Topic: "sensors/{device}/state", Decoder: config.DecoderBproto}})
+	cfg.MQTT.CommandTopic = "sensors/{device}/cmd"
+	cfg.MQTT.QoS = 1
+
+	out := newSampleRecorder()
+	s := poller.NewSubscriber(cfg, out, quietLogger())
+	s.Start(context.Background())
+	defer s.Stop()
+	waitSubscribed(t, broker, "sensors/+/state")
+	broker.Publish("sensors/s1/state", []byte("uptime: 5"))
+	out.wait(t)
+
+	api := newFakeAPI(t, true)
+	defer api.Close()
+	p := poller.NewCommandPoller(api.config(), s.Targets, quietLogger())
+	p.SetSender(config.ProtocolMQTT, s)
+	p.Start(context.Background())
+	defer p.Stop()
+
+	api.queue("s1", "reboot")
+	api.waitStatus(t) // Sent
+	if status := api.waitStatus(t); status.Status != "completed" || status.Message != "Published to sensors/s1/cmd" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	published := broker.Published()
+	if len(published) != 1 || published[0].Topic != "sensors/s1/cmd" || published[0].QoS != 1 {
+		t.Fatalf("Expected one QoS 1 command on sensors/s1/cmd, got %+v", published)
+	}
+	var cmd poller.Command
+	if err := json.Unmarshal(published[0].Payload, &cmd); err != nil || cmd.ID != 1 || cmd.Command != "reboot" {
+		t.Errorf("Unexpected command payload %s: %v", published[0].Payload, err)
+	}
+}
+
+// TEST: GIVEN a subscriber sharing devices with other aggregators and tracking at most two
+// WHEN three devices publish, only one of them leased to this aggregator
+// THEN only the leased device should be forwarded and offered commands, the third dropped, and both forgotten once silent
+func TestSubscriber_LeasesAndBoundsDevices(t *testing.T) {
+	broker := fakeBroker(t)
+	defer broker.Close()
+
+	cfg := mqttConfig(broker, []config.Subscription{{Topic: "sensors/{device}/state", Decoder: config.DecoderBproto}})
+	cfg.MQTT.MaxDevices, cfg.MQTT.DeviceTTL = 2, 1
+
+	out := newSampleRecorder()
+	s := poller.NewSubscriber(cfg, out, quietLogger())
+	s.SetOwner(ownerOf{"s1": true})
+	s.Start(context.Background())
+	defer s.Stop()
+	waitSubscribed(t, broker, "sensors/+/state")
+
+	// Messages are handled in order, so s1's second sample follows the others
+	broker.Publish("sensors/s2/state", []byte("uptime: 5"))
+	broker.Publish("sensors/s1/state", []byte("uptime: 5"))
+	broker.Publish("sensors/s3/state", []byte("uptime: 5"))
+	broker.Publish("sensors/s1/state", []byte("uptime: 6"))
+	for range 2 {
+		if sample := out.wait(t); sample.DeviceID != "s1" {
+			t.Fatalf("Expected only s1 forwarded, got %s", sample.DeviceID)
+		}
+	}
+	select {
+	case sample := <-out.samples:
+		t.Errorf("Expected nothing else forwarded, got %s", sample.DeviceID)
+	default:
+	}
+
+	if wanted := s.Wanted(); !slices.Equal(wanted, []string{"s1", "s2"}) {
+		t.Errorf("Expected s1 and s2 wanted and s3 dropped, got %v", wanted)
+	}
+	if targets := s.Targets(); len(targets) != 1 || targets[0].DeviceID() != "s1" {
+		t.Errorf("Expected only s1 offered commands, got %+v", targets)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if wanted := s.Wanted(); len(wanted) != 0 {
+		t.Errorf("Expected silent devices forgotten, got %v", wanted)
+	}
+}
+
+// ownerOf owns the device IDs set in it
+type ownerOf map[string]bool
+
+func (o ownerOf) Owns(deviceID string) bool { return o[deviceID] }
+
+type sampleRecorder struct {
+	samples chan uploader.Sample
+}
+
+func newSampleRecorder() *sampleRecorder {
+	return &sampleRecorder{samples: make(chan uploader.Sample, 10)}
+}
+
+func (r *sampleRecorder) Submit(s uploader.Sample) bool {
+	r.samples <- s
+	return true
+}
+
+func (r *sampleRecorder) wait(t *testing.T) uploader.Sample {
+	t.Helper()
+	select {
+	case s := <-r.samples:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a sample")
+		return uploader.Sample{}
+	}
+}
+
+func fakeBroker(t *testing.T) *fakedevice.Broker {
+	t.Helper()
+	b, err := fakedevice.NewBroker()
+	if err != nil {
+		t.Fatalf("Failed to start fake broker: %v", err)
+	}
+	return b
+}
+
+func mqttConfig(broker *fakedevice.Broker, subs []config.Subscription) *config.Config {
+	return &config.Config{
+		Telemetry: config.Telemetry{RetryInterval: 1, Timeout: 5},
+		MQTT:      config.MQTT{Broker: broker.Addr(), Subscriptions: subs},
+	}
+}
+
+func waitSubscribed(t *testing.T, broker *fakedevice.Broker, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !broker.Subscribed(filter) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a subscription to %s", filter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
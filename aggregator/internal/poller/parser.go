@@ -7,24 +7,8 @@ import (
 	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
 )
 
-func parseMetrics(response []byte) (*metrics.DeviceMetrics, error) {
-	// Find the payload after HTTP headers
-	parts := strings.Split(string(response), "\r\n\r\n")
-
-	var payload string
-	if len(parts) > 1 {
-		payload = parts[1]
-	} else {
-		payload = parts[0]
-	}
-	// Remove STX, length byte, and ETX
-	payload = payload[2 : len(payload)-1]
-
-	// Remove the end byte if it exists
-	if len(payload) > 0 && payload[len(payload)-1] == 0x03 {
-		payload = payload[:len(payload)-1]
-	}
-
+// parseMetrics parses a decoded bproto text payload: "key: value, key: value, recorded_at: time"
+func parseMetrics(payload string) (*metrics.DeviceMetrics, error) {
 	// Parse the key-value pairs
 	pairs := strings.Split(payload, ", ")
 	result := &metrics.DeviceMetrics{
@@ -33,14 +17,11 @@ func parseMetrics(response []byte) (*metrics.DeviceMetrics, error) {
 
 	var recordedAt string
 	for _, pair := range pairs {
-		parts := strings.Split(pair, ": ")
-		if len(parts) != 2 {
+		key, value, ok := strings.Cut(pair, ": ")
+		if !ok {
 			continue
 		}
 
-		key := parts[0]
-		value := parts[1]
-
 		// Handle recorded_at separately
 		if key == "recorded_at" {
 			recordedAt = value
@@ -76,6 +57,14 @@ func determineUnit(metricType string) string {
 		return "percent"
 	case "uptime":
 		return "seconds"
+	case "battery_percent", "battery_health":
+		return "percent"
+	case "battery_time_to_empty":
+		return "seconds"
+	case "battery_state":
+		return "state"
+	case "ac_online":
+		return "boolean"
 	case "car_light":
 		return "color"
 	case "ped_light":
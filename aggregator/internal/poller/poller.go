@@ -1,125 +1,263 @@
 package poller
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
 	"time"
 
-	"github.com/bxrne/beacon/aggregator/internal/bproto"
 	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/health"
 	"github.com/bxrne/beacon/aggregator/internal/logger"
+	"github.com/bxrne/beacon/aggregator/internal/pipeline"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
 	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
 	"github.com/charmbracelet/log"
 )
 
-// Poller is a service that will send request objects at a frequency to a host
+var (
+	pollDuration = selfmetrics.NewHistogramVec("aggregator_poll_duration_seconds", "seconds", selfmetrics.DefaultBuckets, "target")
+	pollResults  = selfmetrics.NewCounterVec("aggregator_polls", "count", "target", "result")
+	lastSuccess  = selfmetrics.NewGaugeVec("aggregator_last_success_timestamp_seconds", "seconds", "target")
+)
+
+// Poller is a service that will send request objects at a frequency to a target
 type Poller struct {
-	Host      string
-	Port      string
-	Frequency int
-	logger    *log.Logger
-	cfg       *config.Config
+	Target   config.Target
+	logger   *log.Logger
+	cfg      *config.Config
+	uploader uploader.Submitter
+	health   *health.Tracker
+	chain    *pipeline.Chain
+	window   *pipeline.Window // Nil when every poll is uploaded
+	trigger  chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
 }
 
-func NewPoller(host, port string, frequency int, cfg *config.Config) *Poller {
+func NewPoller(target config.Target, cfg *config.Config, uploader uploader.Submitter, health *health.Tracker) *Poller {
 	log := logger.NewLogger(cfg)
-	return &Poller{
-		Host:      host,
-		Port:      port,
-		Frequency: frequency,
-		logger:    log,
-		cfg:       cfg,
+	p := &Poller{
+		Target:   target,
+		logger:   log,
+		cfg:      cfg,
+		uploader: uploader,
+		health:   health,
+		chain:    pipeline.New(cfg.Processors, target),
+		trigger:  make(chan struct{}, 1),
 	}
+	if target.Window > 0 {
+		p.window = pipeline.NewWindow(time.Duration(target.Window)*time.Second, p.chain.Events()...)
+	}
+	return p
 }
 
-// Start begins the polling process
-func (p *Poller) Start() {
+// Start polls in the background until ctx is done or Stop is called
+func (p *Poller) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	go p.run(ctx)
+}
+
+// run polls once straight away and then on every tick. A ticker keeps the
+// schedule fixed however long a poll takes, slow polls skip ticks rather than
+// queueing them.
+func (p *Poller) run(ctx context.Context) {
+	defer close(p.done)
+	if p.window != nil {
+		defer func() { p.submit(p.window.Flush()) }()
+	}
+
+	ticker := time.NewTicker(time.Duration(p.Target.Interval) * time.Second)
+	defer ticker.Stop()
+
 	for {
-		p.sendRequest()
-		time.Sleep(time.Duration(p.Frequency) * time.Second)
+		start := time.Now()
+		err := p.sendRequest(ctx)
+		if ctx.Err() != nil {
+			return // Cut short by shutdown, not the device's fault
+		}
+		pollDuration.With(p.Target.Name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			pollResults.With(p.Target.Name, "error").Inc()
+			p.logger.Errorf("Failed to poll %s: %v", p.Target.Name, err)
+		} else {
+			pollResults.With(p.Target.Name, "success").Inc()
+			lastSuccess.With(p.Target.Name).Set(time.Now().Unix())
+		}
+		p.health.Observe(p.Target.DeviceID(), err)
+		if p.window != nil {
+			p.submit(p.window.Tick(time.Now()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.trigger:
+		}
 	}
 }
 
-// sendRequest sends to host
-func (p *Poller) sendRequest() {
-	conn, err := net.Dial("tcp", net.JoinHostPort(p.Host, p.Port))
-	if err != nil {
-		p.logger.Errorf("Failed to connect to %s:%s: %v\n", p.Host, p.Port, err)
-		return
+// PollNow polls straight away instead of waiting for the next tick. A poll
+// already requested or in flight absorbs the request.
+func (p *Poller) PollNow() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
 	}
-	defer conn.Close()
+}
 
-	// Send GET /metric request
-	request := "GET /metric HTTP/1.0\r\n\r\n"
-	_, err = conn.Write([]byte(request))
+// sendRequest polls the target and queues the reply for upload
+func (p *Poller) sendRequest(ctx context.Context) error {
+	frame, deviceMetrics, err := fetchMetrics(ctx, p.Target, nil)
 	if err != nil {
-		p.logger.Errorf("Failed to send request to %s:%s: %v", p.Host, p.Port, err)
-		return
+		return err
 	}
-
-	// Receive response
-	response := make([]byte, 1024)
-	n, err := conn.Read(response)
-	if err != nil {
-		p.logger.Errorf("Failed to read response from %s:%s: %v", p.Host, p.Port, err)
-		return
+	if frame != nil {
+		p.logger.Debugf("Received v%d frame with %d byte payload from %s", frame.Version, len(frame.Payload), p.Target.Name)
 	}
 
-	_, err = bproto.ParseResponse(response)
-	if err != nil {
-		p.logger.Errorf("Failed to parse response from %s:%s: %v", p.Host, p.Port, err)
-		return
+	addLabels(deviceMetrics, p.Target.Labels)
+	p.chain.Process(deviceMetrics)
+	if p.window != nil {
+		deviceMetrics = p.window.Add(deviceMetrics)
 	}
+	p.submit(deviceMetrics)
+	return nil
+}
 
-	p.logger.Debugf("Received %d bytes from %s:%s", n, p.Host, p.Port)
+// Probe is one poll of a target with everything seen along the way
+type Probe struct {
+	Raw     []byte                 // The reply as received, headers included
+	Frame   *bproto.Frame          // Nil for targets that don't speak bproto
+	Metrics *metrics.DeviceMetrics // Before labels and processors
+}
 
-	metrics, err := parseMetrics(response)
-	if err != nil {
-		p.logger.Errorf("Failed to parse metrics from %s:%s: %v", p.Host, p.Port, err)
-		return
-	}
+// ProbeTarget polls a target once without uploading anything, for debugging
+// a device. The raw reply is kept even when the poll fails.
+func ProbeTarget(ctx context.Context, target config.Target) (*Probe, error) {
+	var raw bytes.Buffer
+	frame, dm, err := fetchMetrics(ctx, target, &raw)
+	return &Probe{Raw: raw.Bytes(), Frame: frame, Metrics: dm}, err
+}
 
-	if err := p.sendMetricsToAPI(metrics); err != nil {
-		p.logger.Errorf("Failed to send metrics to API: %v", err)
-		return
+// fetchMetrics asks a target for its metrics, copying the reply to raw
+// unless it is nil. The frame is nil for targets that don't speak bproto.
+func fetchMetrics(ctx context.Context, target config.Target, raw io.Writer) (*bproto.Frame, *metrics.DeviceMetrics, error) {
+	var body []byte
+	var dm *metrics.DeviceMetrics
+	var err error
+	switch target.Protocol {
+	case config.ProtocolPrometheus:
+		if body, err = scrape(ctx, target, defaultPrometheusPath, prometheusAccept, raw); err == nil {
+			dm, err = parsePrometheus(body, time.Now())
+		}
+	case config.ProtocolHTTPJSON:
+		if body, err = scrape(ctx, target, defaultJSONPath, "application/json", raw); err == nil {
+			dm, err = parseJSON(body, target.Mappings, time.Now())
+		}
+	default:
+		return fetchFrame(ctx, target, raw)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
+	dm.Hostname = target.Address
+	return nil, dm, nil
 }
 
-func (p *Poller) sendMetricsToAPI(metrics *metrics.DeviceMetrics) error {
-	jsonData, err := json.Marshal(metrics)
+// fetchFrame polls a device that answers with a bproto frame
+func fetchFrame(ctx context.Context, target config.Target, raw io.Writer) (*bproto.Frame, *metrics.DeviceMetrics, error) {
+	timeout := time.Duration(target.Timeout) * time.Second
+	conn, err := dialDevice(ctx, target.Addr(), timeout)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect: %w", err)
 	}
+	defer conn.Close()
 
-	url := fmt.Sprintf("%s/api/metric", p.cfg.Telemetry.Server)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	// Send GET /metric request
+	request := fmt.Sprintf("GET /metric HTTP/1.0\r\nAccept: %s\r\n%s: %d\r\n\r\n",
+		bproto.ContentType, bproto.VersionHeader, bproto.Version3)
+	_, err = conn.Write([]byte(request))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-DeviceID", fmt.Sprintf("%v:%v", p.Host, p.Port))
-
-	client := &http.Client{
-		Timeout: time.Duration(p.cfg.Telemetry.Timeout) * time.Second,
+	// Receive response
+	var reader io.Reader = conn
+	if raw != nil {
+		reader = io.TeeReader(conn, raw)
+	}
+	body, resp, err := readResponse(bufio.NewReader(reader))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp != nil && resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected response: %s", resp.Status)
 	}
 
-	resp, err := client.Do(req)
+	frames := bproto.NewReader(body, bproto.WithMaxPayload(maxFrameSize), bproto.WithReadTimeout(conn, timeout))
+	frame, err := frames.ReadFrame()
 	if err != nil {
-		return fmt.Errorf("failed to send metrics: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if frame.Type != bproto.TypeMetrics {
+		return frame, nil, fmt.Errorf("unexpected frame type %d", frame.Type)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	// Structured payloads carry their own units, text ones need guessing
+	var deviceMetrics *metrics.DeviceMetrics
+	if frame.Version >= bproto.Version3 {
+		deviceMetrics, err = bproto.DecodeMetrics(frame)
+	} else {
+		deviceMetrics, err = parseMetrics(string(frame.Payload))
 	}
+	if err != nil {
+		return frame, nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+	return frame, deviceMetrics, nil
+}
 
-	return nil
+// submit queues metrics for upload, nothing is queued for nil or no metrics
+func (p *Poller) submit(dm *metrics.DeviceMetrics) {
+	if dm == nil || len(dm.Metrics) == 0 {
+		return
+	}
+	p.uploader.Submit(uploader.Sample{
+		DeviceID: p.Target.DeviceID(),
+		Metrics:  dm,
+	})
 }
 
+// Stop cancels polling and waits for an in-flight poll to finish
 func (p *Poller) Stop() {
-	p.logger.Info("Stopping poller")
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	p.logger.Info("Stopped poller", "target", p.Target.Name)
+}
+
+// addLabels applies target labels to every metric, labels set by the device win
+func addLabels(dm *metrics.DeviceMetrics, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	for i := range dm.Metrics {
+		m := &dm.Metrics[i]
+		if m.Labels == nil {
+			m.Labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			if _, ok := m.Labels[k]; !ok {
+				m.Labels[k] = v
+			}
+		}
+	}
 }
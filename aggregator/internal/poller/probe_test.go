@@ -0,0 +1,49 @@
+package poller_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/fakedevice"
+	"github.com/bxrne/beacon/aggregator/internal/poller"
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+)
+
+// TEST: GIVEN a fake daemon and a fake diorama
+// WHEN each is probed
+// THEN the raw reply, the frame and the parsed metrics should all be returned
+func TestProbeTarget(t *testing.T) {
+	daemon, daemonTarget := fakeDaemon(t)
+	defer daemon.Close()
+	diorama, err := fakedevice.NewDiorama()
+	if err != nil {
+		t.Fatalf("Failed to start fake diorama: %v", err)
+	}
+	defer diorama.Close()
+
+	tests := []struct {
+		name    string
+		target  config.Target
+		version byte
+	}{
+		{"daemon", daemonTarget, bproto.Version3},
+		{"diorama", diorama.Target("diorama"), bproto.Version1},
+	}
+	for _, tt := range tests {
+		probe, err := poller.ProbeTarget(context.Background(), tt.target)
+		if err != nil {
+			t.Fatalf("%s: probe failed: %v", tt.name, err)
+		}
+		if probe.Frame == nil || probe.Frame.Version != tt.version || probe.Frame.Type != bproto.TypeMetrics {
+			t.Fatalf("%s: expected a v%d metrics frame, got %+v", tt.name, tt.version, probe.Frame)
+		}
+		if !bytes.Contains(probe.Raw, probe.Frame.Payload) {
+			t.Errorf("%s: expected the raw reply to hold the payload, got %q", tt.name, probe.Raw)
+		}
+		if probe.Metrics == nil || len(probe.Metrics.Metrics) == 0 {
+			t.Errorf("%s: expected parsed metrics, got %+v", tt.name, probe.Metrics)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package poller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/pkg/jsonpath"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+const (
+	// maxScrapeBytes bounds the reply of a prometheus or http-json target
+	maxScrapeBytes        = 8 << 20
+	defaultPrometheusPath = "/metrics"
+	defaultJSONPath       = "/"
+	prometheusAccept      = "text/plain;version=0.0.4"
+	// KeyLabel holds the keys or indexes a JSONPath wildcard matched
+	KeyLabel = "key"
+)
+
+// scrapeClient fetches from plain HTTP targets, the target's timeout applies per request
+var scrapeClient = &http.Client{}
+
+// scrape fetches the body of an HTTP target, copying the reply to raw unless it is nil
+func scrape(ctx context.Context, target config.Target, path, accept string, raw io.Writer) ([]byte, error) {
+	if target.Path != "" {
+		path = target.Path
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(target.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+target.Addr()+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := scrapeClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScrapeBytes+1))
+	if raw != nil {
+		if head, dumpErr := httputil.DumpResponse(resp, false); dumpErr == nil {
+			raw.Write(head)
+		}
+		raw.Write(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(body) > maxScrapeBytes {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxScrapeBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return body, nil
+}
+
+// parsePrometheus reads the Prometheus text format. Every sample becomes a
+// metric of its series' name and labels, with a unit guessed from the name.
+func parsePrometheus(body []byte, now time.Time) (*metrics.DeviceMetrics, error) {
+	dm := &metrics.DeviceMetrics{Metrics: make([]metrics.Metric, 0)}
+	recordedAt := now.UTC().Format(time.RFC3339)
+
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue // HELP and TYPE carry nothing a metric needs
+		}
+		m, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if m.Value == "" {
+			continue // NaN
+		}
+		if m.RecordedAt == "" {
+			m.RecordedAt = recordedAt
+		}
+		dm.Metrics = append(dm.Metrics, m)
+	}
+	return dm, nil
+}
+
+// parseSample reads one `name{label="value",...} value [timestamp]` line
+func parseSample(line string) (metrics.Metric, error) {
+	var m metrics.Metric
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return m, fmt.Errorf("missing value")
+	}
+	m.Type, line = line[:end], line[end:]
+	m.Unit = prometheusUnit(m.Type)
+
+	if line[0] == '{' {
+		labels, rest, err := parseLabels(line[1:])
+		if err != nil {
+			return m, err
+		}
+		if len(labels) > 0 {
+			m.Labels = labels
+		}
+		line = rest
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return m, fmt.Errorf("expected a value and an optional timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return m, fmt.Errorf("invalid value %q", fields[0])
+	}
+	if !math.IsNaN(value) {
+		m.Value = fields[0]
+	}
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		m.RecordedAt = time.UnixMilli(ms).UTC().Format(time.RFC3339)
+	}
+	return m, nil
+}
+
+// parseLabels reads label pairs up to the closing brace and returns what follows it
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return nil, "", fmt.Errorf("unclosed {")
+		}
+		if s[0] == '}' {
+			return labels, s[1:], nil
+		}
+
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok || !strings.HasPrefix(rest, `"`) {
+			return nil, "", fmt.Errorf("invalid label %q", s)
+		}
+		var value strings.Builder
+		closed := false
+		i := 1
+		for ; i < len(rest); i++ {
+			c := rest[i]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && i+1 < len(rest) {
+				i++
+				switch rest[i] {
+				case 'n':
+					c = '\n'
+				default:
+					c = rest[i]
+				}
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels[strings.TrimSpace(name)] = value.String()
+		s = rest[i+1:]
+	}
+}
+
+// prometheusUnit guesses a unit from the naming conventions of Prometheus
+func prometheusUnit(name string) string {
+	if strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_bucket") {
+		return "count"
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_total")
+	for _, unit := range []string{"seconds", "bytes", "celsius", "volts", "amperes", "watts", "hertz", "ratio", "percent"} {
+		if strings.HasSuffix(base, "_"+unit) {
+			return unit
+		}
+	}
+	if base != name && strings.HasSuffix(name, "_total") {
+		return "count"
+	}
+	return "unknown"
+}
+
+// parseJSON reads the metrics an http-json target's mappings point at. A
+// mapping that finds nothing is skipped, a reply none of them match is an error.
+func parseJSON(body []byte, mappings []config.Mapping, now time.Time) (*metrics.DeviceMetrics, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+
+	dm := &metrics.DeviceMetrics{Metrics: make([]metrics.Metric, 0)}
+	recordedAt := now.UTC().Format(time.RFC3339)
+	for _, mapping := range mappings {
+		path, err := jsonpath.Compile(mapping.Path)
+		if err != nil {
+			return nil, err
+		}
+		unit := mapping.Unit
+		if unit == "" {
+			unit = "unknown"
+		}
+		for _, match := range path.Find(doc) {
+			value, ok := jsonValue(match.Value)
+			if !ok {
+				continue
+			}
+			m := metrics.Metric{Type: mapping.Type, Value: value, Unit: unit, RecordedAt: recordedAt}
+			if len(match.Keys) > 0 {
+				m.Labels = map[string]string{KeyLabel: strings.Join(match.Keys, ".")}
+			}
+			dm.Metrics = append(dm.Metrics, m)
+		}
+	}
+	if len(dm.Metrics) == 0 {
+		return nil, fmt.Errorf("no mapping matched the reply")
+	}
+	return dm, nil
+}
+
+// jsonValue formats a scalar, objects, arrays and nulls have no metric value
+func jsonValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.String(), true
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
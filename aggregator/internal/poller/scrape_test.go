@@ -0,0 +1,130 @@
+package poller_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/poller"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+const exposition = `# HELP node_cpu_seconds_total Seconds the CPUs spent in each mode.
+# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total{cpu="0",mode="idle"} 1234.5
+node_cpu_seconds_total{cpu="0",mode="user"} 67
+# TYPE node_memory_MemFree_bytes gauge
+node_memory_MemFree_bytes 8.192e+09
+http_requests_total{path="/a,b",note="say \"hi\""} 3 1700000000000
+temperature NaN
+`
+
+// TEST: GIVEN a Prometheus text endpoint
+// WHEN a prometheus target is probed
+// THEN every sample should become a metric with its labels, a guessed unit and its own timestamp when given
+func TestProbeTarget_Prometheus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(exposition))
+	}))
+	defer srv.Close()
+
+	probe, err := poller.ProbeTarget(context.Background(), httpTarget(t, srv, config.ProtocolPrometheus))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if probe.Frame != nil || !strings.Contains(string(probe.Raw), "node_cpu_seconds_total") {
+		t.Errorf("Expected the raw reply and no frame, got %+v", probe)
+	}
+
+	got := probe.Metrics.Metrics
+	want := []struct {
+		metricType, value, unit string
+		labels                  map[string]string
+	}{
+		{"node_cpu_seconds_total", "1234.5", "seconds", map[string]string{"cpu": "0", "mode": "idle"}},
+		{"node_cpu_seconds_total", "67", "seconds", map[string]string{"cpu": "0", "mode": "user"}},
+		{"node_memory_MemFree_bytes", "8.192e+09", "bytes", nil},
+		{"http_requests_total", "3", "count", map[string]string{"path": "/a,b", "note": `say "hi"`}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d metrics, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		m := got[i]
+		if m.Type != w.metricType || m.Value != w.value || m.Unit != w.unit || !reflect.DeepEqual(m.Labels, w.labels) {
+			t.Errorf("Metric %d: expected %+v, got %+v", i, w, m)
+		}
+	}
+	if got[3].RecordedAt != "2023-11-14T22:13:20Z" {
+		t.Errorf("Expected the sample's own timestamp, got %s", got[3].RecordedAt)
+	}
+}
+
+// TEST: GIVEN a JSON endpoint and mappings onto it
+// WHEN an http-json target is probed
+// THEN each mapped value should become a metric, wildcards labelled with the key they matched
+func TestProbeTarget_HTTPJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": {"uptime": 3600, "online": true}, "sensors": [{"temp": 21.5}, {"temp": 9}], "name": "pump"}`))
+	}))
+	defer srv.Close()
+
+	target := httpTarget(t, srv, config.ProtocolHTTPJSON)
+	target.Path = "/status.json"
+	target.Mappings = []config.Mapping{
+		{Type: "uptime", Path: "$.status.uptime", Unit: "seconds"},
+		{Type: "ac_online", Path: "$.status.online", Unit: "boolean"},
+		{Type: "temperature", Path: "$.sensors[*].temp", Unit: "celsius"},
+		{Type: "missing", Path: "$.nowhere"},
+	}
+	probe, err := poller.ProbeTarget(context.Background(), target)
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+
+	var got []metrics.Metric
+	for _, m := range probe.Metrics.Metrics {
+		m.RecordedAt = ""
+		got = append(got, m)
+	}
+	want := []metrics.Metric{
+		{Type: "uptime", Value: "3600", Unit: "seconds"},
+		{Type: "ac_online", Value: "true", Unit: "boolean"},
+		{Type: "temperature", Value: "21.5", Unit: "celsius", Labels: map[string]string{poller.KeyLabel: "0"}},
+		{Type: "temperature", Value: "9", Unit: "celsius", Labels: map[string]string{poller.KeyLabel: "1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if probe.Metrics.Hostname != target.Address {
+		t.Errorf("Expected the target's address as hostname, got %q", probe.Metrics.Hostname)
+	}
+
+	// A reply none of the mappings match is a failed poll
+	target.Mappings = target.Mappings[3:]
+	if _, err := poller.ProbeTarget(context.Background(), target); err == nil {
+		t.Error("Expected an error when no mapping matches")
+	}
+}
+
+func httpTarget(t *testing.T, srv *httptest.Server, protocol string) config.Target {
+	t.Helper()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := config.NewTarget()
+	target.Name, target.Address, target.Port, target.Interval, target.Protocol = protocol, host, port, 1, protocol
+	return target
+}
@@ -0,0 +1,64 @@
+package poller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxFrameSize bounds a single bproto payload from a device
+const maxFrameSize = 1 << 20
+
+// readResponse strips an optional HTTP/1.x status line and headers from a
+// device reply. The daemon answers over HTTP, the diorama with a bare frame,
+// in which case resp is nil and body is the stream itself.
+func readResponse(br *bufio.Reader) (body io.Reader, resp *http.Response, err error) {
+	peek, err := br.Peek(len("HTTP/"))
+	if len(peek) == 0 {
+		return nil, nil, fmt.Errorf("empty response: %w", err)
+	}
+	if !bytes.HasPrefix(peek, []byte("HTTP/")) {
+		return br, nil, nil
+	}
+
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response headers: %w", err)
+	}
+	return resp.Body, resp, nil
+}
+
+// deviceConn closes the connection as soon as its context ends, which
+// unblocks any pending read or write
+type deviceConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *deviceConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// dialDevice connects to a device with timeout for the dial and for sending
+// the request and the first read of the reply
+func dialDevice(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &deviceConn{Conn: conn, stop: stop}, nil
+}
@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+)
+
+const (
+	defaultMaxRetries = 5
+	defaultMaxDelay   = time.Minute
+)
+
+// Policy is capped exponential backoff with jitter. Attempt n waits Base*2^n,
+// capped at Max, with the upper half of that randomised so retries from many
+// pollers don't arrive together.
+type Policy struct {
+	Base       time.Duration
+	Max        time.Duration
+	MaxRetries int
+	// OnRetry is called before each wait, e.g. to count or log retries
+	OnRetry func(err error, delay time.Duration)
+}
+
+// NewPolicy builds a policy from the telemetry config, retry_interval is the
+// first delay
+func NewPolicy(cfg config.Telemetry) Policy {
+	p := Policy{
+		Base:       time.Duration(cfg.RetryInterval) * time.Second,
+		Max:        time.Duration(cfg.MaxRetryInterval) * time.Second,
+		MaxRetries: cfg.MaxRetries,
+	}
+	if p.Max <= 0 {
+		p.Max = defaultMaxDelay
+	}
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = defaultMaxRetries
+	}
+	return p
+}
+
+// Delay returns the jittered backoff before retry number attempt (from 0)
+func (p Policy) Delay(attempt int) time.Duration {
+	d := p.Base
+	for i := 0; i < attempt && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// DelayFor returns the wait before retry number attempt after err: the
+// server's Retry-After when it sent one, capped at Max so a server can't
+// stall retries indefinitely, and the backoff otherwise
+func (p Policy) DelayFor(err error, attempt int) time.Duration {
+	var re *Error
+	if errors.As(err, &re) && re.After > 0 {
+		if p.Max > 0 {
+			return min(re.After, p.Max)
+		}
+		return re.After
+	}
+	return p.Delay(attempt)
+}
+
+// Error marks a failure worth retrying. After overrides the backoff when the
+// server asked for a specific delay with Retry-After.
+type Error struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// Retryable wraps err so Do will try again
+func Retryable(err error) error {
+	return &Error{Err: err}
+}
+
+// IsRetryable reports whether Do would retry err
+func IsRetryable(err error) bool {
+	var re *Error
+	return errors.As(err, &re)
+}
+
+// CheckResponse turns a non-2xx response into an error, retryable only for
+// statuses that may succeed later
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err := fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &Error{Err: err, After: retryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	default:
+		return err
+	}
+}
+
+// retryAfter parses delay-seconds or an HTTP date, 0 when absent or invalid
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error, runs out of
+// retries or ctx ends. The last error is returned.
+func Do(ctx context.Context, p Policy, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			return fmt.Errorf("giving up after %d retries: %w", attempt, err)
+		}
+
+		delay := p.DelayFor(err, attempt)
+		if p.OnRetry != nil {
+			p.OnRetry(err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+)
+
+// TEST: GIVEN a policy with a base of one second and a cap of eight
+// WHEN delays are computed for successive attempts
+// THEN each should fall in the upper half of the doubled, capped delay
+func TestPolicy_DelayIsCappedWithJitter(t *testing.T) {
+	p := retry.Policy{Base: time.Second, Max: 8 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second}
+
+	for attempt, max := range want {
+		for i := 0; i < 50; i++ {
+			if d := p.Delay(attempt); d < max/2 || d > max {
+				t.Fatalf("Delay(%d) = %s, want between %s and %s", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+// TEST: GIVEN responses with various status codes and Retry-After headers
+// WHEN CheckResponse is called
+// THEN only transient statuses should be retryable and Retry-After should set the delay
+func TestCheckResponse(t *testing.T) {
+	cases := []struct {
+		status     int
+		retryAfter string
+		retryable  bool
+		after      time.Duration
+	}{
+		{http.StatusOK, "", false, 0},
+		{http.StatusBadRequest, "", false, 0},
+		{http.StatusNotFound, "", false, 0},
+		{http.StatusTooManyRequests, "7", true, 7 * time.Second},
+		{http.StatusServiceUnavailable, "", true, 0},
+		{http.StatusBadGateway, "soon", true, 0},
+	}
+
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+		if c.retryAfter != "" {
+			resp.Header.Set("Retry-After", c.retryAfter)
+		}
+
+		err := retry.CheckResponse(resp)
+		if (c.status == http.StatusOK) != (err == nil) {
+			t.Errorf("status %d: unexpected error %v", c.status, err)
+		}
+		if retry.IsRetryable(err) != c.retryable {
+			t.Errorf("status %d: retryable = %v, want %v", c.status, !c.retryable, c.retryable)
+		}
+		var re *retry.Error
+		if errors.As(err, &re) && re.After != c.after {
+			t.Errorf("status %d: after = %s, want %s", c.status, re.After, c.after)
+		}
+	}
+}
+
+// TEST: GIVEN a function that fails twice with retryable errors, and one that fails permanently
+// WHEN Do is called
+// THEN the first should succeed on the third attempt and the second should not be retried
+func TestDo(t *testing.T) {
+	retries := 0
+	p := retry.Policy{Base: time.Millisecond, Max: time.Millisecond, MaxRetries: 5, OnRetry: func(error, time.Duration) { retries++ }}
+
+	calls := 0
+	err := retry.Do(context.Background(), p, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return retry.Retryable(errors.New("unavailable"))
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || retries != 2 {
+		t.Errorf("Expected success after 3 calls and 2 retries, got err=%v calls=%d retries=%d", err, calls, retries)
+	}
+
+	calls = 0
+	permanent := errors.New("bad request")
+	err = retry.Do(context.Background(), p, func(context.Context) error {
+		calls++
+		return permanent
+	})
+	if !errors.Is(err, permanent) || calls != 1 {
+		t.Errorf("Expected one call returning the permanent error, got err=%v calls=%d", err, calls)
+	}
+}
+
+// TEST: GIVEN a function that always fails with a retryable error
+// WHEN Do is called with a limit of two retries
+// THEN it should give up after three calls with the last error
+func TestDo_GivesUp(t *testing.T) {
+	p := retry.Policy{Base: time.Millisecond, Max: time.Millisecond, MaxRetries: 2}
+
+	calls := 0
+	err := retry.Do(context.Background(), p, func(context.Context) error {
+		calls++
+		return retry.Retryable(errors.New("unavailable"))
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Expected failure after 3 calls, got err=%v calls=%d", err, calls)
+	}
+}
+
+// TEST: GIVEN a policy capped at a minute
+// WHEN the server asks for a shorter and a far longer Retry-After, or none
+// THEN the shorter should be honoured, the longer capped at a minute and the backoff used without one
+func TestPolicy_DelayForCapsRetryAfter(t *testing.T) {
+	p := retry.Policy{Base: time.Second, Max: time.Minute, MaxRetries: 5}
+	unavailable := errors.New("unavailable")
+
+	if d := p.DelayFor(&retry.Error{Err: unavailable, After: 30 * time.Second}, 0); d != 30*time.Second {
+		t.Errorf("Expected the server's 30s, got %s", d)
+	}
+	if d := p.DelayFor(&retry.Error{Err: unavailable, After: 24 * time.Hour}, 0); d != time.Minute {
+		t.Errorf("Expected a day capped at a minute, got %s", d)
+	}
+	if d := p.DelayFor(retry.Retryable(unavailable), 0); d < time.Second/2 || d > time.Second {
+		t.Errorf("Expected the first backoff, got %s", d)
+	}
+}
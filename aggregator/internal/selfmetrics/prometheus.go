@@ -0,0 +1,97 @@
+package selfmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the Prometheus text exposition format WritePrometheus writes
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes every registered metric in the Prometheus text
+// format, sorted by name
+func WritePrometheus(w io.Writer) error {
+	type family struct {
+		name  string
+		write func(bw *bufio.Writer)
+	}
+
+	mu.Lock()
+	var families []family
+	for name, c := range counters {
+		families = append(families, family{name, func(bw *bufio.Writer) {
+			fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", name, name, c.Value())
+		}})
+	}
+	for name, g := range gauges {
+		families = append(families, family{name, func(bw *bufio.Writer) {
+			fmt.Fprintf(bw, "# TYPE %s gauge\n%s %d\n", name, name, g.Value())
+		}})
+	}
+	for name, v := range counterVecs {
+		families = append(families, family{name, func(bw *bufio.Writer) {
+			fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+			v.each(func(values []string, c *Counter) {
+				fmt.Fprintf(bw, "%s%s %d\n", name, labelSet(v.labels, values), c.Value())
+			})
+		}})
+	}
+	for name, v := range gaugeVecs {
+		families = append(families, family{name, func(bw *bufio.Writer) {
+			fmt.Fprintf(bw, "# TYPE %s gauge\n", name)
+			v.each(func(values []string, g *Gauge) {
+				fmt.Fprintf(bw, "%s%s %d\n", name, labelSet(v.labels, values), g.Value())
+			})
+		}})
+	}
+	for name, v := range histogramVecs {
+		families = append(families, family{name, func(bw *bufio.Writer) {
+			fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+			v.each(func(values []string, h *Histogram) {
+				cumulative, sum, count := h.snapshot()
+				labels := append(append([]string(nil), v.labels...), "le")
+				for i, bound := range h.buckets {
+					le := strconv.FormatFloat(bound, 'g', -1, 64)
+					fmt.Fprintf(bw, "%s_bucket%s %d\n", name, labelSet(labels, append(values[:len(values):len(values)], le)), cumulative[i])
+				}
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, labelSet(labels, append(values[:len(values):len(values)], "+Inf")), count)
+				fmt.Fprintf(bw, "%s_sum%s %s\n", name, labelSet(v.labels, values), strconv.FormatFloat(sum, 'g', -1, 64))
+				fmt.Fprintf(bw, "%s_count%s %d\n", name, labelSet(v.labels, values), count)
+			})
+		}})
+	}
+	mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// labelSet formats {name="value",...}, empty without labels
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
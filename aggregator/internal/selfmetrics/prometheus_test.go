@@ -0,0 +1,44 @@
+package selfmetrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+)
+
+// TEST: GIVEN a counter, a labelled gauge and a labelled histogram
+// WHEN the registry is written in the Prometheus format
+// THEN each family should have its type, escaped labels and cumulative buckets
+func TestWritePrometheus(t *testing.T) {
+	selfmetrics.NewCounter("test_prom_total", "count").Add(3)
+	selfmetrics.NewGaugeVec("test_prom_gauge", "count", "target").With(`a"b`).Set(7)
+	h := selfmetrics.NewHistogramVec("test_prom_seconds", "seconds", []float64{0.1, 1}, "target").With("edge")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var b strings.Builder
+	if err := selfmetrics.WritePrometheus(&b); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_prom_total counter\ntest_prom_total 3\n",
+		"# TYPE test_prom_gauge gauge\ntest_prom_gauge{target=\"a\\\"b\"} 7\n",
+		"# TYPE test_prom_seconds histogram\n",
+		`test_prom_seconds_bucket{target="edge",le="0.1"} 1`,
+		`test_prom_seconds_bucket{target="edge",le="1"} 2`,
+		`test_prom_seconds_bucket{target="edge",le="+Inf"} 3`,
+		`test_prom_seconds_sum{target="edge"} 5.55`,
+		`test_prom_seconds_count{target="edge"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "test_prom_gauge") > strings.Index(out, "test_prom_seconds") {
+		t.Errorf("Expected families sorted by name")
+	}
+}
@@ -0,0 +1,90 @@
+package selfmetrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// INFO: The aggregator reports on itself with the same metric types devices
+// use, so its counters show up on the dashboard like any other device.
+
+var (
+	mu       sync.Mutex
+	counters = map[string]*Counter{}
+	gauges   = map[string]*GaugeFunc{}
+)
+
+// Counter is a monotonically increasing count, safe for concurrent use
+type Counter struct {
+	name string
+	unit string
+	v    atomic.Int64
+}
+
+// NewCounter registers a counter, registering a name twice returns the same counter
+func NewCounter(name, unit string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name, unit: unit}
+	counters[name] = c
+	return c
+}
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n int64)  { c.v.Add(n) }
+func (c *Counter) Value() int64 { return c.v.Load() }
+func (c *Counter) Name() string { return c.name }
+
+// GaugeFunc is a value read when a snapshot is taken, e.g. a queue depth
+type GaugeFunc struct {
+	name string
+	unit string
+	fn   func() int64
+}
+
+// NewGaugeFunc registers a gauge, registering a name again replaces its function
+func NewGaugeFunc(name, unit string, fn func() int64) *GaugeFunc {
+	mu.Lock()
+	defer mu.Unlock()
+	g := &GaugeFunc{name: name, unit: unit, fn: fn}
+	gauges[name] = g
+	return g
+}
+
+func (g *GaugeFunc) Value() int64 { return g.fn() }
+func (g *GaugeFunc) Name() string { return g.name }
+
+// Snapshot returns every registered counter and gauge as a metric, sorted by name
+func Snapshot(recordedAt time.Time) []metrics.Metric {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts := recordedAt.UTC().Format(time.RFC3339)
+	out := make([]metrics.Metric, 0, len(counters)+len(gauges))
+	for _, c := range counters {
+		out = append(out, metrics.Metric{
+			Type:       c.name,
+			Value:      fmt.Sprintf("%d", c.Value()),
+			Unit:       c.unit,
+			RecordedAt: ts,
+		})
+	}
+	for _, g := range gauges {
+		out = append(out, metrics.Metric{
+			Type:       g.name,
+			Value:      fmt.Sprintf("%d", g.Value()),
+			Unit:       g.unit,
+			RecordedAt: ts,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
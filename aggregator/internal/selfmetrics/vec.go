@@ -0,0 +1,202 @@
+package selfmetrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// INFO: Labelled series are only exposed to Prometheus. Snapshot leaves them
+// out, one metric type per target would flood the API's type list.
+
+var (
+	counterVecs   = map[string]*CounterVec{}
+	gaugeVecs     = map[string]*GaugeVec{}
+	histogramVecs = map[string]*HistogramVec{}
+)
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family holds the series of a vec by their joined label values
+type family[T any] struct {
+	name   string
+	unit   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	values map[string][]string
+	create func() *T
+}
+
+func (f *family[T]) with(values []string) *T {
+	if len(values) != len(f.labels) {
+		panic("selfmetrics: " + f.name + " wants labels " + strings.Join(f.labels, ", "))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s := f.create()
+	f.series[key] = s
+	f.values[key] = append([]string(nil), values...)
+	return s
+}
+
+// Delete drops the series with the given label values, e.g. for a removed target
+func (f *family[T]) Delete(values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.Join(values, "\xff")
+	delete(f.series, key)
+	delete(f.values, key)
+}
+
+// each visits the series sorted by label values
+func (f *family[T]) each(fn func(values []string, s *T)) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		series[i], values[i] = f.series[k], f.values[k]
+	}
+	f.mu.Unlock()
+
+	for i := range series {
+		fn(values[i], series[i])
+	}
+}
+
+func newFamily[T any](name, unit string, labels []string, create func() *T) *family[T] {
+	return &family[T]{
+		name:   name,
+		unit:   unit,
+		labels: labels,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		create: create,
+	}
+}
+
+// CounterVec is a counter per combination of label values
+type CounterVec struct {
+	*family[Counter]
+}
+
+// NewCounterVec registers a labelled counter, registering a name twice returns the same vec
+func NewCounterVec(name, unit string, labels ...string) *CounterVec {
+	mu.Lock()
+	defer mu.Unlock()
+	if v, ok := counterVecs[name]; ok {
+		return v
+	}
+	v := &CounterVec{newFamily(name, unit, labels, func() *Counter { return &Counter{name: name, unit: unit} })}
+	counterVecs[name] = v
+	return v
+}
+
+// With returns the counter for the label values, in the order the labels were registered
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+// Gauge is a value that is set rather than counted, safe for concurrent use
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(n int64)  { g.v.Store(n) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+// GaugeVec is a gauge per combination of label values
+type GaugeVec struct {
+	*family[Gauge]
+}
+
+// NewGaugeVec registers a labelled gauge, registering a name twice returns the same vec
+func NewGaugeVec(name, unit string, labels ...string) *GaugeVec {
+	mu.Lock()
+	defer mu.Unlock()
+	if v, ok := gaugeVecs[name]; ok {
+		return v
+	}
+	v := &GaugeVec{newFamily(name, unit, labels, func() *Gauge { return &Gauge{} })}
+	gaugeVecs[name] = v
+	return v
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // Upper bounds, ascending
+	counts  []uint64  // Per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// snapshot returns cumulative bucket counts with the sum and total count
+func (h *Histogram) snapshot() ([]uint64, float64, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative := make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		cumulative[i] = n
+	}
+	return cumulative, h.sum, h.count
+}
+
+// HistogramVec is a histogram per combination of label values
+type HistogramVec struct {
+	*family[Histogram]
+}
+
+// NewHistogramVec registers a labelled histogram, registering a name twice returns the same vec
+func NewHistogramVec(name, unit string, buckets []float64, labels ...string) *HistogramVec {
+	mu.Lock()
+	defer mu.Unlock()
+	if v, ok := histogramVecs[name]; ok {
+		return v
+	}
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	if n := len(bounds); n > 0 && math.IsInf(bounds[n-1], 1) {
+		bounds = bounds[:n-1] // +Inf is always written
+	}
+	v := &HistogramVec{}
+	v.family = newFamily(name, unit, labels, func() *Histogram {
+		return &Histogram{buckets: bounds, counts: make([]uint64, len(bounds))}
+	})
+	histogramVecs[name] = v
+	return v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
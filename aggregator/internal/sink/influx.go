@@ -0,0 +1,130 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// maxInfluxErrorBytes bounds the error body read back from InfluxDB
+const maxInfluxErrorBytes = 4 << 10
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxWriter posts line protocol to an InfluxDB write endpoint, one point
+// per metric with the metric type as the measurement. The device, hostname,
+// unit and labels are tags, and the value is a float field when it parses as
+// one and a string field otherwise.
+type influxWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newInflux(cfg config.Sink, telemetry config.Telemetry) *influxWriter {
+	return &influxWriter{
+		url:    cfg.URL,
+		token:  cfg.Token,
+		client: &http.Client{Timeout: time.Duration(telemetry.Timeout) * time.Second},
+	}
+}
+
+func (w *influxWriter) Write(ctx context.Context, batch []uploader.Sample) error {
+	var body bytes.Buffer
+	for _, s := range batch {
+		for _, m := range s.Metrics.Metrics {
+			writeLine(&body, s, m)
+		}
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return retry.Retryable(fmt.Errorf("failed to write to InfluxDB: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if err := retry.CheckResponse(resp); err != nil {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, maxInfluxErrorBytes))
+		if msg := strings.TrimSpace(string(text)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxInfluxErrorBytes))
+	return nil
+}
+
+func (w *influxWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// writeLine writes one metric as a point
+func writeLine(b *bytes.Buffer, s uploader.Sample, m metrics.Metric) {
+	b.WriteString(measurementEscaper.Replace(m.Type))
+	writeTag(b, "device", s.DeviceID)
+	writeTag(b, "host", s.Metrics.Hostname)
+	writeTag(b, "unit", m.Unit)
+	for _, k := range slices.Sorted(maps.Keys(m.Labels)) {
+		writeTag(b, k, m.Labels[k])
+	}
+
+	if v, err := strconv.ParseFloat(m.Value, 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	} else {
+		b.WriteString(` value="`)
+		b.WriteString(stringEscaper.Replace(m.Value))
+		b.WriteByte('"')
+	}
+
+	// Without a timestamp InfluxDB uses its own clock
+	if t, err := time.Parse(time.RFC3339, m.RecordedAt); err == nil {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	}
+	b.WriteByte('\n')
+}
+
+// writeTag writes ,key=value, tags with empty values are not allowed
+func writeTag(b *bytes.Buffer, key, value string) {
+	if key == "" || value == "" {
+		return
+	}
+	b.WriteByte(',')
+	b.WriteString(tagEscaper.Replace(key))
+	b.WriteByte('=')
+	b.WriteString(tagEscaper.Replace(value))
+}
@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+)
+
+const (
+	defaultJSONLMaxBytes = 64 << 20
+	defaultJSONLMaxFiles = 3
+)
+
+// jsonlWriter appends one JSON sample per line to a file, the same shape as
+// a bulk upload's samples. Past max bytes the file is renamed to .1, older
+// files move up one and the oldest past max files is removed.
+type jsonlWriter struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newJSONL(cfg config.Sink) (*jsonlWriter, error) {
+	w := &jsonlWriter{path: cfg.Path, maxBytes: cfg.MaxBytes, maxFiles: cfg.MaxFiles}
+	if w.maxBytes <= 0 {
+		w.maxBytes = defaultJSONLMaxBytes
+	}
+	if w.maxFiles <= 0 {
+		w.maxFiles = defaultJSONLMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *jsonlWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", w.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat %s: %w", w.path, err)
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+func (w *jsonlWriter) Write(ctx context.Context, batch []uploader.Sample) error {
+	for _, s := range batch {
+		line, err := json.Marshal(bulkSample(s))
+		if err != nil {
+			return fmt.Errorf("failed to marshal metrics: %w", err)
+		}
+		line = append(line, '\n')
+
+		if w.file == nil {
+			// A failed rotation left the file closed
+			if err := w.open(); err != nil {
+				return retry.Retryable(err)
+			}
+		}
+		if w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+			if err := w.rotate(); err != nil {
+				return retry.Retryable(err)
+			}
+		}
+		n, err := w.file.Write(line)
+		w.size += int64(n)
+		if err != nil {
+			return retry.Retryable(fmt.Errorf("failed to write %s: %w", w.path, err))
+		}
+	}
+	return nil
+}
+
+// rotate shifts the rotated files up one and starts an empty file
+func (w *jsonlWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", w.path, err)
+	}
+	w.file = nil
+
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(w.rotated(i), w.rotated(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate %s: %w", w.rotated(i), err)
+		}
+	}
+	if err := os.Rename(w.path, w.rotated(1)); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", w.path, err)
+	}
+	return w.open()
+}
+
+func (w *jsonlWriter) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", w.path, n)
+}
+
+func (w *jsonlWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	"github.com/bxrne/beacon/aggregator/pkg/mqtt"
+)
+
+// topicEscaper keeps device IDs from adding levels or wildcards to a topic
+var topicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttWriter publishes each sample as JSON to the topic for its device. The
+// connection is dialled on first use and again after it drops.
+type mqttWriter struct {
+	broker string
+	topic  string
+	qos    byte
+	opts   mqtt.Options
+	client *mqtt.Client
+}
+
+func newMQTT(cfg config.Sink, telemetry config.Telemetry) *mqttWriter {
+	return &mqttWriter{
+		broker: cfg.Broker,
+		topic:  cfg.Topic,
+		qos:    byte(cfg.QoS),
+		opts: mqtt.Options{
+			ClientID: cfg.ClientID,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			Timeout:  time.Duration(telemetry.Timeout) * time.Second,
+		},
+	}
+}
+
+func (w *mqttWriter) Write(ctx context.Context, batch []uploader.Sample) error {
+	if w.client != nil {
+		select {
+		case <-w.client.Done():
+			w.client = nil
+		default:
+		}
+	}
+	if w.client == nil {
+		client, err := mqtt.Dial(ctx, w.broker, w.opts)
+		if err != nil {
+			return retry.Retryable(fmt.Errorf("failed to connect to %s: %w", w.broker, err))
+		}
+		w.client = client
+	}
+
+	for _, s := range batch {
+		payload, err := json.Marshal(bulkSample(s))
+		if err != nil {
+			return fmt.Errorf("failed to marshal metrics: %w", err)
+		}
+		m := mqtt.Message{
+			Topic:   strings.ReplaceAll(w.topic, "{device}", topicEscaper.Replace(s.DeviceID)),
+			Payload: payload,
+			QoS:     w.qos,
+		}
+		if err := w.client.Publish(ctx, m); err != nil {
+			w.client.Close()
+			w.client = nil
+			return retry.Retryable(fmt.Errorf("failed to publish to %s: %w", m.Topic, err))
+		}
+	}
+	return nil
+}
+
+func (w *mqttWriter) Close() error {
+	if w.client == nil {
+		return nil
+	}
+	return w.client.Close()
+}
@@ -0,0 +1,242 @@
+// Package sink writes the samples uploaded to the API to other destinations
+// too: a local JSONL file, InfluxDB and an MQTT topic
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	defaultQueueSize     = 4096
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+)
+
+var (
+	sinkWrites  = selfmetrics.NewCounterVec("aggregator_sink_writes", "count", "sink", "result")
+	sinkRetries = selfmetrics.NewCounterVec("aggregator_sink_retries", "count", "sink")
+	sinkDrops   = selfmetrics.NewCounterVec("aggregator_sink_drops", "count", "sink")
+	sinkDepth   = selfmetrics.NewGaugeVec("aggregator_sink_queue_depth", "count", "sink")
+)
+
+// Writer writes batches to one destination. An error wrapped with
+// retry.Retryable has the batch written again.
+type Writer interface {
+	Write(ctx context.Context, batch []uploader.Sample) error
+	Close() error
+}
+
+// Sink feeds a writer from its own queue, batching like the uploader, so a
+// destination that is slow or down only ever drops its own samples
+type Sink struct {
+	name          string
+	writer        Writer
+	logger        *log.Logger
+	policy        retry.Policy
+	batchSize     int
+	batchInterval time.Duration
+	queue         chan uploader.Sample
+	wg            sync.WaitGroup
+
+	// ctx aborts retries once a drain has given up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New creates the sink cfg describes, retrying with the telemetry's backoff
+func New(cfg config.Sink, telemetry config.Telemetry, logger *log.Logger) (*Sink, error) {
+	var w Writer
+	var err error
+	switch cfg.Type {
+	case config.SinkJSONL:
+		w, err = newJSONL(cfg)
+	case config.SinkInflux:
+		w = newInflux(cfg, telemetry)
+	case config.SinkMQTT:
+		w = newMQTT(cfg, telemetry)
+	default:
+		err = fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sink %q: %w", cfg.Name, err)
+	}
+	return newSink(cfg, telemetry, w, logger), nil
+}
+
+func newSink(cfg config.Sink, telemetry config.Telemetry, w Writer, logger *log.Logger) *Sink {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sink{
+		name:          cfg.Name,
+		writer:        w,
+		logger:        logger.With("sink", cfg.Name),
+		policy:        retry.NewPolicy(telemetry),
+		batchSize:     cfg.BatchSize,
+		batchInterval: time.Duration(cfg.BatchInterval) * time.Millisecond,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	s.queue = make(chan uploader.Sample, queueSize)
+	if s.batchSize <= 0 {
+		s.batchSize = defaultBatchSize
+	}
+	if s.batchInterval <= 0 {
+		s.batchInterval = defaultBatchInterval
+	}
+	if cfg.MaxRetries > 0 {
+		s.policy.MaxRetries = cfg.MaxRetries
+	}
+	s.policy.OnRetry = func(err error, delay time.Duration) {
+		sinkRetries.With(s.name).Inc()
+		s.logger.Warnf("Sink write failed, retrying in %s: %v", delay, err)
+	}
+	return s
+}
+
+// Name identifies the sink in logs and metrics
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Start runs the write worker until Drain is called
+func (s *Sink) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Submit queues a sample without blocking, it is dropped if the queue is full
+func (s *Sink) Submit(sample uploader.Sample) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.queue <- sample:
+		sinkDepth.With(s.name).Set(int64(len(s.queue)))
+		return true
+	default:
+		sinkDrops.With(s.name).Inc()
+		s.logger.Warnf("Sink queue full, dropping metrics from %s", sample.DeviceID)
+		return false
+	}
+}
+
+// Drain stops accepting samples and waits for queued ones to be written, or
+// for ctx to end. The writer is closed either way.
+func (s *Sink) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		queued := len(s.queue)
+		s.cancel()
+		<-done
+		err = fmt.Errorf("gave up draining sink %s with %d samples queued: %w", s.name, queued, ctx.Err())
+	}
+	if closeErr := s.writer.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close sink %s: %w", s.name, closeErr)
+	}
+	return err
+}
+
+// run collects queued samples into batches and writes them
+func (s *Sink) run() {
+	defer s.wg.Done()
+
+	batch := make([]uploader.Sample, 0, s.batchSize)
+	timer := time.NewTimer(s.batchInterval)
+	timer.Stop()
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			s.write(batch)
+			batch = make([]uploader.Sample, 0, s.batchSize)
+		}
+		timer.Stop()
+		sinkDepth.With(s.name).Set(int64(len(s.queue)))
+	}
+
+	for {
+		select {
+		case sample, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, sample)
+			if len(batch) == 1 {
+				timer.Reset(s.batchInterval)
+			}
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// write retries transient failures and drops the batch if they persist
+func (s *Sink) write(batch []uploader.Sample) {
+	err := retry.Do(s.ctx, s.policy, func(ctx context.Context) error {
+		return s.writer.Write(ctx, batch)
+	})
+	if err != nil {
+		sinkWrites.With(s.name, "failure").Inc()
+		sinkDrops.With(s.name).Add(int64(len(batch)))
+		s.logger.Errorf("Failed to write %d samples, dropping: %v", len(batch), err)
+		return
+	}
+	sinkWrites.With(s.name, "success").Inc()
+}
+
+// Fanout submits every sample to each of its submitters, the uploader and
+// the sinks, each of which queues it on its own
+type Fanout []uploader.Submitter
+
+// Submit reports whether every submitter took the sample
+func (f Fanout) Submit(sample uploader.Sample) bool {
+	ok := true
+	for _, s := range f {
+		ok = s.Submit(sample) && ok
+	}
+	return ok
+}
+
+// bulkSample is a sample as the API's bulk upload takes it, which the sinks
+// that write JSON reuse
+func bulkSample(s uploader.Sample) metrics.BulkSample {
+	return metrics.BulkSample{DeviceID: s.DeviceID, Hostname: s.Metrics.Hostname, Metrics: s.Metrics.Metrics}
+}
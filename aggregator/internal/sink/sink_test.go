@@ -0,0 +1,225 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/fakedevice"
+	"github.com/bxrne/beacon/aggregator/internal/sink"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	"github.com/bxrne/beacon/aggregator/pkg/mqtt"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+var telemetry = config.Telemetry{RetryInterval: 1, MaxRetries: 2, Timeout: 5}
+
+// TEST: GIVEN a JSONL sink with a small size limit and two rotated files
+// WHEN more samples are written than fit
+// THEN the file should rotate, keep two older files and hold whole JSON lines
+func TestSink_JSONLRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "metrics.jsonl")
+	s := startSink(t, config.Sink{Type: config.SinkJSONL, Name: "file", Path: path, MaxBytes: 400, MaxFiles: 2, BatchSize: 1})
+	for i := range 20 {
+		s.Submit(sample(fmt.Sprintf("device-%d", i), "1"))
+	}
+	drain(t, s)
+
+	var devices []string
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		lines := readLines(t, name)
+		if len(lines) == 0 {
+			t.Errorf("Expected samples in %s", filepath.Base(name))
+		}
+		for _, line := range lines {
+			var bs metrics.BulkSample
+			if err := json.Unmarshal([]byte(line), &bs); err != nil {
+				t.Fatalf("Invalid line in %s: %v", filepath.Base(name), err)
+			}
+			devices = append(devices, bs.DeviceID)
+		}
+		if info, _ := os.Stat(name); info.Size() > 400 {
+			t.Errorf("Expected %s to stay within 400 bytes, got %d", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no third rotated file, got %v", err)
+	}
+	if last := devices[len(devices)-1]; last != "device-19" {
+		t.Errorf("Expected the newest sample last in the current file, got %s", last)
+	}
+}
+
+// TEST: GIVEN an InfluxDB sink and a stand-in write endpoint
+// WHEN samples with numeric, text and labelled metrics are written
+// THEN the endpoint should get escaped line protocol with the token
+func TestSink_InfluxLineProtocol(t *testing.T) {
+	bodies := make(chan string, 10)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := startSink(t, config.Sink{Type: config.SinkInflux, Name: "influx", URL: srv.URL + "/api/v2/write?org=o&bucket=b", Token: "secret"})
+	dm := &metrics.DeviceMetrics{Hostname: "pi 1", Metrics: []metrics.Metric{
+		{Type: "cpu usage", Value: "12.5", Unit: "percent", RecordedAt: "2026-01-02T03:04:05Z", Labels: map[string]string{"core": "0", "b": "x=y"}},
+		{Type: "car_light", Value: `say "green"`, Unit: "state", RecordedAt: "2026-01-02T03:04:05Z"},
+	}}
+	s.Submit(uploader.Sample{DeviceID: "10.0.0.1:80", Metrics: dm})
+	drain(t, s)
+
+	want := `cpu\ usage,device=10.0.0.1:80,host=pi\ 1,unit=percent,b=x\=y,core=0 value=12.5 1767323045000000000` + "\n" +
+		`car_light,device=10.0.0.1:80,host=pi\ 1,unit=state value="say \"green\"" 1767323045000000000` + "\n"
+	select {
+	case got := <-bodies:
+		if got != want {
+			t.Errorf("Expected line protocol\n%s\ngot\n%s", want, got)
+		}
+	default:
+		t.Fatal("Expected a write to the endpoint")
+	}
+	if auth != "Token secret" {
+		t.Errorf("Expected the token in Authorization, got %q", auth)
+	}
+}
+
+// TEST: GIVEN an MQTT sink with QoS 1 and a stand-in broker
+// WHEN samples are written, the broker drops the connection and more are written
+// THEN each sample should be published to its device's topic, reconnecting as needed
+func TestSink_MQTTPublishes(t *testing.T) {
+	broker, err := fakedevice.NewBroker()
+	if err != nil {
+		t.Fatalf("Failed to start fake broker: %v", err)
+	}
+	defer broker.Close()
+
+	s := startSink(t, config.Sink{Type: config.SinkMQTT, Name: "mqtt", Broker: broker.Addr(), Topic: "beacon/{device}/metrics", QoS: 1, ClientID: "agg-1"})
+	s.Submit(sample("10.0.0.1:80", "1"))
+	waitPublished(t, broker, 1)
+
+	broker.Disconnect()
+	s.Submit(sample("a/b#", "2"))
+	published := waitPublished(t, broker, 2)
+	drain(t, s)
+
+	topics := []string{published[0].Topic, published[1].Topic}
+	if topics[0] != "beacon/10.0.0.1:80/metrics" || topics[1] != "beacon/a_b_/metrics" {
+		t.Errorf("Unexpected topics %v", topics)
+	}
+	var bs metrics.BulkSample
+	if err := json.Unmarshal(published[1].Payload, &bs); err != nil || bs.DeviceID != "a/b#" || bs.Metrics[0].Value != "2" {
+		t.Errorf("Unexpected payload %s: %v", published[1].Payload, err)
+	}
+	if published[0].QoS != 1 {
+		t.Errorf("Expected QoS 1, got %d", published[0].QoS)
+	}
+	if clients := broker.Clients(); len(clients) != 2 || clients[0].ClientID != "agg-1" {
+		t.Errorf("Expected two connections as agg-1, got %+v", clients)
+	}
+}
+
+// TEST: GIVEN a fanout to an InfluxDB sink that never answers and a JSONL sink
+// WHEN samples are submitted
+// THEN the JSONL sink should write them all while the other sink is stuck
+func TestFanout_SlowSinkDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	slow := startSink(t, config.Sink{Type: config.SinkInflux, Name: "slow", URL: srv.URL, QueueSize: 2, BatchSize: 1})
+	file := startSink(t, config.Sink{Type: config.SinkJSONL, Name: "file", Path: path, BatchSize: 1})
+
+	out := sink.Fanout{slow, file}
+	for i := range 10 {
+		out.Submit(sample(fmt.Sprintf("device-%d", i), "1"))
+	}
+	drain(t, file)
+	if lines := readLines(t, path); len(lines) != 10 {
+		t.Errorf("Expected 10 samples in the file, got %d", len(lines))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := slow.Drain(ctx); err == nil {
+		t.Error("Expected draining the stuck sink to give up")
+	}
+}
+
+func startSink(t *testing.T, cfg config.Sink) *sink.Sink {
+	t.Helper()
+	cfg.BatchInterval = 10
+	s, err := sink.New(cfg, telemetry, log.New(io.Discard))
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	s.Start()
+	return s
+}
+
+func drain(t *testing.T, s *sink.Sink) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Drain(ctx); err != nil {
+		t.Fatalf("Failed to drain sink: %v", err)
+	}
+}
+
+func sample(device, value string) uploader.Sample {
+	return uploader.Sample{DeviceID: device, Metrics: &metrics.DeviceMetrics{
+		Hostname: "host",
+		Metrics:  []metrics.Metric{{Type: "uptime", Value: value, Unit: "seconds", RecordedAt: "2026-01-02T03:04:05Z"}},
+	}}
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func waitPublished(t *testing.T, broker *fakedevice.Broker, n int) []mqtt.Message {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if published := broker.Published(); len(published) >= n {
+			return published
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d messages, got %d", n, len(broker.Published()))
+	return nil
+}
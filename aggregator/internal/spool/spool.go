@@ -0,0 +1,426 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// INFO: The spool is a directory of append-only segment files named by
+// sequence number with one JSON record per line. Records are appended to the
+// newest segment and replayed from a cursor (segment and offset) kept in the
+// cursor file; replayed segments are deleted. Delivery is at least once, a
+// crash between sending a record and saving the cursor sends it again.
+
+const (
+	defaultMaxBytes     = 64 << 20
+	defaultMaxAge       = 24 * time.Hour
+	defaultSegmentBytes = 4 << 20
+
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+)
+
+var spoolDrops = selfmetrics.NewCounter("aggregator_spool_drops", "count")
+
+// Record is one upload waiting in the spool. Metrics are stored as received,
+// so their recorded_at timestamps survive replay unchanged.
+type Record struct {
+	DeviceID  string                 `json:"device_id"`
+	Metrics   *metrics.DeviceMetrics `json:"metrics"`
+	SpooledAt time.Time              `json:"spooled_at"`
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	entries int
+	modTime time.Time
+}
+
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	maxAge       time.Duration
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []*segment // Oldest first, the last one is appended to
+	active   *os.File
+
+	// Replay position, always within the oldest segment
+	readOffset  int64
+	readEntries int
+	reader      *os.File
+	rbuf        *bufio.Reader
+	head        []Record
+	headLen     int64 // Bytes and lines behind head, skipped corrupt lines included
+	headEntries int
+}
+
+// Open loads the spool in cfg.Dir, creating it if needed, and starts a new
+// segment for appends
+func Open(cfg config.Spool) (*Spool, error) {
+	s := &Spool{
+		dir:          cfg.Dir,
+		maxBytes:     cfg.MaxBytes,
+		maxAge:       time.Duration(cfg.MaxAge) * time.Second,
+		segmentBytes: cfg.SegmentBytes,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultMaxBytes
+	}
+	if s.maxAge <= 0 {
+		s.maxAge = defaultMaxAge
+	}
+	if s.segmentBytes <= 0 {
+		s.segmentBytes = defaultSegmentBytes
+	}
+	if s.segmentBytes > s.maxBytes {
+		s.segmentBytes = s.maxBytes
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enforceLimits(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads existing segments and the cursor, deleting segments already replayed
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	cursorSeq, cursorOffset, err := s.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		path := s.segmentPath(seq)
+		if seq < cursorSeq {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove replayed segment: %w", err)
+			}
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read segment %s: %w", name, err)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat segment %s: %w", name, err)
+		}
+		s.segments = append(s.segments, &segment{
+			seq:     seq,
+			size:    int64(len(data)),
+			entries: countLines(data),
+			modTime: info.ModTime(),
+		})
+		if seq == cursorSeq && cursorOffset <= int64(len(data)) {
+			s.readOffset = cursorOffset
+			s.readEntries = countLines(data[:cursorOffset])
+		}
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if len(s.segments) > 0 && s.segments[0].seq != cursorSeq {
+		s.readOffset, s.readEntries = 0, 0
+	}
+	return nil
+}
+
+// Append adds a record to the newest segment, dropping the oldest segments
+// if the spool grows past its size or age limits
+func (s *Spool) Append(rec Record) error {
+	if rec.SpooledAt.IsZero() {
+		rec.SpooledAt = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// NOTE: Not synced per record, the spool covers API outages rather than power loss
+	if _, err := s.active.Write(line); err != nil {
+		return fmt.Errorf("failed to append to spool: %w", err)
+	}
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(len(line))
+	seg.entries++
+	seg.modTime = time.Now()
+
+	if seg.size >= s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	return s.enforceLimits(time.Now())
+}
+
+// Peek returns up to n of the oldest records not yet acknowledged, none if
+// the spool is empty. A batch never spans segments, so it may be short.
+func (s *Spool) Peek(n int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enforceLimits(time.Now()); err != nil {
+		return nil, err
+	}
+	return s.peek(n)
+}
+
+func (s *Spool) peek(n int) ([]Record, error) {
+	for len(s.head) < n {
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(s.segments[0].seq))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open segment: %w", err)
+			}
+			if _, err := f.Seek(s.readOffset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to seek segment: %w", err)
+			}
+			s.reader, s.rbuf = f, bufio.NewReader(f)
+		}
+
+		line, err := s.rbuf.ReadBytes('\n')
+		if err == io.EOF {
+			if len(s.head) > 0 || len(s.segments) == 1 {
+				// End of the batch, or caught up with the segment being
+				// appended to; appends write whole lines
+				break
+			}
+			// A partial line here is from a crash mid-append and is skipped with the segment
+			if err := s.dropOldest(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment: %w", err)
+		}
+
+		s.headLen += int64(len(line))
+		s.headEntries++
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Metrics == nil {
+			spoolDrops.Inc()
+			continue
+		}
+		s.head = append(s.head, rec)
+	}
+	return s.head, nil
+}
+
+// Ack marks the records returned by Peek as delivered
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headEntries == 0 {
+		return nil
+	}
+	s.readOffset += s.headLen
+	s.readEntries += s.headEntries
+	s.head, s.headLen, s.headEntries = nil, 0, 0
+	return s.writeCursor()
+}
+
+// Depth is the number of records waiting to be replayed
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth()
+}
+
+func (s *Spool) depth() int {
+	n := -s.readEntries
+	for _, seg := range s.segments {
+		n += seg.entries
+	}
+	return n
+}
+
+// OldestAge is how long the oldest waiting record has been spooled, 0 when empty
+func (s *Spool) OldestAge() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.depth() == 0 {
+		return 0
+	}
+	head, err := s.peek(1)
+	if err != nil || len(head) == 0 {
+		return 0
+	}
+	return time.Since(head[0].SpooledAt)
+}
+
+// Close releases the segment files, an empty newest segment is removed
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	if last := s.segments[len(s.segments)-1]; last.size == 0 {
+		return os.Remove(s.segmentPath(last.seq))
+	}
+	return nil
+}
+
+// rotate starts a new segment for appends
+func (s *Spool) rotate() error {
+	seq := uint64(1)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if s.active != nil {
+		s.active.Close()
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{seq: seq, modTime: time.Now()})
+	return nil
+}
+
+// enforceLimits drops whole segments, oldest first, while the spool is too
+// large or its oldest segment was last written longer than maxAge ago
+func (s *Spool) enforceLimits(now time.Time) error {
+	for {
+		var total int64
+		for _, seg := range s.segments {
+			total += seg.size
+		}
+		oldest := s.segments[0]
+		expired := oldest.entries > 0 && now.Sub(oldest.modTime) > s.maxAge
+		if total <= s.maxBytes && !expired {
+			return nil
+		}
+
+		if len(s.segments) == 1 {
+			if oldest.size == 0 {
+				return nil
+			}
+			// Everything left is in the segment being appended to
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+
+		spoolDrops.Add(int64(oldest.entries - s.readEntries))
+		if err := s.dropOldest(); err != nil {
+			return err
+		}
+	}
+}
+
+// dropOldest deletes the oldest segment and moves replay to the next one
+func (s *Spool) dropOldest() error {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader, s.rbuf = nil, nil
+	}
+	oldest := s.segments[0]
+	if err := os.Remove(s.segmentPath(oldest.seq)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove segment: %w", err)
+	}
+	s.segments = s.segments[1:]
+	s.readOffset, s.readEntries = 0, 0
+	s.head, s.headLen, s.headEntries = nil, 0, 0
+	return s.writeCursor()
+}
+
+func (s *Spool) readCursor() (uint64, int64, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool cursor: %w", err)
+	}
+
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid spool cursor %q: %w", data, err)
+	}
+	return seq, offset, nil
+}
+
+// writeCursor saves the replay position, replacing the file atomically
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.dir, cursorFile)
+	data := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.readOffset)
+	if err := os.WriteFile(path+".tmp", []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to write spool cursor: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// countLines counts records, including a partial one left by a crash
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte{'\n'})
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package spool_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/spool"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// TEST: GIVEN records appended to a spool that is then closed and reopened
+// WHEN they are peeked and acknowledged
+// THEN they should come back in order with their recorded_at intact, and stay gone after another reopen
+func TestSpool_ReplaysInOrderAcrossRestarts(t *testing.T) {
+	cfg := config.Spool{Dir: t.TempDir(), SegmentBytes: 256}
+	sp := open(t, cfg)
+	for i, ts := range []string{"2024-01-01T00:00:00Z", "2024-01-01T00:00:01Z", "2024-01-01T00:00:02Z"} {
+		if err := sp.Append(record(i, ts)); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	sp.Close()
+
+	sp = open(t, cfg)
+	if depth := sp.Depth(); depth != 3 {
+		t.Fatalf("Expected depth 3 after reopen, got %d", depth)
+	}
+
+	// Acknowledge the first, then restart before the rest
+	first := peek(t, sp)
+	if first.Metrics.Metrics[0].RecordedAt != "2024-01-01T00:00:00Z" {
+		t.Errorf("Expected the oldest record first, got %+v", first.Metrics.Metrics[0])
+	}
+	if err := sp.Ack(); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	sp.Close()
+
+	sp = open(t, cfg)
+	for _, want := range []string{"2024-01-01T00:00:01Z", "2024-01-01T00:00:02Z"} {
+		rec := peek(t, sp)
+		if got := rec.Metrics.Metrics[0].RecordedAt; got != want {
+			t.Errorf("Expected recorded_at %s, got %s", want, got)
+		}
+		sp.Ack()
+	}
+	if recs, _ := sp.Peek(1); len(recs) != 0 || sp.Depth() != 0 {
+		t.Errorf("Expected an empty spool, got %+v (depth %d)", recs, sp.Depth())
+	}
+	sp.Close()
+
+	sp = open(t, cfg)
+	defer sp.Close()
+	if depth := sp.Depth(); depth != 0 {
+		t.Errorf("Expected acknowledged records to stay gone, got depth %d", depth)
+	}
+}
+
+// TEST: GIVEN a spool capped well below the size of the records appended
+// WHEN more records are appended than fit
+// THEN the oldest segments should be dropped and the newest records kept
+func TestSpool_SizeCapDropsOldest(t *testing.T) {
+	sp := open(t, config.Spool{Dir: t.TempDir(), SegmentBytes: 200, MaxBytes: 600})
+	defer sp.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := sp.Append(record(i, "2024-01-01T00:00:00Z")); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	depth := sp.Depth()
+	if depth == 0 || depth >= 50 {
+		t.Fatalf("Expected some but not all records kept, got %d", depth)
+	}
+	if last := lastRecord(t, sp); last.DeviceID != deviceID(49) {
+		t.Errorf("Expected the newest record to survive, got %s", last.DeviceID)
+	}
+}
+
+// TEST: GIVEN a spooled record whose segment was last written beyond the max age
+// WHEN the spool is reopened
+// THEN the record should be expired
+func TestSpool_MaxAgeExpires(t *testing.T) {
+	cfg := config.Spool{Dir: t.TempDir(), MaxAge: 60}
+	sp := open(t, cfg)
+	if err := sp.Append(record(0, "2024-01-01T00:00:00Z")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	sp.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(cfg.Dir, "*.seg"))
+	old := time.Now().Add(-time.Hour)
+	for _, seg := range segments {
+		os.Chtimes(seg, old, old)
+	}
+
+	sp = open(t, cfg)
+	defer sp.Close()
+	if depth := sp.Depth(); depth != 0 {
+		t.Errorf("Expected the expired record to be dropped, got depth %d", depth)
+	}
+}
+
+func open(t *testing.T, cfg config.Spool) *spool.Spool {
+	t.Helper()
+	sp, err := spool.Open(cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return sp
+}
+
+func peek(t *testing.T, sp *spool.Spool) *spool.Record {
+	t.Helper()
+	recs, err := sp.Peek(1)
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("Expected a record, got %v (%v)", recs, err)
+	}
+	return &recs[0]
+}
+
+func lastRecord(t *testing.T, sp *spool.Spool) *spool.Record {
+	t.Helper()
+	var last *spool.Record
+	for {
+		recs, err := sp.Peek(8)
+		if err != nil {
+			t.Fatalf("Peek failed: %v", err)
+		}
+		if len(recs) == 0 {
+			return last
+		}
+		last = &recs[len(recs)-1]
+		sp.Ack()
+	}
+}
+
+func deviceID(i int) string {
+	return fmt.Sprintf("device-%d", i)
+}
+
+func record(i int, recordedAt string) spool.Record {
+	return spool.Record{
+		DeviceID: deviceID(i),
+		Metrics: &metrics.DeviceMetrics{
+			Hostname: "edge",
+			Metrics:  []metrics.Metric{{Type: "uptime", Value: "1", Unit: "seconds", RecordedAt: recordedAt}},
+		},
+	}
+}
@@ -0,0 +1,382 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/retry"
+	"github.com/bxrne/beacon/aggregator/internal/selfmetrics"
+	"github.com/bxrne/beacon/aggregator/internal/spool"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	queueSize = 4096
+	// replayInterval is how often an idle spool is checked for records
+	replayInterval = time.Second
+
+	defaultBatchSize     = 100
+	defaultBatchInterval = time.Second
+	// maxBulkResponseBytes bounds the per-item results read back from the API
+	maxBulkResponseBytes = 1 << 20
+)
+
+var (
+	uploadRetries = selfmetrics.NewCounter("aggregator_upload_retries", "count")
+	uploadDrops   = selfmetrics.NewCounter("aggregator_upload_drops", "count")
+	uploadBatches = selfmetrics.NewCounter("aggregator_upload_batches", "count")
+)
+
+// Sample is one poll result waiting to be sent to the API
+type Sample struct {
+	DeviceID string
+	Metrics  *metrics.DeviceMetrics
+}
+
+// Submitter takes samples to forward without blocking, like the Uploader
+type Submitter interface {
+	Submit(s Sample) bool
+}
+
+// Uploader sends samples to the API from a queue with one shared keep-alive
+// client, so pollers never block on the API and shutdown can drain what is in
+// flight. Samples are batched into gzip compressed bulk requests, flushed when
+// a batch is full or its oldest sample has waited the batch interval. With a
+// spool, failed batches are kept on disk and retried from there with backoff
+// instead of holding up the queue.
+type Uploader struct {
+	cfg           *config.Config
+	logger        *log.Logger
+	client        *http.Client
+	policy        retry.Policy
+	spool         *spool.Spool
+	batchSize     int
+	batchInterval time.Duration
+	queue         chan Sample
+	stop          chan struct{}
+	wg            sync.WaitGroup
+
+	// ctx aborts retries once a drain has given up
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New creates an uploader, sp may be nil to drop samples once retries are exhausted
+func New(cfg *config.Config, logger *log.Logger, sp *spool.Spool) *Uploader {
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &Uploader{
+		cfg:    cfg,
+		logger: logger,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Telemetry.Timeout) * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		policy:        retry.NewPolicy(cfg.Telemetry),
+		spool:         sp,
+		batchSize:     cfg.Telemetry.BatchSize,
+		batchInterval: time.Duration(cfg.Telemetry.BatchInterval) * time.Millisecond,
+		queue:         make(chan Sample, queueSize),
+		stop:          make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	if u.batchSize <= 0 {
+		u.batchSize = defaultBatchSize
+	}
+	if u.batchInterval <= 0 {
+		u.batchInterval = defaultBatchInterval
+	}
+	u.policy.OnRetry = func(err error, delay time.Duration) {
+		uploadRetries.Inc()
+		logger.Warnf("Upload failed, retrying in %s: %v", delay, err)
+	}
+
+	selfmetrics.NewGaugeFunc("aggregator_upload_queue_depth", "count", func() int64 {
+		return int64(len(u.queue))
+	})
+	if sp != nil {
+		selfmetrics.NewGaugeFunc("aggregator_spool_depth", "count", func() int64 {
+			return int64(sp.Depth())
+		})
+		selfmetrics.NewGaugeFunc("aggregator_spool_oldest_age", "seconds", func() int64 {
+			return int64(sp.OldestAge().Seconds())
+		})
+	}
+	return u
+}
+
+// Start runs the upload worker, and the spool replayer if there is a spool,
+// until Drain is called
+func (u *Uploader) Start() {
+	u.wg.Add(1)
+	go u.run()
+
+	if u.spool != nil {
+		if depth := u.spool.Depth(); depth > 0 {
+			u.logger.Infof("Replaying %d spooled samples", depth)
+		}
+		u.wg.Add(1)
+		go u.replay()
+	}
+}
+
+// Submit queues a sample without blocking, it is dropped if the queue is full
+func (u *Uploader) Submit(s Sample) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return false
+	}
+
+	select {
+	case u.queue <- s:
+		return true
+	default:
+		uploadDrops.Inc()
+		u.logger.Warnf("Upload queue full, dropping metrics from %s", s.DeviceID)
+		return false
+	}
+}
+
+// Drain stops accepting samples and waits for queued ones to be sent, or
+// for ctx to end
+func (u *Uploader) Drain(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.closed {
+		u.closed = true
+		close(u.queue)
+		close(u.stop)
+	}
+	u.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Abort requests in flight, what is left is spooled or dropped quickly
+		queued := len(u.queue)
+		u.cancel()
+		<-done
+		return fmt.Errorf("gave up draining with %d samples queued: %w", queued, ctx.Err())
+	}
+}
+
+// run collects queued samples into batches and uploads them
+func (u *Uploader) run() {
+	defer u.wg.Done()
+
+	batch := make([]Sample, 0, u.batchSize)
+	timer := time.NewTimer(u.batchInterval)
+	timer.Stop()
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			u.upload(batch)
+			batch = make([]Sample, 0, u.batchSize)
+		}
+		timer.Stop()
+	}
+
+	for {
+		select {
+		case s, ok := <-u.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == 1 {
+				timer.Reset(u.batchInterval)
+			}
+			if len(batch) >= u.batchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// upload sends a batch. Without a spool transient failures are retried and
+// the batch is dropped if they persist. With one, a failed batch is spooled,
+// and while a backlog exists new batches queue behind it in order. Samples
+// the API rejects are dropped either way.
+func (u *Uploader) upload(batch []Sample) {
+	if u.spool == nil {
+		err := retry.Do(u.ctx, u.policy, func(ctx context.Context) error {
+			return u.send(ctx, batch)
+		})
+		if err != nil {
+			uploadDrops.Add(int64(len(batch)))
+			u.logger.Errorf("Failed to send %d samples to API, dropping: %v", len(batch), err)
+		}
+		return
+	}
+
+	if u.spool.Depth() == 0 {
+		err := u.send(u.ctx, batch)
+		if err == nil {
+			return
+		}
+		if !retry.IsRetryable(err) && u.ctx.Err() == nil {
+			uploadDrops.Add(int64(len(batch)))
+			u.logger.Errorf("Failed to send %d samples to API, dropping: %v", len(batch), err)
+			return
+		}
+		u.logger.Warnf("Failed to send %d samples to API, spooling: %v", len(batch), err)
+	}
+
+	for _, s := range batch {
+		if err := u.spool.Append(spool.Record{DeviceID: s.DeviceID, Metrics: s.Metrics}); err != nil {
+			uploadDrops.Inc()
+			u.logger.Errorf("Failed to spool metrics from %s, dropping: %v", s.DeviceID, err)
+		}
+	}
+}
+
+// replay sends spooled samples oldest first, backing off while the API is down
+func (u *Uploader) replay() {
+	defer u.wg.Done()
+
+	failures := 0
+	delay := replayInterval
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-u.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := u.replaySpool()
+		if err == nil {
+			failures, delay = 0, replayInterval
+			continue
+		}
+
+		uploadRetries.Inc()
+		delay = max(u.policy.DelayFor(err, failures), replayInterval)
+		failures++
+		u.logger.Warnf("Spool replay failed with %d samples waiting, retrying in %s: %v", u.spool.Depth(), delay, err)
+	}
+}
+
+// replaySpool sends spooled batches until the spool is empty or the API
+// fails with a retryable error
+func (u *Uploader) replaySpool() error {
+	for {
+		select {
+		case <-u.stop:
+			return nil
+		default:
+		}
+
+		records, err := u.spool.Peek(u.batchSize)
+		if err != nil {
+			u.logger.Errorf("Failed to read spool: %v", err)
+			return nil
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		batch := make([]Sample, len(records))
+		for i, rec := range records {
+			batch[i] = Sample{DeviceID: rec.DeviceID, Metrics: rec.Metrics}
+		}
+		if err := u.send(u.ctx, batch); err != nil {
+			if retry.IsRetryable(err) || u.ctx.Err() != nil {
+				return err
+			}
+			uploadDrops.Add(int64(len(batch)))
+			u.logger.Errorf("API rejected %d spooled samples, dropping: %v", len(batch), err)
+		}
+		if err := u.spool.Ack(); err != nil {
+			u.logger.Errorf("Failed to advance spool: %v", err)
+			return nil
+		}
+	}
+}
+
+// send posts a batch to the bulk endpoint. An error means nothing was stored;
+// samples rejected individually are counted and logged here.
+func (u *Uploader) send(ctx context.Context, batch []Sample) error {
+	bulk := metrics.BulkRequest{Samples: make([]metrics.BulkSample, len(batch))}
+	for i, s := range batch {
+		bulk.Samples[i] = metrics.BulkSample{DeviceID: s.DeviceID, Hostname: s.Metrics.Hostname, Metrics: s.Metrics.Metrics}
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if err := json.NewEncoder(zw).Encode(bulk); err != nil {
+		return fmt.Errorf("failed to marshal metrics: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress metrics: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/api/metric/bulk", u.cfg.Telemetry.Server)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return retry.Retryable(fmt.Errorf("failed to send metrics: %w", err))
+	}
+	defer resp.Body.Close()
+	// Read to the end so the connection can be reused
+	defer io.Copy(io.Discard, io.LimitReader(resp.Body, maxBulkResponseBytes))
+
+	if err := retry.CheckResponse(resp); err != nil {
+		return err
+	}
+	uploadBatches.Inc()
+
+	var result metrics.BulkResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBulkResponseBytes)).Decode(&result); err != nil {
+		// Stored already, so not worth failing the batch over
+		u.logger.Warnf("Failed to decode bulk upload results: %v", err)
+		return nil
+	}
+	if result.Rejected > 0 {
+		uploadDrops.Add(int64(result.Rejected))
+		for _, r := range result.Results {
+			if r.Status != "ok" {
+				u.logger.Errorf("API rejected metrics from %s: %s", r.DeviceID, r.Error)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package uploader_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/internal/config"
+	"github.com/bxrne/beacon/aggregator/internal/spool"
+	"github.com/bxrne/beacon/aggregator/internal/uploader"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/charmbracelet/log"
+)
+
+// fakeAPI decodes bulk uploads and records the device IDs it stored, in order
+type fakeAPI struct {
+	t     *testing.T
+	calls atomic.Int32
+	// status is returned instead of storing when set
+	status atomic.Int32
+
+	mu      sync.Mutex
+	devices []string
+	batches []int
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	if r.URL.Path != "/api/metric/bulk" || r.Header.Get("Content-Encoding") != "gzip" {
+		f.t.Errorf("Expected a gzip bulk upload, got %s with encoding %q", r.URL.Path, r.Header.Get("Content-Encoding"))
+	}
+	if status := f.status.Load(); status != 0 {
+		w.WriteHeader(int(status))
+		return
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		f.t.Errorf("Invalid gzip body: %v", err)
+		return
+	}
+	var req metrics.BulkRequest
+	if err := json.NewDecoder(zr).Decode(&req); err != nil {
+		f.t.Errorf("Invalid bulk body: %v", err)
+		return
+	}
+
+	resp := metrics.BulkResponse{}
+	f.mu.Lock()
+	f.batches = append(f.batches, len(req.Samples))
+	for _, s := range req.Samples {
+		if s.DeviceID == "bad:80" {
+			resp.Rejected++
+			resp.Results = append(resp.Results, metrics.BulkResult{DeviceID: s.DeviceID, Status: "error", Error: "rejected"})
+			continue
+		}
+		f.devices = append(f.devices, s.DeviceID)
+		resp.Accepted++
+		resp.Results = append(resp.Results, metrics.BulkResult{DeviceID: s.DeviceID, Status: "ok"})
+	}
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeAPI) stored() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.devices...)
+}
+
+// TEST: GIVEN five samples queued with a batch size of two
+// WHEN Drain is called
+// THEN every sample should be sent in three gzip bulk requests
+func TestDrain_SendsQueuedSamplesInBatches(t *testing.T) {
+	api := &fakeAPI{t: t}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	up := newUploader(server.URL, nil)
+	up.Start()
+	for i := 0; i < 5; i++ {
+		if !up.Submit(sample("device:80")) {
+			t.Fatalf("Expected sample %d to be queued", i)
+		}
+	}
+
+	if err := up.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if got := len(api.stored()); got != 5 {
+		t.Errorf("Expected 5 samples stored, got %d", got)
+	}
+	if got := api.calls.Load(); got != 3 {
+		t.Errorf("Expected 3 bulk requests, got %d (%v)", got, api.batches)
+	}
+	if up.Submit(sample("device:80")) {
+		t.Error("Expected Submit to refuse samples after Drain")
+	}
+}
+
+// TEST: GIVEN a partial batch and a long batch size
+// WHEN the batch interval passes
+// THEN the partial batch should be flushed without waiting for Drain
+func TestUpload_FlushesOnInterval(t *testing.T) {
+	api := &fakeAPI{t: t}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.Telemetry.BatchSize = 1000
+	cfg.Telemetry.BatchInterval = 50
+	up := uploader.New(cfg, log.New(io.Discard), nil)
+	up.Start()
+	defer up.Drain(context.Background())
+
+	up.Submit(sample("device:80"))
+	waitFor(t, func() bool { return len(api.stored()) == 1 })
+}
+
+// TEST: GIVEN an API that is unavailable once and rejects one sample outright
+// WHEN a batch is uploaded
+// THEN the batch should be retried once and the rejected sample not retried
+func TestUpload_RetriesTransientFailures(t *testing.T) {
+	api := &fakeAPI{t: t}
+	api.status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.ServeHTTP(w, r)
+		api.status.Store(0)
+	}))
+	defer server.Close()
+
+	up := newUploader(server.URL, nil)
+	up.Start()
+	up.Submit(sample("good:80"))
+	up.Submit(sample("bad:80"))
+
+	if err := up.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if got := api.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 requests (one retry), got %d", got)
+	}
+	if got := api.stored(); len(got) != 1 || got[0] != "good:80" {
+		t.Errorf("Expected only good:80 stored, got %v", got)
+	}
+}
+
+// TEST: GIVEN an API that is down while samples are uploaded with a spool
+// WHEN the API comes back
+// THEN the spooled samples should be replayed in the order they were taken
+func TestUpload_SpoolsAndReplaysInOrder(t *testing.T) {
+	api := &fakeAPI{t: t}
+	api.status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	sp, err := spool.Open(config.Spool{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	defer sp.Close()
+
+	up := newUploader(server.URL, sp)
+	up.Start()
+	defer up.Drain(context.Background())
+
+	ids := []string{"a:80", "b:80", "c:80"}
+	for _, id := range ids {
+		up.Submit(sample(id))
+	}
+	waitFor(t, func() bool { return sp.Depth() == len(ids) })
+
+	api.status.Store(0)
+	waitFor(t, func() bool { return len(api.stored()) == len(ids) })
+	for i, got := range api.stored() {
+		if got != ids[i] {
+			t.Errorf("Expected %s at position %d, got %s", ids[i], i, got)
+		}
+	}
+	waitFor(t, func() bool { return sp.Depth() == 0 })
+}
+
+// TEST: GIVEN an API that never answers
+// WHEN Drain is called with a short deadline
+// THEN it should give up with the context error
+func TestDrain_HonoursDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	up := newUploader(server.URL, nil)
+	up.Start()
+	up.Submit(sample("device:80"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := up.Drain(ctx); err == nil {
+		t.Error("Expected Drain to time out, got nil")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testConfig(server string) *config.Config {
+	return &config.Config{Telemetry: config.Telemetry{Server: server, Timeout: 10, RetryInterval: 1, BatchSize: 2, BatchInterval: 1000}}
+}
+
+func newUploader(server string, sp *spool.Spool) *uploader.Uploader {
+	return uploader.New(testConfig(server), log.New(io.Discard), sp)
+}
+
+func sample(deviceID string) uploader.Sample {
+	return uploader.Sample{
+		DeviceID: deviceID,
+		Metrics: &metrics.DeviceMetrics{
+			Hostname: "device",
+			Metrics:  []metrics.Metric{{Type: "uptime", Value: "10", Unit: "seconds", RecordedAt: "2024-01-01T00:00:00Z"}},
+		},
+	}
+}
@@ -0,0 +1,107 @@
+package bproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// INFO: Two frame layouts are understood.
+// v1 (diorama): STX | LEN (1 byte) | PAYLOAD | ETX
+// v2:           SOH | VERSION | TYPE | LEN (4 bytes, big endian) | PAYLOAD | CRC32 (4 bytes, big endian)
+// The v2 CRC32 (IEEE) covers VERSION through PAYLOAD. The first byte tells
+// the layouts apart, so a v1 length byte can never be mistaken for a version.
+// v3 shares the v2 layout; only the metrics payload encoding differs, text
+// ("key: value, ...") up to v2 and JSON from v3.
+const (
+	StartByte   = 0x02 // STX, starts a v1 frame
+	EndByte     = 0x03 // ETX, ends a v1 frame
+	HeadingByte = 0x01 // SOH, starts a v2 frame
+
+	Version1 byte = 1
+	Version2 byte = 2
+	Version3 byte = 3 // v2 layout with a structured JSON metrics payload
+
+	// VersionHeader is sent by the aggregator with the highest version it decodes
+	VersionHeader = "X-Bproto-Version"
+
+	v1Overhead   = 3
+	v2HeaderSize = 7
+	v2Overhead   = v2HeaderSize + 4
+
+	// MaxV1Payload is all a single length byte can describe
+	MaxV1Payload = 0xFF
+	// MaxPayload bounds v2 frames unless a decoder is configured otherwise
+	MaxPayload = 1 << 20
+
+	// ContentType marks HTTP bodies that are bproto frames
+	ContentType = "application/x-bproto"
+)
+
+type MessageType byte
+
+const (
+	TypeMetrics       MessageType = 0x01
+	TypeCommand       MessageType = 0x02
+	TypeCommandResult MessageType = 0x03
+)
+
+var (
+	ErrBadStart  = errors.New("bproto: invalid start byte")
+	ErrBadEnd    = errors.New("bproto: invalid end byte")
+	ErrVersion   = errors.New("bproto: unsupported version")
+	ErrTruncated = errors.New("bproto: truncated frame")
+	ErrChecksum  = errors.New("bproto: checksum mismatch")
+	ErrOversize  = errors.New("bproto: frame exceeds maximum size")
+)
+
+// Frame is a decoded message. v1 frames carry no type and decode as TypeMetrics.
+type Frame struct {
+	Version byte
+	Type    MessageType
+	Payload []byte
+}
+
+// Encode serialises the frame in the layout of its version
+func Encode(f Frame) ([]byte, error) {
+	switch f.Version {
+	case Version1:
+		if len(f.Payload) > MaxV1Payload {
+			return nil, fmt.Errorf("%w: %d byte payload does not fit a v1 frame", ErrOversize, len(f.Payload))
+		}
+		msg := make([]byte, 0, len(f.Payload)+v1Overhead)
+		msg = append(msg, StartByte, byte(len(f.Payload)))
+		msg = append(msg, f.Payload...)
+		return append(msg, EndByte), nil
+	case Version2, Version3:
+		if len(f.Payload) > MaxPayload {
+			return nil, fmt.Errorf("%w: %d byte payload", ErrOversize, len(f.Payload))
+		}
+		msg := make([]byte, v2HeaderSize, len(f.Payload)+v2Overhead)
+		msg[0] = HeadingByte
+		msg[1] = f.Version
+		msg[2] = byte(f.Type)
+		binary.BigEndian.PutUint32(msg[3:], uint32(len(f.Payload)))
+		msg = append(msg, f.Payload...)
+		return binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg[1:])), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrVersion, f.Version)
+	}
+}
+
+// Decode reads one frame from the start of data and returns it with the
+// number of bytes it occupied
+func Decode(data []byte) (*Frame, int, error) {
+	r := NewReader(bytes.NewReader(data))
+	frame, err := r.ReadFrame()
+	if err == io.EOF {
+		err = ErrTruncated
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return frame, int(r.consumed), nil
+}
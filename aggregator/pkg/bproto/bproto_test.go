@@ -0,0 +1,134 @@
+package bproto_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// TEST: GIVEN a payload larger than a v1 length byte can describe
+// WHEN it is encoded and decoded as a v2 frame
+// THEN the payload, version and type should survive intact
+func TestEncodeDecode_V2RoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("disk_used: 42.00, ", 40))
+	frame := bproto.Frame{Version: bproto.Version2, Type: bproto.TypeMetrics, Payload: payload}
+
+	data, err := bproto.Encode(frame)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	got, n, err := bproto.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("Expected %d bytes consumed, got %d", len(data), n)
+	}
+	if got.Version != bproto.Version2 || got.Type != bproto.TypeMetrics || !bytes.Equal(got.Payload, payload) {
+		t.Errorf("Frame mismatch\nGot: %+v\nWant: %+v", got, frame)
+	}
+}
+
+// TEST: GIVEN a v1 frame as sent by the diorama
+// WHEN it is decoded
+// THEN it should return the payload as a v1 metrics frame
+func TestDecode_V1(t *testing.T) {
+	payload := "car_light: green, ped_light: red, recorded_at: 2024-01-01T00:00:00Z"
+	data := append([]byte{bproto.StartByte, byte(len(payload))}, payload...)
+	data = append(data, bproto.EndByte)
+
+	got, n, err := bproto.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if string(got.Payload) != payload || got.Version != bproto.Version1 || n != len(data) {
+		t.Errorf("Unexpected frame %+v (%d bytes)", got, n)
+	}
+}
+
+// TEST: GIVEN a v2 frame with a flipped payload bit
+// WHEN it is decoded
+// THEN it should return ErrChecksum
+func TestDecode_BadChecksum(t *testing.T) {
+	data, err := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeMetrics, Payload: []byte("uptime: 10")})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data[9] ^= 0x01
+
+	if _, _, err := bproto.Decode(data); !errors.Is(err, bproto.ErrChecksum) {
+		t.Errorf("Expected ErrChecksum, got %v", err)
+	}
+}
+
+// TEST: GIVEN frames cut short or payloads too large for their version
+// WHEN they are encoded or decoded
+// THEN it should return ErrTruncated or ErrOversize
+func TestDecode_TruncatedAndOversize(t *testing.T) {
+	data, err := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeMetrics, Payload: []byte("uptime: 10")})
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	for _, cut := range []int{1, 5, len(data) - 1} {
+		if _, _, err := bproto.Decode(data[:cut]); !errors.Is(err, bproto.ErrTruncated) {
+			t.Errorf("Expected ErrTruncated at %d bytes, got %v", cut, err)
+		}
+	}
+
+	if _, err := bproto.Encode(bproto.Frame{Version: bproto.Version1, Payload: make([]byte, 256)}); !errors.Is(err, bproto.ErrOversize) {
+		t.Errorf("Expected ErrOversize for v1, got %v", err)
+	}
+
+	header := []byte{bproto.HeadingByte, bproto.Version2, byte(bproto.TypeMetrics), 0xFF, 0xFF, 0xFF, 0xFF}
+	if _, _, err := bproto.Decode(header); !errors.Is(err, bproto.ErrOversize) {
+		t.Errorf("Expected ErrOversize for huge declared length, got %v", err)
+	}
+}
+
+// TEST: GIVEN device metrics with units, labels and distinct timestamps
+// WHEN they are encoded for v3 and decoded
+// THEN every field should survive, including values with separators
+func TestEncodeDecodeMetrics_V3(t *testing.T) {
+	dm := &metrics.DeviceMetrics{
+		Hostname: "edge-1",
+		Metrics: []metrics.Metric{
+			{Type: "disk_used", Value: "12.50", Unit: "percent", Labels: map[string]string{"path": "/var"}, RecordedAt: "2024-01-01T00:00:00Z"},
+			{Type: "note", Value: "a, b: c", Unit: "text", RecordedAt: "2024-01-01T00:00:05Z"},
+		},
+	}
+
+	data, err := bproto.EncodeMetrics(bproto.Version3, dm)
+	if err != nil {
+		t.Fatalf("EncodeMetrics failed: %v", err)
+	}
+	frame, _, err := bproto.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	got, err := bproto.DecodeMetrics(frame)
+	if err != nil {
+		t.Fatalf("DecodeMetrics failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, dm) {
+		t.Errorf("Metrics mismatch\nGot: %+v\nWant: %+v", got, dm)
+	}
+}
+
+// TEST: GIVEN peers advertising various versions
+// WHEN Negotiate is called
+// THEN it should answer with v2 by default and never above v3
+func TestNegotiate(t *testing.T) {
+	cases := map[string]byte{"": bproto.Version2, "1": bproto.Version2, "2": bproto.Version2, "3": bproto.Version3, "9": bproto.Version3}
+	for requested, want := range cases {
+		if got := bproto.Negotiate(requested); got != want {
+			t.Errorf("Negotiate(%q) = %d, want %d", requested, got, want)
+		}
+	}
+}
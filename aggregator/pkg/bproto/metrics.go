@@ -0,0 +1,56 @@
+package bproto
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+// Negotiate picks the frame version to answer with from the peer's
+// VersionHeader. Peers that send none get v2.
+func Negotiate(requested string) byte {
+	v, err := strconv.Atoi(requested)
+	if err != nil || v < int(Version2) {
+		return Version2
+	}
+	if v > int(Version3) {
+		return Version3
+	}
+	return byte(v)
+}
+
+// EncodeMetrics frames device metrics using the payload encoding of version
+func EncodeMetrics(version byte, dm *metrics.DeviceMetrics) ([]byte, error) {
+	var payload []byte
+	if version >= Version3 {
+		body, err := json.Marshal(dm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal metrics: %w", err)
+		}
+		payload = body
+	} else {
+		payload = []byte(dm.String())
+	}
+
+	return Encode(Frame{Version: version, Type: TypeMetrics, Payload: payload})
+}
+
+// DecodeMetrics decodes the structured payload of a v3 metrics frame
+func DecodeMetrics(frame *Frame) (*metrics.DeviceMetrics, error) {
+	if frame.Version < Version3 {
+		return nil, fmt.Errorf("%w: v%d metrics are text", ErrVersion, frame.Version)
+	}
+
+	var dm metrics.DeviceMetrics
+	if err := json.Unmarshal(frame.Payload, &dm); err != nil {
+		return nil, fmt.Errorf("failed to decode metrics: %w", err)
+	}
+	for i, m := range dm.Metrics {
+		if m.Type == "" || m.RecordedAt == "" {
+			return nil, fmt.Errorf("metric %d is missing type or recorded_at", i)
+		}
+	}
+	return &dm, nil
+}
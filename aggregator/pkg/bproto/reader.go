@@ -0,0 +1,137 @@
+package bproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Deadliner is implemented by net.Conn
+type Deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Reader decodes consecutive frames from a stream, tolerating partial reads
+type Reader struct {
+	br         *bufio.Reader
+	maxPayload int
+	deadliner  Deadliner
+	timeout    time.Duration
+	consumed   int64
+}
+
+type ReaderOption func(*Reader)
+
+// WithMaxPayload rejects v2 frames declaring more than n payload bytes
+func WithMaxPayload(n int) ReaderOption {
+	return func(r *Reader) {
+		r.maxPayload = n
+	}
+}
+
+// WithReadTimeout sets a read deadline of now+timeout on d before every frame
+func WithReadTimeout(d Deadliner, timeout time.Duration) ReaderOption {
+	return func(r *Reader) {
+		r.deadliner = d
+		r.timeout = timeout
+	}
+}
+
+func NewReader(r io.Reader, opts ...ReaderOption) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	reader := &Reader{br: br, maxPayload: MaxPayload}
+	for _, opt := range opts {
+		opt(reader)
+	}
+	return reader
+}
+
+// ReadFrame returns the next frame. It returns io.EOF only when the stream
+// ends cleanly between frames; an end inside a frame is ErrTruncated.
+func (r *Reader) ReadFrame() (*Frame, error) {
+	if r.deadliner != nil && r.timeout > 0 {
+		if err := r.deadliner.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	start, err := r.br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	r.consumed++
+
+	switch start {
+	case StartByte:
+		length, err := r.br.ReadByte()
+		if err != nil {
+			return nil, truncated(err)
+		}
+		r.consumed++
+
+		body, err := r.read(int(length) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if end := body[length]; end != EndByte {
+			return nil, fmt.Errorf("%w: got %x instead of %x", ErrBadEnd, end, EndByte)
+		}
+		return &Frame{Version: Version1, Type: TypeMetrics, Payload: body[:length]}, nil
+
+	case HeadingByte:
+		header, err := r.read(v2HeaderSize - 1)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != Version2 && header[0] != Version3 {
+			return nil, fmt.Errorf("%w: %d", ErrVersion, header[0])
+		}
+		length := binary.BigEndian.Uint32(header[2:])
+		if uint64(length) > uint64(r.maxPayload) {
+			return nil, fmt.Errorf("%w: declared %d bytes, limit %d", ErrOversize, length, r.maxPayload)
+		}
+
+		body, err := r.read(int(length) + 4)
+		if err != nil {
+			return nil, err
+		}
+		payload := body[:length]
+
+		crc := crc32.NewIEEE()
+		crc.Write(header)
+		crc.Write(payload)
+		if binary.BigEndian.Uint32(body[length:]) != crc.Sum32() {
+			return nil, ErrChecksum
+		}
+		return &Frame{Version: header[0], Type: MessageType(header[1]), Payload: payload}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: got %x", ErrBadStart, start)
+	}
+}
+
+func (r *Reader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(r.br, buf)
+	r.consumed += int64(read)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	return buf, nil
+}
+
+// truncated maps a stream ending mid-frame to ErrTruncated, keeping other
+// errors such as deadlines intact
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrTruncated, err)
+	}
+	return err
+}
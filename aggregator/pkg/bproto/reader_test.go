@@ -0,0 +1,80 @@
+package bproto_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
+)
+
+// TEST: GIVEN a v1 and a v2 frame back to back, delivered one byte per read
+// WHEN ReadFrame is called repeatedly
+// THEN it should return both frames and then io.EOF
+func TestReader_MultipleFramesPartialReads(t *testing.T) {
+	v1, _ := bproto.Encode(bproto.Frame{Version: bproto.Version1, Payload: []byte("car_light: red")})
+	v2, _ := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeCommandResult, Payload: []byte(`{"status":"success"}`)})
+
+	r := bproto.NewReader(iotest.OneByteReader(bytes.NewReader(append(v1, v2...))))
+
+	first, err := r.ReadFrame()
+	if err != nil || string(first.Payload) != "car_light: red" {
+		t.Fatalf("Unexpected first frame %+v: %v", first, err)
+	}
+	second, err := r.ReadFrame()
+	if err != nil || second.Type != bproto.TypeCommandResult || string(second.Payload) != `{"status":"success"}` {
+		t.Fatalf("Unexpected second frame %+v: %v", second, err)
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+// TEST: GIVEN a stream that ends inside a frame
+// WHEN ReadFrame is called
+// THEN it should return ErrTruncated rather than io.EOF
+func TestReader_Truncated(t *testing.T) {
+	data, _ := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeMetrics, Payload: []byte("uptime: 1")})
+
+	r := bproto.NewReader(bytes.NewReader(data[:len(data)-2]))
+	if _, err := r.ReadFrame(); !errors.Is(err, bproto.ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+}
+
+// TEST: GIVEN a reader with a small maximum payload
+// WHEN a larger v2 frame arrives
+// THEN it should return ErrOversize without reading the payload
+func TestReader_MaxPayload(t *testing.T) {
+	data, _ := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeMetrics, Payload: make([]byte, 64)})
+
+	r := bproto.NewReader(bytes.NewReader(data), bproto.WithMaxPayload(32))
+	if _, err := r.ReadFrame(); !errors.Is(err, bproto.ErrOversize) {
+		t.Errorf("Expected ErrOversize, got %v", err)
+	}
+}
+
+// TEST: GIVEN a connection whose peer never sends a full frame
+// WHEN ReadFrame is called with a read timeout
+// THEN it should fail with a deadline error instead of blocking
+func TestReader_ReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go server.Write([]byte{bproto.HeadingByte, bproto.Version2})
+
+	r := bproto.NewReader(client, bproto.WithReadTimeout(client, 50*time.Millisecond))
+	start := time.Now()
+	if _, err := r.ReadFrame(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("ReadFrame blocked past its deadline")
+	}
+}
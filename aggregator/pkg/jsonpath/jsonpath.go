@@ -0,0 +1,152 @@
+package jsonpath
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// INFO: Just enough JSONPath to pick values out of a device's JSON reply:
+// $ for the root, .key and ['key'] for object members, [n] for array
+// elements and .* or [*] for every member or element. Filters, slices and
+// recursive descent are not supported.
+
+type stepKind int
+
+const (
+	member stepKind = iota
+	element
+	wildcard
+)
+
+type step struct {
+	kind  stepKind
+	key   string
+	index int
+}
+
+// Path is a compiled JSONPath expression
+type Path struct {
+	expr  string
+	steps []step
+}
+
+// Match is a value a path found, with the keys or indexes its wildcards
+// stood for, in order
+type Match struct {
+	Value any
+	Keys  []string
+}
+
+// Compile parses a JSONPath expression
+func Compile(expr string) (*Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("jsonpath %q: must start with $", expr)
+	}
+	p := &Path{expr: expr}
+	rest := expr[1:]
+	for rest != "" {
+		var s step
+		var err error
+		switch rest[0] {
+		case '.':
+			s, rest, err = parseDot(rest[1:])
+		case '[':
+			s, rest, err = parseBracket(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected %q", rest[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jsonpath %q: %w", expr, err)
+		}
+		p.steps = append(p.steps, s)
+	}
+	return p, nil
+}
+
+func parseDot(rest string) (step, string, error) {
+	end := strings.IndexAny(rest, ".[")
+	if end < 0 {
+		end = len(rest)
+	}
+	name := rest[:end]
+	switch name {
+	case "":
+		return step{}, "", fmt.Errorf("empty member name")
+	case "*":
+		return step{kind: wildcard}, rest[end:], nil
+	}
+	return step{kind: member, key: name}, rest[end:], nil
+}
+
+func parseBracket(rest string) (step, string, error) {
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return step{}, "", fmt.Errorf("unclosed [")
+	}
+	inner, rest := rest[:end], rest[end+1:]
+	switch {
+	case inner == "*":
+		return step{kind: wildcard}, rest, nil
+	case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+		return step{kind: member, key: inner[1 : len(inner)-1]}, rest, nil
+	}
+	n, err := strconv.Atoi(inner)
+	if err != nil || n < 0 {
+		return step{}, "", fmt.Errorf("invalid index [%s]", inner)
+	}
+	return step{kind: element, index: n}, rest, nil
+}
+
+// String returns the expression the path was compiled from
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Find returns every value the path reaches in doc, a value decoded by
+// encoding/json. Object members under a wildcard come in key order.
+func (p *Path) Find(doc any) []Match {
+	matches := []Match{{Value: doc}}
+	for _, s := range p.steps {
+		var next []Match
+		for _, m := range matches {
+			next = append(next, s.apply(m)...)
+		}
+		matches = next
+	}
+	return matches
+}
+
+func (s step) apply(m Match) []Match {
+	switch v := m.Value.(type) {
+	case map[string]any:
+		switch s.kind {
+		case member:
+			if child, ok := v[s.key]; ok {
+				return []Match{{Value: child, Keys: m.Keys}}
+			}
+		case wildcard:
+			out := make([]Match, 0, len(v))
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				out = append(out, Match{Value: v[key], Keys: append(slices.Clone(m.Keys), key)})
+			}
+			return out
+		}
+	case []any:
+		switch s.kind {
+		case element:
+			if s.index < len(v) {
+				return []Match{{Value: v[s.index], Keys: m.Keys}}
+			}
+		case wildcard:
+			out := make([]Match, 0, len(v))
+			for i, child := range v {
+				out = append(out, Match{Value: child, Keys: append(slices.Clone(m.Keys), strconv.Itoa(i))})
+			}
+			return out
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package jsonpath_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/bxrne/beacon/aggregator/pkg/jsonpath"
+)
+
+const doc = `{
+	"uptime": 42,
+	"battery": {"percent": 80, "charging": true},
+	"sensors": [{"name": "inside", "temp": 21.5}, {"name": "outside", "temp": 9}],
+	"fans": {"cpu": 1200, "case": 800},
+	"odd key": "x"
+}`
+
+// TEST: GIVEN a JSON document
+// WHEN paths with members, indexes, quoted keys and wildcards are found
+// THEN each should return the values and the keys the wildcards stood for
+func TestPath_Find(t *testing.T) {
+	var v any
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want []jsonpath.Match
+	}{
+		{"$.uptime", []jsonpath.Match{{Value: 42.0}}},
+		{"$.battery.charging", []jsonpath.Match{{Value: true}}},
+		{"$['odd key']", []jsonpath.Match{{Value: "x"}}},
+		{"$.sensors[1].temp", []jsonpath.Match{{Value: 9.0}}},
+		{"$.sensors[*].temp", []jsonpath.Match{{Value: 21.5, Keys: []string{"0"}}, {Value: 9.0, Keys: []string{"1"}}}},
+		{"$.fans.*", []jsonpath.Match{{Value: 800.0, Keys: []string{"case"}}, {Value: 1200.0, Keys: []string{"cpu"}}}},
+		{"$.missing", nil},
+		{"$.sensors[5]", nil},
+	}
+	for _, tt := range tests {
+		p, err := jsonpath.Compile(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := p.Find(v); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %+v, got %+v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+// TEST: GIVEN malformed expressions
+// WHEN they are compiled
+// THEN each should be refused
+func TestCompile_Invalid(t *testing.T) {
+	for _, expr := range []string{"uptime", "$.", "$[", "$[-1]", "$[x]", "$..a", "$x"} {
+		if _, err := jsonpath.Compile(expr); err == nil {
+			t.Errorf("Expected %q to be refused", expr)
+		}
+	}
+}
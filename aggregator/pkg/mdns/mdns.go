@@ -0,0 +1,378 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// INFO: Just enough DNS-SD over multicast DNS (RFC 6762, RFC 6763) for daemons
+// to advertise themselves and the aggregator to find them. The browser sends
+// one-shot queries from an ephemeral port, so responders answer it directly by
+// unicast and it never has to share port 5353 with a system mDNS daemon.
+const (
+	// Service is the DNS-SD service type daemons advertise
+	Service = "_beacon._tcp"
+	// Domain is the multicast DNS domain
+	Domain = "local."
+
+	// unicastTTL caps record TTLs in replies to one-shot queries (RFC 6762 §6.7)
+	unicastTTL = 10
+	// multicastTTL is the TTL for host and service records sent to the group
+	multicastTTL = 120
+
+	maxMessageSize = 9000
+
+	// unicastBit is the top bit of a question's class, asking for a unicast reply
+	unicastBit dnsmessage.Class = 1 << 15
+)
+
+// GroupAddr is the IPv4 multicast DNS group
+var GroupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Instance is one advertised service instance
+type Instance struct {
+	Name string            // Instance label, e.g. the hostname
+	Host string            // Host name without the domain
+	Port int               // Port the service listens on
+	IPs  []net.IP          // Addresses of the host, IPv4 only
+	Text map[string]string // TXT key/value pairs
+}
+
+// serviceName is the fully qualified service type, e.g. _beacon._tcp.local.
+func serviceName() string {
+	return Service + "." + Domain
+}
+
+// instanceName is the fully qualified instance name. Dots would split the
+// label, so they are replaced.
+func (i Instance) instanceName() string {
+	return strings.ReplaceAll(i.Name, ".", "-") + "." + serviceName()
+}
+
+func (i Instance) hostName() string {
+	return strings.ReplaceAll(i.Host, ".", "-") + "." + Domain
+}
+
+// ListenGroup joins the multicast DNS group on all interfaces for a responder
+func ListenGroup() (net.PacketConn, error) {
+	return net.ListenMulticastUDP("udp4", nil, GroupAddr)
+}
+
+// Responder answers queries for the service type with a single instance
+type Responder struct {
+	conn     net.PacketConn
+	instance Instance
+}
+
+func NewResponder(conn net.PacketConn, instance Instance) *Responder {
+	return &Responder{conn: conn, instance: instance}
+}
+
+// Serve answers queries until ctx is done. The conn is closed on return.
+func (r *Responder) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { r.conn.Close() })
+	defer stop()
+	defer r.conn.Close()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		reply, unicast, err := r.answer(buf[:n], from)
+		if err != nil || reply == nil {
+			continue // Malformed or not for us, either way there is nothing to say
+		}
+		to := from
+		if !unicast {
+			to = GroupAddr
+		}
+		r.conn.WriteTo(reply, to)
+	}
+}
+
+// answer builds the reply to a query, or nil when it asks about something else.
+// Queries from a port other than 5353 are one-shot and answered by unicast.
+func (r *Responder) answer(query []byte, from net.Addr) ([]byte, bool, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil, false, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Queries from any port but 5353 are one-shot queries (RFC 6762 §6.7)
+	udp, _ := from.(*net.UDPAddr)
+	oneShot := udp == nil || udp.Port != GroupAddr.Port
+	unicast := oneShot
+
+	service := strings.ToLower(serviceName())
+	instance := strings.ToLower(r.instance.instanceName())
+	var asked []dnsmessage.Question
+	for _, q := range questions {
+		if q.Class&^unicastBit != dnsmessage.ClassINET {
+			continue
+		}
+		name := strings.ToLower(q.Name.String())
+		if !(q.Type == dnsmessage.TypePTR && name == service) && !(q.Type == dnsmessage.TypeSRV && name == instance) {
+			continue
+		}
+		unicast = unicast || q.Class&unicastBit != 0
+		asked = append(asked, dnsmessage.Question{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET})
+	}
+	if len(asked) == 0 {
+		return nil, false, nil
+	}
+
+	ttl := uint32(multicastTTL)
+	header = dnsmessage.Header{Response: true, Authoritative: true}
+	if oneShot {
+		// One-shot queries get their ID and questions echoed back
+		ttl = unicastTTL
+		header.ID = headerID(query)
+	} else {
+		asked = nil
+	}
+
+	reply, err := r.instance.records(header, asked, ttl)
+	return reply, unicast, err
+}
+
+// records builds a reply with the PTR answer and SRV, TXT and A records as extras
+func (i Instance) records(header dnsmessage.Header, questions []dnsmessage.Question, ttl uint32) ([]byte, error) {
+	service, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(i.instanceName())
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(i.hostName())
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+
+	rh := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if err := b.PTRResource(rh(service), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if err := b.SRVResource(rh(instance), dnsmessage.SRVResource{Target: host, Port: uint16(i.Port)}); err != nil {
+		return nil, err
+	}
+	txt := make([]string, 0, len(i.Text))
+	for k, v := range i.Text {
+		txt = append(txt, k+"="+v)
+	}
+	if len(txt) == 0 {
+		txt = append(txt, "") // A TXT record must hold at least one string
+	}
+	if err := b.TXTResource(rh(instance), dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return nil, err
+	}
+	for _, ip := range i.IPs {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			continue
+		}
+		if err := b.AResource(rh(host), dnsmessage.AResource{A: [4]byte(ip4)}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+func headerID(msg []byte) uint16 {
+	if len(msg) < 2 {
+		return 0
+	}
+	return uint16(msg[0])<<8 | uint16(msg[1])
+}
+
+// Browser finds instances of the service type with one-shot queries
+type Browser struct {
+	conn net.PacketConn
+	dest net.Addr
+}
+
+// NewBrowser queries dest, normally GroupAddr, from conn. The conn should be
+// bound to an ephemeral port so replies come back by unicast.
+func NewBrowser(conn net.PacketConn, dest net.Addr) *Browser {
+	return &Browser{conn: conn, dest: dest}
+}
+
+// Browse sends a query and collects replies for wait, or until ctx is done
+func (b *Browser) Browse(ctx context.Context, wait time.Duration) ([]Instance, error) {
+	id := uint16(rand.UintN(1 << 16))
+	query, err := buildQuery(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.conn.WriteTo(query, b.dest); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := b.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { b.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	found := make(map[string]Instance)
+	var order []string
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		if headerID(buf[:n]) != id {
+			continue // A stale reply to an earlier browse
+		}
+		for _, inst := range parseReply(buf[:n]) {
+			if _, seen := found[inst.Name]; !seen {
+				order = append(order, inst.Name)
+			}
+			found[inst.Name] = inst
+		}
+	}
+
+	instances := make([]Instance, 0, len(order))
+	for _, name := range order {
+		instances = append(instances, found[name])
+	}
+	return instances, ctx.Err()
+}
+
+func buildQuery(id uint16) ([]byte, error) {
+	name, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 64), dnsmessage.Header{ID: id})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseReply pulls the instances out of a reply. Instances without an SRV
+// record, or that are being withdrawn with a zero TTL, are left out.
+func parseReply(msg []byte) []Instance {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || !header.Response {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+
+	var records []dnsmessage.Resource
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil
+	}
+	records = append(records, answers...)
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil
+	}
+	if extra, err := p.AllAdditionals(); err == nil {
+		records = append(records, extra...)
+	}
+
+	service := strings.ToLower(serviceName())
+	var names []string
+	srv := make(map[string]*dnsmessage.SRVResource)
+	txt := make(map[string][]string)
+	addrs := make(map[string][]net.IP)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		switch body := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == service && rr.Header.TTL > 0 {
+				names = append(names, body.PTR.String())
+			}
+		case *dnsmessage.SRVResource:
+			srv[name] = body
+		case *dnsmessage.TXTResource:
+			txt[name] = body.TXT
+		case *dnsmessage.AResource:
+			addrs[name] = append(addrs[name], net.IP(body.A[:]))
+		}
+	}
+
+	var instances []Instance
+	for _, full := range names {
+		s, ok := srv[strings.ToLower(full)]
+		if !ok {
+			continue
+		}
+		label, _, _ := strings.Cut(full, "."+Service)
+		target := s.Target.String()
+		inst := Instance{
+			Name: label,
+			Host: strings.TrimSuffix(target, "."+Domain),
+			Port: int(s.Port),
+			IPs:  addrs[strings.ToLower(target)],
+			Text: make(map[string]string),
+		}
+		for _, kv := range txt[strings.ToLower(full)] {
+			if k, v, ok := strings.Cut(kv, "="); ok && k != "" {
+				inst.Text[k] = v
+			}
+		}
+		instances = append(instances, inst)
+	}
+	return instances
+}
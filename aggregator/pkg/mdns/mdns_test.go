@@ -0,0 +1,88 @@
+package mdns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/pkg/mdns"
+)
+
+// TEST: GIVEN an in-process responder advertising a daemon instance
+// WHEN a browser sends it a one-shot query
+// THEN it should find the instance with its host, port, address and TXT pairs
+func TestBrowse_FindsResponder(t *testing.T) {
+	addr := startResponder(t, mdns.Instance{
+		Name: "edge.1",
+		Host: "edge-1",
+		Port: 8080,
+		IPs:  []net.IP{net.IPv4(10, 0, 0, 7)},
+		Text: map[string]string{"protocol": "daemon", "interval": "5"},
+	})
+
+	instances := browse(t, addr)
+
+	if len(instances) != 1 {
+		t.Fatalf("Expected 1 instance, got %+v", instances)
+	}
+	got := instances[0]
+	if got.Name != "edge-1" || got.Host != "edge-1" || got.Port != 8080 {
+		t.Errorf("Unexpected instance %+v", got)
+	}
+	if len(got.IPs) != 1 || !got.IPs[0].Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Errorf("Expected address 10.0.0.7, got %v", got.IPs)
+	}
+	if got.Text["protocol"] != "daemon" || got.Text["interval"] != "5" {
+		t.Errorf("Unexpected TXT pairs %v", got.Text)
+	}
+}
+
+// TEST: GIVEN no responder listening at the destination
+// WHEN a browser queries it
+// THEN it should return no instances once the wait is over
+func TestBrowse_NoResponders(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+
+	if instances := browse(t, silent.LocalAddr()); len(instances) != 0 {
+		t.Errorf("Expected no instances, got %+v", instances)
+	}
+}
+
+func startResponder(t *testing.T, instance mdns.Instance) net.Addr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mdns.NewResponder(conn, instance).Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return conn.LocalAddr()
+}
+
+func browse(t *testing.T, dest net.Addr) []mdns.Instance {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	instances, err := mdns.NewBrowser(conn, dest).Browse(context.Background(), 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Browse failed: %v", err)
+	}
+	return instances
+}
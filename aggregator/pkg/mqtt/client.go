@@ -0,0 +1,341 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepAlive = 30 * time.Second
+	defaultTimeout   = 10 * time.Second
+	// maxPacketBytes bounds what is read from the broker
+	maxPacketBytes = 1 << 20
+)
+
+// ErrClosed is returned for anything tried on a connection that is gone
+var ErrClosed = errors.New("mqtt connection closed")
+
+// Options for a connection, the zero value connects anonymously with a
+// random client ID
+type Options struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration // Optional, defaults to 30 seconds
+	Timeout   time.Duration // Optional, for connecting and each acknowledgement, defaults to 10 seconds
+	// OnMessage is called with each message for a subscription, in order from
+	// the connection's reader, so it should not block for long. A QoS 1
+	// message is acknowledged once it returns.
+	OnMessage func(m Message)
+}
+
+// Client is one connection to a broker. It is not reconnected, callers dial
+// again once Done is closed.
+type Client struct {
+	conn    net.Conn
+	opts    Options
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan Packet // Acknowledgements awaited by packet ID
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to a broker at host:port, which may carry a tcp://, mqtt://,
+// ssl:// or mqtts:// scheme, the latter two over TLS. The port defaults to
+// 1883, or 8883 with TLS.
+func Dial(ctx context.Context, broker string, opts Options) (*Client, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = fmt.Sprintf("beacon-%d", time.Now().UnixNano())
+	}
+
+	useTLS := false
+	scheme, addr, ok := strings.Cut(broker, "://")
+	if !ok {
+		addr = broker
+	} else {
+		switch scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("unknown broker scheme %q", scheme)
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = (&tls.Dialer{}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn, opts: opts, pending: make(map[uint16]chan Packet), done: make(chan struct{})}
+	if err := c.connect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.read()
+	go c.ping()
+	return c, nil
+}
+
+// connect sends CONNECT and waits for the broker to accept it
+func (c *Client) connect() error {
+	c.conn.SetDeadline(time.Now().Add(c.opts.Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	packet := encodeConnect(Connect{
+		ClientID:  c.opts.ClientID,
+		Username:  c.opts.Username,
+		Password:  c.opts.Password,
+		KeepAlive: uint16(min(c.opts.KeepAlive/time.Second, 65535)),
+	})
+	if _, err := c.conn.Write(packet.Encode()); err != nil {
+		return fmt.Errorf("failed to send connect: %w", err)
+	}
+	ack, err := ReadPacket(c.conn, maxPacketBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read connack: %w", err)
+	}
+	if ack.Type != TypeConnack || len(ack.Body) < 2 {
+		return fmt.Errorf("expected connack, got packet type %d", ack.Type)
+	}
+	if code := ack.Body[1]; code != 0 {
+		if reason, ok := connackErrors[code]; ok {
+			return fmt.Errorf("broker refused connection: %s", reason)
+		}
+		return fmt.Errorf("broker refused connection with code %d", code)
+	}
+	return nil
+}
+
+// Done is closed once the connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err is why the connection ended, nil while it is up
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Publish sends a message. With QoS 1 it waits for the broker's PUBACK.
+func (c *Client) Publish(ctx context.Context, m Message) error {
+	if m.QoS > 1 {
+		return fmt.Errorf("unsupported QoS %d", m.QoS)
+	}
+	if m.QoS == 0 {
+		return c.write(EncodePublish(m, 0))
+	}
+
+	id, acked, err := c.await()
+	if err != nil {
+		return err
+	}
+	defer c.forget(id)
+	if err := c.write(EncodePublish(m, id)); err != nil {
+		return err
+	}
+	_, err = c.wait(ctx, acked)
+	return err
+}
+
+// Subscribe asks for the messages on filters and waits for the broker to
+// grant them, failing if any is refused
+func (c *Client) Subscribe(ctx context.Context, subs ...Subscription) error {
+	for _, s := range subs {
+		if s.QoS > 1 {
+			return fmt.Errorf("unsupported QoS %d", s.QoS)
+		}
+	}
+	id, acked, err := c.await()
+	if err != nil {
+		return err
+	}
+	defer c.forget(id)
+	if err := c.write(encodeSubscribe(id, subs)); err != nil {
+		return err
+	}
+	ack, err := c.wait(ctx, acked)
+	if err != nil {
+		return err
+	}
+	codes := ack.Body[2:]
+	if len(codes) != len(subs) {
+		return fmt.Errorf("broker answered %d of %d subscriptions", len(codes), len(subs))
+	}
+	for i, code := range codes {
+		if code == subackRefused {
+			return fmt.Errorf("broker refused subscription to %s", subs[i].Filter)
+		}
+	}
+	return nil
+}
+
+// Close sends DISCONNECT and closes the connection
+func (c *Client) Close() error {
+	c.write(Packet{Type: TypeDisconnect})
+	c.fail(ErrClosed)
+	return nil
+}
+
+func (c *Client) write(p Packet) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	if _, err := c.conn.Write(p.Encode()); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// await takes a free packet ID and a channel its acknowledgement is sent on
+func (c *Client) await() (uint16, chan Packet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	for {
+		c.nextID++
+		if c.nextID == 0 {
+			continue // Zero is not a valid packet ID
+		}
+		if _, taken := c.pending[c.nextID]; !taken {
+			break
+		}
+	}
+	acked := make(chan Packet, 1)
+	c.pending[c.nextID] = acked
+	return c.nextID, acked, nil
+}
+
+func (c *Client) forget(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) wait(ctx context.Context, acked chan Packet) (Packet, error) {
+	timer := time.NewTimer(c.opts.Timeout)
+	defer timer.Stop()
+	select {
+	case ack := <-acked:
+		return ack, nil
+	case <-c.done:
+		return Packet{}, c.Err()
+	case <-ctx.Done():
+		return Packet{}, ctx.Err()
+	case <-timer.C:
+		return Packet{}, fmt.Errorf("no acknowledgement within %s", c.opts.Timeout)
+	}
+}
+
+// read handles packets from the broker until the connection fails. The
+// broker answers the pings, so a read that outlasts the keepalive means it
+// is gone.
+func (c *Client) read() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive + c.opts.Timeout))
+		p, err := ReadPacket(c.conn, maxPacketBytes)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		switch p.Type {
+		case TypePuback, TypeSuback:
+			id, err := packetID(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			if acked, ok := c.pending[id]; ok {
+				acked <- p
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+		case TypePublish:
+			m, id, err := DecodePublish(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if c.opts.OnMessage != nil {
+				c.opts.OnMessage(m)
+			}
+			if m.QoS > 0 && c.write(Ack(TypePuback, id)) != nil {
+				return
+			}
+		case TypePingresp:
+		default:
+			c.fail(fmt.Errorf("unexpected packet type %d", p.Type))
+			return
+		}
+	}
+}
+
+func (c *Client) ping() {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.write(Packet{Type: TypePingreq}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// fail closes the connection once, keeping the first reason
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
@@ -0,0 +1,97 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/aggregator/pkg/mqtt"
+)
+
+// TEST: GIVEN a QoS 1 message too large for a one byte remaining length
+// WHEN it is encoded, read back and decoded
+// THEN the topic, payload, QoS, retain flag and packet ID should survive
+func TestPublish_RoundTrip(t *testing.T) {
+	want := mqtt.Message{Topic: "beacon/a/metrics", Payload: []byte(strings.Repeat("x", 300)), QoS: 1, Retain: true}
+	data := mqtt.EncodePublish(want, 42).Encode()
+
+	p, err := mqtt.ReadPacket(bytes.NewReader(data), 1<<10)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	got, id, err := mqtt.DecodePublish(p)
+	if err != nil {
+		t.Fatalf("DecodePublish failed: %v", err)
+	}
+	if got.Topic != want.Topic || !bytes.Equal(got.Payload, want.Payload) || got.QoS != 1 || !got.Retain || id != 42 {
+		t.Errorf("Message mismatch\nGot: %+v (id %d)\nWant: %+v", got, id, want)
+	}
+
+	if _, err := mqtt.ReadPacket(bytes.NewReader(data), 100); err == nil {
+		t.Error("Expected a packet over the limit to be refused")
+	}
+}
+
+// TEST: GIVEN a broker that refuses the connection with bad credentials
+// WHEN a client dials it
+// THEN Dial should fail with the reason, after sending the credentials
+func TestDial_Refused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	connects := make(chan mqtt.Connect, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p, err := mqtt.ReadPacket(conn, 1<<10)
+		if err != nil {
+			return
+		}
+		c, _ := mqtt.DecodeConnect(p)
+		connects <- c
+		conn.Write(mqtt.Connack(4).Encode())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = mqtt.Dial(ctx, "tcp://"+ln.Addr().String(), mqtt.Options{ClientID: "c1", Username: "u", Password: "p"})
+	if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+		t.Errorf("Expected a refusal for bad credentials, got %v", err)
+	}
+	if c := <-connects; c.ClientID != "c1" || c.Username != "u" || c.Password != "p" || c.KeepAlive != 30 {
+		t.Errorf("Unexpected connect %+v", c)
+	}
+}
+
+// TEST: GIVEN topic filters with and without wildcards
+// WHEN topics are matched against them
+// THEN + should match one level, a trailing # any number and $ topics only by name
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"sensors/+/state", "sensors/s1/state", true},
+		{"sensors/+/state", "sensors/s1/x/state", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/s1/state", true},
+		{"sensors/s1", "sensors/s1/state", false},
+		{"+/+", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, tt := range tests {
+		if got := mqtt.Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Package mqtt is just enough MQTT 3.1.1 to publish and subscribe with QoS 0
+// and 1 over one connection, without pulling in a full client library
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Control packet types, the high nibble of the first header byte
+const (
+	TypeConnect    byte = 1
+	TypeConnack    byte = 2
+	TypePublish    byte = 3
+	TypePuback     byte = 4
+	TypeSubscribe  byte = 8
+	TypeSuback     byte = 9
+	TypePingreq    byte = 12
+	TypePingresp   byte = 13
+	TypeDisconnect byte = 14
+)
+
+// protocolLevel is MQTT 3.1.1
+const protocolLevel = 4
+
+var errMalformed = errors.New("malformed packet")
+
+// Packet is one control packet: its type, the flags of the low nibble and
+// everything after the fixed header
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// Encode returns the packet with its fixed header
+func (p Packet) Encode() []byte {
+	out := []byte{p.Type<<4 | p.Flags&0x0f}
+	n := len(p.Body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, p.Body...)
+}
+
+// ReadPacket reads one packet, refusing bodies over max bytes
+func ReadPacket(r io.Reader, max int) (Packet, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Packet{}, err
+	}
+	p := Packet{Type: b[0] >> 4, Flags: b[0] & 0x0f}
+
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return Packet{}, fmt.Errorf("%w: remaining length too long", errMalformed)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return Packet{}, err
+		}
+		n += int(b[0]&0x7f) * mult
+		mult *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	if n > max {
+		return Packet{}, fmt.Errorf("packet of %d bytes exceeds %d", n, max)
+	}
+
+	p.Body = make([]byte, n)
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return Packet{}, err
+	}
+	return p, nil
+}
+
+// Message is an application message published to a topic
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// EncodePublish builds a PUBLISH, id is only sent with QoS 1
+func EncodePublish(m Message, id uint16) Packet {
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 1
+	}
+	return Packet{Type: TypePublish, Flags: flags, Body: append(body, m.Payload...)}
+}
+
+// DecodePublish reads a PUBLISH, the id is 0 with QoS 0
+func DecodePublish(p Packet) (Message, uint16, error) {
+	m := Message{QoS: p.Flags >> 1 & 3, Retain: p.Flags&1 != 0}
+	if m.QoS > 1 {
+		return Message{}, 0, fmt.Errorf("unsupported QoS %d", m.QoS)
+	}
+	topic, rest, err := readString(p.Body)
+	if err != nil {
+		return Message{}, 0, err
+	}
+	m.Topic = topic
+
+	var id uint16
+	if m.QoS > 0 {
+		if len(rest) < 2 {
+			return Message{}, 0, errMalformed
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	m.Payload = rest
+	return m, id, nil
+}
+
+// Ack builds a packet carrying only a packet ID, like PUBACK
+func Ack(typ byte, id uint16) Packet {
+	return Packet{Type: typ, Body: binary.BigEndian.AppendUint16(nil, id)}
+}
+
+// packetID reads the packet ID an acknowledgement starts with
+func packetID(p Packet) (uint16, error) {
+	if len(p.Body) < 2 {
+		return 0, errMalformed
+	}
+	return binary.BigEndian.Uint16(p.Body), nil
+}
+
+// subscribeFlags are the reserved flags a SUBSCRIBE must carry
+const subscribeFlags = 0x02
+
+// Subscription is a topic filter and the highest QoS to receive it with
+type Subscription struct {
+	Filter string
+	QoS    byte
+}
+
+func encodeSubscribe(id uint16, subs []Subscription) Packet {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, s := range subs {
+		body = appendString(body, s.Filter)
+		body = append(body, s.QoS)
+	}
+	return Packet{Type: TypeSubscribe, Flags: subscribeFlags, Body: body}
+}
+
+// DecodeSubscribe reads a SUBSCRIBE, for brokers
+func DecodeSubscribe(p Packet) (uint16, []Subscription, error) {
+	id, err := packetID(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	var subs []Subscription
+	for rest := p.Body[2:]; len(rest) > 0; {
+		var s Subscription
+		if s.Filter, rest, err = readString(rest); err != nil {
+			return 0, nil, err
+		}
+		if len(rest) < 1 {
+			return 0, nil, errMalformed
+		}
+		s.QoS, rest = rest[0], rest[1:]
+		subs = append(subs, s)
+	}
+	if len(subs) == 0 {
+		return 0, nil, fmt.Errorf("%w: subscribe without filters", errMalformed)
+	}
+	return id, subs, nil
+}
+
+// Suback builds the broker's answer to a SUBSCRIBE, a granted QoS per
+// filter or 0x80 for a refused one
+func Suback(id uint16, granted ...byte) Packet {
+	return Packet{Type: TypeSuback, Body: append(binary.BigEndian.AppendUint16(nil, id), granted...)}
+}
+
+// subackRefused is the return code of a filter the broker refused
+const subackRefused = 0x80
+
+// Match reports whether a topic matches a filter, where + matches one level
+// and a trailing # any number of them. Topics starting with $ are only
+// matched by filters that name them.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return i == len(fl)-1
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// Connect is what a CONNECT asks for
+type Connect struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive uint16 // Seconds
+}
+
+func encodeConnect(c Connect) Packet {
+	body := appendString(nil, "MQTT")
+	flags := byte(0x02) // Clean session
+	if c.Username != "" {
+		flags |= 0x80
+	}
+	if c.Password != "" {
+		flags |= 0x40
+	}
+	body = append(body, protocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.Username != "" {
+		body = appendString(body, c.Username)
+	}
+	if c.Password != "" {
+		body = appendString(body, c.Password)
+	}
+	return Packet{Type: TypeConnect, Body: body}
+}
+
+// DecodeConnect reads a CONNECT, for brokers
+func DecodeConnect(p Packet) (Connect, error) {
+	name, rest, err := readString(p.Body)
+	if err != nil {
+		return Connect{}, err
+	}
+	if name != "MQTT" || len(rest) < 4 {
+		return Connect{}, fmt.Errorf("%w: not MQTT 3.1.1", errMalformed)
+	}
+	flags := rest[1]
+	c := Connect{KeepAlive: binary.BigEndian.Uint16(rest[2:])}
+	rest = rest[4:]
+
+	if c.ClientID, rest, err = readString(rest); err != nil {
+		return Connect{}, err
+	}
+	if flags&0x04 != 0 {
+		// Will topic and message, not used here
+		if _, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+		if _, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+	}
+	if flags&0x80 != 0 {
+		if c.Username, rest, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if c.Password, _, err = readString(rest); err != nil {
+			return Connect{}, err
+		}
+	}
+	return c, nil
+}
+
+// Connack builds the broker's answer to a CONNECT, code 0 accepts it
+func Connack(code byte) Packet {
+	return Packet{Type: TypeConnack, Body: []byte{0, code}}
+}
+
+// connackErrors are the refusals a CONNACK can carry
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errMalformed
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
@@ -3,14 +3,16 @@ package metrics
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 )
 
 type Metric struct {
-	Type       string `json:"type"`
-	Value      string `json:"value"`
-	Unit       string `json:"unit"`
-	RecordedAt string `json:"recorded_at"`
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Unit       string            `json:"unit"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	RecordedAt string            `json:"recorded_at"`
 }
 
 type DeviceMetrics struct {
@@ -23,17 +25,21 @@ func (d *DeviceMetrics) String() string {
 		return d.Metrics[i].Type < d.Metrics[j].Type
 	})
 
-	metricsStr := ""
 	// type: value, type: value, recorded_at: time
+	// WARN: Lossy, units, labels and all but the latest recorded_at are dropped. Use the structured v3 payload where possible.
+	parts := make([]string, 0, len(d.Metrics)+1)
+	recordedAt := ""
 	for _, metric := range d.Metrics {
-		metricsStr += fmt.Sprintf("%s: %s, ", metric.Type, metric.Value)
+		parts = append(parts, fmt.Sprintf("%s: %s", metric.Type, metric.Value))
+		if metric.RecordedAt > recordedAt {
+			recordedAt = metric.RecordedAt
+		}
 	}
-	if len(metricsStr) > 0 {
-		metricsStr = metricsStr[:len(metricsStr)-2] // Remove trailing comma and space
+	if recordedAt != "" {
+		parts = append(parts, fmt.Sprintf("recorded_at: %s", recordedAt))
 	}
-	metricsStr += fmt.Sprintf(", recorded_at: %s", d.Metrics[0].RecordedAt) // WARN: Only first metric's recorded_at is used
 
-	return metricsStr
+	return strings.Join(parts, ", ")
 }
 func NewMetric(metricType, value, unit string) Metric {
 	return Metric{
@@ -43,3 +49,55 @@ func NewMetric(metricType, value, unit string) Metric {
 		RecordedAt: time.Now().UTC().Format(time.RFC3339),
 	}
 }
+
+// BulkSample is one device's metrics within a bulk upload
+type BulkSample struct {
+	DeviceID string   `json:"device_id"`
+	Hostname string   `json:"hostname,omitempty"`
+	Metrics  []Metric `json:"metrics"`
+}
+
+// BulkRequest is the body of a bulk upload, sent gzip compressed
+type BulkRequest struct {
+	Samples []BulkSample `json:"samples"`
+}
+
+// BulkResult reports whether one sample of a bulk upload was stored
+type BulkResult struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"` // "ok" or "error"
+	Error    string `json:"error,omitempty"`
+}
+
+// BulkResponse has one result per sample, in request order
+type BulkResponse struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Results  []BulkResult `json:"results"`
+}
+
+// DeviceEvent is a change in a device's reachability as seen by the aggregator
+type DeviceEvent struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`    // unknown, up, degraded, down or flapping
+	Previous string `json:"previous"` // State before the change
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"` // Last poll error, if any
+	At       string `json:"at"`              // RFC 3339
+}
+
+// Heartbeat registers an aggregator with the API and asks for leases on the
+// targets it can poll
+type Heartbeat struct {
+	ID      string   `json:"id"`             // Unique per running instance
+	Name    string   `json:"name,omitempty"` // Service name, for display
+	Targets []string `json:"targets"`        // Device IDs it would poll
+	TTL     int      `json:"ttl"`            // Seconds until the registration and leases lapse
+	Leaving bool     `json:"leaving,omitempty"`
+}
+
+// Leases are the device IDs an aggregator may poll until the TTL lapses
+type Leases struct {
+	Targets []string `json:"targets"`
+	TTL     int      `json:"ttl"`
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bxrne/beacon/aggregator/pkg/mdns"
+)
+
+// advertise answers DNS-SD queries for this daemon until ctx is done
+func (s *Service) advertise(ctx context.Context) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		s.log.Errorf("Failed to get hostname for DNS-SD: %v", err)
+		return
+	}
+	host, _, _ := strings.Cut(hostname, ".")
+
+	instance := mdns.Instance{
+		Name: s.cfg.Discovery.Instance,
+		Host: host,
+		Port: s.cfg.Server.Port,
+		IPs:  localIPv4s(),
+		Text: map[string]string{"protocol": "daemon"},
+	}
+	if instance.Name == "" {
+		instance.Name = host
+	}
+	if s.cfg.Discovery.Interval > 0 {
+		instance.Text["interval"] = strconv.Itoa(s.cfg.Discovery.Interval)
+	}
+
+	conn, err := mdns.ListenGroup()
+	if err != nil {
+		s.log.Errorf("Failed to join the mDNS group: %v", err)
+		return
+	}
+
+	s.log.Infof("Advertising %s as %s.%s", instance.Name, mdns.Service, mdns.Domain)
+	if err := mdns.NewResponder(conn, instance).Serve(ctx); err != nil {
+		s.log.Errorf("DNS-SD responder stopped: %v", err)
+	}
+}
+
+// localIPv4s lists the addresses of interfaces that are up, loopback excluded
+func localIPv4s() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ips = append(ips, ipnet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
@@ -1,15 +1,35 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/bxrne/beacon/daemon/internal/config"
 	"github.com/bxrne/beacon/daemon/internal/logger"
+	"github.com/bxrne/beacon/daemon/internal/sandbox"
+	"github.com/bxrne/beacon/daemon/internal/update"
 )
 
 func main() {
+	// The daemon re-executes itself to apply limits before running commands
+	if len(os.Args) > 1 && os.Args[1] == sandbox.HelperArg {
+		sandbox.Main(os.Args[2:])
+	}
+	// The previous binary watches over an update from outside the new one
+	if len(os.Args) > 1 && os.Args[1] == update.WatchdogArg {
+		update.Watchdog(os.Args[2:])
+	}
+
+	// Roll back an update that died before confirming, before anything else
+	// can fail. A failed check must not keep the daemon from starting.
+	if exe, err := update.Executable(); err == nil {
+		if err := update.RecoverPending(exe); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to recover pending update: %v\n", err)
+		}
+	}
+
 	cfg, err := config.Load("config.toml")
 	if err != nil {
 		panic(err)
@@ -2,36 +2,100 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
 
 	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/bxrne/beacon/daemon/internal/sandbox"
 	"github.com/bxrne/beacon/daemon/internal/server"
+	"github.com/bxrne/beacon/daemon/internal/update"
 	"github.com/charmbracelet/log"
 )
 
 type Service struct {
-	cfg    *config.Config
-	log    *log.Logger
-	server *server.HTTPServer
+	cfg     *config.Config
+	log     *log.Logger
+	server  *server.HTTPServer
+	updater *update.Updater
+	cancel  context.CancelFunc
 }
 
 func NewService(cfg *config.Config, log *log.Logger) (*Service, error) {
-	srv := server.NewHTTPServer(cfg, log)
+	exe, err := update.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	updater, err := update.NewUpdater(cfg.Update, exe, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create updater: %w", err)
+	}
+
+	sb, err := sandbox.New(cfg.Sandbox)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox: %w", err)
+	}
+
+	srv := server.NewHTTPServer(cfg, log, updater, sb)
 
 	return &Service{
-		cfg:    cfg,
-		log:    log,
-		server: srv,
+		cfg:     cfg,
+		log:     log,
+		server:  srv,
+		updater: updater,
 	}, nil
 }
 
 func (s *Service) Run() error {
 	s.log.Infof("Service initialized (%s)", s.cfg.Labels.Environment)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.updater.ConfirmPending(ctx, s.checkHealth)
+	if s.cfg.Discovery.Advertise {
+		go s.advertise(ctx)
+	}
 	return s.server.Start()
 }
 
 func (s *Service) Shutdown() {
 	s.log.Info("Shutting down service...")
+	if s.cancel != nil {
+		s.cancel()
+	}
 	if err := s.server.Shutdown(context.Background()); err != nil {
 		s.log.Errorf("Error shutting down server: %v", err)
 	}
 }
+
+// checkHealth asks our own HTTP server whether it is serving and can
+// collect metrics, which exercises the collectors and the frame encoding
+func (s *Service) checkHealth(ctx context.Context) error {
+	for _, path := range []string{"/health", "/metric"} {
+		if err := s.get(ctx, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) get(ctx context.Context, path string) error {
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.cfg.Server.Port, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("%s failed: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status code: %d", path, resp.StatusCode)
+	}
+	return nil
+}
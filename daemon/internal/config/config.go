@@ -25,11 +25,52 @@ type HTTPServer struct {
 	Timeout int `toml:"timeout"`
 }
 
+// Files bounds the fetch and push commands to an allow-list of paths
+type Files struct {
+	AllowedPaths  []string `toml:"allowed_paths"`
+	MaxFetchBytes int64    `toml:"max_fetch_bytes"`
+	MaxPushBytes  int64    `toml:"max_push_bytes"`
+}
+
+// Update configures the self-update command, PublicKey is a hex ed25519 key
+type Update struct {
+	PublicKey        string `toml:"public_key"`
+	RequireSignature bool   `toml:"require_signature"`
+	GracePeriod      int    `toml:"grace_period"`
+}
+
+// Sandbox limits every process the daemon executes
+type Sandbox struct {
+	CPUSeconds    uint64   `toml:"cpu_seconds"`
+	MemoryMB      uint64   `toml:"memory_mb"`
+	OpenFiles     uint64   `toml:"open_files"`
+	Timeout       int      `toml:"timeout"`
+	MaxOutput     int      `toml:"max_output"`
+	User          string   `toml:"user"`
+	WorkDir       string   `toml:"work_dir"`
+	Jail          bool     `toml:"jail"` // Chroot every command into work_dir, needs the daemon to run as root
+	Env           []string `toml:"env"`
+	PassEnv       []string `toml:"pass_env"` // Names of the daemon's variables added to env, e.g. DISPLAY for notify
+	AllowRun      bool     `toml:"allow_run"`
+	RebootCommand []string `toml:"reboot_command"`
+}
+
+// Discovery advertises the daemon over DNS-SD so aggregators can find it
+type Discovery struct {
+	Advertise bool   `toml:"advertise"` // Optional, answer _beacon._tcp queries on the local network
+	Instance  string `toml:"instance"`  // Optional, defaults to the hostname
+	Interval  int    `toml:"interval"`  // Optional, seconds between polls suggested to aggregators
+}
+
 type Config struct {
 	Monitoring Monitoring `toml:"monitoring"`
 	Labels     Labels     `toml:"labels"`
 	Logging    Logging    `toml:"logging"`
 	Server     HTTPServer `toml:"server"`
+	Files      Files      `toml:"files"`
+	Update     Update     `toml:"update"`
+	Sandbox    Sandbox    `toml:"sandbox"`
+	Discovery  Discovery  `toml:"discovery"`
 }
 
 func Load(path string) (*Config, error) {
@@ -0,0 +1,225 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+)
+
+const (
+	defaultMaxFetchBytes = 64 * 1024
+	defaultMaxPushBytes  = 64 * 1024
+)
+
+var ErrNotAllowed = errors.New("path is not in an allowed directory")
+
+// FetchRequest selects either the last Tail bytes of a file or the range
+// starting at Offset of at most Length bytes
+type FetchRequest struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Tail   int64  `json:"tail"`
+}
+
+type FetchResult struct {
+	Path      string
+	Offset    int64
+	Size      int64
+	Content   []byte
+	Truncated bool
+}
+
+// PushRequest carries the full file content and its expected SHA-256
+type PushRequest struct {
+	Path    string `json:"path"`
+	Content []byte `json:"content"`
+	SHA256  string `json:"sha256"`
+}
+
+// Fetch reads a bounded part of an allow-listed file
+func Fetch(cfg config.Files, req FetchRequest) (*FetchResult, error) {
+	path, err := resolve(cfg, req.Path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	limit := cfg.MaxFetchBytes
+	if limit <= 0 {
+		limit = defaultMaxFetchBytes
+	}
+
+	size := info.Size()
+	offset := req.Offset
+	length := req.Length
+	if req.Tail > 0 {
+		length = req.Tail
+		offset = size - req.Tail
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d outside file of %d bytes", offset, size)
+	}
+	if length <= 0 || length > size-offset {
+		length = size - offset
+	}
+
+	truncated := false
+	if length > limit {
+		// Keep the end of a tail, which is where crash output lives
+		if req.Tail > 0 {
+			offset += length - limit
+		}
+		length = limit
+		truncated = true
+	}
+
+	content := make([]byte, length)
+	n, err := f.ReadAt(content, offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return &FetchResult{
+		Path:      path,
+		Offset:    offset,
+		Size:      size,
+		Content:   content[:n],
+		Truncated: truncated,
+	}, nil
+}
+
+// Push verifies the content checksum and atomically replaces the target file
+func Push(cfg config.Files, req PushRequest) error {
+	limit := cfg.MaxPushBytes
+	if limit <= 0 {
+		limit = defaultMaxPushBytes
+	}
+	if int64(len(req.Content)) > limit {
+		return fmt.Errorf("content of %d bytes exceeds limit of %d", len(req.Content), limit)
+	}
+
+	sum := sha256.Sum256(req.Content)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), req.SHA256) {
+		return fmt.Errorf("checksum mismatch for %s", req.Path)
+	}
+
+	path, err := resolve(cfg, req.Path, false)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		mode = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(req.Content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	// Persist the rename itself; not every platform can sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// resolve cleans the path, follows symlinks and checks it against the allow-list.
+// The file itself must exist only when mustExist is set.
+func resolve(cfg config.Files, path string, mustExist bool) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing path")
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path must be absolute: %s", path)
+	}
+	path = filepath.Clean(path)
+
+	var resolved string
+	if mustExist {
+		p, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve path: %w", err)
+		}
+		resolved = p
+	} else {
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve directory: %w", err)
+		}
+		resolved = filepath.Join(dir, filepath.Base(path))
+		// An existing symlink at the target would be replaced, not followed,
+		// but reject it so the allow-list stays the only source of truth
+		if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to replace symlink: %s", path)
+		}
+	}
+
+	for _, allowed := range cfg.AllowedPaths {
+		root, err := filepath.EvalSymlinks(filepath.Clean(allowed))
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotAllowed, path)
+}
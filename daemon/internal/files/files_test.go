@@ -0,0 +1,142 @@
+package files_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/bxrne/beacon/daemon/internal/files"
+)
+
+// TEST: GIVEN a file in an allowed directory
+// WHEN Fetch is called with a tail larger than the fetch limit
+// THEN it should return the last bytes of the file and mark the result truncated
+func TestFetch_TailBounded(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crash.log")
+	writeFile(t, path, "0123456789abcdef")
+
+	cfg := config.Files{AllowedPaths: []string{dir}, MaxFetchBytes: 4}
+	res, err := files.Fetch(cfg, files.FetchRequest{Path: path, Tail: 8})
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if string(res.Content) != "cdef" {
+		t.Errorf("Expected tail %q, got %q", "cdef", res.Content)
+	}
+	if !res.Truncated || res.Offset != 12 || res.Size != 16 {
+		t.Errorf("Unexpected result metadata: %+v", res)
+	}
+}
+
+// TEST: GIVEN a file in an allowed directory
+// WHEN Fetch is called with an offset and length
+// THEN it should return exactly that range
+func TestFetch_Range(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, "0123456789")
+
+	cfg := config.Files{AllowedPaths: []string{dir}}
+	res, err := files.Fetch(cfg, files.FetchRequest{Path: path, Offset: 2, Length: 3})
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+
+	if string(res.Content) != "234" || res.Truncated {
+		t.Errorf("Expected %q untruncated, got %q (truncated=%v)", "234", res.Content, res.Truncated)
+	}
+}
+
+// TEST: GIVEN a path outside the allowed directories, directly or via a symlink
+// WHEN Fetch is called
+// THEN it should return ErrNotAllowed
+func TestFetch_OutsideAllowList(t *testing.T) {
+	allowed := t.TempDir()
+	other := t.TempDir()
+	secret := filepath.Join(other, "secret")
+	writeFile(t, secret, "nope")
+
+	link := filepath.Join(allowed, "link")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	cfg := config.Files{AllowedPaths: []string{allowed}}
+	for _, path := range []string{secret, link, filepath.Join(allowed, "..", filepath.Base(other), "secret")} {
+		if _, err := files.Fetch(cfg, files.FetchRequest{Path: path}); !errors.Is(err, files.ErrNotAllowed) {
+			t.Errorf("Expected ErrNotAllowed for %s, got %v", path, err)
+		}
+	}
+}
+
+// TEST: GIVEN content with a matching checksum
+// WHEN Push is called for an existing file
+// THEN it should replace the content and keep the file mode
+func TestPush_ReplacesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.toml")
+	writeFile(t, path, "old")
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+
+	content := []byte("level = \"info\"\n")
+	cfg := config.Files{AllowedPaths: []string{dir}}
+	if err := files.Push(cfg, files.PushRequest{Path: path, Content: content, SHA256: checksum(content)}); err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read pushed file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Expected %q, got %q", content, got)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected no leftover temp files, got %d entries", len(entries))
+	}
+}
+
+// TEST: GIVEN content with a wrong checksum
+// WHEN Push is called
+// THEN it should return an error and leave the file untouched
+func TestPush_ChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.toml")
+	writeFile(t, path, "old")
+
+	cfg := config.Files{AllowedPaths: []string{dir}}
+	err := files.Push(cfg, files.PushRequest{Path: path, Content: []byte("new"), SHA256: checksum([]byte("other"))})
+	if err == nil {
+		t.Fatal("Expected checksum error, got nil")
+	}
+
+	if got, _ := os.ReadFile(path); string(got) != "old" {
+		t.Errorf("Expected file to be untouched, got %q", got)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,245 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+)
+
+// HelperArg makes the daemon binary act as the exec helper, see Main
+const HelperArg = "__sandbox-exec"
+
+const (
+	defaultCPUSeconds = 10
+	defaultMemoryMB   = 256
+	defaultOpenFiles  = 64
+	defaultTimeout    = 30 * time.Second
+	defaultMaxOutput  = 64 * 1024
+	defaultPath       = "PATH=/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var ErrOutsideWorkDir = errors.New("script is outside the sandbox work directory")
+
+type Result struct {
+	Output    []byte
+	ExitCode  int
+	Truncated bool
+	Duration  time.Duration
+}
+
+// Sandbox runs commands through a helper process that applies rlimits
+// before exec, with a cleared environment, an optional user, the work
+// directory as an optional chroot jail and a timeout that kills the whole
+// process group.
+type Sandbox struct {
+	cfg     config.Sandbox
+	helper  string
+	timeout time.Duration
+}
+
+func New(cfg config.Sandbox) (*Sandbox, error) {
+	if cfg.CPUSeconds == 0 {
+		cfg.CPUSeconds = defaultCPUSeconds
+	}
+	if cfg.MemoryMB == 0 {
+		cfg.MemoryMB = defaultMemoryMB
+	}
+	if cfg.OpenFiles == 0 {
+		cfg.OpenFiles = defaultOpenFiles
+	}
+	if cfg.MaxOutput <= 0 {
+		cfg.MaxOutput = defaultMaxOutput
+	}
+	if len(cfg.Env) == 0 {
+		cfg.Env = []string{defaultPath}
+	}
+	env := slices.Clip(cfg.Env)
+	for _, name := range cfg.PassEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	cfg.Env = env
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = os.TempDir()
+	}
+
+	if cfg.Jail {
+		if err := checkJail(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	helper, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate helper executable: %w", err)
+	}
+
+	workDir, err := filepath.Abs(cfg.WorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid work directory: %w", err)
+	}
+	if err := os.MkdirAll(workDir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	cfg.WorkDir = workDir
+
+	return &Sandbox{cfg: cfg, helper: helper, timeout: timeout}, nil
+}
+
+// Run executes name with args inside the sandbox. Output is stdout and
+// stderr interleaved, capped at the configured size. A non-zero exit is
+// reported as an error alongside the result. In a jail, name is looked up
+// inside the work directory.
+func (s *Sandbox) Run(ctx context.Context, name string, args ...string) (*Result, error) {
+	return s.RunTimeout(ctx, s.timeout, name, args...)
+}
+
+// RunTimeout is Run with a timeout of its own instead of the configured one
+func (s *Sandbox) RunTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) (*Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	attr, ids, err := sysProcAttr(s.cfg.User, s.cfg.Jail)
+	if err != nil {
+		return nil, err
+	}
+	jail := ""
+	if s.cfg.Jail {
+		jail = s.cfg.WorkDir
+	}
+
+	helperArgs := []string{
+		HelperArg,
+		strconv.FormatUint(s.cfg.CPUSeconds, 10),
+		strconv.FormatUint(s.cfg.MemoryMB<<20, 10),
+		strconv.FormatUint(s.cfg.OpenFiles, 10),
+		jail,
+		ids,
+		name,
+	}
+	cmd := exec.CommandContext(ctx, s.helper, append(helperArgs, args...)...)
+	cmd.Env = s.cfg.Env
+	cmd.Dir = s.cfg.WorkDir
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error { return killGroup(cmd.Process) }
+	// Grandchildren holding the output pipe must not block Wait past the kill
+	cmd.WaitDelay = time.Second
+
+	out := &cappedBuffer{limit: s.cfg.MaxOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	start := time.Now()
+	err = cmd.Run()
+	result := &Result{
+		Output:    out.buf,
+		ExitCode:  cmd.ProcessState.ExitCode(),
+		Truncated: out.truncated,
+		Duration:  time.Since(start),
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return result, fmt.Errorf("%s timed out after %s", name, timeout)
+	}
+	if err != nil {
+		return result, fmt.Errorf("%s failed with exit code %d: %w", name, result.ExitCode, err)
+	}
+	return result, nil
+}
+
+// RunScript runs an executable that lives inside the work directory
+func (s *Sandbox) RunScript(ctx context.Context, script string, args ...string) (*Result, error) {
+	path := filepath.Join(s.cfg.WorkDir, filepath.Clean("/"+script))
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve script: %w", err)
+	}
+
+	rel, err := filepath.Rel(s.cfg.WorkDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%w: %s", ErrOutsideWorkDir, script)
+	}
+
+	// A jailed script is found from the jail's root
+	if s.cfg.Jail {
+		resolved = "/" + filepath.ToSlash(rel)
+	}
+	return s.Run(ctx, resolved, args...)
+}
+
+// Main is the helper entry point, args follow HelperArg. It applies the
+// limits to itself, enters the jail when there is one and replaces itself
+// with the target, so all of it is in place before any target code runs.
+func Main(args []string) {
+	if len(args) < 6 {
+		fmt.Fprintln(os.Stderr, "sandbox: missing arguments")
+		os.Exit(127)
+	}
+
+	var limits [3]uint64
+	for i := range limits {
+		v, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: invalid limit %q\n", args[i])
+			os.Exit(127)
+		}
+		limits[i] = v
+	}
+
+	if err := setLimits(limits[0], limits[1], limits[2]); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(127)
+	}
+
+	if jail, ids := args[3], args[4]; jail != "" {
+		if err := enterJail(jail, ids); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+			os.Exit(127)
+		}
+	}
+
+	path, err := exec.LookPath(args[5])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(127)
+	}
+
+	err = execve(path, args[5:], os.Environ())
+	fmt.Fprintf(os.Stderr, "sandbox: failed to exec %s: %v\n", path, err)
+	os.Exit(127)
+}
+
+// cappedBuffer keeps the first limit bytes written and drops the rest
+type cappedBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - len(b.buf)
+	if room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf = append(b.buf, p[:room]...)
+		}
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
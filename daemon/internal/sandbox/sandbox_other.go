@@ -0,0 +1,53 @@
+//go:build !(linux || darwin)
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// Resource limits, users, jails and process groups are not available here,
+// the timeout and output cap still apply
+func sysProcAttr(username string, jailed bool) (*syscall.SysProcAttr, string, error) {
+	if username != "" {
+		return nil, "", fmt.Errorf("running as another user is not supported on %s", runtime.GOOS)
+	}
+	return nil, "", nil
+}
+
+func checkJail() error {
+	return fmt.Errorf("jails are not supported on %s", runtime.GOOS)
+}
+
+func enterJail(dir, ids string) error {
+	return checkJail()
+}
+
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func setLimits(cpuSeconds, memoryBytes, openFiles uint64) error {
+	return nil
+}
+
+// execve cannot replace the process, so run the target and mirror its exit code
+func execve(path string, argv, env []string) error {
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,212 @@
+package sandbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/bxrne/beacon/daemon/internal/sandbox"
+)
+
+// The test binary doubles as the exec helper, like the daemon binary does,
+// and as a probe reporting what a jailed command sees
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandbox.HelperArg {
+		sandbox.Main(os.Args[2:])
+	}
+	if os.Getenv("SANDBOX_PROBE") != "" {
+		wd, _ := os.Getwd()
+		_, err := os.Stat(os.Args[1])
+		fmt.Printf("%s %d %v\n", wd, os.Getuid(), err == nil)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TEST: GIVEN a sandbox with a cleared environment and an open files limit
+// WHEN a shell reports its environment and limits
+// THEN it should only see the configured environment, work directory and limit
+func TestRun_EnvironmentAndLimits(t *testing.T) {
+	os.Setenv("BEACON_SECRET", "leak")
+	defer os.Unsetenv("BEACON_SECRET")
+
+	workDir := t.TempDir()
+	sb := newSandbox(t, config.Sandbox{WorkDir: workDir, OpenFiles: 32})
+
+	res, err := sb.Run(context.Background(), "sh", "-c", "env; pwd; ulimit -n")
+	if err != nil {
+		t.Fatalf("Run failed: %v (%s)", err, res.Output)
+	}
+
+	out := string(res.Output)
+	if strings.Contains(out, "BEACON_SECRET") {
+		t.Errorf("Expected a cleared environment, got:\n%s", out)
+	}
+	resolved, _ := filepath.EvalSymlinks(workDir)
+	if !strings.Contains(out, resolved) {
+		t.Errorf("Expected work directory %s, got:\n%s", resolved, out)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(out), "32") {
+		t.Errorf("Expected open files limit of 32, got:\n%s", out)
+	}
+}
+
+// TEST: GIVEN a command that forks a background child and outlives the timeout
+// WHEN Run is called
+// THEN it should return a timeout error promptly, having killed the whole group
+func TestRun_TimeoutKillsGroup(t *testing.T) {
+	sb := newSandbox(t, config.Sandbox{WorkDir: t.TempDir(), Timeout: 1})
+
+	start := time.Now()
+	_, err := sb.Run(context.Background(), "sh", "-c", "sleep 30 & sleep 30")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected kill within a few seconds, took %s", elapsed)
+	}
+}
+
+// TEST: GIVEN a command that writes more than the output cap
+// WHEN Run is called
+// THEN the output should be capped and marked truncated
+func TestRun_OutputCapped(t *testing.T) {
+	sb := newSandbox(t, config.Sandbox{WorkDir: t.TempDir(), MaxOutput: 10})
+
+	res, err := sb.Run(context.Background(), "sh", "-c", "printf 0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if string(res.Output) != "0123456789" || !res.Truncated {
+		t.Errorf("Expected 10 truncated bytes, got %q (truncated=%v)", res.Output, res.Truncated)
+	}
+}
+
+// TEST: GIVEN a script path that escapes the work directory
+// WHEN RunScript is called
+// THEN it should refuse to run it
+func TestRunScript_StaysInWorkDir(t *testing.T) {
+	workDir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "evil.sh")
+	if err := os.WriteFile(outside, []byte("#!/bin/sh\necho evil\n"), 0755); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(workDir, "link.sh")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "ok.sh"), []byte("#!/bin/sh\necho ok\n"), 0755); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	sb := newSandbox(t, config.Sandbox{WorkDir: workDir})
+
+	if _, err := sb.RunScript(context.Background(), "link.sh"); !errors.Is(err, sandbox.ErrOutsideWorkDir) {
+		t.Errorf("Expected ErrOutsideWorkDir for symlink, got %v", err)
+	}
+	if _, err := sb.RunScript(context.Background(), "../"+filepath.Base(outside)); err == nil {
+		t.Error("Expected error for relative escape, got nil")
+	}
+
+	res, err := sb.RunScript(context.Background(), "ok.sh")
+	if err != nil || strings.TrimSpace(string(res.Output)) != "ok" {
+		t.Errorf("Expected script output %q, got %q (%v)", "ok", res.Output, err)
+	}
+}
+
+func newSandbox(t *testing.T, cfg config.Sandbox) *sandbox.Sandbox {
+	t.Helper()
+	sb, err := sandbox.New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create sandbox: %v", err)
+	}
+	return sb
+}
+
+// TEST: GIVEN a sandbox that passes DISPLAY through
+// WHEN a shell reports its environment
+// THEN it should see DISPLAY but no other variable of the daemon's
+func TestRun_PassEnv(t *testing.T) {
+	t.Setenv("DISPLAY", ":7")
+	t.Setenv("BEACON_SECRET", "leak")
+	sb := newSandbox(t, config.Sandbox{WorkDir: t.TempDir(), PassEnv: []string{"DISPLAY", "XAUTHORITY"}})
+
+	res, err := sb.Run(context.Background(), "sh", "-c", "env")
+	if err != nil {
+		t.Fatalf("Run failed: %v (%s)", err, res.Output)
+	}
+	if out := string(res.Output); !strings.Contains(out, "DISPLAY=:7") || strings.Contains(out, "BEACON_SECRET") || strings.Contains(out, "XAUTHORITY") {
+		t.Errorf("Expected only DISPLAY passed through, got:\n%s", out)
+	}
+}
+
+// TEST: GIVEN a jailed sandbox running as nobody, with a probe and its libraries in the work directory
+// WHEN the probe is run as a script and looks for a file outside the work directory
+// THEN it should start at the jail's root as nobody and not find the file, and commands outside the jail should not be found
+func TestRunScript_Jail(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("jails need root on linux")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+
+	workDir := t.TempDir()
+	if err := os.Chmod(workDir, 0755); err != nil {
+		t.Fatalf("Failed to open up work directory: %v", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to locate test binary: %v", err)
+	}
+	copyFile(t, exe, filepath.Join(workDir, "probe"))
+	// The probe is linked dynamically when cgo is on, its libraries go along
+	if out, err := exec.Command("ldd", exe).Output(); err == nil {
+		for _, field := range strings.Fields(string(out)) {
+			if strings.HasPrefix(field, "/") {
+				copyFile(t, field, filepath.Join(workDir, field))
+			}
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// The Go runtime reserves more address space than the default limit
+	sb := newSandbox(t, config.Sandbox{WorkDir: workDir, Jail: true, User: "nobody", MemoryMB: 4096, Env: []string{"SANDBOX_PROBE=1"}})
+	res, err := sb.RunScript(context.Background(), "probe", outside)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v (%s)", err, res.Output)
+	}
+	if want := fmt.Sprintf("/ %s false", nobody.Uid); strings.TrimSpace(string(res.Output)) != want {
+		t.Errorf("Expected %q, got %q", want, res.Output)
+	}
+
+	if _, err := sb.Run(context.Background(), "sh", "-c", "true"); err == nil {
+		t.Error("Expected sh outside the jail not to be found")
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", from, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", filepath.Dir(to), err)
+	}
+	if err := os.WriteFile(to, data, 0755); err != nil {
+		t.Fatalf("Failed to write %s: %v", to, err)
+	}
+}
@@ -0,0 +1,115 @@
+//go:build linux || darwin
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sysProcAttr puts the helper in its own process group, optionally as another
+// user. A jailed helper has to chroot before it gives up root, so it gets the
+// user's ids as "uid:gid" to switch to itself instead.
+func sysProcAttr(username string, jailed bool) (*syscall.SysProcAttr, string, error) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if username == "" {
+		return attr, "", nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up sandbox user: %w", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid uid for %s: %w", username, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid gid for %s: %w", username, err)
+	}
+
+	if jailed {
+		return attr, fmt.Sprintf("%d:%d", uid, gid), nil
+	}
+	attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}
+	return attr, "", nil
+}
+
+// checkJail reports why commands can't be chrooted, nil when they can
+func checkJail() error {
+	if os.Geteuid() != 0 {
+		return errors.New("jail needs the daemon to run as root")
+	}
+	return nil
+}
+
+// enterJail chroots into dir and switches to ids, "uid:gid" or empty to
+// stay root
+func enterJail(dir, ids string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return fmt.Errorf("failed to enter jail: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to enter jail: %w", err)
+	}
+	if ids == "" {
+		return nil
+	}
+
+	uidText, gidText, _ := strings.Cut(ids, ":")
+	uid, err := strconv.Atoi(uidText)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q", uidText)
+	}
+	gid, err := strconv.Atoi(gidText)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q", gidText)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("failed to drop groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	return nil
+}
+
+// killGroup kills the helper's process group, taking any children with it
+func killGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err != nil {
+		return p.Kill()
+	}
+	return nil
+}
+
+func setLimits(cpuSeconds, memoryBytes, openFiles uint64) error {
+	limits := []struct {
+		resource int
+		value    uint64
+		name     string
+	}{
+		{syscall.RLIMIT_CPU, cpuSeconds, "cpu"},
+		{syscall.RLIMIT_AS, memoryBytes, "memory"},
+		{syscall.RLIMIT_NOFILE, openFiles, "open files"},
+	}
+
+	for _, l := range limits {
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			return fmt.Errorf("failed to set %s limit: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+func execve(path string, argv, env []string) error {
+	return syscall.Exec(path, argv, env)
+}
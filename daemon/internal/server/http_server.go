@@ -3,25 +3,36 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/bxrne/beacon/aggregator/pkg/bproto"
 	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/bxrne/beacon/daemon/internal/files"
+	"github.com/bxrne/beacon/daemon/internal/sandbox"
 	"github.com/bxrne/beacon/daemon/internal/stats"
+	"github.com/bxrne/beacon/daemon/internal/update"
 	"github.com/charmbracelet/log"
 )
 
 type HTTPServer struct {
-	cfg    *config.Config
-	logger *log.Logger
-	server *http.Server
+	cfg     *config.Config
+	logger  *log.Logger
+	server  *http.Server
+	updater *update.Updater
+	sandbox *sandbox.Sandbox
 }
 
-func NewHTTPServer(cfg *config.Config, logger *log.Logger) *HTTPServer {
+func NewHTTPServer(cfg *config.Config, logger *log.Logger, updater *update.Updater, sandbox *sandbox.Sandbox) *HTTPServer {
 	return &HTTPServer{
-		cfg:    cfg,
-		logger: logger,
+		cfg:     cfg,
+		logger:  logger,
+		updater: updater,
+		sandbox: sandbox,
 	}
 }
 
@@ -29,6 +40,7 @@ func (s *HTTPServer) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/metric", s.handleMetrics)
 	mux.HandleFunc("/cmd", s.handleCommand)
+	mux.HandleFunc("/health", s.handleHealth)
 
 	addr := fmt.Sprintf(":%d", s.cfg.Server.Port)
 	s.logger.Infof("HTTP server listening on port %d", s.cfg.Server.Port)
@@ -63,7 +75,9 @@ func (s *HTTPServer) handleCommand(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var cmd struct {
-		Command string `json:"command"`
+		ID      uint            `json:"id,omitempty"` // Echoed back so the result can be matched to the command
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args,omitempty"`
 	}
 	if err := json.Unmarshal(body, &cmd); err != nil {
 		s.logger.Errorf("Failed to parse command: %v", err)
@@ -71,28 +85,172 @@ func (s *HTTPServer) handleCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := "Command executed successfully"
+	var output []byte
+	restart := false
+
 	// Handle different commands
 	switch cmd.Command {
 	case "notify":
-		message := "Remote command received: notify"
-		if err := stats.SendNotification("Beacon Alert", message, s.logger); err != nil {
+		notice := "Remote command received: notify"
+		if err := stats.SendNotification(r.Context(), s.sandbox, "Beacon Alert", notice, s.logger); err != nil {
 			s.logger.Error("failed to send notification", "error", err)
 			http.Error(w, "Failed to execute command", http.StatusInternalServerError)
 			return
 		}
+	case "fetch":
+		var req files.FetchRequest
+		if err := json.Unmarshal(cmd.Args, &req); err != nil {
+			http.Error(w, "Invalid fetch arguments", http.StatusBadRequest)
+			return
+		}
+		res, err := files.Fetch(s.cfg.Files, req)
+		if err != nil {
+			s.logger.Error("failed to fetch file", "path", req.Path, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to fetch file: %v", err), commandErrorStatus(err))
+			return
+		}
+		output = res.Content
+		message = fmt.Sprintf("Read %d of %d bytes from %s at offset %d", len(res.Content), res.Size, res.Path, res.Offset)
+		if res.Truncated {
+			message += " (truncated)"
+		}
+	case "push":
+		var req files.PushRequest
+		if err := json.Unmarshal(cmd.Args, &req); err != nil {
+			http.Error(w, "Invalid push arguments", http.StatusBadRequest)
+			return
+		}
+		if err := files.Push(s.cfg.Files, req); err != nil {
+			s.logger.Error("failed to push file", "path", req.Path, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to push file: %v", err), commandErrorStatus(err))
+			return
+		}
+		message = fmt.Sprintf("Wrote %d bytes to %s", len(req.Content), req.Path)
+	case "run":
+		if !s.cfg.Sandbox.AllowRun {
+			http.Error(w, "Running scripts is disabled", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Script string   `json:"script"`
+			Args   []string `json:"args"`
+		}
+		if err := json.Unmarshal(cmd.Args, &req); err != nil || req.Script == "" {
+			http.Error(w, "Invalid run arguments", http.StatusBadRequest)
+			return
+		}
+		res, err := s.sandbox.RunScript(r.Context(), req.Script, req.Args...)
+		if err != nil {
+			s.logger.Error("script failed", "script", req.Script, "error", err)
+			http.Error(w, fmt.Sprintf("Script failed: %v", err), commandErrorStatus(err))
+			return
+		}
+		output = res.Output
+		message = fmt.Sprintf("%s exited with code %d in %s", req.Script, res.ExitCode, res.Duration.Round(time.Millisecond))
+		if res.Truncated {
+			message += " (output truncated)"
+		}
+	case "reboot":
+		if len(s.cfg.Sandbox.RebootCommand) == 0 {
+			http.Error(w, "Reboot is not configured", http.StatusNotImplemented)
+			return
+		}
+		reboot := s.cfg.Sandbox.RebootCommand
+		if _, err := s.sandbox.Run(r.Context(), reboot[0], reboot[1:]...); err != nil {
+			s.logger.Error("failed to reboot", "error", err)
+			http.Error(w, fmt.Sprintf("Failed to reboot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		message = "Rebooting device"
+	case "update":
+		if s.updater == nil {
+			http.Error(w, "Self-update is not available", http.StatusNotImplemented)
+			return
+		}
+		var req update.Request
+		if err := json.Unmarshal(cmd.Args, &req); err != nil {
+			http.Error(w, "Invalid update arguments", http.StatusBadRequest)
+			return
+		}
+		if err := s.updater.Prepare(r.Context(), req); err != nil {
+			s.logger.Error("failed to prepare update", "url", req.URL, "error", err)
+			http.Error(w, fmt.Sprintf("Failed to update: %v", err), http.StatusInternalServerError)
+			return
+		}
+		message = fmt.Sprintf("Update %s staged, restarting", req.SHA256)
+		restart = true
 	default:
 		s.logger.Warn("unknown command received", "command", cmd.Command)
 		http.Error(w, "Unknown command", http.StatusBadRequest)
 		return
 	}
 
+	s.writeCommandResponse(w, r, commandResponse{
+		ID:      cmd.ID,
+		Status:  "success",
+		Message: message,
+		Output:  output,
+	})
+
+	if restart {
+		// Let the response reach the aggregator before the process is replaced
+		go func() {
+			time.Sleep(time.Second)
+			if err := s.updater.Restart(); err != nil {
+				s.logger.Error("failed to restart after update", "error", err)
+			}
+		}()
+	}
+}
+
+func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// commandResponse is returned for every executed command, Output is base64 in JSON
+type commandResponse struct {
+	ID      uint   `json:"id,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Output  []byte `json:"output,omitempty"`
+}
+
+// writeCommandResponse answers with a bproto result frame when the caller
+// accepts one, plain JSON otherwise
+func (s *HTTPServer) writeCommandResponse(w http.ResponseWriter, r *http.Request, resp commandResponse) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Failed to encode command result", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), bproto.ContentType) {
+		frame, err := bproto.Encode(bproto.Frame{Version: bproto.Version2, Type: bproto.TypeCommandResult, Payload: body})
+		if err != nil {
+			s.logger.Error("failed to encode command result", "error", err)
+			http.Error(w, "Failed to encode command result", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", bproto.ContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(frame)
+		return
+	}
+
 	// Add proper HTTP headers
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "success",
-		"message": "Command executed successfully",
-	})
+	w.Write(body)
+}
+
+func commandErrorStatus(err error) int {
+	if errors.Is(err, files.ErrNotAllowed) || errors.Is(err, sandbox.ErrOutsideWorkDir) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
 }
 
 func (s *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
@@ -105,15 +263,15 @@ func (s *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 
 	s.logger.Debug("metrics collected successfully")
 
-	payload := deviceMetrics.String()
-	payloadLength := len(payload)
-
-	// Construct message according to protocol: STX + LEN + PAYLOAD + ETX
-	message := make([]byte, payloadLength+3)
-	message[0] = 0x02 // STX
-	message[1] = byte(payloadLength)
-	copy(message[2:], []byte(payload))
-	message[payloadLength+2] = 0x03 // ETX
+	// Older aggregators get the v2 text payload, newer ones structured v3
+	version := bproto.Negotiate(r.Header.Get(bproto.VersionHeader))
+	message, err := bproto.EncodeMetrics(version, deviceMetrics)
+	if err != nil {
+		s.logger.Error("failed to encode metrics", "error", err)
+		http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+		return
+	}
 
+	w.Header().Set("Content-Type", bproto.ContentType)
 	w.Write(message)
 }
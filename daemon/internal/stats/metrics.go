@@ -28,6 +28,7 @@ func CollectMetrics() (*metrics.DeviceMetrics, error) {
 	var memoryMon MemoryMonitor = MemoryMon{}
 	var diskMon DiskMon = DiskMon{}
 	var hostMon HostMon = HostMon{}
+	var powerMon PowerMonitor = PowerMon{}
 
 	// Collect memory usage
 	vmStat, err := memoryMon.VirtualMemory()
@@ -37,7 +38,7 @@ func CollectMetrics() (*metrics.DeviceMetrics, error) {
 	deviceMetrics.Metrics = append(deviceMetrics.Metrics, metrics.Metric{
 		Type:       "memory_used",
 		Value:      fmt.Sprintf("%.2f", vmStat.UsedPercent),
-		Unit:       "%",
+		Unit:       "percent",
 		RecordedAt: time.Now().UTC().Format(time.RFC3339),
 	})
 
@@ -49,7 +50,8 @@ func CollectMetrics() (*metrics.DeviceMetrics, error) {
 	deviceMetrics.Metrics = append(deviceMetrics.Metrics, metrics.Metric{
 		Type:       "disk_used",
 		Value:      fmt.Sprintf("%.2f", diskUsage.UsedPercent),
-		Unit:       "%",
+		Unit:       "percent",
+		Labels:     map[string]string{"path": diskUsage.Path},
 		RecordedAt: time.Now().UTC().Format(time.RFC3339),
 	})
 
@@ -65,5 +67,12 @@ func CollectMetrics() (*metrics.DeviceMetrics, error) {
 		RecordedAt: time.Now().UTC().Format(time.RFC3339),
 	})
 
+	// Collect battery and AC state, absent on machines without a battery
+	supplies, err := powerMon.Supplies()
+	if err != nil {
+		return nil, err
+	}
+	deviceMetrics.Metrics = append(deviceMetrics.Metrics, PowerMetrics(supplies, time.Now())...)
+
 	return &deviceMetrics, nil
 }
@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+)
+
+const powerSupplyRoot = "/sys/class/power_supply"
+
+// PowerSupply is one entry of /sys/class/power_supply. Energy values are
+// in µWh and power in µW, or µAh and µA when the driver reports charge.
+type PowerSupply struct {
+	Name       string
+	Type       string
+	Online     bool
+	Status     string
+	Capacity   float64
+	Now        float64
+	Full       float64
+	FullDesign float64
+	Rate       float64
+}
+
+type PowerMonitor interface {
+	Supplies() ([]PowerSupply, error)
+}
+
+// PowerMon reads power supplies from sysfs, Root defaults to /sys/class/power_supply
+type PowerMon struct {
+	Root string
+}
+
+func (p PowerMon) Supplies() ([]PowerSupply, error) {
+	root := p.Root
+	if root == "" {
+		root = powerSupplyRoot
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil // No power supply class, e.g. containers or non-Linux hosts
+		}
+		return nil, err
+	}
+
+	var supplies []PowerSupply
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		supply := PowerSupply{
+			Name:   entry.Name(),
+			Type:   readAttr(dir, "type"),
+			Online: readAttr(dir, "online") == "1",
+			Status: strings.ToLower(readAttr(dir, "status")),
+		}
+		supply.Capacity, _ = strconv.ParseFloat(readAttr(dir, "capacity"), 64)
+
+		// Prefer energy, fall back to charge; both give the same ratios
+		for _, unit := range []string{"energy", "charge"} {
+			now, err := strconv.ParseFloat(readAttr(dir, unit+"_now"), 64)
+			if err != nil {
+				continue
+			}
+			supply.Now = now
+			supply.Full, _ = strconv.ParseFloat(readAttr(dir, unit+"_full"), 64)
+			supply.FullDesign, _ = strconv.ParseFloat(readAttr(dir, unit+"_full_design"), 64)
+			rate := "power_now"
+			if unit == "charge" {
+				rate = "current_now"
+			}
+			supply.Rate, _ = strconv.ParseFloat(readAttr(dir, rate), 64)
+			break
+		}
+
+		supplies = append(supplies, supply)
+	}
+
+	return supplies, nil
+}
+
+// PowerMetrics summarises all supplies into battery and AC metrics. Multiple
+// batteries are combined by capacity. No metrics are returned without a battery.
+func PowerMetrics(supplies []PowerSupply, recordedAt time.Time) []metrics.Metric {
+	var batteries []PowerSupply
+	hasMains := false
+	acOnline := false
+	for _, s := range supplies {
+		switch s.Type {
+		case "Battery":
+			batteries = append(batteries, s)
+		case "Mains", "USB":
+			hasMains = true
+			acOnline = acOnline || s.Online
+		}
+	}
+	if len(batteries) == 0 {
+		return nil
+	}
+
+	var now, full, design, rate, capacity float64
+	status := "unknown"
+	for _, b := range batteries {
+		now += b.Now
+		full += b.Full
+		design += b.FullDesign
+		rate += b.Rate
+		capacity += b.Capacity
+		// Any battery discharging means we are on battery; a battery
+		// without a status leaves the choice to the others
+		if b.Status != "" && (status == "unknown" || b.Status == "discharging") {
+			status = b.Status
+		}
+	}
+
+	percent := capacity / float64(len(batteries))
+	if full > 0 {
+		percent = now / full * 100
+	}
+	if !hasMains {
+		acOnline = status != "discharging"
+	}
+
+	ts := recordedAt.UTC().Format(time.RFC3339)
+	out := []metrics.Metric{
+		{Type: "battery_percent", Value: fmt.Sprintf("%.2f", percent), Unit: "percent", RecordedAt: ts},
+		{Type: "battery_state", Value: strings.ReplaceAll(status, " ", "_"), Unit: "state", RecordedAt: ts},
+		{Type: "ac_online", Value: strconv.FormatBool(acOnline), Unit: "boolean", RecordedAt: ts},
+	}
+	if design > 0 && full > 0 {
+		out = append(out, metrics.Metric{
+			Type:       "battery_health",
+			Value:      fmt.Sprintf("%.2f", full/design*100),
+			Unit:       "percent",
+			RecordedAt: ts,
+		})
+	}
+	if status == "discharging" && rate > 0 {
+		out = append(out, metrics.Metric{
+			Type:       "battery_time_to_empty",
+			Value:      fmt.Sprintf("%d", int64(now/rate*3600)),
+			Unit:       "seconds",
+			RecordedAt: ts,
+		})
+	}
+
+	return out
+}
+
+func readAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
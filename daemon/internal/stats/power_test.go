@@ -0,0 +1,141 @@
+package stats_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metrics "github.com/bxrne/beacon/aggregator/pkg/types"
+	"github.com/bxrne/beacon/daemon/internal/stats"
+)
+
+// TEST: GIVEN a fake sysfs tree with a discharging battery and AC offline
+// WHEN the power supplies are read and summarised
+// THEN it should report percent, state, time to empty, AC offline and health
+func TestPowerMetrics_Discharging(t *testing.T) {
+	root := t.TempDir()
+	writeSupply(t, root, "AC", map[string]string{"type": "Mains", "online": "0"})
+	writeSupply(t, root, "BAT0", map[string]string{
+		"type":               "Battery",
+		"status":             "Discharging",
+		"capacity":           "50",
+		"energy_now":         "25000000",
+		"energy_full":        "50000000",
+		"energy_full_design": "62500000",
+		"power_now":          "12500000",
+	})
+
+	got := readPower(t, root)
+
+	want := map[string]string{
+		"battery_percent":       "50.00",
+		"battery_state":         "discharging",
+		"ac_online":             "false",
+		"battery_health":        "80.00",
+		"battery_time_to_empty": "7200",
+	}
+	assertMetrics(t, got, want)
+}
+
+// TEST: GIVEN a fake sysfs tree with a charging battery reporting charge instead of energy
+// WHEN the power supplies are read and summarised
+// THEN it should report AC online and no time to empty
+func TestPowerMetrics_ChargingWithChargeUnits(t *testing.T) {
+	root := t.TempDir()
+	writeSupply(t, root, "ADP1", map[string]string{"type": "Mains", "online": "1"})
+	writeSupply(t, root, "BAT1", map[string]string{
+		"type":               "Battery",
+		"status":             "Charging",
+		"charge_now":         "3000000",
+		"charge_full":        "4000000",
+		"charge_full_design": "4000000",
+		"current_now":        "1000000",
+	})
+
+	got := readPower(t, root)
+
+	want := map[string]string{
+		"battery_percent": "75.00",
+		"battery_state":   "charging",
+		"ac_online":       "true",
+		"battery_health":  "100.00",
+	}
+	assertMetrics(t, got, want)
+}
+
+// TEST: GIVEN a machine without batteries or without the power supply class
+// WHEN the power supplies are read and summarised
+// THEN it should report no metrics and no error
+func TestPowerMetrics_NoBattery(t *testing.T) {
+	root := t.TempDir()
+	writeSupply(t, root, "AC", map[string]string{"type": "Mains", "online": "1"})
+
+	if got := readPower(t, root); len(got) != 0 {
+		t.Errorf("Expected no metrics, got %+v", got)
+	}
+	if got := readPower(t, filepath.Join(root, "missing")); len(got) != 0 {
+		t.Errorf("Expected no metrics, got %+v", got)
+	}
+}
+
+func readPower(t *testing.T, root string) []metrics.Metric {
+	t.Helper()
+	supplies, err := stats.PowerMon{Root: root}.Supplies()
+	if err != nil {
+		t.Fatalf("Failed to read power supplies: %v", err)
+	}
+	return stats.PowerMetrics(supplies, time.Now())
+}
+
+// TEST: GIVEN two batteries where the first reports no status
+// WHEN the power supplies are read and summarised
+// THEN it should take the second battery's state instead of an empty one
+func TestPowerMetrics_SkipsEmptyStatus(t *testing.T) {
+	root := t.TempDir()
+	writeSupply(t, root, "AC", map[string]string{"type": "Mains", "online": "1"})
+	writeSupply(t, root, "BAT0", map[string]string{
+		"type":     "Battery",
+		"status":   "",
+		"capacity": "40",
+	})
+	writeSupply(t, root, "BAT1", map[string]string{
+		"type":     "Battery",
+		"status":   "Charging",
+		"capacity": "60",
+	})
+
+	got := readPower(t, root)
+
+	want := map[string]string{
+		"battery_percent": "50.00",
+		"battery_state":   "charging",
+		"ac_online":       "true",
+	}
+	assertMetrics(t, got, want)
+}
+
+func writeSupply(t *testing.T, root, name string, attrs map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", dir, err)
+	}
+	for attr, value := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", attr, err)
+		}
+	}
+}
+
+func assertMetrics(t *testing.T, got []metrics.Metric, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("Expected %d metrics, got %d: %+v", len(want), len(got), got)
+	}
+	for _, m := range got {
+		if value, ok := want[m.Type]; !ok || value != m.Value {
+			t.Errorf("Unexpected metric %s=%s, want %q", m.Type, m.Value, value)
+		}
+	}
+}
@@ -1,14 +1,22 @@
 package stats
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"runtime"
+	"time"
 
+	"github.com/bxrne/beacon/daemon/internal/sandbox"
 	"github.com/charmbracelet/log"
 )
 
-func SendNotification(title, message string, logger *log.Logger) error {
+// notifyTimeout bounds how long a dialog waits to be dismissed
+const notifyTimeout = 15 * time.Second
+
+// SendNotification shows a dialog on the desktop through the sandbox, which
+// needs the session's variables, like DISPLAY, in pass_env. A dialog nobody
+// dismisses is killed after notifyTimeout and reported as an error.
+func SendNotification(ctx context.Context, sb *sandbox.Sandbox, title, message string, logger *log.Logger) error {
 	logger.Info("sending notification",
 		"title", title,
 		"message", message,
@@ -18,21 +26,21 @@ func SendNotification(title, message string, logger *log.Logger) error {
 	case "darwin":
 		script := fmt.Sprintf(`display dialog "%s" with title "%s" buttons {"OK"} default button "OK" with icon caution`,
 			message, title)
-		cmd := exec.Command("osascript", "-e", script)
-		return cmd.Run()
+		_, err := sb.RunTimeout(ctx, notifyTimeout, "osascript", "-e", script)
+		return err
 
 	case "linux":
-		cmd := exec.Command("zenity", "--warning",
+		_, err := sb.RunTimeout(ctx, notifyTimeout, "zenity", "--warning",
 			"--title", title,
 			"--text", message,
 			"--width", "300")
-		return cmd.Run()
+		return err
 
 	case "windows":
 		script := fmt.Sprintf(`Add-Type -AssemblyName PresentationFramework;[System.Windows.MessageBox]::Show('%s','%s','OK','Warning')`,
 			message, title)
-		cmd := exec.Command("powershell", "-Command", script)
-		return cmd.Run()
+		_, err := sb.RunTimeout(ctx, notifyTimeout, "powershell", "-Command", script)
+		return err
 
 	default:
 		return fmt.Errorf("notifications not supported on %s", runtime.GOOS)
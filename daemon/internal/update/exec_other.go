@@ -0,0 +1,20 @@
+//go:build !unix
+
+package update
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func reexec(path string) error {
+	return fmt.Errorf("restarting in place is not supported on %s", runtime.GOOS)
+}
+
+func startWatchdog(exe string) error {
+	return fmt.Errorf("update watchdog is not supported on %s", runtime.GOOS)
+}
+
+func killProcess(pid int) error {
+	return fmt.Errorf("update watchdog is not supported on %s", runtime.GOOS)
+}
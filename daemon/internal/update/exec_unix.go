@@ -0,0 +1,49 @@
+//go:build unix
+
+package update
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// reexec replaces the process image, keeping the PID for service managers
+func reexec(path string) error {
+	return syscall.Exec(path, append([]string{path}, os.Args[1:]...), os.Environ())
+}
+
+// startWatchdog runs the previous binary as the watchdog of this process, in
+// its own session so it lives on whatever the new binary does. Nothing waits
+// for it, so once done it lingers as a zombie until the daemon exits.
+func startWatchdog(exe string) error {
+	cmd := exec.Command(exe+previousSuffix, WatchdogArg, exe, strconv.Itoa(os.Getpid()))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// killProcess kills a hung binary outright and waits a little for it to go,
+// which frees its port
+func killProcess(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return err
+	}
+	for range 50 {
+		if syscall.Kill(pid, 0) != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
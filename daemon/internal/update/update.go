@@ -0,0 +1,411 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	defaultGracePeriod = 30 * time.Second
+	maxBinaryBytes     = 256 << 20
+	previousSuffix     = ".prev"
+	pendingSuffix      = ".pending"
+	// watchdogMargin lets the new binary roll itself back before the watchdog steps in
+	watchdogMargin = 10 * time.Second
+)
+
+// WatchdogArg makes the previous binary watch over an update, see Watchdog
+const WatchdogArg = "__update-watchdog"
+
+// Request is the argument of the update command. Signature is an ed25519
+// signature over the raw SHA-256 digest of the binary, base64 in JSON.
+type Request struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// pending is written next to the binary between the swap and a healthy start
+type pending struct {
+	Deadline time.Time `json:"deadline"`
+	SHA256   string    `json:"sha256"`
+	Started  bool      `json:"started,omitempty"` // Set by the first start of the new binary
+}
+
+type Updater struct {
+	exe       string
+	cfg       config.Update
+	publicKey ed25519.PublicKey
+	client    *http.Client
+	logger    *log.Logger
+	// exec replaces the running process and watch starts the watchdog of an
+	// update, swapped out in tests
+	exec  func(path string) error
+	watch func(exe string) error
+	// supervised leaves restarting a killed daemon to its service manager
+	supervised bool
+}
+
+// Executable returns the resolved path of the running binary
+func Executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func NewUpdater(cfg config.Update, exe string, logger *log.Logger) (*Updater, error) {
+	u := &Updater{
+		exe:    exe,
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		logger: logger,
+		exec:   reexec,
+		watch:  startWatchdog,
+	}
+
+	if cfg.PublicKey != "" {
+		key, err := hex.DecodeString(cfg.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid update public key")
+		}
+		u.publicKey = ed25519.PublicKey(key)
+	}
+	if cfg.RequireSignature && u.publicKey == nil {
+		return nil, fmt.Errorf("update signatures are required but no public key is configured")
+	}
+
+	return u, nil
+}
+
+// Prepare downloads and verifies the new binary, then swaps it into place
+// keeping the current one for rollback. The process keeps running the old
+// code until Restart is called.
+func (u *Updater) Prepare(ctx context.Context, req Request) error {
+	if req.URL == "" || req.SHA256 == "" {
+		return fmt.Errorf("url and sha256 are required")
+	}
+
+	tmp, err := u.download(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // No-op once renamed
+
+	prev := u.exe + previousSuffix
+	os.Remove(prev)
+	if err := os.Link(u.exe, prev); err != nil {
+		if err := copyFile(u.exe, prev); err != nil {
+			return fmt.Errorf("failed to keep previous binary: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmp, u.exe); err != nil {
+		return fmt.Errorf("failed to swap binary: %w", err)
+	}
+
+	grace := time.Duration(u.cfg.GracePeriod) * time.Second
+	if grace <= 0 {
+		grace = defaultGracePeriod
+	}
+	marker, err := json.Marshal(pending{Deadline: time.Now().Add(grace), SHA256: req.SHA256})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(u.exe+pendingSuffix, marker, 0644); err != nil {
+		u.rollbackFiles()
+		return fmt.Errorf("failed to record pending update: %w", err)
+	}
+
+	u.logger.Info("update staged", "sha256", req.SHA256, "grace", grace)
+	return nil
+}
+
+// Restart re-executes the binary on disk in place of this process. With an
+// update pending, the previous binary is first started as its watchdog.
+func (u *Updater) Restart() error {
+	if _, err := os.Stat(u.exe + pendingSuffix); err == nil && u.watch != nil {
+		if err := u.watch(u.exe); err != nil {
+			u.logger.Warn("failed to start update watchdog", "error", err)
+		}
+	}
+	u.logger.Info("restarting into new binary", "path", u.exe)
+	return u.exec(u.exe)
+}
+
+// ConfirmPending is run at startup. If the binary was just swapped in it
+// must report healthy before the grace period ends or the previous binary
+// is restored and executed.
+func (u *Updater) ConfirmPending(ctx context.Context, healthy func(context.Context) error) {
+	data, err := os.ReadFile(u.exe + pendingSuffix)
+	if err != nil {
+		return
+	}
+
+	var p pending
+	if err := json.Unmarshal(data, &p); err != nil {
+		u.logger.Error("corrupt pending update marker, rolling back", "error", err)
+		u.Rollback()
+		return
+	}
+
+	u.logger.Info("verifying updated binary", "sha256", p.SHA256, "deadline", p.Deadline)
+
+	ctx, cancel := context.WithDeadline(ctx, p.Deadline)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		err := healthy(ctx)
+		if err == nil {
+			os.Remove(u.exe + pendingSuffix)
+			os.Remove(u.exe + previousSuffix)
+			u.logger.Info("update confirmed healthy", "sha256", p.SHA256)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			u.logger.Error("updated binary failed its health check", "error", err)
+			u.Rollback()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RecoverPending is run first thing in main, before anything the new binary
+// could fail on. A marker from an earlier start means the new binary died
+// before confirming its health, a past deadline that it never did. Either way
+// the previous binary is restored and executed, otherwise the marker records
+// this start.
+func RecoverPending(exe string) error {
+	return recoverPending(&Updater{exe: exe, logger: log.Default(), exec: reexec}, time.Now())
+}
+
+func recoverPending(u *Updater, now time.Time) error {
+	path := u.exe + pendingSuffix
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var p pending
+	switch err := json.Unmarshal(data, &p); {
+	case err != nil:
+		u.logger.Error("corrupt pending update marker, rolling back", "error", err)
+	case p.Started:
+		u.logger.Error("updated binary exited before confirming its health, rolling back", "sha256", p.SHA256)
+	case now.After(p.Deadline):
+		u.logger.Error("updated binary started after its deadline, rolling back", "sha256", p.SHA256)
+	default:
+		p.Started = true
+		if data, err = json.Marshal(p); err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+		return err
+	}
+
+	if err := u.rollbackFiles(); err != nil {
+		return err
+	}
+	return u.Restart()
+}
+
+// Watchdog is the entry point of the previous binary started by Restart,
+// args follow WatchdogArg: the daemon's executable and PID. If the update
+// is still pending past its deadline, the new binary hung or died with
+// nothing to restart it, so the watchdog restores the previous binary,
+// kills the new one and executes the previous one in its place. Under a
+// service manager, which restarts the daemon itself, the watchdog exits
+// after the kill instead.
+func Watchdog(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "update watchdog: missing arguments")
+		os.Exit(2)
+	}
+	pid, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "update watchdog: invalid pid %q\n", args[1])
+		os.Exit(2)
+	}
+
+	// The daemon takes no arguments, the watchdog's must not carry over to it
+	os.Args = os.Args[:1]
+
+	u := &Updater{exe: args[0], logger: log.Default(), exec: reexec, supervised: underServiceManager()}
+	if err := u.watchPending(pid, killProcess, time.Second); err != nil {
+		u.logger.Error("update watchdog failed", "error", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// underServiceManager reports whether the daemon was started by systemd,
+// which sets these for every service it runs and restarts it when it dies
+func underServiceManager() bool {
+	return os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// watchPending polls the marker until it is gone or past the deadline with
+// a margin, then rolls back and replaces the process pid, or only kills it
+// when supervised
+func (u *Updater) watchPending(pid int, kill func(pid int) error, poll time.Duration) error {
+	for {
+		data, err := os.ReadFile(u.exe + pendingSuffix)
+		if err != nil {
+			return nil // Confirmed or rolled back
+		}
+		var p pending
+		if json.Unmarshal(data, &p) != nil || time.Now().After(p.Deadline.Add(watchdogMargin)) {
+			break
+		}
+		time.Sleep(poll)
+	}
+
+	u.logger.Error("updated binary did not confirm its health in time, rolling back", "pid", pid)
+	if err := u.rollbackFiles(); err != nil {
+		return err
+	}
+	if err := kill(pid); err != nil {
+		return fmt.Errorf("failed to stop updated binary: %w", err)
+	}
+	if u.supervised {
+		u.logger.Info("left the restart of the previous binary to the service manager")
+		return nil
+	}
+	return u.Restart()
+}
+
+// Rollback restores the previous binary and executes it
+func (u *Updater) Rollback() {
+	if err := u.rollbackFiles(); err != nil {
+		u.logger.Error("rollback failed", "error", err)
+		return
+	}
+	if err := u.Restart(); err != nil {
+		u.logger.Error("failed to restart previous binary", "error", err)
+	}
+}
+
+func (u *Updater) rollbackFiles() error {
+	defer os.Remove(u.exe + pendingSuffix)
+
+	prev := u.exe + previousSuffix
+	if _, err := os.Stat(prev); err != nil {
+		return fmt.Errorf("no previous binary to roll back to: %w", err)
+	}
+	if err := os.Rename(prev, u.exe); err != nil {
+		return fmt.Errorf("failed to restore previous binary: %w", err)
+	}
+	u.logger.Warn("rolled back to previous binary", "path", u.exe)
+	return nil
+}
+
+// download streams the binary next to the current one, hashing as it goes
+func (u *Updater) download(ctx context.Context, req Request) (string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to download binary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download binary, status code: %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(u.exe), "."+filepath.Base(u.exe)+".*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, maxBinaryBytes+1))
+	if err == nil && n > maxBinaryBytes {
+		err = fmt.Errorf("binary exceeds %d bytes", maxBinaryBytes)
+	}
+	if err == nil {
+		err = tmp.Chmod(0755)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = u.verify(hash.Sum(nil), req)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+func (u *Updater) verify(digest []byte, req Request) error {
+	if !strings.EqualFold(hex.EncodeToString(digest), req.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %x", digest)
+	}
+
+	if len(req.Signature) == 0 {
+		if u.cfg.RequireSignature {
+			return errors.New("signature required but none provided")
+		}
+		return nil
+	}
+	if u.publicKey == nil {
+		return errors.New("signature provided but no public key is configured")
+	}
+	if !ed25519.Verify(u.publicKey, digest, req.Signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
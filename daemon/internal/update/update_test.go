@@ -0,0 +1,257 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/daemon/internal/config"
+	"github.com/charmbracelet/log"
+)
+
+// TEST: GIVEN a binary served over HTTP with a matching checksum
+// WHEN Prepare and Restart are called
+// THEN the binary should be swapped, the old one kept and the new one executed
+func TestPrepare_SwapsBinary(t *testing.T) {
+	newBinary := []byte("#!/bin/sh\necho new\n")
+	srv := serveBinary(t, newBinary)
+	u, execs := newTestUpdater(t, config.Update{})
+
+	if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex(newBinary)}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if err := u.Restart(); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+
+	assertFile(t, u.exe, string(newBinary))
+	assertFile(t, u.exe+previousSuffix, "old")
+	if len(*execs) != 1 || (*execs)[0] != u.exe {
+		t.Errorf("Expected one exec of %s, got %v", u.exe, *execs)
+	}
+	if _, err := os.Stat(u.exe + pendingSuffix); err != nil {
+		t.Errorf("Expected pending marker: %v", err)
+	}
+}
+
+// TEST: GIVEN a binary whose checksum does not match the request
+// WHEN Prepare is called
+// THEN it should fail and leave the running binary untouched
+func TestPrepare_ChecksumMismatch(t *testing.T) {
+	srv := serveBinary(t, []byte("tampered"))
+	u, _ := newTestUpdater(t, config.Update{})
+
+	if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex([]byte("expected"))}); err == nil {
+		t.Fatal("Expected checksum error, got nil")
+	}
+
+	assertFile(t, u.exe, "old")
+	entries, _ := os.ReadDir(filepath.Dir(u.exe))
+	if len(entries) != 1 {
+		t.Errorf("Expected no leftover files, got %d entries", len(entries))
+	}
+}
+
+// TEST: GIVEN an updater that requires signatures
+// WHEN Prepare is called with a bad and then a good ed25519 signature
+// THEN only the good signature should be accepted
+func TestPrepare_Signature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	binary := []byte("signed")
+	digest := sha256.Sum256(binary)
+	srv := serveBinary(t, binary)
+	u, _ := newTestUpdater(t, config.Update{PublicKey: hex.EncodeToString(pub), RequireSignature: true})
+
+	req := Request{URL: srv.URL, SHA256: digestHex(binary)}
+	if err := u.Prepare(context.Background(), req); err == nil {
+		t.Fatal("Expected missing signature error, got nil")
+	}
+
+	req.Signature = ed25519.Sign(priv, []byte("something else"))
+	if err := u.Prepare(context.Background(), req); err == nil {
+		t.Fatal("Expected invalid signature error, got nil")
+	}
+
+	req.Signature = ed25519.Sign(priv, digest[:])
+	if err := u.Prepare(context.Background(), req); err != nil {
+		t.Fatalf("Expected valid signature to pass, got %v", err)
+	}
+	assertFile(t, u.exe, "signed")
+}
+
+// TEST: GIVEN a staged update whose health check never passes
+// WHEN ConfirmPending runs past the grace period
+// THEN the previous binary should be restored and executed
+func TestConfirmPending_RollsBack(t *testing.T) {
+	binary := []byte("broken")
+	srv := serveBinary(t, binary)
+	u, execs := newTestUpdater(t, config.Update{GracePeriod: 1})
+
+	if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex(binary)}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	u.ConfirmPending(context.Background(), func(context.Context) error {
+		return errors.New("not serving")
+	})
+
+	assertFile(t, u.exe, "old")
+	if _, err := os.Stat(u.exe + pendingSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected pending marker to be removed, got %v", err)
+	}
+	if len(*execs) != 1 {
+		t.Errorf("Expected rollback to exec the previous binary, got %v", *execs)
+	}
+}
+
+// TEST: GIVEN a staged update whose health check passes
+// WHEN ConfirmPending runs
+// THEN the update should be committed and the previous binary discarded
+func TestConfirmPending_Commits(t *testing.T) {
+	binary := []byte("healthy")
+	srv := serveBinary(t, binary)
+	u, execs := newTestUpdater(t, config.Update{})
+
+	if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex(binary)}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	u.ConfirmPending(context.Background(), func(context.Context) error { return nil })
+
+	assertFile(t, u.exe, "healthy")
+	for _, suffix := range []string{pendingSuffix, previousSuffix} {
+		if _, err := os.Stat(u.exe + suffix); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", suffix, err)
+		}
+	}
+	if len(*execs) != 0 {
+		t.Errorf("Expected no exec, got %v", *execs)
+	}
+}
+
+// TEST: GIVEN a staged update
+// WHEN the new binary starts once and then again without confirming
+// THEN the first start should be recorded and the second should restore and execute the previous binary
+func TestRecoverPending(t *testing.T) {
+	binary := []byte("crashes")
+	srv := serveBinary(t, binary)
+	u, execs := newTestUpdater(t, config.Update{})
+	if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex(binary)}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	if err := recoverPending(u, time.Now()); err != nil {
+		t.Fatalf("First start failed: %v", err)
+	}
+	assertFile(t, u.exe, "crashes")
+	if len(*execs) != 0 {
+		t.Fatalf("Expected the first start to go ahead, got execs %v", *execs)
+	}
+
+	if err := recoverPending(u, time.Now()); err != nil {
+		t.Fatalf("Second start failed: %v", err)
+	}
+	assertFile(t, u.exe, "old")
+	if _, err := os.Stat(u.exe + pendingSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected pending marker to be removed, got %v", err)
+	}
+	if len(*execs) != 1 {
+		t.Errorf("Expected the second start to exec the previous binary, got %v", *execs)
+	}
+}
+
+// TEST: GIVEN a staged update the new binary never confirms, with and without a service manager
+// WHEN the watchdog outlasts the deadline
+// THEN it should restore the previous binary and kill the new one, executing the previous one only without a service manager
+func TestWatchPending_RollsBack(t *testing.T) {
+	for _, supervised := range []bool{false, true} {
+		binary := []byte("hangs")
+		srv := serveBinary(t, binary)
+		u, execs := newTestUpdater(t, config.Update{GracePeriod: 1})
+		u.supervised = supervised
+		if err := u.Prepare(context.Background(), Request{URL: srv.URL, SHA256: digestHex(binary)}); err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		marker, _ := json.Marshal(pending{Deadline: time.Now().Add(-watchdogMargin), SHA256: digestHex(binary)})
+		if err := os.WriteFile(u.exe+pendingSuffix, marker, 0644); err != nil {
+			t.Fatalf("Failed to backdate marker: %v", err)
+		}
+
+		var killed []int
+		err := u.watchPending(42, func(pid int) error {
+			killed = append(killed, pid)
+			return nil
+		}, time.Millisecond)
+		if err != nil {
+			t.Fatalf("supervised=%v: watchPending failed: %v", supervised, err)
+		}
+
+		assertFile(t, u.exe, "old")
+		if len(killed) != 1 || killed[0] != 42 {
+			t.Errorf("supervised=%v: expected the new binary to be killed, got %v", supervised, killed)
+		}
+		if want := map[bool]int{false: 1, true: 0}[supervised]; len(*execs) != want {
+			t.Errorf("supervised=%v: expected %d execs of the previous binary, got %v", supervised, want, *execs)
+		}
+	}
+}
+
+func newTestUpdater(t *testing.T, cfg config.Update) (*Updater, *[]string) {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "beacon-daemon")
+	if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatalf("Failed to write executable: %v", err)
+	}
+
+	u, err := NewUpdater(cfg, exe, log.New(io.Discard))
+	if err != nil {
+		t.Fatalf("Failed to create updater: %v", err)
+	}
+
+	var execs []string
+	u.exec = func(path string) error {
+		execs = append(execs, path)
+		return nil
+	}
+	u.watch = func(string) error { return nil }
+	return u, &execs
+}
+
+func serveBinary(t *testing.T, content []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func digestHex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected %s to contain %q, got %q", filepath.Base(path), want, got)
+	}
+}
@@ -39,6 +39,22 @@ type CommandType struct {
 	Name string `toml:"name"`
 }
 
+// Releases is a directory of daemon binaries served for self-update
+type Releases struct {
+	Dir string `toml:"dir"`
+}
+
+// Commands bounds how long a command may wait on its aggregator
+type Commands struct {
+	SentTimeout int `toml:"sent_timeout"` // Seconds a command may stay sent before it is failed, defaults to 900
+}
+
+// Alerts toggles the conditions reported by /api/alerts
+type Alerts struct {
+	OnBattery   bool `toml:"on_battery"`
+	Unreachable bool `toml:"unreachable"` // Devices the aggregator reports down or flapping
+}
+
 type Config struct {
 	Labels       Labels        `toml:"labels"`
 	Logging      Logging       `toml:"logging"`
@@ -46,6 +62,9 @@ type Config struct {
 	Database     Database      `toml:"database"`
 	Metrics      Metrics       `toml:"metrics"`
 	CommandTypes []CommandType `toml:"command_types"`
+	Releases     Releases      `toml:"releases"`
+	Commands     Commands      `toml:"commands"`
+	Alerts       Alerts        `toml:"alerts"`
 }
 
 func Load(path string) (*Config, error) {
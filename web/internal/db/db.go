@@ -30,7 +30,7 @@ func NewDatabase(cfg *config.Config) (*gorm.DB, error) {
 }
 
 func migrate(db *gorm.DB, cfg *config.Config) error {
-	if err := db.AutoMigrate(&Device{}, &Unit{}, &MetricType{}, &Metric{}, &CommandType{}, &Command{}); err != nil {
+	if err := db.AutoMigrate(&Device{}, &Unit{}, &MetricType{}, &Metric{}, &CommandType{}, &Command{}, &DeviceEvent{}, &Aggregator{}, &TargetLease{}); err != nil {
 		return err
 	}
 
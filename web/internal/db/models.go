@@ -8,7 +8,22 @@ import (
 
 type Device struct {
 	gorm.Model
-	Name string `gorm:"unique;not null"`
+	Name       string `gorm:"unique;not null"`
+	State      string `gorm:"default:unknown"` // Reachability reported by the aggregator
+	StateSince *time.Time
+	LastError  string
+}
+
+// DeviceEvent is a reachability change, kept to show downtime over time
+type DeviceEvent struct {
+	gorm.Model
+	DeviceID uint   `gorm:"index:idx_device_events_device_at,priority:1"`
+	Device   Device `gorm:"foreignKey:DeviceID"`
+	State    string `gorm:"not null"`
+	Previous string
+	Reason   string
+	Error    string
+	At       time.Time `gorm:"not null;index:idx_device_events_device_at,priority:2"`
 }
 
 type Unit struct {
@@ -25,6 +40,7 @@ type Metric struct {
 	gorm.Model
 	TypeID     uint
 	Value      string `gorm:"not null"` // Ensure Value is a string
+	Labels     string // JSON object of labels, empty when the metric has none
 	UnitID     uint
 	DeviceID   uint
 	Type       MetricType `gorm:"foreignKey:TypeID"`
@@ -35,15 +51,36 @@ type Metric struct {
 
 type Command struct {
 	gorm.Model
-	Name     string `gorm:"not null"` // Removed unique constraint
-	DeviceID uint
-	Device   Device `gorm:"foreignKey:DeviceID"`
-	Status   string `gorm:"default:pending"`
-	SentAt   *time.Time
-	ErrorMsg string
+	Name        string `gorm:"not null"` // Removed unique constraint
+	DeviceID    uint
+	Device      Device     `gorm:"foreignKey:DeviceID"`
+	Status      string     `gorm:"default:pending"`
+	Args        string     // Raw JSON arguments passed through to the device
+	Output      string     // Base64 output returned by the device, e.g. fetched file content
+	SentAt      *time.Time // When the aggregator took the command for the device
+	CompletedAt *time.Time // When it completed or failed
+	ErrorMsg    string     // Why it failed
 }
 
 type CommandType struct {
 	gorm.Model
 	Name string `gorm:"unique;not null"`
 }
+
+// Aggregator is a registered aggregator, live until ExpiresAt unless it
+// heartbeats again
+type Aggregator struct {
+	ID        string `gorm:"primaryKey"`
+	Name      string
+	Targets   string    // JSON array of the device IDs it asked for
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TargetLease grants one aggregator the polling of a device until ExpiresAt
+type TargetLease struct {
+	Target    string    `gorm:"primaryKey"` // Device ID
+	Owner     string    `gorm:"index;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
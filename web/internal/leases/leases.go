@@ -0,0 +1,89 @@
+// Package leases decides which aggregator polls which target when several
+// can reach it. Each target goes to the live aggregator that ranks highest for
+// it by rendezvous hashing, so adding or losing an aggregator only moves the
+// targets it gains or held.
+package leases
+
+import (
+	"hash/fnv"
+	"slices"
+	"time"
+)
+
+// Member is a live aggregator and the device IDs it asked for
+type Member struct {
+	ID      string
+	Targets []string
+}
+
+// Lease is a target's current owner
+type Lease struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// Preferred returns the ID of the member that should own target, or "" when
+// no member wants it
+func Preferred(target string, members []Member) string {
+	var best string
+	var bestScore uint64
+	for _, m := range members {
+		if !slices.Contains(m.Targets, target) {
+			continue
+		}
+		if score := rank(m.ID, target); best == "" || score > bestScore || (score == bestScore && m.ID < best) {
+			best, bestScore = m.ID, score
+		}
+	}
+	return best
+}
+
+func rank(member, target string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+
+	// FNV alone barely changes the high bits between similar IDs, so one
+	// member would rank highest for nearly every target. Mix them in.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Decide returns the targets member id should hold after a heartbeat asking
+// for wanted, and the leases it holds but should give up. A member keeps its
+// leases while it is preferred and claims free or lapsed ones it is
+// preferred for. A lease held by another live owner is never taken, the
+// owner releases it on its own next heartbeat instead, so a target is never
+// polled twice.
+func Decide(id string, wanted []string, members []Member, leases map[string]Lease, now time.Time) (hold, release []string) {
+	for _, target := range wanted {
+		lease, leased := leases[target]
+		free := !leased || !now.Before(lease.ExpiresAt)
+		preferred := Preferred(target, members) == id
+
+		switch {
+		case leased && lease.Owner == id && preferred:
+			hold = append(hold, target)
+		case leased && lease.Owner == id:
+			release = append(release, target) // Hand over to the preferred member
+		case free && preferred:
+			hold = append(hold, target)
+		}
+	}
+
+	// Leases on targets no longer asked for
+	for target, lease := range leases {
+		if lease.Owner == id && !slices.Contains(wanted, target) {
+			release = append(release, target)
+		}
+	}
+	slices.Sort(hold)
+	slices.Sort(release)
+	return hold, release
+}
@@ -0,0 +1,98 @@
+package leases
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func targets(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("10.0.0.%d:8080", i)
+	}
+	return out
+}
+
+// TEST: GIVEN three aggregators asking for the same targets
+// WHEN each heartbeats in turn against an empty lease table
+// THEN every target should be held by exactly one of them and each should get a share
+func TestDecide_SharesTargets(t *testing.T) {
+	now := time.Now()
+	wanted := targets(30)
+	members := []Member{{"a", wanted}, {"b", wanted}, {"c", wanted}}
+	leases := map[string]Lease{}
+
+	counts := map[string]int{}
+	for _, m := range members {
+		hold, release := Decide(m.ID, m.Targets, members, leases, now)
+		if len(release) != 0 {
+			t.Errorf("%s: expected nothing to release, got %v", m.ID, release)
+		}
+		for _, target := range hold {
+			if lease, ok := leases[target]; ok {
+				t.Fatalf("%s claimed %s held by %s", m.ID, target, lease.Owner)
+			}
+			leases[target] = Lease{Owner: m.ID, ExpiresAt: now.Add(time.Minute)}
+			counts[m.ID]++
+		}
+	}
+
+	if len(leases) != len(wanted) {
+		t.Errorf("Expected all %d targets leased, got %d", len(wanted), len(leases))
+	}
+	for _, m := range members {
+		if counts[m.ID] == 0 {
+			t.Errorf("Expected %s to get a share, got %v", m.ID, counts)
+		}
+	}
+}
+
+// TEST: GIVEN a lease held by an aggregator that stopped heartbeating
+// WHEN the lease is live and then after it expires
+// THEN the remaining aggregator should leave it alone and then claim it
+func TestDecide_ClaimsExpiredLeases(t *testing.T) {
+	now := time.Now()
+	wanted := []string{"dev"}
+	members := []Member{{"a", wanted}} // b is no longer live
+	leases := map[string]Lease{"dev": {Owner: "b", ExpiresAt: now.Add(time.Second)}}
+
+	if hold, _ := Decide("a", wanted, members, leases, now); len(hold) != 0 {
+		t.Errorf("Expected a live lease to be left alone, got %v", hold)
+	}
+	if hold, _ := Decide("a", wanted, members, leases, now.Add(2*time.Second)); !reflect.DeepEqual(hold, wanted) {
+		t.Errorf("Expected the expired lease to be claimed, got %v", hold)
+	}
+}
+
+// TEST: GIVEN an aggregator holding leases
+// WHEN a preferred aggregator joins and the holder stops asking for a target
+// THEN the holder should release those leases and keep the rest
+func TestDecide_ReleasesHandedOver(t *testing.T) {
+	now := time.Now()
+	wanted := targets(20)
+	leases := map[string]Lease{}
+	for _, target := range wanted {
+		leases[target] = Lease{Owner: "a", ExpiresAt: now.Add(time.Minute)}
+	}
+	members := []Member{{"a", wanted[1:]}, {"b", wanted}}
+
+	hold, release := Decide("a", wanted[1:], members, leases, now)
+	if len(hold)+len(release) != len(wanted) {
+		t.Fatalf("Expected every lease to be kept or released, got %v and %v", hold, release)
+	}
+	for _, target := range hold {
+		if Preferred(target, members) != "a" {
+			t.Errorf("Kept %s preferred by %s", target, Preferred(target, members))
+		}
+	}
+	for _, target := range release {
+		if target != wanted[0] && Preferred(target, members) != "b" {
+			t.Errorf("Released %s preferred by a", target)
+		}
+	}
+	if len(release) < 2 {
+		t.Errorf("Expected the unwanted target and some handovers released, got %v", release)
+	}
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -10,25 +11,98 @@ import (
 
 // These should match values in metric_types table
 type Metric struct {
-	Type       string `json:"type"`  // References metric_types.name
-	Value      string `json:"value"` // Changed from float64 to string
-	Unit       string `json:"unit"`  // References units.name
-	RecordedAt string `json:"recorded_at"`
+	Type       string            `json:"type"`  // References metric_types.name
+	Value      string            `json:"value"` // Changed from float64 to string
+	Unit       string            `json:"unit"`  // References units.name
+	Labels     map[string]string `json:"labels,omitempty"`
+	RecordedAt string            `json:"recorded_at"`
+}
+
+// EncodeLabels stores labels as a JSON object, empty when there are none
+func (m Metric) EncodeLabels() (string, error) {
+	if len(m.Labels) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(m.Labels)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode labels: %w", err)
+	}
+	return string(data), nil
 }
 
 type DeviceMetrics struct {
 	Metrics []Metric `json:"metrics"`
 }
 
+// BulkSample is one device's metrics within a bulk upload
+type BulkSample struct {
+	DeviceID string   `json:"device_id"`
+	Hostname string   `json:"hostname,omitempty"`
+	Metrics  []Metric `json:"metrics"`
+}
+
+// BulkRequest is the body of a bulk upload, usually gzip compressed
+type BulkRequest struct {
+	Samples []BulkSample `json:"samples"`
+}
+
+// BulkResult reports whether one sample of a bulk upload was stored
+type BulkResult struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"` // "ok" or "error"
+	Error    string `json:"error,omitempty"`
+}
+
+// BulkResponse has one result per sample, in request order
+type BulkResponse struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Results  []BulkResult `json:"results"`
+}
+
+// DeviceEvent is a change in a device's reachability as seen by the aggregator
+type DeviceEvent struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`    // unknown, up, degraded, down or flapping
+	Previous string `json:"previous"` // State before the change
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"` // Last poll error, if any
+	At       string `json:"at"`              // RFC 3339
+}
+
+// Heartbeat registers an aggregator and asks for leases on the targets it can poll
+type Heartbeat struct {
+	ID      string   `json:"id"`             // Unique per running instance
+	Name    string   `json:"name,omitempty"` // Service name, for display
+	Targets []string `json:"targets"`        // Device IDs it would poll
+	TTL     int      `json:"ttl"`            // Seconds until the registration and leases lapse
+	Leaving bool     `json:"leaving,omitempty"`
+}
+
+// Leases are the device IDs an aggregator may poll until the TTL lapses
+type Leases struct {
+	Targets []string `json:"targets"`
+	TTL     int      `json:"ttl"`
+}
+
 type CommandResponse struct {
-	Device  string `json:"device"`
-	Command string `json:"command"`
+	ID      uint            `json:"id"`
+	Device  string          `json:"device"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty" swaggertype:"object"`
 }
 
+// CommandStatusRequest moves a command to sent, completed or failed. Message
+// is kept as the error of a failed command.
 type CommandStatusRequest struct {
-	Device  string `json:"device"`
-	Command string `json:"command"`
-	Status  string `json:"status"`
+	ID          uint   `json:"id"`     // Zero from aggregators that predate command IDs, matched by device and command
+	Device      string `json:"device"` // Optional with an ID, checked when given
+	Command     string `json:"command"`
+	Status      string `json:"status"`
+	Message     string `json:"message,omitempty"`
+	Output      []byte `json:"output,omitempty"`       // Base64 in JSON
+	SentAt      string `json:"sent_at,omitempty"`      // Optional, RFC 3339, defaults to when the update arrives
+	CompletedAt string `json:"completed_at,omitempty"` // Optional, RFC 3339, defaults to when the update arrives
 }
 
 // ValidateMetricType checks if the metric type exists in DB
@@ -102,9 +176,15 @@ func PersistMetric(db *gorm.DB, deviceMetrics DeviceMetrics, name string) error
 			return fmt.Errorf("invalid recorded_at format: %w", err)
 		}
 
+		labels, err := metric.EncodeLabels()
+		if err != nil {
+			return err
+		}
+
 		newMetric := models.Metric{
 			TypeID:     metricType.ID,
 			Value:      metric.Value,
+			Labels:     labels,
 			UnitID:     unit.ID,
 			DeviceID:   device.ID,
 			RecordedAt: recordedAt,
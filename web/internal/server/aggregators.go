@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bxrne/beacon/web/internal/db"
+	"github.com/bxrne/beacon/web/internal/leases"
+	"github.com/bxrne/beacon/web/internal/metrics"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxLeaseTTL bounds how long a target stays unpolled after its aggregator dies
+const maxLeaseTTL = 300
+
+// aggregatorStatus is a registered aggregator and how many targets it holds
+type aggregatorStatus struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Wanted    int       `json:"wanted"`
+	Leased    int       `json:"leased"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleAggregatorHeartbeat godoc
+// @Summary      Aggregator heartbeat
+// @Description  Register an aggregator, or keep it registered, and renew its target leases. Targets are shared among the live aggregators that ask for them; the response lists those this aggregator may poll until the TTL lapses.
+// @Tags         aggregator
+// @Accept       json
+// @Produce      json
+// @Param        heartbeat  body      metrics.Heartbeat  true  "Aggregator and the targets it can poll"
+// @Success      200        {object}  metrics.Leases
+// @Failure      400        {object}  errorResponse
+// @Failure      500        {object}  errorResponse
+// @Router       /aggregator/heartbeat [post]
+func (s *Server) handleAggregatorHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var hb metrics.Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request"})
+		return
+	}
+	if hb.ID == "" {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "missing aggregator ID"})
+		return
+	}
+	if hb.TTL <= 0 || hb.TTL > maxLeaseTTL {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "ttl must be between 1 and 300 seconds"})
+		return
+	}
+
+	// SQLite allows one writer, heartbeats queue here rather than failing busy
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+
+	var held []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if hb.Leaving {
+			if err := tx.Where("owner = ?", hb.ID).Delete(&db.TargetLease{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&db.Aggregator{ID: hb.ID}).Error
+		}
+
+		var err error
+		held, err = s.renewLeases(tx, hb, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to handle aggregator heartbeat", "aggregator", hb.ID, "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to renew leases"})
+		return
+	}
+
+	if held == nil {
+		held = []string{}
+	}
+	s.respondJSON(w, http.StatusOK, metrics.Leases{Targets: held, TTL: hb.TTL})
+}
+
+// renewLeases registers the aggregator and settles its leases against those of
+// the other live aggregators
+func (s *Server) renewLeases(tx *gorm.DB, hb metrics.Heartbeat, now time.Time) ([]string, error) {
+	wanted, err := json.Marshal(hb.Targets)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(time.Duration(hb.TTL) * time.Second)
+	self := db.Aggregator{ID: hb.ID, Name: hb.Name, Targets: string(wanted), ExpiresAt: expires}
+	if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&self).Error; err != nil {
+		return nil, err
+	}
+
+	var live []db.Aggregator
+	if err := tx.Where("expires_at > ?", now).Find(&live).Error; err != nil {
+		return nil, err
+	}
+	members := make([]leases.Member, 0, len(live))
+	for _, agg := range live {
+		var targets []string
+		if err := json.Unmarshal([]byte(agg.Targets), &targets); err != nil {
+			s.logger.Warn("ignoring aggregator with unreadable targets", "aggregator", agg.ID, "error", err)
+			continue
+		}
+		members = append(members, leases.Member{ID: agg.ID, Targets: targets})
+	}
+
+	// Leases on the targets asked for and any this aggregator holds
+	var rows []db.TargetLease
+	if err := tx.Where("target IN ? OR owner = ?", hb.Targets, hb.ID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	current := make(map[string]leases.Lease, len(rows))
+	for _, row := range rows {
+		current[row.Target] = leases.Lease{Owner: row.Owner, ExpiresAt: row.ExpiresAt}
+	}
+
+	hold, release := leases.Decide(hb.ID, hb.Targets, members, current, now)
+	if len(release) > 0 {
+		if err := tx.Where("owner = ? AND target IN ?", hb.ID, release).Delete(&db.TargetLease{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, target := range hold {
+		lease := db.TargetLease{Target: target, Owner: hb.ID, ExpiresAt: expires}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&lease).Error; err != nil {
+			return nil, err
+		}
+	}
+	return hold, nil
+}
+
+// handleGetAggregators godoc
+// @Summary      List aggregators
+// @Description  List the live aggregators with how many targets each asked for and holds
+// @Tags         aggregator
+// @Produce      json
+// @Success      200  {object}  []aggregatorStatus
+// @Failure      500  {object}  errorResponse
+// @Router       /aggregator [get]
+func (s *Server) handleGetAggregators(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	var live []db.Aggregator
+	if err := s.db.Where("expires_at > ?", now).Order("id").Find(&live).Error; err != nil {
+		s.logger.Error("failed to get aggregators", "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get aggregators"})
+		return
+	}
+
+	var counts []struct {
+		Owner string
+		Count int
+	}
+	if err := s.db.Model(&db.TargetLease{}).Select("owner, COUNT(*) AS count").
+		Where("expires_at > ?", now).Group("owner").Scan(&counts).Error; err != nil {
+		s.logger.Error("failed to count leases", "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get aggregators"})
+		return
+	}
+	leased := make(map[string]int, len(counts))
+	for _, c := range counts {
+		leased[c.Owner] = c.Count
+	}
+
+	statuses := make([]aggregatorStatus, 0, len(live))
+	for _, agg := range live {
+		var wanted []string
+		_ = json.Unmarshal([]byte(agg.Targets), &wanted)
+		statuses = append(statuses, aggregatorStatus{
+			ID:        agg.ID,
+			Name:      agg.Name,
+			Wanted:    len(wanted),
+			Leased:    leased[agg.ID],
+			ExpiresAt: agg.ExpiresAt,
+		})
+	}
+	s.respondJSON(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/web/internal/metrics"
+)
+
+// TEST: GIVEN two aggregators asking for the same target, the first holding its lease
+// WHEN the first stops heartbeating and its lease lapses
+// THEN the second should be refused the target while the lease is live and get it after
+func TestHandleAggregatorHeartbeat_ReassignsLapsedLease(t *testing.T) {
+	_, srv := newTestServer(t)
+	url := srv.URL + "/api/aggregator/heartbeat"
+	targets := []string{"10.0.0.1:80"}
+
+	var leases metrics.Leases
+	if status := postJSON(t, url, metrics.Heartbeat{ID: "a", Targets: targets, TTL: 1}, &leases); status != http.StatusOK {
+		t.Fatalf("Expected a's heartbeat to succeed, got status %d", status)
+	}
+	if !slices.Equal(leases.Targets, targets) {
+		t.Fatalf("Expected a to hold the target, got %v", leases.Targets)
+	}
+
+	postJSON(t, url, metrics.Heartbeat{ID: "b", Targets: targets, TTL: 30}, &leases)
+	if slices.Contains(leases.Targets, targets[0]) {
+		t.Fatalf("Expected b refused a live lease, got %v", leases.Targets)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	postJSON(t, url, metrics.Heartbeat{ID: "b", Targets: targets, TTL: 30}, &leases)
+	if !slices.Equal(leases.Targets, targets) || leases.TTL != 30 {
+		t.Errorf("Expected b to take the lapsed lease, got %+v", leases)
+	}
+
+	var aggregators []aggregatorStatus
+	getJSON(t, srv.URL+"/api/aggregator", "", &aggregators)
+	if len(aggregators) != 1 || aggregators[0].ID != "b" || aggregators[0].Leased != 1 {
+		t.Errorf("Expected only b live with the lease, got %+v", aggregators)
+	}
+}
+
+// TEST: GIVEN heartbeats without an ID, with a TTL out of range and one leaving
+// WHEN they are posted
+// THEN the invalid ones should be refused and the leaving one should free its leases
+func TestHandleAggregatorHeartbeat_Validates(t *testing.T) {
+	s, srv := newTestServer(t)
+	url := srv.URL + "/api/aggregator/heartbeat"
+
+	if status := postJSON(t, url, metrics.Heartbeat{Targets: []string{"x"}, TTL: 10}, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an ID, got %d", status)
+	}
+	if status := postJSON(t, url, metrics.Heartbeat{ID: "a", TTL: maxLeaseTTL + 1}, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a TTL over %d, got %d", maxLeaseTTL, status)
+	}
+
+	postJSON(t, url, metrics.Heartbeat{ID: "a", Targets: []string{"x"}, TTL: 10}, nil)
+	if status := postJSON(t, url, metrics.Heartbeat{ID: "a", TTL: 10, Leaving: true}, nil); status != http.StatusOK {
+		t.Fatalf("Expected the leaving heartbeat to succeed, got %d", status)
+	}
+	var leases int64
+	s.db.Table("target_leases").Count(&leases)
+	if leases != 0 {
+		t.Errorf("Expected the leaving aggregator's leases freed, got %d", leases)
+	}
+}
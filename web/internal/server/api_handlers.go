@@ -1,25 +1,58 @@
 package server
 
 import (
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bxrne/beacon/web/internal/db"
 	"github.com/bxrne/beacon/web/internal/metrics"
+	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 )
 
+const (
+	// maxBulkBodyBytes bounds a bulk upload, before and after decompression
+	maxBulkBodyBytes = 32 << 20
+	maxBulkSamples   = 5000
+)
+
 type errorResponse struct {
 	Error string `json:"error"`
 }
 
 type commandRequest struct {
-	Device  string `json:"device"`
-	Command string `json:"command"`
+	Device  string          `json:"device"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty" swaggertype:"object"`
+}
+
+type commandRecord struct {
+	ID          uint            `json:"id"`
+	Command     string          `json:"command"`
+	Args        json.RawMessage `json:"args,omitempty" swaggertype:"object"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	HasOutput   bool            `json:"has_output"`
+	CreatedAt   time.Time       `json:"created_at"`
+	SentAt      *time.Time      `json:"sent_at,omitempty"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// commandTransitions are the status changes a command may make, completed
+// and failed are final
+var commandTransitions = map[string]map[string]bool{
+	"pending": {"sent": true, "completed": true, "failed": true},
+	"sent":    {"completed": true, "failed": true},
 }
 
 // handleMetric godoc
@@ -49,7 +82,7 @@ func (s *Server) handleMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.persistMetrics(deviceID, deviceMetrics); err != nil {
+	if err := s.persistMetrics(s.db, deviceID, deviceMetrics); err != nil {
 		s.logger.Errorf("Failed to persist metrics: %v", err)
 		http.Error(w, "Failed to persist metrics", http.StatusInternalServerError)
 		return
@@ -58,20 +91,103 @@ func (s *Server) handleMetric(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) persistMetrics(deviceID string, deviceMetrics metrics.DeviceMetrics) error {
+// handleBulkMetric godoc
+// @Summary      Submit metrics for many devices
+// @Description  Submit samples for many devices in one request, gzip compressed when Content-Encoding is gzip. Each sample is stored or rejected on its own.
+// @Tags         metrics
+// @Accept       json
+// @Produce      json
+// @Param        Content-Encoding  header    string               false  "gzip or identity"
+// @Param        samples           body      metrics.BulkRequest  true   "Samples by device"
+// @Success      200               {object}  metrics.BulkResponse
+// @Failure      400               {object}  errorResponse
+// @Failure      413               {object}  errorResponse
+// @Failure      415               {object}  errorResponse
+// @Failure      500               {object}  errorResponse
+// @Router       /metric/bulk [post]
+func (s *Server) handleBulkMetric(w http.ResponseWriter, r *http.Request) {
+	var body io.ReadCloser = http.MaxBytesReader(w, r.Body, maxBulkBodyBytes)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid gzip body"})
+			return
+		}
+		defer zr.Close()
+		// Bound the decompressed size too, a small body can inflate enormously
+		body = http.MaxBytesReader(w, zr, maxBulkBodyBytes)
+	default:
+		s.respondJSON(w, http.StatusUnsupportedMediaType, errorResponse{Error: "unsupported content encoding"})
+		return
+	}
+
+	var req metrics.BulkRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.respondJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: "request too large"})
+			return
+		}
+		s.logger.Errorf("Failed to decode bulk metrics: %v", err)
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid metrics format"})
+		return
+	}
+	if len(req.Samples) > maxBulkSamples {
+		s.respondJSON(w, http.StatusRequestEntityTooLarge, errorResponse{Error: fmt.Sprintf("at most %d samples per request", maxBulkSamples)})
+		return
+	}
+
+	// One transaction for the batch, with a savepoint per sample so a bad
+	// sample is rolled back without losing the rest
+	resp := metrics.BulkResponse{Results: make([]metrics.BulkResult, len(req.Samples))}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i, sample := range req.Samples {
+			result := metrics.BulkResult{DeviceID: sample.DeviceID, Status: "ok"}
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				if sample.DeviceID == "" {
+					return errors.New("missing device ID")
+				}
+				return s.persistMetrics(tx, sample.DeviceID, metrics.DeviceMetrics{Metrics: sample.Metrics})
+			})
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+				resp.Rejected++
+			} else {
+				resp.Accepted++
+			}
+			resp.Results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("Failed to persist bulk metrics: %v", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to persist metrics"})
+		return
+	}
+
+	if resp.Rejected > 0 {
+		s.logger.Warnf("Rejected %d of %d bulk samples", resp.Rejected, len(req.Samples))
+	}
+	s.respondJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) persistMetrics(tx *gorm.DB, deviceID string, deviceMetrics metrics.DeviceMetrics) error {
 	for _, metric := range deviceMetrics.Metrics {
 		var metricType db.MetricType
-		if err := s.db.FirstOrCreate(&metricType, db.MetricType{Name: metric.Type}).Error; err != nil {
+		if err := tx.FirstOrCreate(&metricType, db.MetricType{Name: metric.Type}).Error; err != nil {
 			return err
 		}
 
 		var unit db.Unit
-		if err := s.db.FirstOrCreate(&unit, db.Unit{Name: metric.Unit}).Error; err != nil {
+		if err := tx.FirstOrCreate(&unit, db.Unit{Name: metric.Unit}).Error; err != nil {
 			return err
 		}
 
 		var device db.Device
-		if err := s.db.FirstOrCreate(&device, db.Device{Name: deviceID}).Error; err != nil {
+		if err := tx.FirstOrCreate(&device, db.Device{Name: deviceID}).Error; err != nil {
 			return err
 		}
 
@@ -88,14 +204,20 @@ func (s *Server) persistMetrics(deviceID string, deviceMetrics metrics.DeviceMet
 			return fmt.Errorf("invalid RecordedAt format: %v (raw: %q)", err, metric.RecordedAt)
 		}
 
+		labels, err := metric.EncodeLabels()
+		if err != nil {
+			return err
+		}
+
 		dbMetric := db.Metric{
 			TypeID:     metricType.ID,
 			Value:      metric.Value,
+			Labels:     labels,
 			UnitID:     unit.ID,
 			DeviceID:   device.ID,
 			RecordedAt: recordedAt,
 		}
-		if err := s.db.Create(&dbMetric).Error; err != nil {
+		if err := tx.Create(&dbMetric).Error; err != nil {
 			return err
 		}
 	}
@@ -186,6 +308,229 @@ func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request) {
 	s.respondJSON(w, http.StatusOK, deviceNames)
 }
 
+// deviceStates are the reachability states the aggregator reports
+var deviceStates = map[string]bool{"unknown": true, "up": true, "degraded": true, "down": true, "flapping": true}
+
+const (
+	defaultDowntimeHours = 24
+	maxDowntimeHours     = 24 * 30
+)
+
+type deviceStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// downtimePeriod is a stretch of time a device was not up
+type downtimePeriod struct {
+	State  string    `json:"state"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+type downtimeResponse struct {
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Periods []downtimePeriod `json:"periods"`
+}
+
+// handleDeviceEvent godoc
+// @Summary      Record a device state change
+// @Description  Record a reachability change reported by the aggregator and update the device's current state
+// @Tags         devices
+// @Accept       json
+// @Produce      json
+// @Param        event  body      metrics.DeviceEvent  true  "State change"
+// @Success      200    {object}  map[string]string
+// @Failure      400    {object}  errorResponse
+// @Failure      500    {object}  errorResponse
+// @Router       /device/event [post]
+func (s *Server) handleDeviceEvent(w http.ResponseWriter, r *http.Request) {
+	var event metrics.DeviceEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request"})
+		return
+	}
+	if event.DeviceID == "" {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "missing device ID"})
+		return
+	}
+	if !deviceStates[event.State] {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown state %q", event.State)})
+		return
+	}
+	at, err := time.Parse(time.RFC3339, event.At)
+	if err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid at format"})
+		return
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var device db.Device
+		if err := tx.FirstOrCreate(&device, db.Device{Name: event.DeviceID}).Error; err != nil {
+			return err
+		}
+		record := db.DeviceEvent{
+			DeviceID: device.ID,
+			State:    event.State,
+			Previous: event.Previous,
+			Reason:   event.Reason,
+			Error:    event.Error,
+			At:       at,
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+
+		// A late retry of an older event must not overwrite a newer state
+		if device.StateSince != nil && device.StateSince.After(at) {
+			return nil
+		}
+		return tx.Model(&device).Updates(map[string]interface{}{
+			"state":       event.State,
+			"state_since": at,
+			"last_error":  event.Error,
+		}).Error
+	})
+	if err != nil {
+		s.logger.Error("failed to record device event", "device", event.DeviceID, "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to record device event"})
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+// handleGetDeviceStatus godoc
+// @Summary      List device reachability
+// @Description  List every device with the reachability last reported by the aggregator
+// @Tags         devices
+// @Produce      json
+// @Success      200  {object}  []deviceStatus
+// @Failure      500  {object}  errorResponse
+// @Router       /device/status [get]
+func (s *Server) handleGetDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	var devices []db.Device
+	if err := s.db.Order("name").Find(&devices).Error; err != nil {
+		s.logger.Errorf("handleGetDeviceStatus: failed to get devices: %s", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get devices"})
+		return
+	}
+
+	statuses := make([]deviceStatus, 0, len(devices))
+	for _, device := range devices {
+		state := device.State
+		if state == "" {
+			state = "unknown"
+		}
+		statuses = append(statuses, deviceStatus{
+			Name:      device.Name,
+			State:     state,
+			Since:     device.StateSince,
+			LastError: device.LastError,
+		})
+	}
+
+	s.respondJSON(w, http.StatusOK, statuses)
+}
+
+// handleGetDowntime godoc
+// @Summary      Get downtime periods
+// @Description  Get the periods a device was degraded, down or flapping over the last hours
+// @Tags         devices
+// @Produce      json
+// @Param        X-DeviceID  header    string  true   "Device ID"
+// @Param        hours       query     int     false  "Hours to look back, defaults to 24"
+// @Success      200         {object}  downtimeResponse
+// @Failure      400         {object}  errorResponse
+// @Failure      404         {object}  errorResponse
+// @Failure      500         {object}  errorResponse
+// @Router       /device/downtime [get]
+func (s *Server) handleGetDowntime(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.Header.Get("X-DeviceID")
+	if deviceID == "" {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "missing device ID"})
+		return
+	}
+
+	hours := defaultDowntimeHours
+	if h := r.URL.Query().Get("hours"); h != "" {
+		parsed, err := strconv.Atoi(h)
+		if err != nil || parsed <= 0 || parsed > maxDowntimeHours {
+			s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("hours must be between 1 and %d", maxDowntimeHours)})
+			return
+		}
+		hours = parsed
+	}
+
+	var device db.Device
+	if err := s.db.First(&device, "name = ?", deviceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s.respondJSON(w, http.StatusNotFound, errorResponse{Error: "device not found"})
+		} else {
+			s.logger.Errorf("handleGetDowntime: failed to query device: %s", err)
+			s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to query device"})
+		}
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-time.Duration(hours) * time.Hour)
+
+	// The last event before the window gives the state it opens in
+	var opening db.DeviceEvent
+	if err := s.db.Where("device_id = ? AND at < ?", device.ID, from).Order("at desc").Limit(1).Find(&opening).Error; err != nil {
+		s.logger.Errorf("handleGetDowntime: failed to get device events: %s", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get device events"})
+		return
+	}
+	var events []db.DeviceEvent
+	if err := s.db.Where("device_id = ? AND at >= ? AND at <= ?", device.ID, from, to).Order("at asc, id asc").Find(&events).Error; err != nil {
+		s.logger.Errorf("handleGetDowntime: failed to get device events: %s", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get device events"})
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, downtimeResponse{From: from, To: to, Periods: downtimePeriods(opening, events, from, to)})
+}
+
+// downtimePeriods folds state changes into the periods spent degraded, down
+// or flapping between from and to. opening is the last change before from,
+// zero when there is none.
+func downtimePeriods(opening db.DeviceEvent, events []db.DeviceEvent, from, to time.Time) []downtimePeriod {
+	periods := []downtimePeriod{}
+	var open *downtimePeriod
+	enter := func(e db.DeviceEvent, at time.Time) {
+		if open != nil {
+			if open.State == e.State {
+				return
+			}
+			open.End = at
+			periods = append(periods, *open)
+			open = nil
+		}
+		if e.State == "degraded" || e.State == "down" || e.State == "flapping" {
+			open = &downtimePeriod{State: e.State, Reason: e.Reason, Error: e.Error, Start: at}
+		}
+	}
+
+	if opening.ID != 0 {
+		enter(opening, from)
+	}
+	for _, e := range events {
+		enter(e, e.At)
+	}
+	if open != nil {
+		open.End = to
+		periods = append(periods, *open)
+	}
+	return periods
+}
+
 // handleGetMetrics godoc
 // @Summary      Get metrics with pagination and filtering
 // @Description  Get metrics for a device with pagination and filtering options
@@ -261,27 +606,13 @@ func (s *Server) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
 	var responseMetrics interface{}
 	if isChartsView {
 		// For charts view, we want both percent and color metrics
-		latestMetrics := make(map[string]db.Metric)
-		for _, metric := range metrics {
-			if metric.Unit.Name == "percent" || metric.Unit.Name == "color" {
-				existing, exists := latestMetrics[metric.Type.Name]
-				if !exists || metric.RecordedAt.After(existing.RecordedAt) {
-					latestMetrics[metric.Type.Name] = metric
-				}
-			}
-		}
-
-		// Convert map to slice
-		var latestMetricsSlice []db.Metric
-		for _, metric := range latestMetrics {
-			latestMetricsSlice = append(latestMetricsSlice, metric)
-		}
-
-		// Ensure we always return an empty array instead of null
-		if latestMetricsSlice == nil {
-			latestMetricsSlice = []db.Metric{}
+		latestMetrics, err := s.chartMetrics(device.ID, metricType != "", metricTypeIDs)
+		if err != nil {
+			s.logger.Errorf("handleGetMetrics: failed to get chart metrics: %s", err)
+			s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get metrics"})
+			return
 		}
-		responseMetrics = latestMetricsSlice
+		responseMetrics = latestMetrics
 	} else {
 		responseMetrics = metrics
 	}
@@ -341,11 +672,17 @@ func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(req.Args) > 0 && !json.Valid(req.Args) {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid command arguments"})
+		return
+	}
+
 	// Create command with status
 	command := db.Command{
 		Name:     req.Command,
 		DeviceID: device.ID,
 		Status:   "pending",
+		Args:     string(req.Args),
 	}
 
 	if err := s.db.Create(&command).Error; err != nil {
@@ -353,6 +690,7 @@ func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
 		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to create command"})
 		return
 	}
+	s.commands.notify(device.Name)
 
 	s.respondJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Command queued successfully"})
 }
@@ -388,8 +726,10 @@ func (s *Server) handleGetCommands(w http.ResponseWriter, r *http.Request) {
 	var response []metrics.CommandResponse
 	for _, cmd := range commands {
 		response = append(response, metrics.CommandResponse{
+			ID:      cmd.ID,
 			Device:  deviceID,
 			Command: cmd.Name,
+			Args:    rawArgs(cmd.Args),
 		})
 	}
 
@@ -403,13 +743,15 @@ func (s *Server) handleGetCommands(w http.ResponseWriter, r *http.Request) {
 
 // handleCommandStatus godoc
 // @Summary      Update command status
-// @Description  Update the status of a command for a device
+// @Description  Move a command to sent, completed or failed. Commands are found by ID, completed and failed are final.
 // @Tags         command
 // @Accept       json
 // @Produce      json
 // @Param        commandStatusRequest  body      metrics.CommandStatusRequest  true  "Command status request"
 // @Success      200                   {object}  map[string]string
 // @Failure      400                   {object}  errorResponse
+// @Failure      404                   {object}  errorResponse
+// @Failure      409                   {object}  errorResponse
 // @Failure      500                   {object}  errorResponse
 // @Router       /command/status [post]
 func (s *Server) handleCommandStatus(w http.ResponseWriter, r *http.Request) {
@@ -418,18 +760,331 @@ func (s *Server) handleCommandStatus(w http.ResponseWriter, r *http.Request) {
 		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request"})
 		return
 	}
+	if !commandTransitions["pending"][req.Status] {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown status %q", req.Status)})
+		return
+	}
+	sentAt, err := optionalTime(req.SentAt)
+	if err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid sent_at format"})
+		return
+	}
+	completedAt, err := optionalTime(req.CompletedAt)
+	if err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid completed_at format"})
+		return
+	}
 
-	// Update command status
-	result := s.db.Model(&db.Command{}).
-		Where("device_id IN (SELECT id FROM devices WHERE name = ?) AND name = ? AND status = ?",
-			req.Device, req.Command, "pending").
-		Update("status", req.Status)
+	var command db.Command
+	query := s.db.Preload("Device")
+	if req.ID != 0 {
+		err = query.First(&command, req.ID).Error
+	} else {
+		// Aggregators from before command IDs report by device and name, settle the oldest match only
+		err = query.Where("device_id IN (SELECT id FROM devices WHERE name = ?) AND name = ? AND status IN ?",
+			req.Device, req.Command, []string{"pending", "sent"}).Order("id").First(&command).Error
+	}
+	if err != nil {
+		s.respondJSON(w, http.StatusNotFound, errorResponse{Error: "command not found"})
+		return
+	}
+	if req.Device != "" && command.Device.Name != req.Device {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "command belongs to another device"})
+		return
+	}
+	if !commandTransitions[command.Status][req.Status] {
+		s.respondJSON(w, http.StatusConflict, errorResponse{Error: fmt.Sprintf("command %d is %s, cannot change to %s", command.ID, command.Status, req.Status)})
+		return
+	}
 
+	now := time.Now().UTC()
+	updates := map[string]interface{}{"status": req.Status}
+	if command.SentAt == nil {
+		if sentAt == nil {
+			sentAt = &now
+		}
+		updates["sent_at"] = sentAt
+	}
+	if req.Status != "sent" {
+		if completedAt == nil {
+			completedAt = &now
+		}
+		updates["completed_at"] = completedAt
+	}
+	if req.Status == "failed" {
+		updates["error_msg"] = req.Message
+	}
+	if len(req.Output) > 0 {
+		updates["output"] = base64.StdEncoding.EncodeToString(req.Output)
+	}
+
+	// Only from the status read above, a concurrent update wins
+	result := s.db.Model(&db.Command{}).Where("id = ? AND status = ?", command.ID, command.Status).Updates(updates)
 	if result.Error != nil {
 		s.logger.Error("failed to update command status", "error", result.Error)
 		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to update command status"})
 		return
 	}
+	if result.RowsAffected == 0 {
+		s.respondJSON(w, http.StatusConflict, errorResponse{Error: fmt.Sprintf("command %d changed status concurrently", command.ID)})
+		return
+	}
 
 	s.respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
+
+// optionalTime parses an RFC 3339 time, nil when empty
+func optionalTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// handleGetCommandHistory godoc
+// @Summary      List commands
+// @Description  List the most recent commands for a device with their status
+// @Tags         command
+// @Produce      json
+// @Param        X-DeviceID  header    string  true  "Device ID"
+// @Success      200         {object}  []commandRecord
+// @Failure      400         {object}  errorResponse
+// @Failure      500         {object}  errorResponse
+// @Router       /command/history [get]
+func (s *Server) handleGetCommandHistory(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.Header.Get("X-DeviceID")
+	if deviceID == "" {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "missing device ID"})
+		return
+	}
+
+	var commands []db.Command
+	if err := s.db.Where("device_id IN (SELECT id FROM devices WHERE name = ?)", deviceID).
+		Order("created_at desc").Limit(50).Find(&commands).Error; err != nil {
+		s.logger.Error("failed to get command history", "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get commands"})
+		return
+	}
+
+	response := []commandRecord{}
+	for _, cmd := range commands {
+		response = append(response, commandRecord{
+			ID:          cmd.ID,
+			Command:     cmd.Name,
+			Args:        rawArgs(cmd.Args),
+			Status:      cmd.Status,
+			Error:       cmd.ErrorMsg,
+			HasOutput:   cmd.Output != "",
+			CreatedAt:   cmd.CreatedAt,
+			SentAt:      cmd.SentAt,
+			CompletedAt: cmd.CompletedAt,
+		})
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// handleGetCommandOutput godoc
+// @Summary      Download command output
+// @Description  Download the output a device returned for a command, e.g. a fetched file
+// @Tags         command
+// @Produce      octet-stream
+// @Param        id  path  int  true  "Command ID"
+// @Success      200
+// @Failure      404  {object}  errorResponse
+// @Failure      500  {object}  errorResponse
+// @Router       /command/{id}/output [get]
+func (s *Server) handleGetCommandOutput(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid command ID"})
+		return
+	}
+
+	var command db.Command
+	if err := s.db.First(&command, id).Error; err != nil || command.Output == "" {
+		s.respondJSON(w, http.StatusNotFound, errorResponse{Error: "no output for command"})
+		return
+	}
+
+	output, err := base64.StdEncoding.DecodeString(command.Output)
+	if err != nil {
+		s.logger.Error("failed to decode command output", "id", id, "error", err)
+		s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to decode output"})
+		return
+	}
+
+	// Name the download after the fetched file when there is one
+	filename := fmt.Sprintf("%s-%d.out", command.Name, command.ID)
+	var args struct {
+		Path string `json:"path"`
+	}
+	if json.Unmarshal([]byte(command.Args), &args) == nil && args.Path != "" {
+		filename = path.Base(args.Path)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(output)
+}
+
+// rawArgs returns stored command arguments as embeddable JSON
+func rawArgs(args string) json.RawMessage {
+	if args == "" {
+		return nil
+	}
+	return json.RawMessage(args)
+}
+
+type alert struct {
+	Device  string    `json:"device"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// handleGetAlerts godoc
+// @Summary      List active alerts
+// @Description  List devices in an alerting state, such as running on battery or unreachable
+// @Tags         alerts
+// @Produce      json
+// @Success      200  {object}  []alert
+// @Failure      500  {object}  errorResponse
+// @Router       /alerts [get]
+func (s *Server) handleGetAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts := []alert{}
+
+	if s.cfg.Alerts.OnBattery {
+		acOnline, err := s.latestMetrics("ac_online")
+		if err != nil {
+			s.logger.Error("failed to get ac_online metrics", "error", err)
+			s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get alerts"})
+			return
+		}
+		percents, err := s.latestMetrics("battery_percent")
+		if err != nil {
+			s.logger.Error("failed to get battery_percent metrics", "error", err)
+			s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get alerts"})
+			return
+		}
+		batteryByDevice := make(map[uint]string)
+		for _, m := range percents {
+			batteryByDevice[m.DeviceID] = m.Value
+		}
+
+		for _, m := range acOnline {
+			if m.Value != "false" {
+				continue
+			}
+			since, err := s.onBatterySince(m)
+			if err != nil {
+				s.logger.Error("failed to find when the device went onto battery", "device", m.Device.Name, "error", err)
+				s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get alerts"})
+				return
+			}
+			message := "Running on battery"
+			if percent, ok := batteryByDevice[m.DeviceID]; ok {
+				message = fmt.Sprintf("Running on battery (%s%%)", percent)
+			}
+			alerts = append(alerts, alert{
+				Device:  m.Device.Name,
+				Type:    "on_battery",
+				Message: message,
+				Since:   since,
+			})
+		}
+	}
+
+	if s.cfg.Alerts.Unreachable {
+		var devices []db.Device
+		if err := s.db.Where("state IN ?", []string{"down", "flapping"}).Find(&devices).Error; err != nil {
+			s.logger.Error("failed to get unreachable devices", "error", err)
+			s.respondJSON(w, http.StatusInternalServerError, errorResponse{Error: "failed to get alerts"})
+			return
+		}
+		for _, d := range devices {
+			message := "Unreachable"
+			if d.State == "flapping" {
+				message = "Flapping between up and down"
+			}
+			if d.LastError != "" {
+				message = fmt.Sprintf("%s (%s)", message, d.LastError)
+			}
+			since := d.UpdatedAt
+			if d.StateSince != nil {
+				since = *d.StateSince
+			}
+			alerts = append(alerts, alert{
+				Device:  d.Name,
+				Type:    d.State,
+				Message: message,
+				Since:   since,
+			})
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, alerts)
+}
+
+// onBatterySince finds when the on-battery run ending in latest began: the
+// first ac_online sample after the last one that was not false
+func (s *Server) onBatterySince(latest db.Metric) (time.Time, error) {
+	var online db.Metric
+	err := s.db.Where("device_id = ? AND type_id = ? AND value <> ? AND recorded_at <= ?", latest.DeviceID, latest.TypeID, "false", latest.RecordedAt).
+		Order("recorded_at DESC").Limit(1).Find(&online).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var first db.Metric
+	query := s.db.Where("device_id = ? AND type_id = ? AND value = ?", latest.DeviceID, latest.TypeID, "false")
+	if online.ID != 0 {
+		query = query.Where("recorded_at > ?", online.RecordedAt)
+	}
+	if err := query.Order("recorded_at").Limit(1).Find(&first).Error; err != nil {
+		return time.Time{}, err
+	}
+	if first.ID == 0 {
+		return latest.RecordedAt, nil
+	}
+	return first.RecordedAt, nil
+}
+
+// chartMetrics returns the most recent percent and color metric of each type
+// for a device, limited to typeIDs when filtered. Of the rollups an
+// aggregator uploads for a window, told apart by their stat label, only the
+// last value is charted.
+func (s *Server) chartMetrics(deviceID uint, filtered bool, typeIDs []uint) ([]db.Metric, error) {
+	latest := []db.Metric{}
+	inner := s.db.Table("metrics").
+		Select("metrics.id, ROW_NUMBER() OVER (PARTITION BY metrics.type_id ORDER BY metrics.recorded_at DESC, metrics.id DESC) AS n").
+		Joins("JOIN units ON units.id = metrics.unit_id").
+		Where("metrics.device_id = ? AND metrics.deleted_at IS NULL AND units.name IN ?", deviceID, []string{"percent", "color"}).
+		Where("COALESCE(json_extract(NULLIF(metrics.labels, ''), '$.stat'), 'last') = 'last'")
+	if filtered {
+		inner = inner.Where("metrics.type_id IN ?", typeIDs)
+	}
+	err := s.db.Preload("Type").Preload("Unit").
+		Where("id IN (?)", s.db.Table("(?) AS ranked", inner).Select("id").Where("n = 1")).
+		Find(&latest).Error
+	return latest, err
+}
+
+// latestMetrics returns the most recent metric of a type for every device
+func (s *Server) latestMetrics(metricType string) ([]db.Metric, error) {
+	var latest []db.Metric
+	inner := s.db.Table("metrics").
+		Select("metrics.id, ROW_NUMBER() OVER (PARTITION BY metrics.device_id ORDER BY metrics.recorded_at DESC, metrics.id DESC) AS n").
+		Joins("JOIN metric_types ON metric_types.id = metrics.type_id").
+		Where("metric_types.name = ? AND metrics.deleted_at IS NULL", metricType)
+	err := s.db.Preload("Device").
+		Where("id IN (?)", s.db.Table("(?) AS ranked", inner).Select("id").Where("n = 1")).
+		Find(&latest).Error
+	return latest, err
+}
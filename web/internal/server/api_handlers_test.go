@@ -0,0 +1,304 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/web/internal/db"
+	"github.com/bxrne/beacon/web/internal/metrics"
+)
+
+// TEST: GIVEN a bulk upload with a good sample, one without a device and one with a bad timestamp
+// WHEN it is posted
+// THEN each sample should get its own result and only the good one should be stored
+func TestHandleBulkMetric_PerSampleResults(t *testing.T) {
+	s, srv := newTestServer(t)
+
+	metric := func(recordedAt string) []metrics.Metric {
+		return []metrics.Metric{{Type: "battery_percent", Value: "80", Unit: "percent", RecordedAt: recordedAt}}
+	}
+	req := metrics.BulkRequest{Samples: []metrics.BulkSample{
+		{DeviceID: "pi-1", Metrics: metric("2026-01-02T03:04:05Z")},
+		{DeviceID: "", Metrics: metric("2026-01-02T03:04:05Z")},
+		{DeviceID: "pi-2", Metrics: metric("yesterday")},
+	}}
+
+	var resp metrics.BulkResponse
+	if status := postJSON(t, srv.URL+"/api/metric/bulk", req, &resp); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if resp.Accepted != 1 || resp.Rejected != 2 || len(resp.Results) != 3 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if r := resp.Results[0]; r.DeviceID != "pi-1" || r.Status != "ok" {
+		t.Errorf("Expected the first sample stored, got %+v", r)
+	}
+	if r := resp.Results[1]; r.Status != "error" || r.Error != "missing device ID" {
+		t.Errorf("Expected the second sample rejected for its device, got %+v", r)
+	}
+	if r := resp.Results[2]; r.DeviceID != "pi-2" || r.Status != "error" || r.Error == "" {
+		t.Errorf("Expected the third sample rejected for its timestamp, got %+v", r)
+	}
+
+	var stored []db.Metric
+	s.db.Preload("Device").Find(&stored)
+	if len(stored) != 1 || stored[0].Device.Name != "pi-1" {
+		t.Errorf("Expected only pi-1's metric stored, got %+v", stored)
+	}
+	var devices int64
+	s.db.Model(&db.Device{}).Where("name = ?", "pi-2").Count(&devices)
+	if devices != 0 {
+		t.Error("Expected the rejected sample's device to be rolled back")
+	}
+}
+
+// TEST: GIVEN a completed command
+// WHEN it is moved back to pending, failed, or an unknown command is updated
+// THEN the update should be refused with 400, 409 and 404 and the command left completed
+func TestHandleCommandStatus_Transitions(t *testing.T) {
+	s, srv := newTestServer(t)
+	queueCommand(t, s, srv.URL, "pi-1", "reboot")
+
+	url := srv.URL + "/api/command/status"
+	if status := postJSON(t, url, metrics.CommandStatusRequest{ID: 1, Status: "completed"}, nil); status != http.StatusOK {
+		t.Fatalf("Expected the command to complete, got status %d", status)
+	}
+
+	tests := []struct {
+		req    metrics.CommandStatusRequest
+		status int
+	}{
+		{metrics.CommandStatusRequest{ID: 1, Status: "pending"}, http.StatusBadRequest},
+		{metrics.CommandStatusRequest{ID: 1, Status: "failed"}, http.StatusConflict},
+		{metrics.CommandStatusRequest{ID: 1, Status: "sent"}, http.StatusConflict},
+		{metrics.CommandStatusRequest{ID: 1, Device: "pi-2", Status: "failed"}, http.StatusBadRequest},
+		{metrics.CommandStatusRequest{ID: 99, Status: "completed"}, http.StatusNotFound},
+		{metrics.CommandStatusRequest{Device: "pi-1", Command: "reboot", Status: "completed"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		var reply errorResponse
+		if status := postJSON(t, url, tt.req, &reply); status != tt.status || reply.Error == "" {
+			t.Errorf("%+v: expected %d with an error, got %d %+v", tt.req, tt.status, status, reply)
+		}
+	}
+
+	var cmd db.Command
+	s.db.First(&cmd, 1)
+	if cmd.Status != "completed" || cmd.CompletedAt == nil {
+		t.Errorf("Expected the command to stay completed, got %+v", cmd)
+	}
+}
+
+// TEST: GIVEN two notify commands queued for the same device
+// WHEN the second is settled by ID and then one is settled by name without an ID
+// THEN the ID should pick the second and the name the oldest still open
+func TestHandleCommandStatus_SettlesByID(t *testing.T) {
+	s, srv := newTestServer(t)
+	queueCommand(t, s, srv.URL, "pi-1", "notify")
+	queueCommand(t, s, srv.URL, "pi-1", "notify")
+
+	url := srv.URL + "/api/command/status"
+	req := metrics.CommandStatusRequest{ID: 2, Device: "pi-1", Command: "notify", Status: "failed", Message: "no display", Output: []byte("log")}
+	if status := postJSON(t, url, req, nil); status != http.StatusOK {
+		t.Fatalf("Expected command 2 to fail, got status %d", status)
+	}
+
+	var commands []db.Command
+	s.db.Order("id").Find(&commands)
+	if commands[0].Status != "pending" || commands[1].Status != "failed" || commands[1].ErrorMsg != "no display" || commands[1].Output != "bG9n" {
+		t.Fatalf("Expected only command 2 failed, got %+v", commands)
+	}
+
+	req = metrics.CommandStatusRequest{Device: "pi-1", Command: "notify", Status: "completed"}
+	if status := postJSON(t, url, req, nil); status != http.StatusOK {
+		t.Fatalf("Expected the open command to complete, got status %d", status)
+	}
+	s.db.Order("id").Find(&commands)
+	if commands[0].Status != "completed" || commands[0].SentAt == nil || commands[1].Status != "failed" {
+		t.Errorf("Expected command 1 completed by name, got %+v", commands)
+	}
+}
+
+// TEST: GIVEN a command sent long ago, one sent just now and one still pending
+// WHEN stale sent commands are swept
+// THEN only the old sent command should be failed, with a reason
+func TestFailStaleCommands(t *testing.T) {
+	s, srv := newTestServer(t)
+	for range 3 {
+		queueCommand(t, s, srv.URL, "pi-1", "notify")
+	}
+	now := time.Now().UTC()
+	url := srv.URL + "/api/command/status"
+	for id, sentAt := range map[uint]time.Time{1: now.Add(-time.Hour), 2: now} {
+		req := metrics.CommandStatusRequest{ID: id, Status: "sent", SentAt: sentAt.Format(time.RFC3339)}
+		if status := postJSON(t, url, req, nil); status != http.StatusOK {
+			t.Fatalf("Expected command %d sent, got status %d", id, status)
+		}
+	}
+
+	if n, err := s.failStaleCommands(now); err != nil || n != 1 {
+		t.Fatalf("Expected one command failed, got %d (%v)", n, err)
+	}
+	var commands []db.Command
+	s.db.Order("id").Find(&commands)
+	if c := commands[0]; c.Status != "failed" || c.ErrorMsg == "" || c.CompletedAt == nil {
+		t.Errorf("Expected the old sent command failed, got %+v", c)
+	}
+	if commands[1].Status != "sent" || commands[2].Status != "pending" {
+		t.Errorf("Expected the others untouched, got %s and %s", commands[1].Status, commands[2].Status)
+	}
+}
+
+// TEST: GIVEN two windows of rollups uploaded by an aggregator, each stat of a series under the same type
+// WHEN the charts view is fetched
+// THEN the series should be charted once, with the last value of the latest window
+func TestHandleGetMetrics_ChartsRollups(t *testing.T) {
+	_, srv := newTestServer(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rollups := func(at time.Time, stats map[string]string) []metrics.Metric {
+		var out []metrics.Metric
+		for _, stat := range []string{"min", "max", "avg", "last", "count"} {
+			unit := "percent"
+			if stat == "count" {
+				unit = "count"
+			}
+			out = append(out, metrics.Metric{Type: "battery_percent", Value: stats[stat], Unit: unit,
+				Labels: map[string]string{"stat": stat}, RecordedAt: at.Format(time.RFC3339)})
+		}
+		return out
+	}
+	req := metrics.BulkRequest{Samples: []metrics.BulkSample{
+		{DeviceID: "pi-1", Metrics: rollups(start, map[string]string{"min": "10", "max": "90", "avg": "50", "last": "60", "count": "5"})},
+		{DeviceID: "pi-1", Metrics: rollups(start.Add(time.Minute), map[string]string{"min": "20", "max": "95", "avg": "55", "last": "70", "count": "5"})},
+	}}
+	var resp metrics.BulkResponse
+	if postJSON(t, srv.URL+"/api/metric/bulk", req, &resp); resp.Accepted != 2 {
+		t.Fatalf("Expected both windows stored, got %+v", resp)
+	}
+
+	var charts struct {
+		Metrics []db.Metric `json:"metrics"`
+	}
+	if status := getJSON(t, srv.URL+"/api/metrics?view=charts", "pi-1", &charts); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if len(charts.Metrics) != 1 {
+		t.Fatalf("Expected one charted series, got %+v", charts.Metrics)
+	}
+	if m := charts.Metrics[0]; m.Type.Name != "battery_percent" || m.Value != "70" || !m.RecordedAt.Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected the latest window's last value, got %+v", m)
+	}
+}
+
+// TEST: GIVEN a device flapping before a window, then up, down, degraded, up and down again within it
+// WHEN downtime periods are folded over the window
+// THEN the window should open flapping and list each stretch that was not up
+func TestDowntimePeriods(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(h int) time.Time { return from.Add(time.Duration(h) * time.Hour) }
+
+	opening := db.DeviceEvent{State: "flapping", Reason: "timeouts", At: from.Add(-time.Hour)}
+	opening.ID = 1
+	events := []db.DeviceEvent{
+		{State: "up", At: at(1)},
+		{State: "down", Reason: "refused", Error: "connection refused", At: at(3)},
+		{State: "down", Reason: "refused", At: at(4)}, // Repeated state extends the period
+		{State: "degraded", Reason: "slow", At: at(5)},
+		{State: "up", At: at(6)},
+		{State: "down", Reason: "timeout", At: at(8)},
+	}
+
+	got := downtimePeriods(opening, events, from, to)
+	want := []downtimePeriod{
+		{State: "flapping", Reason: "timeouts", Start: from, End: at(1)},
+		{State: "down", Reason: "refused", Error: "connection refused", Start: at(3), End: at(5)},
+		{State: "degraded", Reason: "slow", Start: at(5), End: at(6)},
+		{State: "down", Reason: "timeout", Start: at(8), End: to},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d periods, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Period %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	if got := downtimePeriods(db.DeviceEvent{}, nil, from, to); len(got) != 0 {
+		t.Errorf("Expected no periods without events, got %+v", got)
+	}
+}
+
+// TEST: GIVEN a device that ran on battery, went back to mains, then onto battery again
+// WHEN alerts are listed
+// THEN the on-battery alert should date from the first sample of the current run
+func TestHandleGetAlerts_OnBatterySince(t *testing.T) {
+	_, srv := newTestServer(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var samples []metrics.BulkSample
+	for i, online := range []string{"false", "false", "true", "false", "false", "false"} {
+		at := start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)
+		samples = append(samples, metrics.BulkSample{DeviceID: "pi-1", Metrics: []metrics.Metric{
+			{Type: "ac_online", Value: online, Unit: "bool", RecordedAt: at},
+			{Type: "battery_percent", Value: fmt.Sprint(90 - i), Unit: "percent", RecordedAt: at},
+		}})
+	}
+	var resp metrics.BulkResponse
+	if postJSON(t, srv.URL+"/api/metric/bulk", metrics.BulkRequest{Samples: samples}, &resp); resp.Accepted != len(samples) {
+		t.Fatalf("Expected every sample stored, got %+v", resp)
+	}
+
+	var alerts []alert
+	if status := getJSON(t, srv.URL+"/api/alerts", "", &alerts); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("Expected one alert, got %+v", alerts)
+	}
+	want := alert{Device: "pi-1", Type: "on_battery", Message: "Running on battery (85%)", Since: start.Add(3 * time.Minute)}
+	if got := alerts[0]; got.Device != want.Device || got.Type != want.Type || got.Message != want.Message || !got.Since.Equal(want.Since) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+// TEST: GIVEN a device on battery whose older mains samples are backfilled afterwards
+// WHEN alerts are listed
+// THEN the alert should follow the most recently recorded samples, not the last uploaded
+func TestHandleGetAlerts_OnBatteryBackfilled(t *testing.T) {
+	_, srv := newTestServer(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sample := func(i int, online string) metrics.BulkSample {
+		at := start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)
+		return metrics.BulkSample{DeviceID: "pi-1", Metrics: []metrics.Metric{
+			{Type: "ac_online", Value: online, Unit: "bool", RecordedAt: at},
+			{Type: "battery_percent", Value: fmt.Sprint(90 - i), Unit: "percent", RecordedAt: at},
+		}}
+	}
+	for _, samples := range [][]metrics.BulkSample{
+		{sample(3, "false"), sample(4, "false"), sample(5, "false")},
+		{sample(0, "false"), sample(1, "false"), sample(2, "true")},
+	} {
+		var resp metrics.BulkResponse
+		if postJSON(t, srv.URL+"/api/metric/bulk", metrics.BulkRequest{Samples: samples}, &resp); resp.Accepted != len(samples) {
+			t.Fatalf("Expected every sample stored, got %+v", resp)
+		}
+	}
+
+	var alerts []alert
+	if status := getJSON(t, srv.URL+"/api/alerts", "", &alerts); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("Expected one alert, got %+v", alerts)
+	}
+	want := alert{Device: "pi-1", Type: "on_battery", Message: "Running on battery (85%)", Since: start.Add(3 * time.Minute)}
+	if got := alerts[0]; got.Device != want.Device || got.Type != want.Type || got.Message != want.Message || !got.Since.Equal(want.Since) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bxrne/beacon/web/internal/db"
+	"github.com/bxrne/beacon/web/internal/metrics"
+)
+
+// commandStreamHeartbeat keeps idle streams alive through proxies, and
+// rechecks for commands queued by another instance sharing the database
+const commandStreamHeartbeat = 15 * time.Second
+
+// commandHub wakes the command streams of a device when it gets a command
+type commandHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{} // By device name
+}
+
+func newCommandHub() *commandHub {
+	return &commandHub{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+func (h *commandHub) subscribe(devices []string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	for _, device := range devices {
+		if h.subs[device] == nil {
+			h.subs[device] = make(map[chan struct{}]struct{})
+		}
+		h.subs[device][wake] = struct{}{}
+	}
+	return wake
+}
+
+func (h *commandHub) unsubscribe(wake chan struct{}, devices []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, device := range devices {
+		delete(h.subs[device], wake)
+		if len(h.subs[device]) == 0 {
+			delete(h.subs, device)
+		}
+	}
+}
+
+func (h *commandHub) notify(device string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for wake := range h.subs[device] {
+		select {
+		case wake <- struct{}{}:
+		default: // Already woken
+		}
+	}
+}
+
+// handleCommandStream godoc
+// @Summary      Stream pending commands
+// @Description  Stream pending commands for every given device as server-sent events, one command event per command as soon as it is queued
+// @Tags         command
+// @Produce      text/event-stream
+// @Param        X-DeviceID  header    []string  true  "Device IDs, repeated per device"
+// @Success      200         {object}  metrics.CommandResponse
+// @Failure      400         {object}  errorResponse
+// @Router       /command/stream [get]
+func (s *Server) handleCommandStream(w http.ResponseWriter, r *http.Request) {
+	devices := r.Header.Values("X-DeviceID")
+	if len(devices) == 0 {
+		s.respondJSON(w, http.StatusBadRequest, errorResponse{Error: "missing device ID"})
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		s.logger.Debug("failed to clear write deadline", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		s.logger.Error("command stream cannot flush", "error", err)
+		return
+	}
+
+	wake := s.commands.subscribe(devices)
+	defer s.commands.unsubscribe(wake, devices)
+	s.logger.Info("command stream opened", "devices", len(devices), "source", r.RemoteAddr)
+	defer s.logger.Info("command stream closed", "source", r.RemoteAddr)
+
+	heartbeat := time.NewTicker(commandStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	sent := make(map[uint]bool) // Pending commands already on this stream
+	for {
+		if err := s.streamPendingCommands(w, devices, sent); err != nil {
+			s.logger.Debug("command stream write failed", "error", err)
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamPendingCommands writes the pending commands not yet sent, and forgets
+// sent commands that are no longer pending
+func (s *Server) streamPendingCommands(w http.ResponseWriter, devices []string, sent map[uint]bool) error {
+	var commands []db.Command
+	if err := s.db.Preload("Device").Where("device_id IN (SELECT id FROM devices WHERE name IN ?) AND status = ?",
+		devices, "pending").Order("id").Find(&commands).Error; err != nil {
+		s.logger.Error("failed to get commands", "error", err)
+		return nil // Retried on the next wakeup or heartbeat
+	}
+
+	pending := make(map[uint]bool, len(commands))
+	for _, cmd := range commands {
+		pending[cmd.ID] = true
+		if sent[cmd.ID] {
+			continue
+		}
+		data, err := json.Marshal(metrics.CommandResponse{
+			ID:      cmd.ID,
+			Device:  cmd.Device.Name,
+			Command: cmd.Name,
+			Args:    rawArgs(cmd.Args),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: command\ndata: %s\n\n", strconv.FormatUint(uint64(cmd.ID), 10), data); err != nil {
+			return err
+		}
+		sent[cmd.ID] = true
+	}
+	for id := range sent {
+		if !pending[id] {
+			delete(sent, id)
+		}
+	}
+	return nil
+}
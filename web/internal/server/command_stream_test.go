@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bxrne/beacon/web/internal/db"
+	"github.com/bxrne/beacon/web/internal/metrics"
+)
+
+// TEST: GIVEN a command stream open for two devices
+// WHEN a command is queued for one of them
+// THEN it should arrive at once as a command event with its ID
+func TestHandleCommandStream_DeliversQueued(t *testing.T) {
+	s, srv := newTestServer(t)
+	for _, device := range []string{"pi-1", "pi-2"} {
+		if err := db.RegisterDevice(s.db, device); err != nil {
+			t.Fatalf("Failed to register device: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/command/stream", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Add("X-DeviceID", "pi-1")
+	req.Header.Add("X-DeviceID", "pi-2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, ct)
+	}
+
+	events := make(chan []string, 1)
+	go func() {
+		var event []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				event = append(event, line)
+				continue
+			}
+			events <- event
+			event = nil
+		}
+		close(events)
+	}()
+
+	queueCommand(t, s, srv.URL, "pi-2", "reboot")
+	select {
+	case event := <-events:
+		if len(event) != 3 || event[0] != "id: 1" || event[1] != "event: command" {
+			t.Fatalf("Unexpected event %q", event)
+		}
+		var cmd metrics.CommandResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event[2], "data: ")), &cmd); err != nil {
+			t.Fatalf("Invalid event data %q: %v", event[2], err)
+		}
+		if cmd.ID != 1 || cmd.Device != "pi-2" || cmd.Command != "reboot" {
+			t.Errorf("Unexpected command %+v", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the command event")
+	}
+}
@@ -5,18 +5,27 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
 
 	_ "github.com/bxrne/beacon/web/docs" // This line is necessary for go-swagger to find your docs
 	"github.com/bxrne/beacon/web/internal/config"
+	"github.com/bxrne/beacon/web/internal/db"
 	"github.com/bxrne/beacon/web/internal/metrics"
 	"github.com/charmbracelet/log"
 	"github.com/gorilla/mux"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
+const (
+	// defaultSentTimeout outlasts the aggregator's reply timeout and retries
+	defaultSentTimeout = 15 * time.Minute
+	// sentSweepInterval is how often stale sent commands are failed
+	sentSweepInterval = time.Minute
+)
+
 type Server struct {
 	router       *mux.Router
 	srv          *http.Server
@@ -24,6 +33,8 @@ type Server struct {
 	cfg          *config.Config
 	db           *gorm.DB
 	metricsCache *metrics.MetricsCache
+	commands     *commandHub
+	leaseMu      sync.Mutex // Serialises aggregator heartbeats
 }
 
 func New(cfg *config.Config, logger *log.Logger, db *gorm.DB) *Server {
@@ -33,6 +44,7 @@ func New(cfg *config.Config, logger *log.Logger, db *gorm.DB) *Server {
 		cfg:          cfg,
 		db:           db.Session(&gorm.Session{}),
 		metricsCache: metrics.NewMetricsCache(cfg),
+		commands:     newCommandHub(),
 	}
 
 	s.setupRoutes()
@@ -63,6 +75,7 @@ func (s *Server) Start(ctx context.Context) error {
 	}()
 
 	s.logger.Infof("Server started on port %d", s.cfg.Server.Port)
+	go s.sweepSentCommands(ctx)
 	<-ctx.Done()
 
 	s.logger.Info("Server stopping")
@@ -82,6 +95,41 @@ func (s *Server) Stop(ctx context.Context) error {
 	return s.srv.Shutdown(ctx)
 }
 
+// sweepSentCommands fails stale sent commands until ctx is done
+func (s *Server) sweepSentCommands(ctx context.Context) {
+	ticker := time.NewTicker(sentSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := s.failStaleCommands(now); err != nil {
+				s.logger.Error("failed to expire sent commands", "error", err)
+			}
+		}
+	}
+}
+
+// failStaleCommands fails the commands sent longer than the sent timeout
+// ago, whose aggregator died or lost its result, and returns how many
+func (s *Server) failStaleCommands(now time.Time) (int64, error) {
+	timeout := time.Duration(s.cfg.Commands.SentTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSentTimeout
+	}
+	now = now.UTC()
+	result := s.db.Model(&db.Command{}).Where("status = ? AND sent_at < ?", "sent", now.Add(-timeout)).Updates(map[string]interface{}{
+		"status":       "failed",
+		"completed_at": now,
+		"error_msg":    fmt.Sprintf("no result within %s of sending", timeout),
+	})
+	if result.RowsAffected > 0 {
+		s.logger.Warn("failed stale sent commands", "count", result.RowsAffected)
+	}
+	return result.RowsAffected, result.Error
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
@@ -92,6 +140,11 @@ func (rec *statusRecorder) WriteHeader(code int) {
 	rec.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the writer underneath, to flush streams
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -128,6 +181,9 @@ func (s *Server) setupRoutes() {
 
 	s.router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	s.router.PathPrefix("/docs/").Handler(httpSwagger.WrapHandler)
+	if s.cfg.Releases.Dir != "" {
+		s.router.PathPrefix("/releases/").Handler(http.StripPrefix("/releases/", http.FileServer(http.Dir(s.cfg.Releases.Dir))))
+	}
 
 	// WARN: Silence favicon warnings
 	s.router.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -138,9 +194,19 @@ func (s *Server) setupRoutes() {
 	apiRouter.HandleFunc("/health", s.handleHealth).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/metric", s.handleMetric).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/metric", s.handleGetMetric).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/metric/bulk", s.handleBulkMetric).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/device", s.handleGetDevices).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/device/event", s.handleDeviceEvent).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/device/status", s.handleGetDeviceStatus).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/device/downtime", s.handleGetDowntime).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/alerts", s.handleGetAlerts).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/metrics", s.handleGetMetrics).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/command", s.handleCommand).Methods(http.MethodPost)
 	apiRouter.HandleFunc("/command", s.handleGetCommands).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/command/status", s.handleCommandStatus).Methods(http.MethodPost) // Change this line to use POST method
+	apiRouter.HandleFunc("/command/stream", s.handleCommandStream).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/command/history", s.handleGetCommandHistory).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/command/{id:[0-9]+}/output", s.handleGetCommandOutput).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/aggregator", s.handleGetAggregators).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/aggregator/heartbeat", s.handleAggregatorHeartbeat).Methods(http.MethodPost)
 }
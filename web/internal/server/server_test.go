@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bxrne/beacon/web/internal/config"
+	"github.com/bxrne/beacon/web/internal/db"
+	"github.com/charmbracelet/log"
+)
+
+// newTestServer serves the API over an in-memory database seeded with the
+// types the migration needs and the notify and reboot commands
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := &config.Config{
+		Server:   config.Server{CacheTTL: 60},
+		Database: config.Database{DSN: ":memory:"},
+		Metrics: config.Metrics{
+			Types:    []string{"car_light", "ped_light", "ac_online", "battery_percent"},
+			Units:    []string{"color", "bool", "percent", "count"},
+			Commands: []string{"notify", "reboot"},
+		},
+		Alerts: config.Alerts{OnBattery: true},
+	}
+	gdb, err := db.NewDatabase(cfg)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// Every connection to :memory: is a database of its own
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		t.Fatalf("Failed to get database handle: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	s := New(cfg, log.New(io.Discard), gdb)
+	srv := httptest.NewServer(s.router)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// postJSON posts body as JSON and decodes the reply into out when it is not nil
+func postJSON(t *testing.T, url string, body, out any) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode reply from %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// getJSON gets url as device and decodes the reply into out
+func getJSON(t *testing.T, url, device string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if device != "" {
+		req.Header.Set("X-DeviceID", device)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("Failed to decode reply from %s: %v", url, err)
+	}
+	return resp.StatusCode
+}
+
+// queueCommand registers device and queues command for it
+func queueCommand(t *testing.T, s *Server, url, device, command string) {
+	t.Helper()
+	if err := db.RegisterDevice(s.db, device); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	if status := postJSON(t, url+"/api/command", commandRequest{Device: device, Command: command}, nil); status != http.StatusOK {
+		t.Fatalf("Expected %s to be queued, got status %d", command, status)
+	}
+}
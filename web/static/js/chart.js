@@ -3,6 +3,9 @@ document.addEventListener("DOMContentLoaded", async () => {
 	const gaugeContainer = document.getElementById("gaugeContainer");
 	const colorContainer = document.getElementById("colorContainer");
 	const metricTypeFilter = document.getElementById("metricTypeFilter");
+	const downtimeContainer = document.getElementById("downtimeContainer");
+	const downtimeBar = document.getElementById("downtimeBar");
+	const downtimeList = document.getElementById("downtimeList");
 	let refreshIntervalId = null;
 
 	async function fetchDevices() {
@@ -80,6 +83,43 @@ document.addEventListener("DOMContentLoaded", async () => {
 		}
 	}
 
+	async function fetchDowntime(deviceID) {
+		const response = await fetch("/api/device/downtime?hours=24", {
+			headers: {
+				"X-DeviceID": deviceID,
+			},
+		});
+		if (!response.ok) {
+			downtimeContainer.style.display = "none";
+			return;
+		}
+		const data = await response.json();
+		const from = new Date(data.from).getTime();
+		const span = new Date(data.to).getTime() - from;
+
+		downtimeBar.innerHTML = "";
+		downtimeList.innerHTML = "";
+		document.getElementById("downtimeFrom").textContent = new Date(data.from).toLocaleString();
+		document.getElementById("downtimeTo").textContent = new Date(data.to).toLocaleString();
+
+		// Periods are drawn over a green bar, so gaps read as up
+		data.periods.forEach((period) => {
+			const start = new Date(period.start).getTime();
+			const end = new Date(period.end).getTime();
+			const segment = document.createElement("div");
+			segment.className = `downtime-segment state-${period.state}`;
+			segment.style.left = `${((start - from) / span) * 100}%`;
+			segment.style.width = `${((end - start) / span) * 100}%`;
+			segment.title = `${period.state}: ${period.reason}`;
+			downtimeBar.appendChild(segment);
+
+			const item = document.createElement("li");
+			item.textContent = `${period.state} from ${new Date(start).toLocaleString()} to ${new Date(end).toLocaleString()}: ${period.reason}${period.error ? ` (${period.error})` : ""}`;
+			downtimeList.appendChild(item);
+		});
+		downtimeContainer.style.display = "";
+	}
+
 	function filterMetrics() {
 		const filterText = metricTypeFilter.value.toLowerCase();
 		const gaugeElements = gaugeContainer.querySelectorAll(".gauge");
@@ -105,6 +145,7 @@ document.addEventListener("DOMContentLoaded", async () => {
 		clearInterval(refreshIntervalId);
 		refreshIntervalId = setInterval(() => {
 			fetchMetrics(deviceID);
+			fetchDowntime(deviceID);
 		}, interval);
 	}
 
@@ -114,6 +155,7 @@ document.addEventListener("DOMContentLoaded", async () => {
 		const deviceID = this.value;
 		if (deviceID) {
 			fetchMetrics(deviceID);
+			fetchDowntime(deviceID);
 			startAutoRefresh(deviceID);
 		} else {
 			clearMetrics();
@@ -126,5 +168,6 @@ document.addEventListener("DOMContentLoaded", async () => {
 	function clearMetrics() {
 		gaugeContainer.innerHTML = "";
 		colorContainer.innerHTML = "";
+		downtimeContainer.style.display = "none";
 	}
 });
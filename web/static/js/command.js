@@ -3,6 +3,9 @@ document.addEventListener("DOMContentLoaded", async () => {
 	const commandForm = document.getElementById("commandForm");
 	const errorAlert = document.getElementById("errorAlert");
 	const successAlert = document.getElementById("successAlert");
+	const argsInput = document.getElementById("argsInput");
+	const fileInput = document.getElementById("fileInput");
+	const commandHistory = document.getElementById("commandHistory");
 
 	// Fetch and populate devices
 	async function loadDevices() {
@@ -17,6 +20,52 @@ document.addEventListener("DOMContentLoaded", async () => {
 		});
 	}
 
+	async function loadHistory(deviceID) {
+		commandHistory.innerHTML = "";
+		if (!deviceID) return;
+
+		const response = await fetch("/api/command/history", {
+			headers: {
+				"X-DeviceID": deviceID,
+			},
+		});
+		const commands = await response.json();
+
+		commands.forEach((cmd) => {
+			const row = document.createElement("tr");
+			const args = cmd.args ? JSON.stringify(cmd.args) : "";
+			row.innerHTML = `
+                <td>${cmd.command}</td>
+                <td><code></code></td>
+                <td>${cmd.status}<div class="command-error"></div></td>
+                <td>${new Date(cmd.created_at).toLocaleString()}</td>
+                <td>${cmd.completed_at ? new Date(cmd.completed_at).toLocaleString() : ""}</td>
+                <td>${cmd.has_output ? `<a href="/api/command/${cmd.id}/output">Download</a>` : ""}</td>
+            `;
+			// Arguments may carry user-supplied paths, keep them as text
+			row.querySelector("code").textContent = args.length > 80 ? args.slice(0, 80) + "…" : args;
+			row.querySelector(".command-error").textContent = cmd.error || "";
+			commandHistory.appendChild(row);
+		});
+	}
+
+	// Encode the selected file and its SHA-256 the way the daemon's push command expects
+	async function readPushFile(file) {
+		const buffer = await file.arrayBuffer();
+		const digest = await crypto.subtle.digest("SHA-256", buffer);
+		const sha256 = Array.from(new Uint8Array(digest))
+			.map((b) => b.toString(16).padStart(2, "0"))
+			.join("");
+
+		let binary = "";
+		new Uint8Array(buffer).forEach((b) => {
+			binary += String.fromCharCode(b);
+		});
+		return { content: btoa(binary), sha256 };
+	}
+
+	deviceSelect.addEventListener("change", () => loadHistory(deviceSelect.value));
+
 	// Handle form submission
 	commandForm.addEventListener("submit", async (e) => {
 		e.preventDefault();
@@ -29,6 +78,16 @@ document.addEventListener("DOMContentLoaded", async () => {
 		};
 
 		try {
+			if (argsInput.value.trim() !== "") {
+				command.args = JSON.parse(argsInput.value);
+			}
+			if (fileInput.files.length > 0) {
+				command.args = Object.assign(
+					command.args || {},
+					await readPushFile(fileInput.files[0])
+				);
+			}
+
 			const response = await fetch("/api/command", {
 				method: "POST",
 				headers: {
@@ -44,7 +103,10 @@ document.addEventListener("DOMContentLoaded", async () => {
 
 			successAlert.textContent = "Command sent successfully";
 			successAlert.style.display = "block";
+			const deviceID = deviceSelect.value;
 			commandForm.reset();
+			deviceSelect.value = deviceID;
+			await loadHistory(deviceID);
 		} catch (err) {
 			errorAlert.textContent = err.message;
 			errorAlert.style.display = "block";
@@ -6,8 +6,49 @@ document.addEventListener("DOMContentLoaded", async () => {
 	const metricTypeFilter = document.getElementById("metricTypeFilter");
 	const sortMetrics = document.getElementById("sortMetrics");
 	const sortLabel = document.getElementById("sortLabel");
+	const alertsContainer = document.getElementById("alerts");
+	const deviceStatusTable = document.getElementById("deviceStatus");
 	let refreshIntervalId = null;
 
+	// Device names, labels and values come from devices, keep them as text
+	function addCell(row, text) {
+		const cell = document.createElement("td");
+		cell.textContent = text;
+		row.appendChild(cell);
+		return cell;
+	}
+
+	async function fetchAlerts() {
+		const response = await fetch("/api/alerts");
+		const alerts = await response.json();
+		alertsContainer.innerHTML = "";
+		alerts.forEach((alert) => {
+			const banner = document.createElement("div");
+			banner.className = "alert-banner";
+			banner.textContent = `${alert.device}: ${alert.message} since ${new Date(
+				alert.since
+			).toLocaleString()}`;
+			alertsContainer.appendChild(banner);
+		});
+	}
+
+	async function fetchDeviceStatus() {
+		const response = await fetch("/api/device/status");
+		const statuses = await response.json();
+		deviceStatusTable.innerHTML = "";
+		statuses.forEach((status) => {
+			const row = document.createElement("tr");
+			addCell(row, status.name);
+			const badge = document.createElement("span");
+			badge.className = `state-badge state-${status.state}`;
+			badge.textContent = status.state;
+			addCell(row, "").appendChild(badge);
+			addCell(row, status.since ? new Date(status.since).toLocaleString() : "");
+			addCell(row, status.last_error || "");
+			deviceStatusTable.appendChild(row);
+		});
+	}
+
 	async function fetchDevices() {
 		const response = await fetch("/api/device");
 		const devices = await response.json();
@@ -35,12 +76,15 @@ document.addEventListener("DOMContentLoaded", async () => {
 		if (data.metrics) {
 			data.metrics.forEach((metric) => {
 				const row = document.createElement("tr");
-				row.innerHTML = `
-                <td>${metric.Type ? metric.Type.Name : ""}</td>
-                <td>${metric.Value}</td>
-                <td>${metric.Unit ? metric.Unit.Name : ""}</td>
-                <td>${new Date(metric.RecordedAt).toLocaleString()}</td>
-            `;
+				const labels = metric.Labels
+					? Object.entries(JSON.parse(metric.Labels))
+							.map(([k, v]) => `${k}=${v}`)
+							.join(", ")
+					: "";
+				addCell(row, `${metric.Type ? metric.Type.Name : ""}${labels ? ` {${labels}}` : ""}`);
+				addCell(row, metric.Value);
+				addCell(row, metric.Unit ? metric.Unit.Name : "");
+				addCell(row, new Date(metric.RecordedAt).toLocaleString());
 				metricsTable.appendChild(row);
 			});
 		}
@@ -119,6 +163,10 @@ document.addEventListener("DOMContentLoaded", async () => {
 	}
 
 	await fetchDevices();
+	await fetchAlerts();
+	await fetchDeviceStatus();
+	setInterval(fetchAlerts, 30000);
+	setInterval(fetchDeviceStatus, 30000);
 
 	deviceSelect.addEventListener("change", function () {
 		const deviceID = this.value;